@@ -258,9 +258,19 @@ func tryAddStartup() error {
 		return err
 	}
 
-	if !startup.Exists("mrext/" + appName) {
+	migrated, err := startup.MigrateService(appName)
+	if err != nil {
+		return err
+	} else if migrated {
+		err = startup.Save()
+		if err != nil {
+			return err
+		}
+	}
+
+	if !startup.HasSupervised(appName) {
 		if utils.YesOrNoPrompt("LastPlayed must be set to run on MiSTer startup. Add it now?") {
-			err = startup.AddService("mrext/" + appName)
+			err = startup.AddSupervised(appName)
 			if err != nil {
 				return err
 			}
@@ -276,10 +286,11 @@ func tryAddStartup() error {
 }
 
 func main() {
-	svcOpt := flag.String("service", "", "manage playlog service (start, stop, restart, status)")
+	svcOpt := flag.String("service", "", "manage playlog service (start, stop, restart, status, supervise)")
 	flag.Parse()
 
 	logger := service.NewLogger(appName)
+	service.HandleSupervise(logger, svcOpt)
 
 	cfg, err := config.LoadUserConfig(appName, &config.UserConfig{
 		LastPlayed: config.LastPlayedConfig{
@@ -312,7 +323,7 @@ func main() {
 	if err != nil {
 		logger.Error("error checking recents option: %s", err)
 		fmt.Println("Could not read the MiSTer.ini file. Make sure the \"recents\" option is enabled if lastplayed doesn't work.")
-	} else if recents {
+	} else if !recents {
 		logger.Error("recents option not enabled, exiting...")
 		fmt.Println("The \"recents\" option must be enabled for lastplayed to work.")
 		fmt.Println("Configure it in the MiSTer.ini file and run lastplayed again.")
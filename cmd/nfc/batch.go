@@ -0,0 +1,450 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/wizzomafizzo/mrext/pkg/config"
+	"github.com/wizzomafizzo/mrext/pkg/games"
+	"github.com/wizzomafizzo/mrext/pkg/gamesdb"
+	"github.com/wizzomafizzo/mrext/pkg/nfcctl"
+	"github.com/wizzomafizzo/mrext/pkg/service"
+	"github.com/wizzomafizzo/mrext/pkg/utils"
+)
+
+// Batch mode writes a list of tokens to a stack of cards, one after another.
+// Each card is read back after it's written, and cards which were already
+// written in the batch are skipped, so it's safe to leave the last card on
+// the reader. A report of which card got which game can be saved for
+// printing labels.
+
+// batchItem is a token to be written to a card in a batch.
+type batchItem struct {
+	Name string
+	Text string
+}
+
+type batchResult struct {
+	batchItem
+	UID   string
+	Error string
+}
+
+// batchName returns a readable name for a token, used when a batch list
+// doesn't include names.
+func batchName(text string) string {
+	if strings.HasPrefix(text, "**") {
+		return text
+	}
+	base := filepath.Base(text)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+// parseBatchList reads a list of tokens to write, either one per line or a
+// CSV file with a header row containing a "text" column and an optional
+// "name" column. Blank lines and lines starting with # are ignored.
+func parseBatchList(r io.Reader) ([]batchItem, error) {
+	lines := make([]string, 0)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(lines) == 0 {
+		return nil, errors.New("batch list is empty")
+	}
+
+	header, err := csv.NewReader(strings.NewReader(lines[0])).Read()
+	textCol, nameCol := -1, -1
+	if err == nil {
+		for i, col := range header {
+			switch strings.ToLower(strings.TrimSpace(col)) {
+			case "text":
+				textCol = i
+			case "name":
+				nameCol = i
+			}
+		}
+	}
+
+	items := make([]batchItem, 0, len(lines))
+
+	if textCol == -1 {
+		for _, line := range lines {
+			items = append(items, batchItem{Name: batchName(line), Text: line})
+		}
+		return items, nil
+	}
+
+	cr := csv.NewReader(strings.NewReader(strings.Join(lines[1:], "\n")))
+	cr.FieldsPerRecord = -1
+	records, err := cr.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("error parsing batch csv: %w", err)
+	}
+
+	for i, record := range records {
+		if textCol >= len(record) || strings.TrimSpace(record[textCol]) == "" {
+			return nil, fmt.Errorf("batch csv row %d has no text", i+1)
+		}
+
+		item := batchItem{Text: strings.TrimSpace(record[textCol])}
+		if nameCol != -1 && nameCol < len(record) {
+			item.Name = strings.TrimSpace(record[nameCol])
+		}
+		if item.Name == "" {
+			item.Name = batchName(item.Text)
+		}
+
+		items = append(items, item)
+	}
+
+	return items, nil
+}
+
+func loadBatchFile(path string) ([]batchItem, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return parseBatchList(f)
+}
+
+// relativeGamePath returns the path of a game relative to the games folder
+// it's in, which is shorter to store on a card and still works if the
+// game is moved to another drive.
+func relativeGamePath(cfg *config.UserConfig, path string) string {
+	for _, folder := range games.GetGamesFolders(cfg) {
+		rel, err := filepath.Rel(folder, path)
+		if err == nil && !strings.HasPrefix(rel, "..") {
+			return rel
+		}
+	}
+	return path
+}
+
+// loadBatchSystem lists every game indexed in the games database for a
+// system. A folder inside the system's games folder can be selected with
+// "system/folder".
+func loadBatchSystem(cfg *config.UserConfig, arg string) ([]batchItem, error) {
+	systemId, folder, _ := strings.Cut(arg, "/")
+
+	system, err := games.LookupSystem(systemId)
+	if err != nil {
+		return nil, err
+	}
+
+	if !gamesdb.SystemIndexed(*system) {
+		return nil, fmt.Errorf("%s is not in the games database, update it with the search app first", system.Id)
+	}
+
+	results, err := gamesdb.SearchNamesPartial([]games.System{*system}, "")
+	if err != nil {
+		return nil, err
+	}
+
+	folder = strings.ToLower(strings.Trim(folder, "/"))
+	items := make([]batchItem, 0, len(results))
+	for _, result := range results {
+		text := relativeGamePath(cfg, result.Path)
+		if folder != "" && !strings.Contains(strings.ToLower("/"+filepath.Dir(text)+"/"), "/"+folder+"/") {
+			continue
+		}
+		items = append(items, batchItem{Name: result.Name, Text: text})
+	}
+
+	if len(items) == 0 {
+		return nil, fmt.Errorf("no games found for %s", arg)
+	}
+
+	sort.SliceStable(items, func(i, j int) bool {
+		return strings.ToLower(items[i].Name) < strings.ToLower(items[j].Name)
+	})
+
+	return items, nil
+}
+
+// batchWriter writes text to the next card on the reader which isn't in
+// the skip list. The UID of the card is returned even if writing failed.
+type batchWriter interface {
+	WriteNext(text string, skip []string, onProgress func(nfcctl.Message)) (string, error)
+}
+
+// directBatchWriter writes to cards using a reader opened by this process.
+type directBatchWriter struct {
+	reader Reader
+	stop   <-chan struct{}
+}
+
+func (w *directBatchWriter) WriteNext(text string, skip []string, onProgress func(nfcctl.Message)) (string, error) {
+	lastDuplicate := ""
+
+	for {
+		select {
+		case <-w.stop:
+			return "", nfcctl.ErrCancelled
+		default:
+		}
+
+		tag, err := w.reader.Poll()
+		if err != nil {
+			return "", err
+		}
+
+		if tag == nil {
+			continue
+		}
+
+		if utils.Contains(skip, tag.UID) {
+			if tag.UID != lastDuplicate {
+				lastDuplicate = tag.UID
+				onProgress(nfcctl.Message{Event: nfcctl.EventDuplicate, Card: &nfcctl.Card{UID: tag.UID}})
+			}
+			time.Sleep(periodBetweenPolls)
+			continue
+		}
+
+		err = identifyTag(w.reader, tag)
+		if err != nil {
+			return tag.UID, err
+		}
+
+		onProgress(nfcctl.Message{Event: nfcctl.EventWriting, Card: &nfcctl.Card{UID: tag.UID, Type: tag.Type}})
+		_, err = programTag(w.reader, tag, nfcctl.CmdBatchWrite, text)
+		return tag.UID, err
+	}
+}
+
+// serviceBatchWriter hands off each write to the running service. Closing
+// stop ends the batch, but the service's current write must also be
+// cancelled for it to return straight away.
+type serviceBatchWriter struct {
+	stop <-chan struct{}
+}
+
+func (w *serviceBatchWriter) WriteNext(text string, skip []string, onProgress func(nfcctl.Message)) (string, error) {
+	for {
+		select {
+		case <-w.stop:
+			return "", nfcctl.ErrCancelled
+		default:
+		}
+
+		uid := ""
+		card, err := nfcctl.BatchWrite(text, skip, func(msg nfcctl.Message) {
+			if msg.Event == nfcctl.EventWriting && msg.Card != nil {
+				uid = msg.Card.UID
+			}
+			onProgress(msg)
+		})
+		if errors.Is(err, nfcctl.ErrTimedOut) {
+			// keep waiting, the batch can be stopped with ctrl-c
+			continue
+		} else if err != nil {
+			return uid, err
+		}
+
+		return card.UID, nil
+	}
+}
+
+// runBatch writes each item to a new card, printing progress to out. A
+// failed card is reported and skipped, and the batch moves on to the next
+// item. Stops early if the writer is cancelled.
+func runBatch(items []batchItem, writer batchWriter, out io.Writer) []batchResult {
+	results := make([]batchResult, 0, len(items))
+	skip := make([]string, 0, len(items))
+
+	onProgress := func(msg nfcctl.Message) {
+		switch msg.Event {
+		case nfcctl.EventDuplicate:
+			_, _ = fmt.Fprintf(out, "Card %s was already written, place a new card\n", msg.Card.UID)
+		case nfcctl.EventWriting:
+			_, _ = fmt.Fprintf(out, "Writing to card: %s\n", msg.Card.UID)
+		}
+	}
+
+	for i, item := range items {
+		_, _ = fmt.Fprintf(out, "[%d/%d] Place card for: %s\n", i+1, len(items), item.Name)
+
+		uid, err := writer.WriteNext(item.Text, skip, onProgress)
+		if errors.Is(err, nfcctl.ErrCancelled) {
+			_, _ = fmt.Fprintln(out, "Batch cancelled")
+			break
+		}
+
+		result := batchResult{batchItem: item, UID: uid}
+		if uid != "" {
+			skip = append(skip, uid)
+		}
+
+		if err != nil {
+			logger.Error("error writing batch card %s: %s", item.Text, err)
+			result.Error = err.Error()
+			_, _ = fmt.Fprintf(out, "Error writing card, it will be skipped: %s\n", err)
+		} else {
+			logger.Info("batch wrote %s to card: %s", item.Text, uid)
+			_, _ = fmt.Fprintf(out, "Wrote and verified card: %s\n", uid)
+		}
+
+		results = append(results, result)
+	}
+
+	return results
+}
+
+// writeBatchReport saves a CSV of which card was written with which game,
+// for printing labels.
+func writeBatchReport(w io.Writer, results []batchResult) error {
+	cw := csv.NewWriter(w)
+
+	err := cw.Write([]string{"uid", "name", "text", "error"})
+	if err != nil {
+		return err
+	}
+
+	for _, result := range results {
+		err := cw.Write([]string{result.UID, result.Name, result.Text, result.Error})
+		if err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+func printBatchResults(w io.Writer, results []batchResult) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "UID\tNAME\tRESULT")
+
+	failed := 0
+	for _, result := range results {
+		status := "ok"
+		if result.Error != "" {
+			status = "failed: " + result.Error
+			failed++
+		}
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\n", result.UID, result.Name, status)
+	}
+
+	err := tw.Flush()
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "%d cards written, %d failed\n", len(results)-failed, failed)
+	return err
+}
+
+// handleBatchCommand writes a batch of cards, using the service if it's
+// running or the reader directly if not. The results are printed and
+// optionally saved to a report file, even if the batch is cancelled.
+func handleBatchCommand(items []batchItem, reportPath string, svc *service.Service, cfg config.NfcConfig) error {
+	stop := make(chan struct{})
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	var writer batchWriter
+
+	if svc.Running() {
+		status, err := nfcctl.GetStatus()
+		if err != nil {
+			return err
+		}
+
+		// the service would launch each new card in between writes
+		if status.LauncherEnabled {
+			err := nfcctl.SetLauncherEnabled(false)
+			if err != nil {
+				return err
+			}
+			defer func() {
+				err := nfcctl.SetLauncherEnabled(true)
+				if err != nil {
+					logger.Error("error re-enabling launcher: %s", err)
+				}
+			}()
+		}
+
+		go func() {
+			if _, ok := <-sigs; ok {
+				close(stop)
+				err := nfcctl.Cancel()
+				if err != nil {
+					logger.Error("error cancelling batch: %s", err)
+				}
+			}
+		}()
+
+		writer = &serviceBatchWriter{stop: stop}
+	} else {
+		reader, err := openReaderWithRetries(cfg)
+		if err != nil {
+			return fmt.Errorf("could not open device: %w", err)
+		}
+
+		defer func(reader Reader) {
+			err := reader.Close()
+			if err != nil {
+				logger.Warn("error closing device: %s", err)
+			}
+			logger.Info("closed nfc device")
+		}(reader)
+
+		go func() {
+			if _, ok := <-sigs; ok {
+				close(stop)
+			}
+		}()
+
+		writer = &directBatchWriter{reader: reader, stop: stop}
+	}
+
+	_, _ = fmt.Fprintf(os.Stderr, "Writing %d cards, press ctrl-c to stop\n", len(items))
+	results := runBatch(items, writer, os.Stderr)
+
+	err := printBatchResults(os.Stdout, results)
+	if err != nil {
+		return err
+	}
+
+	if reportPath == "" {
+		return nil
+	}
+
+	f, err := os.Create(reportPath)
+	if err != nil {
+		return err
+	}
+
+	err = writeBatchReport(f, results)
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	fmt.Printf("Saved report to %s\n", reportPath)
+	return f.Close()
+}
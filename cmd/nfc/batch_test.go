@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/wizzomafizzo/mrext/pkg/nfcctl"
+)
+
+func TestParseBatchList(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []batchItem
+	}{
+		{
+			name:  "plain list",
+			input: "# snes favourites\nSNES/Super Mario World.sfc\n\n**system:nes\n",
+			want: []batchItem{
+				{Name: "Super Mario World", Text: "SNES/Super Mario World.sfc"},
+				{Name: "**system:nes", Text: "**system:nes"},
+			},
+		},
+		{
+			name:  "csv",
+			input: "name,text\n\"Zelda, A Link to the Past\",SNES/Zelda.sfc\n,Genesis/Sonic.md\n",
+			want: []batchItem{
+				{Name: "Zelda, A Link to the Past", Text: "SNES/Zelda.sfc"},
+				{Name: "Sonic", Text: "Genesis/Sonic.md"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			items, err := parseBatchList(strings.NewReader(tt.input))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(items, tt.want) {
+				t.Errorf("got %+v, want %+v", items, tt.want)
+			}
+		})
+	}
+
+	for _, input := range []string{"", "# nothing\n", "text,name\n,Zelda\n"} {
+		_, err := parseBatchList(strings.NewReader(input))
+		if err == nil {
+			t.Errorf("%q: expected error", input)
+		}
+	}
+}
+
+// swappingWriter places the next tag on the reader whenever a duplicate card
+// is found, like someone swapping cards during a batch.
+type swappingWriter struct {
+	directBatchWriter
+	reader *virtualReader
+	next   []*virtualTag
+}
+
+func (w *swappingWriter) WriteNext(text string, skip []string, onProgress func(nfcctl.Message)) (string, error) {
+	return w.directBatchWriter.WriteNext(text, skip, func(msg nfcctl.Message) {
+		if msg.Event == nfcctl.EventDuplicate {
+			w.reader.Insert(w.next[0])
+			w.next = w.next[1:]
+		}
+		onProgress(msg)
+	})
+}
+
+func TestRunBatch(t *testing.T) {
+	reader := newVirtualReader()
+
+	cards := make([]*virtualTag, 0)
+	for _, card := range []struct{ uid, model string }{
+		{"04a1b2c3", virtualNtag213},
+		{"04d4e5f6", virtualMifare1k},
+		{"04778899", virtualUltralight},
+	} {
+		tag, err := newVirtualTag(card.uid, card.model, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		cards = append(cards, tag)
+	}
+	reader.Insert(cards[0])
+
+	writer := &swappingWriter{
+		directBatchWriter: directBatchWriter{reader: reader, stop: make(chan struct{})},
+		reader:            reader,
+		next:              cards[1:],
+	}
+
+	items := []batchItem{
+		{Name: "Super Mario World", Text: "SNES/Super Mario World.sfc"},
+		{Name: "NES", Text: "**system:nes"},
+		{Name: "Too Long", Text: "Arcade/" + strings.Repeat("x", 64) + ".mra"},
+	}
+
+	var out bytes.Buffer
+	results := runBatch(items, writer, &out)
+
+	if len(results) != 3 {
+		t.Fatalf("got %d results: %+v", len(results), results)
+	}
+
+	for i, uid := range []string{"04a1b2c3", "04d4e5f6", "04778899"} {
+		if results[i].UID != uid {
+			t.Errorf("result %d: got uid %s, want %s", i, results[i].UID, uid)
+		}
+		if results[i].Name != items[i].Name {
+			t.Errorf("result %d: got name %s", i, results[i].Name)
+		}
+	}
+
+	if results[0].Error != "" || results[1].Error != "" {
+		t.Errorf("unexpected errors: %+v", results)
+	}
+	// doesn't fit on an ultralight
+	if results[2].Error == "" {
+		t.Error("expected error writing too much text")
+	}
+
+	if !strings.Contains(out.String(), "Card 04a1b2c3 was already written") {
+		t.Errorf("duplicate card not reported:\n%s", out.String())
+	}
+
+	reader.Insert(cards[1])
+	tag, err := waitForTag(reader, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = verifyTag(reader, tag, "**system:nes")
+	if err != nil {
+		t.Error(err)
+	}
+	err = verifyTag(reader, tag, "**system:snes")
+	if err == nil {
+		t.Error("expected verification to fail")
+	}
+
+	var report bytes.Buffer
+	err = writeBatchReport(&report, results[:2])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantReport := "uid,name,text,error\n" +
+		"04a1b2c3,Super Mario World,SNES/Super Mario World.sfc,\n" +
+		"04d4e5f6,NES,**system:nes,\n"
+	if report.String() != wantReport {
+		t.Errorf("got report:\n%s", report.String())
+	}
+}
+
+func TestRunBatchCancel(t *testing.T) {
+	reader := newVirtualReader()
+	stop := make(chan struct{})
+	close(stop)
+
+	writers := []batchWriter{
+		&directBatchWriter{reader: reader, stop: stop},
+		&serviceBatchWriter{stop: stop},
+	}
+
+	for _, writer := range writers {
+		results := runBatch(
+			[]batchItem{{Name: "NES", Text: "**system:nes"}},
+			writer,
+			&bytes.Buffer{},
+		)
+		if len(results) != 0 {
+			t.Errorf("%T: got results %+v", writer, results)
+		}
+	}
+}
@@ -2,18 +2,30 @@ package main
 
 import (
 	"encoding/hex"
-	"fmt"
+	"errors"
 
 	"github.com/clausecker/nfc/v2"
 )
 
 const (
-	TypeNTAG      = "NTAG"
-	TypeMifare    = "MIFARE"
-	WRITE_COMMAND = byte(0xA2)
-	READ_COMMAND  = byte(0x30)
+	TypeNTAG        = "NTAG"
+	TypeMifare      = "MIFARE"
+	TypeUltralight  = "ULTRALIGHT"
+	TypeUltralightC = "ULTRALIGHT_C"
+	TypeNTAG424     = "NTAG424"
+	TypeISO15693    = "ISO15693"
+	WRITE_COMMAND   = byte(0xA2)
+	READ_COMMAND    = byte(0x30)
 )
 
+// ErrUnsupportedTag is returned when trying to read or write a tag type
+// which can only be identified by its UID.
+var ErrUnsupportedTag = errors.New("unsupported tag type")
+
+// errTagProtected is returned when a tag's data can't be read, like
+// Skylanders and LEGO Dimensions toys. These tags can still be mapped by UID.
+var errTagProtected = errors.New("tag data is protected")
+
 func getCardUID(target nfc.Target) string {
 	var uid string
 	switch target.Modulation() {
@@ -28,18 +40,6 @@ func getCardUID(target nfc.Target) string {
 	return uid
 }
 
-func comm(pnd nfc.Device, tx []byte, replySize int) ([]byte, error) {
-	rx := make([]byte, replySize)
-
-	timeout := 0
-	_, err := pnd.InitiatorTransceiveBytes(tx, rx, timeout)
-	if err != nil {
-		return nil, fmt.Errorf("comm error: %s", err)
-	}
-
-	return rx, nil
-}
-
 func getCardType(target nfc.Target) string {
 	switch target.Modulation() {
 	case nfc.Modulation{Type: nfc.ISO14443a, BaudRate: nfc.Nbr106}:
@@ -50,8 +50,14 @@ func getCardType(target nfc.Target) string {
 		}
 		if card.Atqa == [2]byte{0x00, 0x44} && card.Sak == 0x00 {
 			// https://www.nxp.com/docs/en/data-sheet/NTAG213_215_216.pdf page 33
+			// Ultralight tags respond the same way, they're told apart
+			// later by identifyType2Tag
 			return TypeNTAG
 		}
+		if card.Atqa == [2]byte{0x03, 0x44} && card.Sak == 0x20 {
+			// https://www.nxp.com/docs/en/data-sheet/NT4H2421Gx.pdf page 13
+			return TypeNTAG424
+		}
 	}
 	return ""
 }
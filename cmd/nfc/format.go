@@ -0,0 +1,302 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/wizzomafizzo/mrext/pkg/nfcctl"
+)
+
+// MIFARE Classic NDEF formatting follows NXP's application note AN1304 and
+// uses the same layout as libnfc's mifare-classic-format utility.
+// https://www.nxp.com/docs/en/application-note/AN1304.pdf
+
+const (
+	MIFARE_MAD_INFO_BYTE = byte(0x01)
+	MIFARE_WRITE_COMMAND = byte(0xA0)
+)
+
+var (
+	// NDEF application ID 0xE103, stored little endian in the MAD for each
+	// sector
+	mifareNdefAid = []byte{0x03, 0xE1}
+	// Access bits and general purpose byte of the MAD sector
+	mifareMadAccess = []byte{0x78, 0x77, 0x88, 0xC1}
+	// Access bits and general purpose byte of NDEF sectors
+	mifareNdefAccess = []byte{0x7F, 0x07, 0x88, 0x40}
+
+	errAlreadyFormatted = errors.New("card is already NDEF formatted")
+)
+
+// madCrc calculates the CRC-8 of a MIFARE Application Directory.
+func madCrc(data []byte) byte {
+	crc := byte(0xC7)
+	for _, b := range data {
+		crc ^= b
+		for i := 0; i < 8; i++ {
+			if crc&0x80 != 0 {
+				crc = crc<<1 ^ 0x1D
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// buildMad returns blocks 1 and 2 of a MIFARE Application Directory which
+// assigns every sector to NDEF.
+func buildMad() []byte {
+	mad := []byte{0x00, MIFARE_MAD_INFO_BYTE}
+	for sector := 1; sector <= MIFARE_WRITABLE_SECTOR_COUNT; sector++ {
+		mad = append(mad, mifareNdefAid...)
+	}
+	mad[0] = madCrc(mad[1:])
+	return mad
+}
+
+func buildMifareTrailer(keyA []byte, access []byte) []byte {
+	trailer := append([]byte{}, keyA...)
+	trailer = append(trailer, access...)
+	return append(trailer, mifareDefaultKey...)
+}
+
+func writeMifareBlock(reader Reader, block int, data []byte) error {
+	_, err := comm(reader, append([]byte{MIFARE_WRITE_COMMAND, byte(block)}, data...), 2)
+	return err
+}
+
+// formatMifare NDEF formats a blank MIFARE Classic 1K card, which still uses
+// the default transport keys. Sector 0 is set up as the MAD and all other
+// sectors are given the NDEF key, with an empty NDEF message in sector 1.
+func formatMifare(reader Reader, cardUid string) error {
+	_, err := comm(reader, buildMifareAuthCommand(4, cardUid), 2)
+	if err == nil {
+		return errAlreadyFormatted
+	}
+
+	// a failed authentication halts the card
+	err = reselectTag(reader)
+	if err != nil {
+		return err
+	}
+
+	for sector := 0; sector <= MIFARE_WRITABLE_SECTOR_COUNT; sector++ {
+		firstBlock := sector * 4
+
+		_, err := comm(reader, buildMifareKeyAuthCommand(byte(firstBlock), mifareDefaultKey, cardUid), 2)
+		if err != nil {
+			return fmt.Errorf("card is not blank, sector %d uses a custom key: %w", sector, err)
+		}
+
+		var trailer []byte
+		switch sector {
+		case 0:
+			mad := buildMad()
+			err = writeMifareBlock(reader, 1, mad[:MIFARE_BLOCK_SIZE_BYTES])
+			if err == nil {
+				err = writeMifareBlock(reader, 2, mad[MIFARE_BLOCK_SIZE_BYTES:])
+			}
+			trailer = buildMifareTrailer(mifareMadKey, mifareMadAccess)
+		case 1:
+			empty := make([]byte, MIFARE_BLOCK_SIZE_BYTES)
+			copy(empty, []byte{0x03, 0x00, 0xFE})
+			err = writeMifareBlock(reader, firstBlock, empty)
+			trailer = buildMifareTrailer(mifareNdefKey, mifareNdefAccess)
+		default:
+			trailer = buildMifareTrailer(mifareNdefKey, mifareNdefAccess)
+		}
+		if err != nil {
+			return err
+		}
+
+		err = writeMifareBlock(reader, firstBlock+3, trailer)
+		if err != nil {
+			return fmt.Errorf("error writing sector %d trailer: %w", sector, err)
+		}
+	}
+
+	return nil
+}
+
+// getType2PageCount returns the number of user memory pages on an NTAG or
+// Ultralight tag.
+func getType2PageCount(reader Reader, tag *Tag) (int, error) {
+	switch tag.Type {
+	case TypeNTAG:
+		return getNtagBlockCount(reader)
+	case TypeUltralight, TypeUltralightC:
+		capacity, err := getUltralightCapacity(reader, tag.Type)
+		return capacity / 4, err
+	default:
+		return 0, fmt.Errorf("%w: %s", ErrUnsupportedTag, tagTypeName(tag.Type))
+	}
+}
+
+// checkType2Writable returns errTagProtected if the capability container
+// marks the tag as read only.
+func checkType2Writable(reader Reader) error {
+	rx, err := comm(reader, []byte{READ_COMMAND, 0x03}, 16)
+	if err != nil {
+		return err
+	}
+
+	if rx[3]&0x0F != 0x00 {
+		return fmt.Errorf("%w: card is read only", errTagProtected)
+	}
+
+	return nil
+}
+
+// eraseType2 clears the user memory of an NTAG or Ultralight tag, leaving an
+// empty NDEF message in place.
+func eraseType2(reader Reader, tag *Tag) error {
+	pageCount, err := getType2PageCount(reader, tag)
+	if err != nil {
+		return err
+	}
+
+	err = checkType2Writable(reader)
+	if err != nil {
+		return err
+	}
+
+	for page := 4; page < 4+pageCount; page++ {
+		data := []byte{0x00, 0x00, 0x00, 0x00}
+		if page == 4 {
+			data = []byte{0x03, 0x00, 0xFE, 0x00}
+		}
+
+		_, err := comm(reader, append([]byte{WRITE_COMMAND, byte(page)}, data...), 1)
+		if err != nil {
+			return fmt.Errorf("error erasing page %d: %w", page, err)
+		}
+	}
+
+	return nil
+}
+
+// getType2DynamicLock returns the page and value of the dynamic lock bytes,
+// which protect the memory not covered by the static lock bytes in page 2.
+// Returns a nil value for tags which only have static lock bytes.
+// https://www.nxp.com/docs/en/data-sheet/NTAG213_215_216.pdf page 17
+func getType2DynamicLock(reader Reader, tag *Tag) (byte, []byte, error) {
+	switch tag.Type {
+	case TypeUltralight:
+		return 0, nil, nil
+	case TypeUltralightC:
+		return 0x28, []byte{0xFF, 0xFF, 0x00, 0x00}, nil
+	}
+
+	rx, err := comm(reader, []byte{READ_COMMAND, 0x03}, 16)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	lock := []byte{0xFF, 0xFF, 0xFF, 0x00}
+	switch rx[2] {
+	case NTAG_215_IDENTIFIER:
+		return 0x82, lock, nil
+	case NTAG_216_IDENTIFIER:
+		return 0xE2, lock, nil
+	default:
+		return 0x28, lock, nil
+	}
+}
+
+// lockType2 permanently makes an NTAG or Ultralight tag read only. The
+// capability container is marked read only and then the lock bits are set,
+// none of which can ever be cleared again.
+func lockType2(reader Reader, tag *Tag) error {
+	err := canLockTag(tag)
+	if err != nil {
+		return err
+	}
+
+	dynamicPage, dynamicLock, err := getType2DynamicLock(reader, tag)
+	if err != nil {
+		return err
+	}
+
+	// the static lock bytes also lock the capability container, so it must
+	// be written first
+	writes := [][]byte{{0x03, 0x00, 0x00, 0x00, 0x0F}}
+	if dynamicLock != nil {
+		writes = append(writes, append([]byte{dynamicPage}, dynamicLock...))
+	}
+	writes = append(writes, []byte{0x02, 0x00, 0x00, 0xFF, 0xFF})
+
+	for _, write := range writes {
+		_, err := comm(reader, append([]byte{WRITE_COMMAND}, write...), 1)
+		if err != nil {
+			return fmt.Errorf("error writing lock page %d: %w", write[0], err)
+		}
+	}
+
+	return nil
+}
+
+// canLockTag returns an error if a tag can't be locked, so the check can be
+// made before anything is written to it.
+func canLockTag(tag *Tag) error {
+	switch tag.Type {
+	case TypeNTAG, TypeUltralight, TypeUltralightC:
+		return nil
+	default:
+		return fmt.Errorf("%w: %s cards can't be locked", ErrUnsupportedTag, tagTypeName(tag.Type))
+	}
+}
+
+// formatTag NDEF formats a blank tag. Only MIFARE Classic cards need to be
+// formatted, other supported tags are sold ready to use.
+func formatTag(reader Reader, tag *Tag) error {
+	if tag.Type != TypeMifare {
+		return fmt.Errorf("%w: only MIFARE Classic cards need formatting, use erase to clear other cards", ErrUnsupportedTag)
+	}
+	return formatMifare(reader, tag.UID)
+}
+
+// eraseTag removes any NDEF data from a tag.
+func eraseTag(reader Reader, tag *Tag) error {
+	switch tag.Type {
+	case TypeNTAG, TypeUltralight, TypeUltralightC:
+		return eraseType2(reader, tag)
+	default:
+		return fmt.Errorf("%w: %s cards can't be erased", ErrUnsupportedTag, tagTypeName(tag.Type))
+	}
+}
+
+// programTag runs a write, write-lock, batch write, format or erase command
+// on a tag, returning the text now stored on it. Batch writes are read back
+// to make sure they were written correctly.
+func programTag(reader Reader, tag *Tag, cmd string, text string) (string, error) {
+	switch cmd {
+	case nfcctl.CmdWrite:
+		_, err := writeTag(reader, tag, text)
+		return text, err
+	case nfcctl.CmdBatchWrite:
+		_, err := writeTag(reader, tag, text)
+		if err != nil {
+			return "", err
+		}
+		return text, verifyTag(reader, tag, text)
+	case nfcctl.CmdWriteLock:
+		err := canLockTag(tag)
+		if err != nil {
+			return "", err
+		}
+
+		_, err = writeTag(reader, tag, text)
+		if err != nil {
+			return "", err
+		}
+
+		return text, lockType2(reader, tag)
+	case nfcctl.CmdFormat:
+		return "", formatTag(reader, tag)
+	case nfcctl.CmdErase:
+		return "", eraseTag(reader, tag)
+	default:
+		return "", fmt.Errorf("unknown command: %s", cmd)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/wizzomafizzo/mrext/pkg/nfcctl"
+)
+
+func TestBuildMad(t *testing.T) {
+	mad := buildMad()
+	if len(mad) != 2*MIFARE_BLOCK_SIZE_BYTES {
+		t.Fatalf("got MAD length %d", len(mad))
+	}
+	// same CRC as cards formatted by libnfc and NXP's tools
+	if mad[0] != 0x14 {
+		t.Errorf("got CRC %02x, want 14", mad[0])
+	}
+}
+
+func insertVirtualTag(t *testing.T, model string, text string) (*virtualReader, *Tag) {
+	t.Helper()
+
+	vt, err := newVirtualTag("04a1b2c3", model, text)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader := newVirtualReader()
+	reader.Insert(vt)
+
+	tag, err := waitForTag(reader, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = identifyTag(reader, tag)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return reader, tag
+}
+
+func TestFormatMifare(t *testing.T) {
+	reader, tag := insertVirtualTag(t, virtualMifareBlank, "")
+
+	_, err := programTag(reader, tag, nfcctl.CmdWrite, "**system:snes")
+	if err == nil {
+		t.Fatal("expected error writing to blank card")
+	}
+
+	_, err = programTag(reader, tag, nfcctl.CmdFormat, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = programTag(reader, tag, nfcctl.CmdWrite, "**system:snes")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	card, err := pollDevice(reader, Card{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if card.Text != "**system:snes" {
+		t.Errorf("got text %q", card.Text)
+	}
+
+	_, err = programTag(reader, tag, nfcctl.CmdFormat, "")
+	if !errors.Is(err, errAlreadyFormatted) {
+		t.Errorf("got %v, want already formatted error", err)
+	}
+}
+
+func TestEraseTag(t *testing.T) {
+	for _, model := range []string{virtualNtag213, virtualNtag216, virtualUltralightC} {
+		t.Run(model, func(t *testing.T) {
+			reader, tag := insertVirtualTag(t, model, "**system:snes")
+
+			_, err := programTag(reader, tag, nfcctl.CmdErase, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			card, err := pollDevice(reader, Card{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if card.Text != "" {
+				t.Errorf("got text %q after erase", card.Text)
+			}
+		})
+	}
+
+	reader, tag := insertVirtualTag(t, virtualMifare1k, "**system:snes")
+	_, err := programTag(reader, tag, nfcctl.CmdErase, "")
+	if !errors.Is(err, ErrUnsupportedTag) {
+		t.Errorf("got %v, want unsupported tag error", err)
+	}
+}
+
+func TestWriteLock(t *testing.T) {
+	for _, model := range []string{virtualNtag215, virtualUltralight} {
+		t.Run(model, func(t *testing.T) {
+			reader, tag := insertVirtualTag(t, model, "")
+
+			_, err := programTag(reader, tag, nfcctl.CmdWriteLock, "**system:snes")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			card, err := pollDevice(reader, Card{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if card.Text != "**system:snes" {
+				t.Errorf("got text %q", card.Text)
+			}
+
+			_, err = programTag(reader, tag, nfcctl.CmdWrite, "**system:nes")
+			if !errors.Is(err, errTagProtected) {
+				t.Errorf("got %v, want protected error", err)
+			}
+
+			_, err = programTag(reader, tag, nfcctl.CmdErase, "")
+			if !errors.Is(err, errTagProtected) {
+				t.Errorf("got %v, want protected error", err)
+			}
+		})
+	}
+
+	// nothing is written if the card can't be locked afterwards
+	reader, tag := insertVirtualTag(t, virtualMifare1k, "")
+	_, err := programTag(reader, tag, nfcctl.CmdWriteLock, "**system:snes")
+	if !errors.Is(err, ErrUnsupportedTag) {
+		t.Errorf("got %v, want unsupported tag error", err)
+	}
+	card, err := pollDevice(reader, Card{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if card.Text != "" {
+		t.Errorf("got text %q on unlockable card", card.Text)
+	}
+}
+
+func TestCardCommandFromFlags(t *testing.T) {
+	tests := []struct {
+		name        string
+		write       string
+		format      bool
+		erase       bool
+		lock        bool
+		confirmLock bool
+		want        string
+		wantErr     bool
+	}{
+		{name: "none", want: ""},
+		{name: "write", write: "**system:snes", want: nfcctl.CmdWrite},
+		{name: "format", format: true, want: nfcctl.CmdFormat},
+		{name: "erase", erase: true, want: nfcctl.CmdErase},
+		{name: "lock", write: "**system:snes", lock: true, confirmLock: true, want: nfcctl.CmdWriteLock},
+		{name: "lock unconfirmed", write: "**system:snes", lock: true, wantErr: true},
+		{name: "lock without write", lock: true, confirmLock: true, wantErr: true},
+		{name: "multiple", write: "**system:snes", erase: true, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := cardCommandFromFlags(tt.write, tt.format, tt.erase, tt.lock, tt.confirmLock)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v", tt.name, err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
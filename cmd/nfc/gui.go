@@ -5,9 +5,9 @@ import (
 	"github.com/wizzomafizzo/mrext/pkg/config"
 	"github.com/wizzomafizzo/mrext/pkg/curses"
 	"github.com/wizzomafizzo/mrext/pkg/mister"
+	"github.com/wizzomafizzo/mrext/pkg/nfcctl"
 	"github.com/wizzomafizzo/mrext/pkg/service"
 	"github.com/wizzomafizzo/mrext/pkg/utils"
-	"net"
 	"os"
 	"strconv"
 	"strings"
@@ -22,7 +22,17 @@ func tryAddStartup(stdscr *goncurses.Window) error {
 		logger.Error("failed to load startup file: %s", err)
 	}
 
-	if !startup.Exists("mrext/" + appName) {
+	migrated, err := startup.MigrateService(appName)
+	if err != nil {
+		logger.Error("failed to move startup entry to supervisor: %s", err)
+	} else if migrated {
+		err = startup.Save()
+		if err != nil {
+			logger.Error("failed to save startup: %s", err)
+		}
+	}
+
+	if !startup.HasSupervised(appName) {
 		win, err := curses.NewWindow(stdscr, 6, 43, "", -1)
 		if err != nil {
 			return err
@@ -71,7 +81,7 @@ func tryAddStartup(stdscr *goncurses.Window) error {
 		}
 
 		if selected == 0 {
-			err = startup.AddService("mrext/" + appName)
+			err = startup.AddSupervised(appName)
 			if err != nil {
 				return err
 			}
@@ -129,27 +139,13 @@ func displayServiceInfo(stdscr *goncurses.Window, service *service.Service) erro
 		scanTime := "never"
 		tagUid := ""
 		tagText := ""
-		conn, err := net.Dial("unix", config.TempFolder+"/nfc.sock")
+		status, err := nfcctl.GetStatus()
 		if err != nil {
-			logger.Debug("could not connect to nfc service: %s", err)
-		} else {
-			_, err := conn.Write([]byte("status"))
-			if err != nil {
-				logger.Debug("could not write to nfc service: %s", err)
-			} else {
-				buf := make([]byte, 4096)
-				_, err := conn.Read(buf)
-				if err != nil {
-					logger.Debug("could not read from nfc service: %s", err)
-				} else {
-					parts := strings.SplitN(string(buf), ",", 5)
-					if parts[0] != "0" {
-						scanTime = parts[0]
-					}
-					tagUid = parts[1]
-					tagText = parts[3]
-				}
-			}
+			logger.Debug("could not get nfc service status: %s", err)
+		} else if status.LastScan != nil {
+			scanTime = strconv.FormatInt(status.LastScan.ScanTime.Unix(), 10)
+			tagUid = status.LastScan.UID
+			tagText = status.LastScan.Text
 		}
 
 		var logLines []string
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ISO 15693 tags, like NXP ICODE, are NFC Forum Type 5 tags. The data area
+// follows a capability container in block 0, and 4 byte blocks are read and
+// written with unaddressed commands.
+// NFCForum-TS-Type-5-Tag_1.0
+
+const (
+	ISO15693_FLAG_HIGH_RATE = byte(0x02)
+	ISO15693_FLAG_ERROR     = byte(0x01)
+	ISO15693_READ_BLOCK     = byte(0x20)
+	ISO15693_WRITE_BLOCK    = byte(0x21)
+	ISO15693_BLOCK_SIZE     = 4
+	ISO15693_MAX_BLOCKS     = 256
+)
+
+var errNotNdefFormatted = errors.New("tag is not NDEF formatted")
+
+func iso15693Command(reader Reader, tx []byte, replySize int) ([]byte, error) {
+	rx, err := reader.Transceive(tx, replySize+1)
+	if err != nil {
+		return nil, fmt.Errorf("comm error: %w", err)
+	}
+
+	if len(rx) < 1 {
+		return nil, fmt.Errorf("invalid response")
+	}
+
+	if rx[0]&ISO15693_FLAG_ERROR != 0 {
+		code := byte(0)
+		if len(rx) > 1 {
+			code = rx[1]
+		}
+		return nil, fmt.Errorf("command %02x failed with error %02x", tx[1], code)
+	}
+
+	return rx[1:], nil
+}
+
+func readISO15693Block(reader Reader, block int) ([]byte, error) {
+	rx, err := iso15693Command(reader, []byte{ISO15693_FLAG_HIGH_RATE, ISO15693_READ_BLOCK, byte(block)}, ISO15693_BLOCK_SIZE)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rx) < ISO15693_BLOCK_SIZE {
+		return nil, fmt.Errorf("short read from block %d", block)
+	}
+
+	return rx[:ISO15693_BLOCK_SIZE], nil
+}
+
+// getISO15693Layout reads the capability container, returning the first
+// block of the data area and its size in bytes.
+func getISO15693Layout(reader Reader) (int, int, error) {
+	cc, err := readISO15693Block(reader, 0)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if cc[0] != 0xE1 && cc[0] != 0xE2 {
+		return 0, 0, errNotNdefFormatted
+	}
+
+	if cc[2] != 0x00 {
+		return 1, int(cc[2]) * 8, nil
+	}
+
+	// 8 byte capability container, the size is in the second block
+	ext, err := readISO15693Block(reader, 1)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return 2, (int(ext[2])<<8 | int(ext[3])) * 8, nil
+}
+
+func getISO15693Capacity(reader Reader) (int, error) {
+	_, capacity, err := getISO15693Layout(reader)
+	return capacity, err
+}
+
+func readISO15693(reader Reader) ([]byte, error) {
+	start, capacity, err := getISO15693Layout(reader)
+	if errors.Is(err, errNotNdefFormatted) {
+		logger.Info("ISO 15693 tag is not NDEF formatted")
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	allBlocks := make([]byte, 0)
+	end := start + capacity/ISO15693_BLOCK_SIZE
+	for block := start; block < end && block < ISO15693_MAX_BLOCKS; block++ {
+		data, err := readISO15693Block(reader, block)
+		if err != nil {
+			return nil, err
+		}
+
+		allBlocks = append(allBlocks, data...)
+
+		if ndefReadComplete(allBlocks) {
+			break
+		}
+	}
+
+	return allBlocks, nil
+}
+
+func writeISO15693(reader Reader, text string) ([]byte, error) {
+	payload, err := BuildMessage(text)
+	if err != nil {
+		return nil, err
+	}
+
+	start, capacity, err := getISO15693Layout(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(payload) > capacity {
+		return nil, fmt.Errorf("Payload too big for card: [%d/%d] bytes used\n", len(payload), capacity)
+	}
+
+	for i, chunk := range chunkBy(payload, ISO15693_BLOCK_SIZE) {
+		for len(chunk) < ISO15693_BLOCK_SIZE {
+			chunk = append(chunk, 0x00)
+		}
+
+		tx := []byte{ISO15693_FLAG_HIGH_RATE, ISO15693_WRITE_BLOCK, byte(start + i)}
+		_, err := iso15693Command(reader, append(tx, chunk...), 0)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return payload, nil
+}
@@ -4,13 +4,15 @@ import (
 	_ "embed"
 	"errors"
 	"fmt"
-	"github.com/gocarina/gocsv"
 	"github.com/wizzomafizzo/mrext/pkg/config"
 	"github.com/wizzomafizzo/mrext/pkg/input"
 	"github.com/wizzomafizzo/mrext/pkg/mister"
-	"io"
+	"github.com/wizzomafizzo/mrext/pkg/nfclog"
+	"github.com/wizzomafizzo/mrext/pkg/nfcmap"
 	"os"
 	"strings"
+	"sync"
+	"time"
 )
 
 // Breviceps (https://freesound.org/people/Breviceps/sounds/445978/)
@@ -25,95 +27,250 @@ var successSound []byte
 //go:embed sounds/fail.wav
 var failSound []byte
 
-type NfcMappingEntry struct {
-	MatchUID  string `csv:"match_uid"`
-	MatchText string `csv:"match_text"`
-	Text      string `csv:"text"`
-}
+const (
+	removeActionNone    = "none"
+	defaultRemoveAction = "**system:menu"
+)
 
 func loadDatabase(state *ServiceState) error {
-	uids := make(map[string]string)
-	texts := make(map[string]string)
-
 	if _, err := os.Stat(config.NfcDatabaseFile); errors.Is(err, os.ErrNotExist) {
 		logger.Info("no database file found, skipping")
+		state.SetDB(&nfcmap.Database{})
 		return nil
 	}
 
-	f, err := os.Open(config.NfcDatabaseFile)
-	if err != nil {
+	db, err := nfcmap.Load(config.NfcDatabaseFile)
+
+	var validationErrs nfcmap.ValidationErrors
+	if errors.As(err, &validationErrs) {
+		for _, e := range validationErrs {
+			logger.Warn("invalid database entry, skipping: %s", e)
+		}
+	} else if err != nil {
 		return err
 	}
-	defer func(c io.Closer) {
-		_ = c.Close()
-	}(f)
 
-	entries := make([]NfcMappingEntry, 0)
-	err = gocsv.Unmarshal(f, &entries)
-	if err != nil {
-		return err
+	logger.Info("loaded %d entries from database", len(db.Rules))
+	state.SetDB(db)
+
+	return nil
+}
+
+// launchFunc launches the given text, split into commands. Override is true
+// when the text came from the database rather than the card itself.
+type launchFunc func(text string, override bool) error
+
+// launchCard launches the active card. The returned entry records what was
+// launched for the scan log.
+func launchCard(state *ServiceState, launch launchFunc) (nfclog.Entry, error) {
+	card := state.GetActiveCard()
+	entry := scanLogEntry(card)
+
+	text := card.Text
+	override := false
+
+	if rule, ok := state.GetDB().Match(card.UID, card.CardType, card.Text); ok && rule.Text != "" {
+		logger.Info("launching with database match override (line %d)", rule.Line)
+		text = rule.Text
+		override = true
+		entry.MappingLine = rule.Line
 	}
 
-	count := 0
-	for i, entry := range entries {
-		if entry.MatchUID == "" && entry.MatchText == "" {
-			logger.Warn("entry %d has no UID or text, skipping", i+1)
-			continue
-		}
+	if text == "" {
+		return entry, fmt.Errorf("no text NDEF found in card or database")
+	}
 
-		if entry.MatchUID != "" {
-			uid := strings.TrimSpace(entry.MatchUID)
-			uid = strings.ToLower(uid)
-			uid = strings.ReplaceAll(uid, ":", "")
-			uids[uid] = strings.TrimSpace(entry.Text)
-		}
+	entry.Launch = text
+	logger.Info("launching with text: %s", text)
+	return entry, launch(text, override)
+}
 
-		if entry.MatchText != "" {
-			text := strings.TrimSpace(entry.MatchText)
-			texts[text] = strings.TrimSpace(entry.Text)
+// removeAction returns the text to launch when a card is removed from the
+// reader. A database entry's on_remove value takes priority over the global
+// exit_on_remove setting, and can be set to "none" to disable the action for
+// that entry.
+func removeAction(cfg *config.UserConfig, db *nfcmap.Database, card Card) (string, bool) {
+	if rule, ok := db.Match(card.UID, card.CardType, card.Text); ok && rule.OnRemove != "" {
+		if strings.EqualFold(rule.OnRemove, removeActionNone) {
+			return "", false
 		}
+		return rule.OnRemove, true
+	}
 
-		count++
+	if cfg.Nfc.ExitOnRemove {
+		if cfg.Nfc.OnRemove != "" {
+			return cfg.Nfc.OnRemove, true
+		}
+		return defaultRemoveAction, true
 	}
-	logger.Info("loaded %d entries from database", count)
 
-	state.SetDB(uids, texts)
+	return "", false
+}
 
-	return nil
+// backgroundScripts runs card scripts in the background, one at a time, so
+// the reader keeps polling while a script waits.
+type backgroundScripts struct {
+	mu     sync.Mutex
+	cancel chan struct{}
+	done   chan struct{}
 }
 
-func launchCard(cfg *config.UserConfig, state *ServiceState, kbd input.Keyboard) error {
-	card := state.GetActiveCard()
-	uidMap, textMap := state.GetDB()
+// Start cancels the running script and starts a new one. Run must return
+// soon after cancel is closed.
+func (b *backgroundScripts) Start(run func(cancel <-chan struct{})) {
+	b.Cancel()
 
-	text := card.Text
-	override := false
+	b.mu.Lock()
+	defer b.mu.Unlock()
 
-	if v, ok := uidMap[card.UID]; ok {
-		logger.Info("launching with uid match override")
-		text = v
-		override = true
+	cancel := make(chan struct{})
+	done := make(chan struct{})
+	b.cancel = cancel
+	b.done = done
+
+	go func() {
+		defer close(done)
+		run(cancel)
+	}()
+}
+
+// Cancel stops the running script, if there is one, and waits for it to
+// finish.
+func (b *backgroundScripts) Cancel() {
+	b.mu.Lock()
+	cancel, done := b.cancel, b.done
+	b.cancel, b.done = nil, nil
+	b.mu.Unlock()
+
+	if cancel == nil {
+		return
 	}
 
-	if v, ok := textMap[card.Text]; ok {
-		logger.Info("launching with text match override")
-		text = v
-		override = true
+	close(cancel)
+	<-done
+}
+
+// cardHandler reacts to changes in the card on the reader between polls.
+type cardHandler struct {
+	cfg    *config.UserConfig
+	state  *ServiceState
+	launch launchFunc
+	onScan func(card Card)
+	// scanLog is optional, every scanned card is recorded to it
+	scanLog *nfclog.Log
+	// scripts is optional, its running script is cancelled when the card
+	// changes
+	scripts *backgroundScripts
+}
+
+func scanLogEntry(card Card) nfclog.Entry {
+	return nfclog.Entry{
+		Time: card.ScanTime,
+		UID:  card.UID,
+		Type: card.CardType,
+		Text: card.Text,
 	}
+}
 
-	if text == "" {
-		return fmt.Errorf("no text NDEF found in card or database")
+func (h *cardHandler) logScan(entry nfclog.Entry) {
+	if h.scanLog == nil {
+		return
 	}
 
-	logger.Info("launching with text: %s", text)
-	cmds := strings.Split(text, "||")
+	err := h.scanLog.Add(entry)
+	if err != nil {
+		logger.Error("error writing scan log: %s", err)
+	}
+}
+
+func (h *cardHandler) update(activeCard Card, newScanned Card) error {
+	h.state.SetActiveCard(newScanned)
 
-	for _, cmd := range cmds {
-		err := mister.LaunchToken(cfg, cfg.Nfc.AllowCommands || override, kbd, cmd)
-		if err != nil {
-			return err
+	if h.scripts != nil && activeCard.UID != newScanned.UID {
+		h.scripts.Cancel()
+	}
+
+	if activeCard.UID != "" && newScanned.UID == "" {
+		if h.state.IsLauncherDisabled() {
+			logger.Info("launcher disabled, skipping remove action")
+		} else if text, ok := removeAction(h.cfg, h.state.GetDB(), activeCard); ok {
+			logger.Info("running remove action: %s", text)
+			err := h.launch(text, true)
+			if err != nil {
+				return fmt.Errorf("error running remove action: %w", err)
+			}
 		}
 	}
 
+	if newScanned.UID == "" || activeCard.UID == newScanned.UID {
+		return nil
+	}
+
+	if h.onScan != nil {
+		h.onScan(newScanned)
+	}
+
+	if h.state.IsLauncherDisabled() {
+		logger.Info("launcher disabled, skipping")
+		entry := scanLogEntry(newScanned)
+		entry.Result = nfclog.ResultSkipped
+		h.logScan(entry)
+		return nil
+	}
+
+	entry, err := launchCard(h.state, h.launch)
+	if err != nil {
+		entry.Result = nfclog.ResultFailed
+		entry.Error = err.Error()
+	} else {
+		entry.Result = nfclog.ResultLaunched
+	}
+	h.logScan(entry)
+
+	return err
+}
+
+// logReadError records a card which was detected but couldn't be read.
+func (h *cardHandler) logReadError(err error) {
+	var readErr *cardReadError
+	if !errors.As(err, &readErr) {
+		return
+	}
+
+	h.logScan(nfclog.Entry{
+		Time:   time.Now(),
+		UID:    readErr.uid,
+		Type:   readErr.cardType,
+		Result: nfclog.ResultReadError,
+		Error:  readErr.err.Error(),
+	})
+}
+
+// launchText runs text from a card as a script. See script.go for the
+// format. Scripts which wait are started in the background and only errors
+// before they start are returned, later errors are logged.
+func launchText(cfg *config.UserConfig, kbd input.Keyboard, scripts *backgroundScripts, text string, override bool) error {
+	script, err := parseScript(text)
+	if err != nil {
+		return err
+	}
+
+	runner := newScriptRunner(&kbd, func(cmd string) error {
+		return mister.LaunchToken(cfg, cfg.Nfc.AllowCommands || override, kbd, cmd)
+	})
+
+	if !script.background() {
+		return runner.Run(script, nil)
+	}
+
+	scripts.Start(func(cancel <-chan struct{}) {
+		err := runner.Run(script, cancel)
+		if errors.Is(err, errScriptCancelled) {
+			logger.Info("script cancelled: %s", text)
+		} else if err != nil {
+			logger.Error("error running script: %s", err)
+		}
+	})
+
 	return nil
 }
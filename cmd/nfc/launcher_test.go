@@ -0,0 +1,228 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wizzomafizzo/mrext/pkg/config"
+	"github.com/wizzomafizzo/mrext/pkg/nfclog"
+	"github.com/wizzomafizzo/mrext/pkg/nfcmap"
+)
+
+// simulateReader feeds a sequence of poll results through a card handler, as
+// if a reader had reported them one after the other. An empty UID means no
+// card is on the reader.
+func simulateReader(t *testing.T, cfg *config.UserConfig, db string, polls []Card) []string {
+	t.Helper()
+
+	state := &ServiceState{}
+	if db != "" {
+		parsed, err := nfcmap.Parse(strings.NewReader(db))
+		if err != nil {
+			t.Fatal(err)
+		}
+		state.SetDB(parsed)
+	}
+
+	launched := make([]string, 0)
+	handler := &cardHandler{
+		cfg:   cfg,
+		state: state,
+		launch: func(text string, _ bool) error {
+			launched = append(launched, text)
+			return nil
+		},
+	}
+
+	for _, card := range polls {
+		err := handler.update(state.GetActiveCard(), card)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return launched
+}
+
+func TestRemoveActions(t *testing.T) {
+	cardA := Card{UID: "04a1", CardType: TypeNTAG, Text: "**system:snes"}
+	cardB := Card{UID: "04b2", CardType: TypeNTAG, Text: "**system:nes"}
+	none := Card{}
+
+	db := `match_uid,text,on_remove
+04b2,,**system:genesis
+04c3,,none
+`
+	cardC := Card{UID: "04c3", CardType: TypeNTAG, Text: "**system:n64"}
+
+	tests := []struct {
+		name  string
+		nfc   config.NfcConfig
+		polls []Card
+		want  []string
+	}{
+		{
+			name:  "disabled by default",
+			polls: []Card{cardA, cardA, none},
+			want:  []string{"**system:snes"},
+		},
+		{
+			name:  "exit on remove",
+			nfc:   config.NfcConfig{ExitOnRemove: true},
+			polls: []Card{cardA, cardA, none, none, cardA},
+			want:  []string{"**system:snes", "**system:menu", "**system:snes"},
+		},
+		{
+			name:  "custom global action",
+			nfc:   config.NfcConfig{ExitOnRemove: true, OnRemove: "**random:all"},
+			polls: []Card{cardA, none},
+			want:  []string{"**system:snes", "**random:all"},
+		},
+		{
+			name:  "mapping action without global mode",
+			polls: []Card{cardB, none, cardA, none},
+			want:  []string{"**system:nes", "**system:genesis", "**system:snes"},
+		},
+		{
+			name:  "mapping disables global mode",
+			nfc:   config.NfcConfig{ExitOnRemove: true},
+			polls: []Card{cardC, none, cardA, none},
+			want:  []string{"**system:n64", "**system:snes", "**system:menu"},
+		},
+		{
+			name:  "swapping cards skips remove action",
+			nfc:   config.NfcConfig{ExitOnRemove: true},
+			polls: []Card{cardA, cardB},
+			want:  []string{"**system:snes", "**system:nes"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.UserConfig{Nfc: tt.nfc}
+			got := simulateReader(t, cfg, db, tt.polls)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScanLog(t *testing.T) {
+	db, err := nfcmap.Parse(strings.NewReader(`match_uid,text
+04b2,**system:genesis
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state := &ServiceState{}
+	state.SetDB(db)
+
+	path := filepath.Join(t.TempDir(), "scans.log")
+	handler := &cardHandler{
+		cfg:   &config.UserConfig{},
+		state: state,
+		launch: func(text string, _ bool) error {
+			if text == "**system:broken" {
+				return errors.New("unknown system")
+			}
+			return nil
+		},
+		scanLog: nfclog.New(path, 0, 0),
+	}
+
+	polls := []Card{
+		{UID: "04a1", CardType: TypeNTAG, Text: "**system:snes"},
+		{UID: "04b2", CardType: TypeMifare, Text: "**system:nes"},
+		{UID: "04c3", CardType: TypeNTAG, Text: "**system:broken"},
+	}
+	for _, card := range polls {
+		_ = handler.update(state.GetActiveCard(), card)
+	}
+
+	state.DisableLauncher()
+	_ = handler.update(state.GetActiveCard(), Card{UID: "04d4", CardType: TypeNTAG})
+	state.EnableLauncher()
+
+	handler.logReadError(&cardReadError{uid: "04e5", cardType: TypeNTAG, err: errors.New("comm error")})
+
+	entries, err := nfclog.Read(path, nfclog.Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make([]string, 0)
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		got = append(got, fmt.Sprintf("%s %s %d %s %s", e.UID, e.Result, e.MappingLine, e.Launch, e.Error))
+	}
+
+	want := []string{
+		"04a1 launched 0 **system:snes ",
+		"04b2 launched 2 **system:genesis ",
+		"04c3 failed 0 **system:broken unknown system",
+		"04d4 skipped 0  ",
+		"04e5 read_error 0  comm error",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q\nwant %q", got, want)
+	}
+}
+
+func TestBackgroundScriptCancelled(t *testing.T) {
+	state := &ServiceState{}
+	scripts := &backgroundScripts{}
+	runner, _ := fakeRunner(&fakeKeyboard{}, &fakeTracker{cores: []string{""}}, "")
+	runner.after = time.After
+
+	results := make(chan error, 2)
+	handler := &cardHandler{
+		cfg:     &config.UserConfig{},
+		state:   state,
+		scripts: scripts,
+		launch: func(text string, _ bool) error {
+			script, err := parseScript(text)
+			if err != nil {
+				return err
+			}
+			scripts.Start(func(cancel <-chan struct{}) {
+				results <- runner.Run(script, cancel)
+			})
+			return nil
+		},
+	}
+
+	started := time.Now()
+	err := handler.update(state.GetActiveCard(), Card{UID: "04a1", Text: "**delay:60000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a new card cancels the running script
+	err = handler.update(state.GetActiveCard(), Card{UID: "04b2", Text: "**wait:core=pacman,timeout=60000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-results; !errors.Is(err, errScriptCancelled) {
+		t.Errorf("got %v, want cancelled", err)
+	}
+
+	// and so does removing it
+	err = handler.update(state.GetActiveCard(), Card{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-results; !errors.Is(err, errScriptCancelled) {
+		t.Errorf("got %v, want cancelled", err)
+	}
+
+	if time.Since(started) > 10*time.Second {
+		t.Error("scripts weren't cancelled straight away")
+	}
+}
@@ -5,24 +5,26 @@ import (
 	"errors"
 	"flag"
 	"fmt"
-	"net"
 	"os"
 	"os/exec"
 	"os/signal"
+	"path/filepath"
 	"strings"
 	"sync"
 	"syscall"
+	"text/tabwriter"
 	"time"
 
-	"github.com/fsnotify/fsnotify"
 	gc "github.com/rthornton128/goncurses"
 	"github.com/wizzomafizzo/mrext/pkg/curses"
 	"github.com/wizzomafizzo/mrext/pkg/input"
+	"github.com/wizzomafizzo/mrext/pkg/nfcctl"
+	"github.com/wizzomafizzo/mrext/pkg/nfclog"
+	"github.com/wizzomafizzo/mrext/pkg/nfcmap"
 
 	"github.com/wizzomafizzo/mrext/pkg/config"
 	"github.com/wizzomafizzo/mrext/pkg/service"
 
-	"github.com/clausecker/nfc/v2"
 	"github.com/wizzomafizzo/mrext/pkg/mister"
 )
 
@@ -45,12 +47,7 @@ const (
 	launcherDisabledPath = config.TempFolder + "/nfc.disabled"
 )
 
-var (
-	supportedCardTypes = []nfc.Modulation{
-		{Type: nfc.ISO14443a, BaudRate: nfc.Nbr106},
-	}
-	logger = service.NewLogger(appName)
-)
+var logger = service.NewLogger(appName)
 
 type Card struct {
 	CardType string
@@ -65,9 +62,9 @@ type ServiceState struct {
 	lastScanned     Card
 	stopService     bool
 	disableLauncher bool
-	dbLoadTime      time.Time
-	uidMap          map[string]string
-	textMap         map[string]string
+	db              *nfcmap.Database
+	job             *readerJob
+	connection      string
 }
 
 func (s *ServiceState) SetActiveCard(card Card) {
@@ -127,36 +124,44 @@ func (s *ServiceState) IsLauncherDisabled() bool {
 	return s.disableLauncher
 }
 
-func (s *ServiceState) GetDB() (map[string]string, map[string]string) {
+func (s *ServiceState) GetDB() *nfcmap.Database {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	return s.uidMap, s.textMap
+	return s.db
 }
 
-func (s *ServiceState) GetDBLoadTime() time.Time {
+func (s *ServiceState) SetDB(db *nfcmap.Database) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	return s.dbLoadTime
+	s.db = db
 }
 
-func (s *ServiceState) SetDB(uidMap map[string]string, textMap map[string]string) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.dbLoadTime = time.Now()
-	s.uidMap = uidMap
-	s.textMap = textMap
+// cardReadError is returned by pollDevice when a card was detected but its
+// data couldn't be read.
+type cardReadError struct {
+	uid      string
+	cardType string
+	err      error
+}
+
+func (e *cardReadError) Error() string {
+	return e.err.Error()
+}
+
+func (e *cardReadError) Unwrap() error {
+	return e.err
 }
 
 func pollDevice(
-	pnd *nfc.Device,
+	reader Reader,
 	activeCard Card,
 ) (Card, error) {
-	count, target, err := pnd.InitiatorPollTarget(supportedCardTypes, timesToPoll, periodBetweenPolls)
-	if err != nil && !errors.Is(err, nfc.Error(nfc.ETIMEOUT)) {
+	tag, err := reader.Poll()
+	if err != nil {
 		return activeCard, err
 	}
 
-	if count <= 0 {
+	if tag == nil {
 		if activeCard.UID != "" && time.Since(activeCard.ScanTime) > timeToForgetCard {
 			logger.Info("card removed")
 			activeCard = Card{}
@@ -165,36 +170,23 @@ func pollDevice(
 		return activeCard, nil
 	}
 
-	cardUid := getCardUID(target)
-	if cardUid == "" {
-		logger.Warn("unable to detect card UID: %s", target.String())
-	}
-
-	if cardUid == activeCard.UID {
+	if tag.UID == activeCard.UID {
 		return activeCard, nil
 	}
 
-	logger.Info("card UID: %s", cardUid)
-
-	var record []byte
-	cardType := getCardType(target)
+	logger.Info("card UID: %s", tag.UID)
 
-	if cardType == TypeNTAG {
-		logger.Info("NTAG detected")
-		record, err = readNtag(*pnd, logger)
-		if err != nil {
-			return activeCard, fmt.Errorf("error reading ntag: %s", err)
-		}
-		cardType = TypeNTAG
+	err = identifyTag(reader, tag)
+	if err != nil {
+		logger.Warn("could not identify card type: %s", err)
 	}
 
-	if cardType == TypeMifare {
-		logger.Info("Mifare detected")
-		record, err = readMifare(*pnd, cardUid)
-		if err != nil {
-			logger.Error("error reading mifare: %s", err)
-		}
-		cardType = TypeMifare
+	record, err := readTag(reader, tag)
+	if errors.Is(err, ErrUnsupportedTag) || errors.Is(err, errTagProtected) {
+		// the UID can still be used in mappings
+		logger.Info("%s, card can only be identified by UID", err)
+	} else if err != nil {
+		return activeCard, &cardReadError{uid: tag.UID, cardType: tag.Type, err: err}
 	}
 
 	logger.Debug("record bytes: %s", hex.EncodeToString(record))
@@ -206,8 +198,8 @@ func pollDevice(
 	}
 
 	card := Card{
-		CardType: cardType,
-		UID:      cardUid,
+		CardType: tag.Type,
+		UID:      tag.UID,
 		Text:     tagText,
 		ScanTime: time.Now(),
 	}
@@ -270,77 +262,19 @@ func startService(cfg *config.UserConfig) (func() error, error) {
 		}
 	}
 
-	var closeDbWatcher func() error
-	dbWatcher, err := fsnotify.NewWatcher()
-	if err != nil {
-		logger.Error("error creating watcher: %s", err)
-	} else {
-		closeDbWatcher = dbWatcher.Close
-	}
-
-	go func() {
-		// this turned out to be not trivial to say the least, mostly due to
-		// the fact the fsnotify library does not implement the IN_CLOSE_WRITE
-		// inotify event, which signals the file has finished being written
-		// see: https://github.com/fsnotify/fsnotify/issues/372
-		//
-		// during a standard write operation, a file may emit multiple write
-		// events, including when the file could be half-written
-		//
-		// it's also the case that editors may delete the file and create a new
-		// one, which kills the active watcher
-		//
-		// this solution is very ugly, but it appears to work well :)
-		// i think it will be sufficient for the use case, and i really like
-		// this idea a lot. it's certainly preferable to the screen flicker
-		// with the previous setup
-		//
-		// there doesn't appear to be any actively maintained wrapper for
-		// inotify, so i think it would be best to write one for mrext later
-		const delay = 1 * time.Second
-		for {
-			select {
-			case event, ok := <-dbWatcher.Events:
-				if !ok {
-					return
-				}
-				if event.Has(fsnotify.Write) {
-					// usually receives multiple write events, just act on the first
-					if time.Since(state.GetDBLoadTime()) < delay {
-						continue
-					}
-					time.Sleep(delay)
-					logger.Info("database changed, reloading")
-					err := loadDatabase(state)
-					if err != nil {
-						logger.Error("error loading database: %s", err)
-					}
-				} else if event.Has(fsnotify.Remove) {
-					// editors may also delete the file on write
-					time.Sleep(delay)
-					_, err := os.Stat(config.NfcDatabaseFile)
-					if err == nil {
-						err = dbWatcher.Add(config.NfcDatabaseFile)
-						if err != nil {
-							logger.Error("error watching database: %s", err)
-						}
-						logger.Info("database changed, reloading")
-						err := loadDatabase(state)
-						if err != nil {
-							logger.Error("error loading database: %s", err)
-						}
-					}
-				}
-			case err, ok := <-dbWatcher.Errors:
-				if !ok {
-					return
-				}
-				logger.Error("watcher error: %s", err)
+	closeDbWatcher, err := nfcmap.Watch(
+		config.NfcDatabaseFile,
+		func() {
+			logger.Info("database changed, reloading")
+			err := loadDatabase(state)
+			if err != nil {
+				logger.Error("error loading database: %s", err)
 			}
-		}
-	}()
-
-	err = dbWatcher.Add(config.NfcDatabaseFile)
+		},
+		func(err error) {
+			logger.Error("watcher error: %s", err)
+		},
+	)
 	if err != nil {
 		logger.Error("error watching database: %s", err)
 	}
@@ -349,29 +283,47 @@ func startService(cfg *config.UserConfig) (func() error, error) {
 		state.DisableLauncher()
 	}
 
+	scripts := &backgroundScripts{}
+	handler := &cardHandler{
+		cfg:     cfg,
+		state:   state,
+		scripts: scripts,
+		launch: func(text string, override bool) error {
+			return launchText(cfg, kbd, scripts, text, override)
+		},
+		onScan: func(card Card) {
+			playSuccess()
+
+			err := writeScanResult(card)
+			if err != nil {
+				logger.Warn("error writing tmp scan result: %s", err)
+			}
+		},
+	}
+
+	if !cfg.Nfc.DisableScanLog {
+		handler.scanLog = nfclog.New(config.NfcScanLogFile, int64(cfg.Nfc.ScanLogSize)*1024, 0)
+	}
+
 	go func() {
-		var pnd nfc.Device
+		var reader Reader
 		var err error
 
 	reconnect:
-		pnd, err = openDeviceWithRetries(cfg.Nfc)
+		state.SetConnection("")
+		reader, err = openReaderWithRetries(cfg.Nfc)
 		if err != nil {
 			return
 		}
+		state.SetConnection(reader.Connection())
 
-		defer func(pnd nfc.Device) {
-			err := pnd.Close()
+		defer func(reader Reader) {
+			err := reader.Close()
 			if err != nil {
 				logger.Warn("error closing device: %s", err)
 			}
-		}(pnd)
-
-		if err := pnd.InitiatorInit(); err != nil {
-			logger.Error("could not init initiator: %s", err)
-			return
-		}
+		}(reader)
 
-		logger.Info("opened connection: %s %s", pnd, pnd.Connection())
 		logger.Info("polling for %d times with %s delay", timesToPoll, periodBetweenPolls)
 		var lastError time.Time
 
@@ -380,9 +332,20 @@ func startService(cfg *config.UserConfig) (func() error, error) {
 				break
 			}
 
+			if job := state.GetJob(); job != nil {
+				err := runJob(reader, state, job)
+				if errors.Is(err, ErrReaderDisconnected) {
+					logger.Error("error during poll: %s", err)
+					logger.Error("fatal IO error, device was unplugged, exiting...")
+					goto reconnect
+				}
+				time.Sleep(periodBetweenLoop)
+				continue
+			}
+
 			activeCard := state.GetActiveCard()
-			newScanned, err := pollDevice(&pnd, activeCard)
-			if errors.Is(err, nfc.Error(nfc.EIO)) {
+			newScanned, err := pollDevice(reader, activeCard)
+			if errors.Is(err, ErrReaderDisconnected) {
 				logger.Error("error during poll: %s", err)
 				logger.Error("fatal IO error, device was unplugged, exiting...")
 				if time.Since(lastError) > 1*time.Second {
@@ -393,30 +356,15 @@ func startService(cfg *config.UserConfig) (func() error, error) {
 				logger.Error("error during poll: %s", err)
 				if time.Since(lastError) > 1*time.Second {
 					playFail()
+					// failed reads are retried every loop, only log them
+					// as often as the fail sound plays
+					handler.logReadError(err)
 				}
 				lastError = time.Now()
 				goto end
 			}
 
-			state.SetActiveCard(newScanned)
-
-			if newScanned.UID == "" || activeCard.UID == newScanned.UID {
-				goto end
-			}
-
-			playSuccess()
-
-			err = writeScanResult(newScanned)
-			if err != nil {
-				logger.Warn("error writing tmp scan result: %s", err)
-			}
-
-			if state.IsLauncherDisabled() {
-				logger.Info("launcher disabled, skipping")
-				goto end
-			}
-
-			err = launchCard(cfg, state, kbd)
+			err = handler.update(activeCard, newScanned)
 			if err != nil {
 				logger.Error("error launching card: %s", err)
 				if time.Since(lastError) > 1*time.Second {
@@ -431,88 +379,19 @@ func startService(cfg *config.UserConfig) (func() error, error) {
 		}
 	}()
 
-	socket, err := net.Listen("unix", config.TempFolder+"/nfc.sock")
+	closeSocket, err := startSocket(state)
 	if err != nil {
 		logger.Error("error creating socket: %s", err)
 		return nil, err
 	}
 
-	go func() {
-		for {
-			if state.ShouldStopService() {
-				break
-			}
-
-			conn, err := socket.Accept()
-			if err != nil {
-				logger.Error("error accepting connection: %s", err)
-				return
-			}
-
-			go func(conn net.Conn) {
-				logger.Debug("new socket connection")
-
-				defer func(conn net.Conn) {
-					err := conn.Close()
-					if err != nil {
-						logger.Warn("error closing connection: %s", err)
-					}
-				}(conn)
-
-				buf := make([]byte, 4096)
-
-				n, err := conn.Read(buf)
-				if err != nil {
-					logger.Error("error reading from connection: %s", err)
-					return
-				}
-
-				if n == 0 {
-					return
-				}
-				logger.Debug("received %d bytes", n)
-
-				payload := ""
-
-				switch strings.TrimSpace(string(buf[:n])) {
-				case "status":
-					lastScanned := state.GetLastScanned()
-					if lastScanned.UID != "" {
-						payload = fmt.Sprintf(
-							"%d,%s,%t,%s",
-							lastScanned.ScanTime.Unix(),
-							lastScanned.UID,
-							!state.IsLauncherDisabled(),
-							lastScanned.Text,
-						)
-					} else {
-						payload = fmt.Sprintf("0,,%t,", !state.IsLauncherDisabled())
-					}
-				case "disable":
-					state.DisableLauncher()
-					logger.Info("launcher disabled")
-				case "enable":
-					state.EnableLauncher()
-					logger.Info("launcher enabled")
-				default:
-					logger.Warn("unknown command: %s", strings.TrimRight(string(buf[:n]), "\n"))
-				}
-
-				_, err = conn.Write([]byte(payload))
-				if err != nil {
-					logger.Error("error writing to connection: %s", err)
-					return
-				}
-			}(conn)
-		}
-	}()
-
 	return func() error {
-		err := socket.Close()
+		err := closeSocket()
 		if err != nil {
 			logger.Warn("error closing socket: %s", err)
 		}
 		state.StopService()
+		scripts.Cancel()
 		if closeDbWatcher != nil {
 			return closeDbWatcher()
 		}
@@ -545,8 +424,8 @@ func addToStartup() error {
 		return err
 	}
 
-	if !startup.Exists("mrext/" + appName) {
-		err = startup.AddService("mrext/" + appName)
+	if startup.Exists("mrext/"+appName) || !startup.HasSupervised(appName) {
+		err = startup.AddSupervised(appName)
 		if err != nil {
 			return err
 		}
@@ -560,205 +439,239 @@ func addToStartup() error {
 	return nil
 }
 
-func openDeviceWithRetries(config config.NfcConfig) (nfc.Device, error) {
-	var connectionString = config.ConnectionString
-	if connectionString == "" && config.ProbeDevice == true {
-		connectionString = detectConnectionString()
+// handleCardCommand runs a write, write-lock, format or erase command on the
+// next card placed on the reader. If the service is running the command is
+// handed off to it, otherwise the reader is opened directly.
+func handleCardCommand(cmd string, text string, svc *service.Service, cfg config.NfcConfig) error {
+	if !svc.Running() {
+		return runDirect(cmd, text, cfg)
 	}
 
-	tries := 0
-	for {
-		pnd, err := nfc.Open(connectionString)
-		if err == nil {
-			logger.Info("successful connect after %d tries", tries)
-			return pnd, err
-		}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigs)
 
-		if tries >= connectMaxTries {
-			logger.Error("could not open device after %d tries: %s", connectMaxTries, err)
-			return pnd, err
+	go func() {
+		if _, ok := <-sigs; ok {
+			err := nfcctl.Cancel()
+			if err != nil {
+				logger.Error("error cancelling %s: %s", cmd, err)
+			}
 		}
+	}()
 
-		tries++
+	onProgress := func(msg nfcctl.Message) {
+		switch msg.Event {
+		case nfcctl.EventWaiting:
+			_, _ = fmt.Fprintln(os.Stderr, "Waiting for card...")
+		case nfcctl.EventWriting:
+			_, _ = fmt.Fprintln(os.Stderr, "Writing to card:", msg.Card.UID)
+		}
 	}
-}
 
-func detectConnectionString() string {
-	logger.Info("attempting to probe for NFC device")
-	devices, _ := getSerialDeviceList()
+	var card *nfcctl.Card
+	var err error
 
-	for _, device := range devices {
-		connectionString := "pn532_uart:" + device
-		pnd, err := nfc.Open(connectionString)
-		logger.Info("trying %s", connectionString)
-		if err == nil {
-			logger.Info("success using serial: %s", connectionString)
-			pnd.Close()
-			return connectionString
-		}
+	switch cmd {
+	case nfcctl.CmdWrite:
+		card, err = nfcctl.Write(text, onProgress)
+	case nfcctl.CmdWriteLock:
+		card, err = nfcctl.WriteAndLock(text, onProgress)
+	case nfcctl.CmdFormat:
+		card, err = nfcctl.Format(onProgress)
+	case nfcctl.CmdErase:
+		card, err = nfcctl.Erase(onProgress)
+	default:
+		return fmt.Errorf("unknown command: %s", cmd)
+	}
+	if err != nil {
+		return err
 	}
 
-	return ""
+	logger.Info("successfully ran %s on card: %s", cmd, card.UID)
+	return nil
 }
 
-func getSerialDeviceList() ([]string, error) {
-	path := "/dev/serial/by-id/"
-	f, err := os.Open(path)
+func runDirect(cmd string, text string, cfg config.NfcConfig) error {
+	reader, err := openReaderWithRetries(cfg)
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("could not open device: %w", err)
 	}
-	files, err := f.Readdir(0)
+
+	defer func(reader Reader) {
+		err := reader.Close()
+		if err != nil {
+			logger.Warn("error closing device: %s", err)
+		}
+		logger.Info("closed nfc device")
+	}(reader)
+
+	_, _ = fmt.Fprintln(os.Stderr, "Waiting for card...")
+	tag, err := waitForTag(reader, int(nfcctl.JobTimeout/(timesToPoll*periodBetweenPolls)))
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	var devices []string
+	logger.Info("Found card with UID: %s", tag.UID)
 
-	for _, v := range files {
-		if !v.IsDir() {
-			devices = append(devices, path+v.Name())
-		}
+	err = identifyTag(reader, tag)
+	if err != nil {
+		return err
 	}
 
-	return devices, nil
-}
-
-func handleWriteCommand(textToWrite string, svc *service.Service, config config.NfcConfig) {
-	serviceRunning := svc.Running()
-	if serviceRunning {
-		err := svc.Stop()
+	if cmd != nfcctl.CmdFormat {
+		capacity, err := getTagCapacity(reader, tag)
 		if err != nil {
-			logger.Error("error stopping service: %s", err)
-			_, _ = fmt.Fprintln(os.Stderr, "Error stopping service:", err)
-			os.Exit(1)
-		}
-
-		tries := 15
-		for {
-			if !svc.Running() {
-				break
-			}
-			time.Sleep(100 * time.Millisecond)
-			tries--
-			if tries <= 0 {
-				logger.Error("error stopping service: %s", err)
-				_, _ = fmt.Fprintln(os.Stderr, "Error stopping service:", err)
-				os.Exit(1)
-			}
+			return err
 		}
+		logger.Info("card type: %s, capacity: %d bytes", tag.Type, capacity)
 	}
 
-	restartService := func() {
-		if serviceRunning {
-			err := svc.Start()
-			if err != nil {
-				logger.Error("error starting service: %s", err)
-				_, _ = fmt.Fprintln(os.Stderr, "Error starting service:", err)
-				os.Exit(1)
-			}
-		}
+	_, err = programTag(reader, tag, cmd, text)
+	if err != nil {
+		return err
 	}
 
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-	cancelled := make(chan bool, 1)
-
-	go func() {
-		<-sigs
-		cancelled <- true
-		restartService()
-		os.Exit(0)
-	}()
-
-	var pnd nfc.Device
-	var err error
+	logger.Info("successfully ran %s on card: %s", cmd, tag.UID)
+	return nil
+}
 
-	pnd, err = openDeviceWithRetries(config)
+// handleHistoryCommand prints the scan log, or exports it to a file if an
+// export path is given.
+func handleHistoryCommand(filter nfclog.Filter, exportPath string) error {
+	entries, err := nfclog.Read(config.NfcScanLogFile, filter)
 	if err != nil {
-		logger.Error("giving up, exiting")
-		_, _ = fmt.Fprintln(os.Stderr, "Could not open device:", err)
-		restartService()
-		os.Exit(1)
+		return err
 	}
 
-	defer func(pnd nfc.Device) {
-		err := pnd.Close()
+	if exportPath != "" {
+		f, err := os.Create(exportPath)
 		if err != nil {
-			logger.Warn("error closing device: %s", err)
+			return err
 		}
-		logger.Info("closed nfc device")
-	}(pnd)
 
-	var count int
-	var target nfc.Target
-	tries := 6 // ~30 seconds
-
-	for tries > 0 {
-		count, target, err = pnd.InitiatorPollTarget(supportedCardTypes, timesToPoll, periodBetweenPolls)
-
-		if err != nil && err.Error() != "timeout" {
-			logger.Error("could not poll: %s", err)
-			_, _ = fmt.Fprintln(os.Stderr, "Could not poll:", err)
-			restartService()
-			os.Exit(1)
+		if strings.EqualFold(filepath.Ext(exportPath), ".json") {
+			err = nfclog.WriteJSON(f, entries)
+		} else {
+			err = nfclog.WriteCSV(f, entries)
 		}
-
-		if count > 0 {
-			break
+		if err != nil {
+			_ = f.Close()
+			return err
 		}
 
-		tries--
+		fmt.Printf("Exported %d scans to %s\n", len(entries), exportPath)
+		return f.Close()
 	}
 
-	if count == 0 {
-		logger.Error("could not detect a card")
-		_, _ = fmt.Fprintln(os.Stderr, "Could not detect a card")
-		restartService()
-		os.Exit(1)
+	if len(entries) == 0 {
+		fmt.Println("No scans found.")
+		return nil
 	}
 
-	cardUid := getCardUID(target)
-	logger.Info("Found card with UID: %s", cardUid)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "TIME\tUID\tTYPE\tRESULT\tDETAILS")
+	for _, entry := range entries {
+		details := entry.Launch
+		if entry.Error != "" {
+			details = entry.Error
+		}
+		if entry.MappingLine > 0 {
+			details = fmt.Sprintf("%s (mapping line %d)", details, entry.MappingLine)
+		}
 
-	cardType := getCardType(target)
-	var bytesWritten []byte
+		_, _ = fmt.Fprintf(
+			w,
+			"%s\t%s\t%s\t%s\t%s\n",
+			entry.Time.Local().Format("2006-01-02 15:04:05"),
+			entry.UID,
+			entry.Type,
+			entry.Result,
+			details,
+		)
+	}
 
-	switch cardType {
-	case TypeMifare:
-		bytesWritten, err = writeMifare(pnd, textToWrite, cardUid)
-		if err != nil {
-			logger.Error("error writing to card: %s", err)
-			_, _ = fmt.Fprintln(os.Stderr, "Error writing to card:", err)
-			fmt.Println("Mifare cards need to NDEF formatted. If this is a brand new card, please use NFC tools mobile app to write some text (this only needs to be done the first time)")
-			restartService()
-			os.Exit(1)
-		}
-	case TypeNTAG:
-		bytesWritten, err = writeNtag(pnd, textToWrite)
-		if err != nil {
-			logger.Error("error writing to card: %s", err)
-			_, _ = fmt.Fprintln(os.Stderr, "Error writing to card:", err)
-			restartService()
-			os.Exit(1)
+	return w.Flush()
+}
+
+// cardCommandFromFlags returns the card command selected on the command line,
+// or an empty string if there is none.
+func cardCommandFromFlags(write string, format bool, erase bool, lock bool, confirmLock bool) (string, error) {
+	selected := 0
+	for _, set := range []bool{write != "", format, erase} {
+		if set {
+			selected++
 		}
-	default:
-		logger.Error("Unsupported card type: %s", cardType)
-		restartService()
-		os.Exit(1)
+	}
+	if selected > 1 {
+		return "", errors.New("only one of -write, -format and -erase can be used at a time")
 	}
 
-	logger.Info("successfully wrote to card: %s", hex.EncodeToString(bytesWritten))
-	_, _ = fmt.Fprintln(os.Stderr, "Successfully wrote to card")
+	if lock {
+		if write == "" {
+			return "", errors.New("-lock can only be used with -write")
+		}
+		if !confirmLock {
+			return "", errors.New("locking a card is permanent and it can never be written to again, add -confirm-lock to continue")
+		}
+		return nfcctl.CmdWriteLock, nil
+	}
 
-	restartService()
-	os.Exit(0)
+	switch {
+	case write != "":
+		return nfcctl.CmdWrite, nil
+	case format:
+		return nfcctl.CmdFormat, nil
+	case erase:
+		return nfcctl.CmdErase, nil
+	default:
+		return "", nil
+	}
 }
 
 func main() {
-	svcOpt := flag.String("service", "", "manage nfc service (start, stop, restart, status)")
+	svcOpt := flag.String("service", "", "manage nfc service (start, stop, restart, status, supervise)")
 	writeOpt := flag.String("write", "", "write text to tag")
+	formatOpt := flag.Bool("format", false, "NDEF format a blank MIFARE Classic card so it can be written to")
+	eraseOpt := flag.Bool("erase", false, "erase all NDEF data from an NTAG or Ultralight tag")
+	lockOpt := flag.Bool("lock", false, "permanently make tag read only after writing, requires -confirm-lock")
+	confirmLockOpt := flag.Bool("confirm-lock", false, "confirm tag should be locked, this can't be undone")
+	historyOpt := flag.Bool("history", false, "list recently scanned cards")
+	historyUidOpt := flag.String("history-uid", "", "only list scans of the card with this UID")
+	historyLimitOpt := flag.Int("history-limit", 20, "number of scans to list, 0 for all")
+	exportOpt := flag.String("history-export", "", "export scan history to a .csv or .json file")
+	batchOpt := flag.String("batch", "", "write a list of tokens to cards one after another, from a text file with one per line or a CSV file with text and name columns")
+	batchSystemOpt := flag.String("batch-system", "", "write every game in the games database for a system (e.g. snes or snes/Favorites) to cards one after another")
+	batchReportOpt := flag.String("batch-report", "", "save a CSV report of written card UIDs and game names to this file")
 	flag.Parse()
 
+	service.HandleSupervise(logger, svcOpt)
+
+	if *historyOpt || *exportOpt != "" {
+		filter := nfclog.Filter{UID: *historyUidOpt, Limit: *historyLimitOpt}
+		if *exportOpt != "" && !*historyOpt {
+			filter.Limit = 0
+		}
+
+		err := handleHistoryCommand(filter, *exportOpt)
+		if err != nil {
+			_, _ = fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	cardCmd, flagErr := cardCommandFromFlags(*writeOpt, *formatOpt, *eraseOpt, *lockOpt, *confirmLockOpt)
+	if flagErr == nil && (*batchOpt != "" || *batchSystemOpt != "") {
+		if cardCmd != "" || (*batchOpt != "" && *batchSystemOpt != "") {
+			flagErr = errors.New("-batch and -batch-system can't be used with each other or other card commands")
+		}
+	}
+	if flagErr != nil {
+		_, _ = fmt.Fprintln(os.Stderr, "Error:", flagErr)
+		os.Exit(1)
+	}
+
 	cfg, err := config.LoadUserConfig(appName, &config.UserConfig{
 		Nfc: config.NfcConfig{
 			ProbeDevice: true,
@@ -783,8 +696,43 @@ func main() {
 		os.Exit(1)
 	}
 
-	if *writeOpt != "" {
-		handleWriteCommand(*writeOpt, svc, cfg.Nfc)
+	if *batchOpt != "" || *batchSystemOpt != "" {
+		var items []batchItem
+		if *batchOpt != "" {
+			items, err = loadBatchFile(*batchOpt)
+		} else {
+			items, err = loadBatchSystem(cfg, *batchSystemOpt)
+		}
+		if err == nil {
+			err = handleBatchCommand(items, *batchReportOpt, svc, cfg.Nfc)
+		}
+		if err != nil {
+			logger.Error("error writing batch: %s", err)
+			_, _ = fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if cardCmd != "" {
+		err := handleCardCommand(cardCmd, *writeOpt, svc, cfg.Nfc)
+		if err != nil {
+			logger.Error("error running %s on card: %s", cardCmd, err)
+			_, _ = fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(1)
+		}
+
+		switch cardCmd {
+		case nfcctl.CmdWriteLock:
+			_, _ = fmt.Fprintln(os.Stderr, "Successfully wrote to and locked card")
+		case nfcctl.CmdFormat:
+			_, _ = fmt.Fprintln(os.Stderr, "Successfully formatted card")
+		case nfcctl.CmdErase:
+			_, _ = fmt.Fprintln(os.Stderr, "Successfully erased card")
+		default:
+			_, _ = fmt.Fprintln(os.Stderr, "Successfully wrote to card")
+		}
+		os.Exit(0)
 	}
 
 	svc.ServiceHandler(svcOpt)
@@ -1,12 +1,10 @@
 package main
 
 import (
-	"bytes"
 	"encoding/hex"
 	"errors"
 	"fmt"
 
-	"github.com/clausecker/nfc/v2"
 	"golang.org/x/exp/slices"
 )
 
@@ -16,21 +14,32 @@ const (
 	MIFARE_BLOCK_SIZE_BYTES           = 16
 )
 
+var (
+	// NDEF well known private key, used for sectors 1-15 of formatted cards
+	mifareNdefKey = []byte{0xd3, 0xf7, 0xd3, 0xf7, 0xd3, 0xf7}
+	// MIFARE Application Directory key, used for sector 0 of formatted cards
+	mifareMadKey = []byte{0xa0, 0xa1, 0xa2, 0xa3, 0xa4, 0xa5}
+	// Transport key used by blank cards
+	mifareDefaultKey = []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+)
+
 // buildMifareAuthCommand returns a command to authenticate against a block
+// using the NDEF key
 func buildMifareAuthCommand(block byte, cardUid string) []byte {
-	command := []byte{
-		// Auth using key A
-		0x60, block,
-		// Using the NDEF well known private key
-		0xd3, 0xf7, 0xd3, 0xf7, 0xd3, 0xf7,
-	}
+	return buildMifareKeyAuthCommand(block, mifareNdefKey, cardUid)
+}
+
+// buildMifareKeyAuthCommand returns a command to authenticate against a
+// block using the given key A
+func buildMifareKeyAuthCommand(block byte, key []byte, cardUid string) []byte {
+	command := append([]byte{0x60, block}, key...)
 	// And finally append the card UID to the end
 	uidBytes, _ := hex.DecodeString(cardUid)
 	return append(command, uidBytes...)
 }
 
 // readMifare reads data from all blocks in sectors 1-15
-func readMifare(pnd nfc.Device, cardUid string) ([]byte, error) {
+func readMifare(reader Reader, cardUid string) ([]byte, error) {
 	permissionSectors := []int{4, 8, 12, 16, 20, 24, 28, 32, 36, 40, 44, 48, 52, 56, 60}
 	var allBlocks = []byte{}
 	for block := 0; block < 64; block++ {
@@ -50,18 +59,22 @@ func readMifare(pnd nfc.Device, cardUid string) ([]byte, error) {
 		// We need to authenticate before any read/ write operations can be performed
 		// Only need to authenticate once per sector
 		if block%4 == 0 {
-			comm(pnd, buildMifareAuthCommand(byte(block), cardUid), 2)
+			_, err := comm(reader, buildMifareAuthCommand(byte(block), cardUid), 2)
+			if err != nil && len(allBlocks) == 0 {
+				// Not NDEF formatted or using its own keys, like Skylanders
+				return nil, fmt.Errorf("%w: %s", errTagProtected, err)
+			}
 		}
 
-		blockData, err := comm(pnd, []byte{0x30, byte(block)}, 16)
+		blockData, err := comm(reader, []byte{0x30, byte(block)}, 16)
 		if err != nil {
 			return nil, err
 		}
 
 		allBlocks = append(allBlocks, blockData...)
 
-		if bytes.Contains(blockData, NDEF_END) {
-			// Once we find the end of the NDEF text record there is no need to
+		if ndefReadComplete(allBlocks) {
+			// Once we find the end of the NDEF message there is no need to
 			// continue reading the rest of the card.
 			// This should make things "load" quicker
 			break
@@ -78,7 +91,7 @@ func getMifareCapacityInBytes() int {
 }
 
 // writeMifare writes the given text string to a Mifare card starting from sector, skipping any trailer blocks
-func writeMifare(pnd nfc.Device, text string, cardUid string) ([]byte, error) {
+func writeMifare(reader Reader, text string, cardUid string) ([]byte, error) {
 	var payload, err = BuildMessage(text)
 	if err != nil {
 		return nil, err
@@ -104,14 +117,14 @@ func writeMifare(pnd nfc.Device, text string, cardUid string) ([]byte, error) {
 			blockToWrite := (sector * 4) + sectorIndex
 			if sectorIndex == 0 {
 				// We changed sectors, time to authenticate
-				_, err := comm(pnd, buildMifareAuthCommand(byte(blockToWrite), cardUid), 2)
+				_, err := comm(reader, buildMifareAuthCommand(byte(blockToWrite), cardUid), 2)
 				if err != nil {
 					return nil, err
 				}
 			}
 
 			writeBlockCommand := append([]byte{0xA0, byte(blockToWrite)}, chunks[chunkIndex]...)
-			_, err := comm(pnd, writeBlockCommand, 2)
+			_, err := comm(reader, writeBlockCommand, 2)
 			if err != nil {
 				return nil, err
 			}
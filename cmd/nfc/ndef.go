@@ -3,19 +3,474 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
-
-	"github.com/hsanjuan/go-ndef"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf16"
 )
 
+// NFCForum-TS-NDEF_1.0 and NFCForum-TS-Type-2-Tag_1.1
+
 var NDEF_END = []byte{0xFE}
 var NDEF_START = []byte{0x54, 0x02, 0x65, 0x6E}
 
+// TLV block types found in tag memory
+const (
+	tlvNull          = 0x00
+	tlvLockControl   = 0x01
+	tlvMemoryControl = 0x02
+	tlvNdefMessage   = 0x03
+	tlvProprietary   = 0xFD
+	tlvTerminator    = 0xFE
+)
+
+// Type name formats
+const (
+	TnfEmpty       = byte(0x00)
+	TnfWellKnown   = byte(0x01)
+	TnfMime        = byte(0x02)
+	TnfAbsoluteURI = byte(0x03)
+	TnfExternal    = byte(0x04)
+	TnfUnknown     = byte(0x05)
+	TnfUnchanged   = byte(0x06)
+)
+
+// Record header flags
+const (
+	ndefFlagMB  = byte(0x80) // message begin
+	ndefFlagME  = byte(0x40) // message end
+	ndefFlagCF  = byte(0x20) // chunk flag
+	ndefFlagSR  = byte(0x10) // short record
+	ndefFlagIL  = byte(0x08) // ID length present
+	ndefTnfMask = byte(0x07)
+)
+
+const (
+	RecordTypeText = "T"
+	RecordTypeUri  = "U"
+)
+
+var ErrNoNdefMessage = errors.New("no NDEF message found")
+
+// NFCForum-TS-RTD_URI_1.0 page 3
+var uriPrefixes = []string{
+	"",
+	"http://www.",
+	"https://www.",
+	"http://",
+	"https://",
+	"tel:",
+	"mailto:",
+	"ftp://anonymous:anonymous@",
+	"ftp://ftp.",
+	"ftps://",
+	"sftp://",
+	"smb://",
+	"nfs://",
+	"ftp://",
+	"dav://",
+	"news:",
+	"telnet://",
+	"imap:",
+	"rtsp://",
+	"urn:",
+	"pop:",
+	"sip:",
+	"sips:",
+	"tftp:",
+	"btspp://",
+	"btl2cap://",
+	"btgoep://",
+	"tcpobex://",
+	"irdaobex://",
+	"file://",
+	"urn:epc:id:",
+	"urn:epc:tag:",
+	"urn:epc:pat:",
+	"urn:epc:raw:",
+	"urn:epc:",
+	"urn:nfc:",
+}
+
+// NdefRecord is a single record of an NDEF message. Chunked records are
+// joined together when a message is parsed.
+type NdefRecord struct {
+	TNF     byte
+	Type    string
+	ID      string
+	Payload []byte
+}
+
+func NewTextRecord(text string, language string) NdefRecord {
+	payload := []byte{byte(len(language))}
+	payload = append(payload, language...)
+	payload = append(payload, text...)
+	return NdefRecord{TNF: TnfWellKnown, Type: RecordTypeText, Payload: payload}
+}
+
+// NewUriRecord creates a URI record, abbreviating the longest matching
+// prefix from the standard list.
+func NewUriRecord(uri string) NdefRecord {
+	code := 0
+	for i, prefix := range uriPrefixes {
+		if strings.HasPrefix(uri, prefix) && len(prefix) > len(uriPrefixes[code]) {
+			code = i
+		}
+	}
+
+	payload := []byte{byte(code)}
+	payload = append(payload, uri[len(uriPrefixes[code]):]...)
+	return NdefRecord{TNF: TnfWellKnown, Type: RecordTypeUri, Payload: payload}
+}
+
+// NewMimeRecord creates a record with a payload of an RFC 2046 media type,
+// like "application/json".
+func NewMimeRecord(mimeType string, payload []byte) NdefRecord {
+	return NdefRecord{TNF: TnfMime, Type: mimeType, Payload: payload}
+}
+
+// NewExternalRecord creates a record with an NFC Forum external type, in
+// the format "domain:type".
+func NewExternalRecord(extType string, payload []byte) NdefRecord {
+	return NdefRecord{TNF: TnfExternal, Type: strings.ToLower(extType), Payload: payload}
+}
+
+// Text returns the contents of a well-known text record.
+func (r NdefRecord) Text() (string, bool) {
+	if r.TNF != TnfWellKnown || r.Type != RecordTypeText || len(r.Payload) < 1 {
+		return "", false
+	}
+
+	status := r.Payload[0]
+	langLen := int(status & 0x3F)
+	if 1+langLen > len(r.Payload) {
+		return "", false
+	}
+	text := r.Payload[1+langLen:]
+
+	if status&0x80 == 0 {
+		return string(text), true
+	}
+
+	// UTF-16, big endian unless there's a byte order mark
+	order := binary.ByteOrder(binary.BigEndian)
+	if len(text) >= 2 {
+		if text[0] == 0xFF && text[1] == 0xFE {
+			order = binary.LittleEndian
+			text = text[2:]
+		} else if text[0] == 0xFE && text[1] == 0xFF {
+			text = text[2:]
+		}
+	}
+
+	units := make([]uint16, 0, len(text)/2)
+	for i := 0; i+1 < len(text); i += 2 {
+		units = append(units, order.Uint16(text[i:]))
+	}
+
+	return string(utf16.Decode(units)), true
+}
+
+// Language returns the IANA language code of a text record.
+func (r NdefRecord) Language() string {
+	if _, ok := r.Text(); !ok {
+		return ""
+	}
+	return string(r.Payload[1 : 1+int(r.Payload[0]&0x3F)])
+}
+
+// Uri returns the full URI of a well-known URI record.
+func (r NdefRecord) Uri() (string, bool) {
+	if r.TNF != TnfWellKnown || r.Type != RecordTypeUri || len(r.Payload) < 1 {
+		return "", false
+	}
+
+	prefix := ""
+	if int(r.Payload[0]) < len(uriPrefixes) {
+		prefix = uriPrefixes[r.Payload[0]]
+	}
+
+	return prefix + string(r.Payload[1:]), true
+}
+
+// marshalChunk encodes a single record or record chunk, using the short
+// record format if the payload fits.
+func marshalChunk(flags byte, tnf byte, recordType string, id string, payload []byte) ([]byte, error) {
+	if len(recordType) > 255 || len(id) > 255 {
+		return nil, fmt.Errorf("record type or id too long")
+	}
+
+	flags |= tnf & ndefTnfMask
+	if len(payload) < 256 {
+		flags |= ndefFlagSR
+	}
+	if id != "" {
+		flags |= ndefFlagIL
+	}
+
+	buf := []byte{flags, byte(len(recordType))}
+	if flags&ndefFlagSR != 0 {
+		buf = append(buf, byte(len(payload)))
+	} else {
+		length := make([]byte, 4)
+		binary.BigEndian.PutUint32(length, uint32(len(payload)))
+		buf = append(buf, length...)
+	}
+	if id != "" {
+		buf = append(buf, byte(len(id)))
+	}
+	buf = append(buf, recordType...)
+	buf = append(buf, id...)
+	buf = append(buf, payload...)
+
+	return buf, nil
+}
+
+// MarshalNdefMessage encodes records into a raw NDEF message. If chunkSize
+// is greater than 0, payloads larger than it are split into chunked records.
+func MarshalNdefMessage(records []NdefRecord, chunkSize int) ([]byte, error) {
+	if len(records) == 0 {
+		return nil, fmt.Errorf("message has no records")
+	}
+
+	msg := make([]byte, 0)
+	for i, record := range records {
+		chunks := [][]byte{record.Payload}
+		if chunkSize > 0 && len(record.Payload) > chunkSize {
+			chunks = chunkBy(record.Payload, chunkSize)
+		}
+
+		for j, chunk := range chunks {
+			var flags byte
+			if i == 0 && j == 0 {
+				flags |= ndefFlagMB
+			}
+			if i == len(records)-1 && j == len(chunks)-1 {
+				flags |= ndefFlagME
+			}
+			if j < len(chunks)-1 {
+				flags |= ndefFlagCF
+			}
+
+			var data []byte
+			var err error
+			if j == 0 {
+				data, err = marshalChunk(flags, record.TNF, record.Type, record.ID, chunk)
+			} else {
+				data, err = marshalChunk(flags, TnfUnchanged, "", "", chunk)
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			msg = append(msg, data...)
+		}
+	}
+
+	return msg, nil
+}
+
+type ndefChunk struct {
+	flags   byte
+	record  NdefRecord
+	chunked bool
+}
+
+func unmarshalChunk(data []byte) (ndefChunk, int, error) {
+	var chunk ndefChunk
+	if len(data) < 3 {
+		return chunk, 0, fmt.Errorf("record header truncated")
+	}
+
+	flags := data[0]
+	typeLen := int(data[1])
+	pos := 2
+
+	var payloadLen uint32
+	if flags&ndefFlagSR != 0 {
+		payloadLen = uint32(data[pos])
+		pos++
+	} else {
+		if len(data) < pos+4 {
+			return chunk, 0, fmt.Errorf("record header truncated")
+		}
+		payloadLen = binary.BigEndian.Uint32(data[pos:])
+		pos += 4
+	}
+
+	idLen := 0
+	if flags&ndefFlagIL != 0 {
+		if len(data) < pos+1 {
+			return chunk, 0, fmt.Errorf("record header truncated")
+		}
+		idLen = int(data[pos])
+		pos++
+	}
+
+	// lengths are compared before converting to int, a long record's payload
+	// length can overflow int on 32-bit builds
+	if uint64(typeLen)+uint64(idLen)+uint64(payloadLen) > uint64(len(data)-pos) {
+		return chunk, 0, fmt.Errorf("record truncated")
+	}
+
+	chunk.flags = flags
+	chunk.chunked = flags&ndefFlagCF != 0
+	chunk.record.TNF = flags & ndefTnfMask
+	chunk.record.Type = string(data[pos : pos+typeLen])
+	pos += typeLen
+	chunk.record.ID = string(data[pos : pos+idLen])
+	pos += idLen
+	chunk.record.Payload = append([]byte{}, data[pos:pos+int(payloadLen)]...)
+	pos += int(payloadLen)
+
+	return chunk, pos, nil
+}
+
+// UnmarshalNdefMessage decodes a raw NDEF message into its records.
+func UnmarshalNdefMessage(data []byte) ([]NdefRecord, error) {
+	records := make([]NdefRecord, 0)
+	var current *NdefRecord
+
+	pos := 0
+	for pos < len(data) {
+		chunk, n, err := unmarshalChunk(data[pos:])
+		if err != nil {
+			return records, err
+		}
+		pos += n
+
+		if pos == n && chunk.flags&ndefFlagMB == 0 {
+			return records, fmt.Errorf("first record is missing message begin flag")
+		}
+
+		if current != nil {
+			// continuation of a chunked record
+			if chunk.record.TNF != TnfUnchanged || chunk.record.Type != "" {
+				return records, fmt.Errorf("invalid chunk in record %d", len(records))
+			}
+			current.Payload = append(current.Payload, chunk.record.Payload...)
+		} else {
+			if chunk.record.TNF == TnfUnchanged {
+				return records, fmt.Errorf("unexpected chunk in record %d", len(records))
+			}
+			record := chunk.record
+			current = &record
+		}
+
+		if !chunk.chunked {
+			records = append(records, *current)
+			current = nil
+			if chunk.flags&ndefFlagME != 0 {
+				return records, nil
+			}
+		}
+	}
+
+	if current != nil {
+		return records, fmt.Errorf("message ended inside a chunked record")
+	}
+
+	return records, fmt.Errorf("message is missing message end flag")
+}
+
+// tlvLength reads the length field of a TLV block, which is either one byte
+// or 0xFF followed by two bytes.
+func tlvLength(blocks []byte, pos int) (int, int, bool) {
+	if pos >= len(blocks) {
+		return 0, 0, false
+	}
+
+	if blocks[pos] != 0xFF {
+		return int(blocks[pos]), 1, true
+	}
+
+	if pos+2 >= len(blocks) {
+		return 0, 0, false
+	}
+
+	return int(binary.BigEndian.Uint16(blocks[pos+1:])), 3, true
+}
+
+// findNdefTlv walks the TLV blocks in tag memory looking for the first NDEF
+// message. Returns whether the search finished, in which case the message
+// is nil if the tag doesn't have one, or if more data is needed.
+func findNdefTlv(blocks []byte) ([]byte, bool) {
+	pos := 0
+	for pos < len(blocks) {
+		switch blocks[pos] {
+		case tlvNull:
+			pos++
+		case tlvTerminator:
+			return nil, true
+		case tlvLockControl, tlvMemoryControl, tlvProprietary, tlvNdefMessage:
+			length, size, ok := tlvLength(blocks, pos+1)
+			if !ok {
+				return nil, false
+			}
+
+			start := pos + 1 + size
+			if start+length > len(blocks) {
+				return nil, false
+			}
+
+			if blocks[pos] == tlvNdefMessage {
+				return blocks[start : start+length], true
+			}
+
+			pos = start + length
+		default:
+			// not NDEF formatted
+			return nil, true
+		}
+	}
+
+	return nil, false
+}
+
+// ndefReadComplete returns true if enough tag memory has been read to
+// either contain the whole NDEF message or know there isn't one.
+func ndefReadComplete(blocks []byte) bool {
+	_, done := findNdefTlv(blocks)
+	return done
+}
+
+// ParseMessage decodes all NDEF records from raw tag memory, starting at
+// the first data block.
+func ParseMessage(blocks []byte) ([]NdefRecord, error) {
+	msg, _ := findNdefTlv(blocks)
+	if len(msg) == 0 {
+		return nil, ErrNoNdefMessage
+	}
+
+	return UnmarshalNdefMessage(msg)
+}
+
+// ParseRecordText returns the text used to launch from a tag. This is the
+// first text record, or the first URI record if there's no text.
 func ParseRecordText(blocks []byte) string {
-	// Find the text NDEF record
+	records, err := ParseMessage(blocks)
+	if err == nil {
+		for _, record := range records {
+			if text, ok := record.Text(); ok {
+				return text
+			}
+		}
+
+		for _, record := range records {
+			if uri, ok := record.Uri(); ok {
+				return uri
+			}
+		}
+
+		return ""
+	}
+
+	// Fallback for tags with a malformed message but a recognisable
+	// english text record
 	startIndex := bytes.Index(blocks, NDEF_START)
 	endIndex := bytes.Index(blocks, NDEF_END)
 
-	if startIndex != -1 && endIndex != -1 {
+	if startIndex != -1 && endIndex != -1 && startIndex+4 <= endIndex {
 		tagText := string(blocks[startIndex+4 : endIndex])
 		return tagText
 	}
@@ -23,22 +478,27 @@ func ParseRecordText(blocks []byte) string {
 	return ""
 }
 
-func BuildMessage(text string) ([]byte, error) {
-	msg := ndef.NewTextMessage(text, "en")
-	var payload, err = msg.Marshal()
+// BuildRecordsMessage encodes records into an NDEF message TLV ready to be
+// written to a tag.
+func BuildRecordsMessage(records ...NdefRecord) ([]byte, error) {
+	payload, err := MarshalNdefMessage(records, 0)
 	if err != nil {
 		return nil, err
 	}
 
-	var header, _ = CalculateNdefHeader(payload)
+	header, err := CalculateNdefHeader(payload)
 	if err != nil {
 		return nil, err
 	}
 	payload = append(header, payload...)
-	payload = append(payload, []byte{0xFE}...)
+	payload = append(payload, NDEF_END...)
 	return payload, nil
 }
 
+func BuildMessage(text string) ([]byte, error) {
+	return BuildRecordsMessage(NewTextRecord(text, "en"))
+}
+
 func CalculateNdefHeader(ndefRecord []byte) ([]byte, error) {
 	var recordLength = len(ndefRecord)
 	if recordLength < 255 {
@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"encoding/hex"
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -62,3 +63,204 @@ func TestBuildMessage(t *testing.T) {
 		})
 	}
 }
+
+func TestParseMessage(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []NdefRecord
+	}{
+		{
+			name:  "text",
+			input: "0308d101045402656e41fe",
+			want:  []NdefRecord{NewTextRecord("A", "en")},
+		},
+		{
+			name:  "uri",
+			input: "0310d1010c55046578616d706c652e636f6dfe",
+			want:  []NdefRecord{NewUriRecord("https://example.com")},
+		},
+		{
+			name:  "lock control and null tlvs",
+			input: "0103a0104400000308d101045402656e41fe",
+			want:  []NdefRecord{NewTextRecord("A", "en")},
+		},
+		{
+			name:  "multiple records",
+			input: "03159101045402656e415101095504736e65732e6f7267fe",
+			want:  []NdefRecord{NewTextRecord("A", "en"), NewUriRecord("https://snes.org")},
+		},
+		{
+			name:  "mime with id",
+			input: "0314da0a0501746578742f706c61696e3168656c6c6ffe",
+			want:  []NdefRecord{{TNF: TnfMime, Type: "text/plain", ID: "1", Payload: []byte("hello")}},
+		},
+		{
+			name:  "external",
+			input: "0315d40e046d69737465722e696f3a67616d65736e6573fe",
+			want:  []NdefRecord{NewExternalRecord("mister.io:game", []byte("snes"))},
+		},
+		{
+			name:  "long record",
+			input: "030bc101000000045402656e41fe",
+			want:  []NdefRecord{NewTextRecord("A", "en")},
+		},
+		{
+			name:  "chunked record",
+			input: "0318b20a02746578742f706c61696e68653600026c6c5600016ffe",
+			want:  []NdefRecord{NewMimeRecord("text/plain", []byte("hello"))},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			input, err := hex.DecodeString(tc.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ParseMessage(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("expected: %+v, got: %+v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestParseMessageErrors(t *testing.T) {
+	tests := map[string]string{
+		"blank":                "0300fe",
+		"not formatted":        "a5a5a5a5",
+		"truncated tlv":        "0320d101045402656e41fe",
+		"truncated record":     "0304d1010454fe",
+		"missing begin":        "0308510104540265" + "6e41fe",
+		"missing end":          "0308910104540265" + "6e41fe",
+		"unterminated chunks":  "0310b20a02746578742f706c61696e6865fe",
+		"long record overflow": "030bc1017fffffff5402656e41fe",
+		"long record max":      "030bc101ffffffff5402656e41fe",
+	}
+
+	for name, input := range tests {
+		t.Run(name, func(t *testing.T) {
+			data, err := hex.DecodeString(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = ParseMessage(data)
+			if err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+}
+
+func TestParseRecordText(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{name: "text", input: "0314d101105402656e2a2a72616e646f6d3a736e6573fe", want: "**random:snes"},
+		{name: "uri", input: "0310d1010c55046578616d706c652e636f6dfe", want: "https://example.com"},
+		{name: "text preferred", input: "03159101095504736e65732e6f7267" + "5101045402656e41fe", want: "A"},
+		{name: "utf-16 text", input: "030bd1010754826a6165e5672cfe", want: "日本"},
+		{name: "mime only", input: "0314da0a0501746578742f706c61696e3168656c6c6ffe", want: ""},
+		{name: "legacy fallback", input: "0320d101045402656e41fe", want: "A"},
+		{name: "blank", input: "0300fe", want: ""},
+		{name: "long record overflow", input: "030bc1017fffffff5402656e41fe", want: "A"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			input, err := hex.DecodeString(tc.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := ParseRecordText(input)
+			if got != tc.want {
+				t.Fatalf("expected: %q, got: %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestMarshalNdefMessage(t *testing.T) {
+	tests := []struct {
+		name      string
+		records   []NdefRecord
+		chunkSize int
+		want      string
+	}{
+		{
+			name:    "uri prefix",
+			records: []NdefRecord{NewUriRecord("https://www.example.com")},
+			want:    "d1010c55026578616d706c652e636f6d",
+		},
+		{
+			name:    "custom scheme",
+			records: []NdefRecord{NewUriRecord("mister://snes")},
+			want:    "d1010e55006d69737465723a2f2f736e6573",
+		},
+		{
+			name:    "multiple records",
+			records: []NdefRecord{NewTextRecord("A", "en"), NewUriRecord("https://snes.org")},
+			want:    "9101045402656e415101095504736e65732e6f7267",
+		},
+		{
+			name:    "mime with id",
+			records: []NdefRecord{{TNF: TnfMime, Type: "text/plain", ID: "1", Payload: []byte("hello")}},
+			want:    "da0a0501746578742f706c61696e3168656c6c6f",
+		},
+		{
+			name:      "chunked",
+			records:   []NdefRecord{NewMimeRecord("text/plain", []byte("hello"))},
+			chunkSize: 2,
+			want:      "b20a02746578742f706c61696e68653600026c6c5600016f",
+		},
+		{
+			name:      "payload smaller than chunk size",
+			records:   []NdefRecord{NewTextRecord("A", "en")},
+			chunkSize: 16,
+			want:      "d101045402656e41",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := MarshalNdefMessage(tc.records, tc.chunkSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hex.EncodeToString(got) != tc.want {
+				t.Fatalf("expected: %v, got: %v", tc.want, hex.EncodeToString(got))
+			}
+
+			// everything should survive a round trip
+			parsed, err := UnmarshalNdefMessage(got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(parsed, tc.records) {
+				t.Fatalf("round trip expected: %+v, got: %+v", tc.records, parsed)
+			}
+		})
+	}
+
+	long := NewMimeRecord("application/octet-stream", bytes.Repeat([]byte{0xFE}, 300))
+	data, err := BuildRecordsMessage(long)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseMessage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed, []NdefRecord{long}) {
+		t.Fatalf("long record round trip failed: %+v", parsed)
+	}
+	if !ndefReadComplete(data) || ndefReadComplete(data[:100]) {
+		t.Fatal("expected read to be complete only once the whole message is read")
+	}
+}
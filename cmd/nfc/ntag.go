@@ -5,7 +5,6 @@ import (
 	"errors"
 	"fmt"
 
-	"github.com/clausecker/nfc/v2"
 	"github.com/wizzomafizzo/mrext/pkg/service"
 )
 
@@ -29,32 +28,41 @@ var LEGO_DIMENSIONS_MATCHER = []byte{
 	0x01, 0x0F, 0x54, 0x02,
 	0x65, 0x6E}
 
-func readNtag(pnd nfc.Device, logger *service.Logger) ([]byte, error) {
-	blockCount, err := getNtagBlockCount(pnd)
+func readNtag(reader Reader, logger *service.Logger) ([]byte, error) {
+	blockCount, err := getNtagBlockCount(reader)
 	if err != nil {
 		return []byte{}, err
 	}
 	logger.Info("NTAG has %d blocks", blockCount)
 
+	allBlocks, err := readType2Pages(reader, blockCount)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(allBlocks) >= 14 && bytes.Equal(allBlocks[0:14], LEGO_DIMENSIONS_MATCHER) {
+		logger.Info("found Lego Dimensions tag")
+		return nil, errTagProtected
+	}
+
+	return allBlocks, nil
+}
+
+// readType2Pages reads user memory of an NTAG or Ultralight tag, 4 pages at
+// a time, starting from page 4.
+func readType2Pages(reader Reader, blockCount int) ([]byte, error) {
 	allBlocks := make([]byte, 0)
-	currentBlock := 4
 
-	for i := 0; i <= (blockCount / 4); i++ {
-		blocks, err := comm(pnd, []byte{READ_COMMAND, byte(currentBlock)}, 16)
+	for currentBlock := 4; currentBlock < 4+blockCount; currentBlock += 4 {
+		blocks, err := comm(reader, []byte{READ_COMMAND, byte(currentBlock)}, 16)
 		if err != nil {
 			return nil, err
 		}
 
-		if byte(currentBlock) == 0x04 && bytes.Equal(blocks[0:14], LEGO_DIMENSIONS_MATCHER) {
-			logger.Info("found Lego Dimensions tag")
-			return []byte{}, nil
-		}
-
 		allBlocks = append(allBlocks, blocks...)
-		currentBlock = currentBlock + 4
 
-		if bytes.Contains(allBlocks, NDEF_END) {
-			// Once we find the end of the NDEF text record there is no need to
+		if ndefReadComplete(allBlocks) {
+			// Once we find the end of the NDEF message there is no need to
 			// continue reading the rest of the card.
 			// This should make things "load" quicker
 			logger.Debug("found end of ndef record")
@@ -65,13 +73,19 @@ func readNtag(pnd nfc.Device, logger *service.Logger) ([]byte, error) {
 	return allBlocks, nil
 }
 
-func writeNtag(pnd nfc.Device, text string) ([]byte, error) {
-	var payload, err = BuildMessage(text)
+func writeNtag(reader Reader, text string) ([]byte, error) {
+	cardCapacity, err := getNtagCapacity(reader)
 	if err != nil {
 		return nil, err
 	}
 
-	cardCapacity, err := getNtagCapacity(pnd)
+	return writeType2Pages(reader, text, cardCapacity)
+}
+
+// writeType2Pages writes text to an NTAG or Ultralight tag, starting from
+// page 4.
+func writeType2Pages(reader Reader, text string, cardCapacity int) ([]byte, error) {
+	var payload, err = BuildMessage(text)
 	if err != nil {
 		return nil, err
 	}
@@ -80,6 +94,11 @@ func writeNtag(pnd nfc.Device, text string) ([]byte, error) {
 		return nil, errors.New(fmt.Sprintf("Payload too big for card: [%d/%d] bytes used\n", len(payload), cardCapacity))
 	}
 
+	err = checkType2Writable(reader)
+	if err != nil {
+		return nil, err
+	}
+
 	var startingBlock byte = 0x04
 	for i, chunk := range chunkBy(payload, 4) {
 		for len(chunk) < 4 {
@@ -87,7 +106,7 @@ func writeNtag(pnd nfc.Device, text string) ([]byte, error) {
 		}
 		var tx = []byte{WRITE_COMMAND, startingBlock + byte(i)}
 		tx = append(tx, chunk...)
-		_, err := comm(pnd, tx, 1)
+		_, err := comm(reader, tx, 1)
 		if err != nil {
 			return nil, err
 		}
@@ -96,13 +115,9 @@ func writeNtag(pnd nfc.Device, text string) ([]byte, error) {
 	return payload, nil
 }
 
-func getNtagBlockCount(pnd nfc.Device) (int, error) {
+func getNtagBlockCount(reader Reader) (int, error) {
 	// Find tag capacity by looking in block 3 (capability container)
-	tx := []byte{READ_COMMAND, 0x03}
-	rx := make([]byte, 16)
-
-	timeout := 0
-	_, err := pnd.InitiatorTransceiveBytes(tx, rx, timeout)
+	rx, err := comm(reader, []byte{READ_COMMAND, 0x03}, 16)
 	if err != nil {
 		return 0, err
 	}
@@ -123,13 +138,9 @@ func getNtagBlockCount(pnd nfc.Device) (int, error) {
 	}
 }
 
-func getNtagCapacity(pnd nfc.Device) (int, error) {
+func getNtagCapacity(reader Reader) (int, error) {
 	// Find tag capacity by looking in block 3 (capability container)
-	tx := []byte{READ_COMMAND, 0x03}
-	rx := make([]byte, 16)
-
-	timeout := 0
-	_, err := pnd.InitiatorTransceiveBytes(tx, rx, timeout)
+	rx, err := comm(reader, []byte{READ_COMMAND, 0x03}, 16)
 	if err != nil {
 		return 0, err
 	}
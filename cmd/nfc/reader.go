@@ -0,0 +1,236 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/wizzomafizzo/mrext/pkg/config"
+)
+
+// ErrReaderDisconnected is returned by a reader when the device has gone away
+// and needs to be reopened.
+var ErrReaderDisconnected = errors.New("reader disconnected")
+
+// Tag is a card detected by a reader.
+type Tag struct {
+	UID  string
+	Type string
+}
+
+// Reader is a backend capable of detecting tags and sending raw commands to
+// them. Raw commands use the standard command set of each tag type: NTAG and
+// MIFARE commands, ISO 7816-4 APDUs for Type 4 tags and ISO 15693 requests.
+type Reader interface {
+	// Poll waits for a tag to be presented to the reader. Returns nil if no
+	// tag was detected before the backend's polling period ran out.
+	Poll() (*Tag, error)
+	// Transceive sends a raw command to the last polled tag and returns the
+	// reply, which is at most replySize bytes.
+	Transceive(tx []byte, replySize int) ([]byte, error)
+	Connection() string
+	Close() error
+}
+
+type readerBackend struct {
+	prefix string
+	open   func(cfg config.NfcConfig) (Reader, error)
+}
+
+// readerBackends are matched by connection string prefix, in order. The
+// libnfc backend handles everything else, including auto-detection, and
+// supports most USB and serial readers through its own drivers.
+var readerBackends = []readerBackend{
+	{prefix: virtualReaderPrefix, open: openVirtualReader},
+	{prefix: pcscReaderPrefix, open: openPcscReader},
+}
+
+func openReader(cfg config.NfcConfig) (Reader, error) {
+	for _, backend := range readerBackends {
+		if strings.HasPrefix(cfg.ConnectionString, backend.prefix) {
+			return backend.open(cfg)
+		}
+	}
+
+	return openLibnfcReader(cfg)
+}
+
+func openReaderWithRetries(cfg config.NfcConfig) (Reader, error) {
+	tries := 0
+	for {
+		reader, err := openReader(cfg)
+		if err == nil {
+			logger.Info("successful connect after %d tries", tries)
+			return reader, err
+		}
+
+		if tries >= connectMaxTries {
+			logger.Error("could not open device after %d tries: %s", connectMaxTries, err)
+			return nil, err
+		}
+
+		tries++
+	}
+}
+
+// comm sends a raw command and returns a reply padded to replySize bytes.
+func comm(reader Reader, tx []byte, replySize int) ([]byte, error) {
+	rx, err := reader.Transceive(tx, replySize)
+	if err != nil {
+		return nil, fmt.Errorf("comm error: %w", err)
+	}
+
+	if len(rx) < replySize {
+		rx = append(rx, make([]byte, replySize-len(rx))...)
+	}
+
+	return rx, nil
+}
+
+// waitForTag polls the reader until a tag is detected or the number of tries
+// runs out.
+func waitForTag(reader Reader, tries int) (*Tag, error) {
+	for tries > 0 {
+		tag, err := reader.Poll()
+		if err != nil {
+			return nil, err
+		}
+
+		if tag != nil {
+			return tag, nil
+		}
+
+		tries--
+	}
+
+	return nil, fmt.Errorf("could not detect a card")
+}
+
+// identifyTag refines the type of a tag, for tags which can't be told apart
+// when they're polled.
+func identifyTag(reader Reader, tag *Tag) error {
+	if tag.Type != TypeNTAG {
+		return nil
+	}
+
+	tagType, err := identifyType2Tag(reader)
+	if err != nil {
+		return err
+	}
+
+	tag.Type = tagType
+	return nil
+}
+
+// readTag reads the raw NDEF blocks from a tag. Returns ErrUnsupportedTag or
+// errTagProtected if the tag can only be identified by its UID.
+func readTag(reader Reader, tag *Tag) ([]byte, error) {
+	switch tag.Type {
+	case TypeNTAG:
+		logger.Info("NTAG detected")
+		record, err := readNtag(reader, logger)
+		if errors.Is(err, errTagProtected) {
+			return nil, err
+		} else if err != nil {
+			return nil, fmt.Errorf("error reading ntag: %s", err)
+		}
+		return record, nil
+	case TypeUltralight, TypeUltralightC:
+		logger.Info("Ultralight detected")
+		record, err := readUltralight(reader, tag.Type)
+		if err != nil {
+			return nil, fmt.Errorf("error reading ultralight: %w", err)
+		}
+		return record, nil
+	case TypeMifare:
+		logger.Info("Mifare detected")
+		record, err := readMifare(reader, tag.UID)
+		if errors.Is(err, errTagProtected) {
+			return nil, err
+		} else if err != nil {
+			logger.Error("error reading mifare: %s", err)
+		}
+		return record, nil
+	case TypeNTAG424:
+		logger.Info("NTAG 424 detected")
+		record, err := readType4(reader)
+		if errors.Is(err, errTagProtected) {
+			return nil, err
+		} else if err != nil {
+			return nil, fmt.Errorf("error reading ntag 424: %w", err)
+		}
+		return record, nil
+	case TypeISO15693:
+		logger.Info("ISO 15693 detected")
+		record, err := readISO15693(reader)
+		if err != nil {
+			return nil, fmt.Errorf("error reading iso 15693: %w", err)
+		}
+		return record, nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedTag, tagTypeName(tag.Type))
+	}
+}
+
+// writeTag writes text as an NDEF message to a tag, returning the bytes
+// written.
+func writeTag(reader Reader, tag *Tag, text string) ([]byte, error) {
+	switch tag.Type {
+	case TypeMifare:
+		payload, err := writeMifare(reader, text, tag.UID)
+		if err != nil {
+			return nil, fmt.Errorf("%w (MIFARE cards must be NDEF formatted with -format before they can be written to)", err)
+		}
+		return payload, nil
+	case TypeNTAG:
+		return writeNtag(reader, text)
+	case TypeUltralight, TypeUltralightC:
+		return writeUltralight(reader, text, tag.Type)
+	case TypeNTAG424:
+		return writeType4(reader, text)
+	case TypeISO15693:
+		return writeISO15693(reader, text)
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedTag, tagTypeName(tag.Type))
+	}
+}
+
+// verifyTag reads back a tag which was just written to, and checks it now
+// contains the expected text.
+func verifyTag(reader Reader, tag *Tag, text string) error {
+	record, err := readTag(reader, tag)
+	if err != nil {
+		return fmt.Errorf("error verifying card: %w", err)
+	}
+
+	if readText := ParseRecordText(record); readText != text {
+		return fmt.Errorf("verification failed, card contains %q", readText)
+	}
+
+	return nil
+}
+
+// getTagCapacity returns the number of bytes available for NDEF data on a tag.
+func getTagCapacity(reader Reader, tag *Tag) (int, error) {
+	switch tag.Type {
+	case TypeNTAG:
+		return getNtagCapacity(reader)
+	case TypeUltralight, TypeUltralightC:
+		return getUltralightCapacity(reader, tag.Type)
+	case TypeMifare:
+		return getMifareCapacityInBytes(), nil
+	case TypeNTAG424:
+		return getType4Capacity(reader)
+	case TypeISO15693:
+		return getISO15693Capacity(reader)
+	default:
+		return 0, fmt.Errorf("%w: %s", ErrUnsupportedTag, tagTypeName(tag.Type))
+	}
+}
+
+func tagTypeName(tagType string) string {
+	if tagType == "" {
+		return "unknown"
+	}
+	return tagType
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/clausecker/nfc/v2"
+	"github.com/wizzomafizzo/mrext/pkg/config"
+)
+
+var supportedCardTypes = []nfc.Modulation{
+	{Type: nfc.ISO14443a, BaudRate: nfc.Nbr106},
+}
+
+// libnfcReader supports ISO 14443A tags. libnfc has no ISO 15693 support,
+// so those tags need a PC/SC reader, see pcscReader.
+type libnfcReader struct {
+	pnd nfc.Device
+	uid []byte
+}
+
+func openLibnfcReader(cfg config.NfcConfig) (Reader, error) {
+	var connectionString = cfg.ConnectionString
+	if connectionString == "" && cfg.ProbeDevice == true {
+		connectionString = detectConnectionString()
+	}
+
+	pnd, err := nfc.Open(connectionString)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := pnd.InitiatorInit(); err != nil {
+		_ = pnd.Close()
+		return nil, fmt.Errorf("could not init initiator: %s", err)
+	}
+
+	logger.Info("opened connection: %s %s", pnd, pnd.Connection())
+
+	return &libnfcReader{pnd: pnd}, nil
+}
+
+func (r *libnfcReader) Poll() (*Tag, error) {
+	count, target, err := r.pnd.InitiatorPollTarget(supportedCardTypes, timesToPoll, periodBetweenPolls)
+	if errors.Is(err, nfc.Error(nfc.EIO)) {
+		return nil, fmt.Errorf("%w: %s", ErrReaderDisconnected, err)
+	} else if err != nil && !errors.Is(err, nfc.Error(nfc.ETIMEOUT)) {
+		return nil, err
+	}
+
+	if count <= 0 {
+		return nil, nil
+	}
+
+	tag := &Tag{
+		UID:  getCardUID(target),
+		Type: getCardType(target),
+	}
+
+	if tag.UID == "" {
+		logger.Warn("unable to detect card UID: %s", target.String())
+	}
+
+	r.uid, _ = hex.DecodeString(tag.UID)
+
+	return tag, nil
+}
+
+func (r *libnfcReader) Transceive(tx []byte, replySize int) ([]byte, error) {
+	rx := make([]byte, replySize)
+
+	timeout := 0
+	n, err := r.pnd.InitiatorTransceiveBytes(tx, rx, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return rx[:n], nil
+}
+
+// Reselect wakes up the last polled tag after a command it didn't support.
+func (r *libnfcReader) Reselect() error {
+	_, err := r.pnd.InitiatorSelectPassiveTarget(supportedCardTypes[0], r.uid)
+	return err
+}
+
+func (r *libnfcReader) Connection() string {
+	return r.pnd.Connection()
+}
+
+func (r *libnfcReader) Close() error {
+	return r.pnd.Close()
+}
+
+func detectConnectionString() string {
+	logger.Info("attempting to probe for NFC device")
+	devices, _ := getSerialDeviceList()
+
+	for _, device := range devices {
+		connectionString := "pn532_uart:" + device
+		pnd, err := nfc.Open(connectionString)
+		logger.Info("trying %s", connectionString)
+		if err == nil {
+			logger.Info("success using serial: %s", connectionString)
+			pnd.Close()
+			return connectionString
+		}
+	}
+
+	return ""
+}
+
+func getSerialDeviceList() ([]string, error) {
+	path := "/dev/serial/by-id/"
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	files, err := f.Readdir(0)
+	if err != nil {
+		return nil, err
+	}
+
+	var devices []string
+
+	for _, v := range files {
+		if !v.IsDir() {
+			devices = append(devices, path+v.Name())
+		}
+	}
+
+	return devices, nil
+}
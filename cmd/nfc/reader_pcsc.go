@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wizzomafizzo/mrext/pkg/config"
+)
+
+// The PC/SC reader talks to a running pcscd over its socket, so it works with
+// any reader pcsc-lite has a driver for, without linking against it. It's
+// enabled with a connection string of "pcsc:" followed by an optional part of
+// the reader name, otherwise the first reader found is used:
+//
+//	connection_string=pcsc:ACR1552
+//
+// Unlike libnfc, PC/SC readers such as the ACR1552U can poll ISO 15693 tags.
+// Reads and writes of those tags are sent as the PC/SC storage card APDUs,
+// READ BINARY and UPDATE BINARY. Other tags are identified by their UID only.
+
+const pcscReaderPrefix = "pcsc:"
+
+// pcscdSocket is the default socket path of pcsc-lite.
+var pcscdSocket = "/run/pcscd/pcscd.comm"
+
+// Messages follow the pcsc-lite client protocol, version 4.4. Each request is
+// a header of the message size and command, followed by a fixed size struct
+// of 32 bit fields in host byte order. Replies are the same struct, filled in.
+const (
+	pcscProtocolMajor = 4
+	pcscProtocolMinor = 4
+
+	pcscCmdEstablishContext = 0x01
+	pcscCmdReleaseContext   = 0x02
+	pcscCmdConnect          = 0x04
+	pcscCmdDisconnect       = 0x06
+	pcscCmdTransmit         = 0x09
+	pcscCmdVersion          = 0x11
+	pcscCmdGetReadersState  = 0x12
+
+	pcscScopeSystem   = 2
+	pcscShareShared   = 2
+	pcscProtocolAny   = 3
+	pcscLeaveCard     = 0
+	pcscStatePresent  = 0x0004
+	pcscMaxReaders    = 16
+	pcscMaxNameLength = 128
+	pcscMaxAtrLength  = 33
+	pcscMaxBufferSize = 264
+	pcscIoRequestSize = 8
+
+	// readerName, eventCounter, readerState, readerSharing, cardAtr (padded
+	// to 36 bytes), cardAtrLength and cardProtocol
+	pcscReaderStateSize = pcscMaxNameLength + 4*3 + 36 + 4*2
+)
+
+// PC/SC Part 3 ATR of a storage card: the RID of the standard, followed by
+// the card standard byte.
+var pcscStorageCardRid = []byte{0xA0, 0x00, 0x00, 0x03, 0x06}
+
+var errPcscUnsupported = errors.New("command not supported by pc/sc reader")
+
+type pcscReaderState struct {
+	name         string
+	eventCounter uint32
+	state        uint32
+	atr          []byte
+}
+
+type pcscReader struct {
+	mu         sync.Mutex
+	conn       net.Conn
+	context    uint32
+	name       string
+	pollPeriod time.Duration
+	// card is the handle of the connected tag, or 0 if there isn't one
+	card         int32
+	protocol     uint32
+	eventCounter uint32
+	tag          *Tag
+}
+
+func openPcscReader(cfg config.NfcConfig) (Reader, error) {
+	conn, err := net.Dial("unix", pcscdSocket)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to pcscd: %w", err)
+	}
+
+	r := &pcscReader{conn: conn, pollPeriod: periodBetweenPolls}
+
+	version := []uint32{pcscProtocolMajor, pcscProtocolMinor, 0}
+	if err := r.call(pcscCmdVersion, version); err != nil {
+		_ = conn.Close()
+		return nil, err
+	} else if version[2] != 0 {
+		_ = conn.Close()
+		return nil, fmt.Errorf("pcscd protocol %d.%d not supported", version[0], version[1])
+	}
+
+	establish := []uint32{pcscScopeSystem, 0, 0}
+	if err := r.call(pcscCmdEstablishContext, establish); err != nil {
+		_ = conn.Close()
+		return nil, err
+	} else if establish[2] != 0 {
+		_ = conn.Close()
+		return nil, fmt.Errorf("could not establish pc/sc context: %08x", establish[2])
+	}
+	r.context = establish[1]
+
+	states, err := r.readerStates()
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	want := strings.TrimPrefix(cfg.ConnectionString, pcscReaderPrefix)
+	for _, state := range states {
+		if strings.Contains(state.name, want) {
+			r.name = state.name
+			break
+		}
+	}
+
+	if r.name == "" {
+		_ = r.Close()
+		return nil, fmt.Errorf("no pc/sc reader found matching %q", want)
+	}
+
+	logger.Info("opened pc/sc reader: %s", r.name)
+
+	return r, nil
+}
+
+// call sends a request and reads the reply back into the same fields.
+func (r *pcscReader) call(cmd uint32, fields []uint32) error {
+	var buf bytes.Buffer
+	_ = binary.Write(&buf, binary.LittleEndian, []uint32{uint32(len(fields) * 4), cmd})
+	_ = binary.Write(&buf, binary.LittleEndian, fields)
+
+	if _, err := r.conn.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("%w: %s", ErrReaderDisconnected, err)
+	}
+
+	if err := binary.Read(r.conn, binary.LittleEndian, fields); err != nil {
+		return fmt.Errorf("%w: %s", ErrReaderDisconnected, err)
+	}
+
+	return nil
+}
+
+func (r *pcscReader) readerStates() ([]pcscReaderState, error) {
+	header := make([]byte, 8)
+	binary.LittleEndian.PutUint32(header[4:], pcscCmdGetReadersState)
+	if _, err := r.conn.Write(header); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrReaderDisconnected, err)
+	}
+
+	raw := make([]byte, pcscMaxReaders*pcscReaderStateSize)
+	if _, err := io.ReadFull(r.conn, raw); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrReaderDisconnected, err)
+	}
+
+	var states []pcscReaderState
+	for i := 0; i < pcscMaxReaders; i++ {
+		entry := raw[i*pcscReaderStateSize : (i+1)*pcscReaderStateSize]
+		name := string(bytes.TrimRight(entry[:pcscMaxNameLength], "\x00"))
+		if name == "" {
+			continue
+		}
+
+		atrLength := binary.LittleEndian.Uint32(entry[176:])
+		if atrLength > pcscMaxAtrLength {
+			atrLength = pcscMaxAtrLength
+		}
+
+		states = append(states, pcscReaderState{
+			name:         name,
+			eventCounter: binary.LittleEndian.Uint32(entry[128:]),
+			state:        binary.LittleEndian.Uint32(entry[132:]),
+			atr:          append([]byte(nil), entry[140:140+atrLength]...),
+		})
+	}
+
+	return states, nil
+}
+
+func (r *pcscReader) connect() error {
+	name := make([]byte, pcscMaxNameLength)
+	copy(name, r.name)
+
+	fields := make([]uint32, 1+pcscMaxNameLength/4+5)
+	fields[0] = r.context
+	for i := 0; i < pcscMaxNameLength/4; i++ {
+		fields[1+i] = binary.LittleEndian.Uint32(name[i*4:])
+	}
+	rest := fields[1+pcscMaxNameLength/4:]
+	rest[0] = pcscShareShared
+	rest[1] = pcscProtocolAny
+
+	if err := r.call(pcscCmdConnect, fields); err != nil {
+		return err
+	} else if rest[4] != 0 {
+		return fmt.Errorf("could not connect to card: %08x", rest[4])
+	}
+
+	r.card = int32(rest[2])
+	r.protocol = rest[3]
+
+	return nil
+}
+
+func (r *pcscReader) disconnect() {
+	if r.card == 0 {
+		return
+	}
+
+	err := r.call(pcscCmdDisconnect, []uint32{uint32(r.card), pcscLeaveCard, 0})
+	if err != nil {
+		logger.Warn("error disconnecting card: %s", err)
+	}
+
+	r.card = 0
+	r.tag = nil
+}
+
+// transmit sends an APDU to the connected card and returns the reply data and
+// status word.
+func (r *pcscReader) transmit(apdu []byte) ([]byte, uint16, error) {
+	if r.card == 0 {
+		return nil, 0, fmt.Errorf("no card connected")
+	}
+
+	fields := []uint32{
+		uint32(r.card),
+		r.protocol, pcscIoRequestSize,
+		uint32(len(apdu)),
+		r.protocol, pcscIoRequestSize,
+		pcscMaxBufferSize,
+		0,
+	}
+
+	var buf bytes.Buffer
+	_ = binary.Write(&buf, binary.LittleEndian, []uint32{uint32(len(fields) * 4), pcscCmdTransmit})
+	_ = binary.Write(&buf, binary.LittleEndian, fields)
+	buf.Write(apdu)
+
+	if _, err := r.conn.Write(buf.Bytes()); err != nil {
+		return nil, 0, fmt.Errorf("%w: %s", ErrReaderDisconnected, err)
+	}
+
+	if err := binary.Read(r.conn, binary.LittleEndian, fields); err != nil {
+		return nil, 0, fmt.Errorf("%w: %s", ErrReaderDisconnected, err)
+	} else if fields[7] != 0 {
+		return nil, 0, fmt.Errorf("transmit failed: %08x", fields[7])
+	}
+
+	if fields[6] > pcscMaxBufferSize {
+		return nil, 0, fmt.Errorf("invalid reply length: %d", fields[6])
+	}
+
+	rx := make([]byte, fields[6])
+	if _, err := io.ReadFull(r.conn, rx); err != nil {
+		return nil, 0, fmt.Errorf("%w: %s", ErrReaderDisconnected, err)
+	}
+
+	if len(rx) < 2 {
+		return nil, 0, fmt.Errorf("invalid reply: %x", rx)
+	}
+
+	n := len(rx) - 2
+	return rx[:n], binary.BigEndian.Uint16(rx[n:]), nil
+}
+
+// pcscCardType returns the tag type from the ATR of a PC/SC storage card.
+func pcscCardType(atr []byte) string {
+	i := bytes.Index(atr, pcscStorageCardRid)
+	if i < 0 || len(atr) <= i+len(pcscStorageCardRid) {
+		return ""
+	}
+
+	// ISO 15693 parts 1 to 4
+	standard := atr[i+len(pcscStorageCardRid)]
+	if standard >= 0x09 && standard <= 0x0C {
+		return TypeISO15693
+	}
+
+	return ""
+}
+
+func (r *pcscReader) Poll() (*Tag, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i := 0; i < timesToPoll; i++ {
+		states, err := r.readerStates()
+		if err != nil {
+			return nil, err
+		}
+
+		var state *pcscReaderState
+		for j := range states {
+			if states[j].name == r.name {
+				state = &states[j]
+				break
+			}
+		}
+
+		if state == nil {
+			return nil, fmt.Errorf("%w: %s removed", ErrReaderDisconnected, r.name)
+		}
+
+		if state.state&pcscStatePresent != 0 {
+			if r.tag != nil && r.eventCounter == state.eventCounter {
+				return r.tag, nil
+			}
+
+			r.disconnect()
+			if err := r.connect(); err != nil {
+				return nil, err
+			}
+			r.eventCounter = state.eventCounter
+
+			uid, sw, err := r.transmit([]byte{0xFF, 0xCA, 0x00, 0x00, 0x00})
+			if err != nil {
+				return nil, err
+			} else if sw != 0x9000 {
+				logger.Warn("unable to detect card UID: %04x", sw)
+			}
+
+			r.tag = &Tag{
+				UID:  hex.EncodeToString(uid),
+				Type: pcscCardType(state.atr),
+			}
+
+			return r.tag, nil
+		}
+
+		r.disconnect()
+		time.Sleep(r.pollPeriod)
+	}
+
+	return nil, nil
+}
+
+// Transceive translates ISO 15693 block requests to their PC/SC APDUs, and
+// the replies back to ISO 15693 responses.
+func (r *pcscReader) Transceive(tx []byte, replySize int) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.tag == nil || r.tag.Type != TypeISO15693 || len(tx) < 3 {
+		return nil, errPcscUnsupported
+	}
+
+	var apdu []byte
+	switch {
+	case tx[1] == ISO15693_READ_BLOCK:
+		apdu = []byte{0xFF, 0xB0, 0x00, tx[2], ISO15693_BLOCK_SIZE}
+	case tx[1] == ISO15693_WRITE_BLOCK && len(tx) == 3+ISO15693_BLOCK_SIZE:
+		apdu = append([]byte{0xFF, 0xD6, 0x00, tx[2], ISO15693_BLOCK_SIZE}, tx[3:]...)
+	default:
+		return nil, errPcscUnsupported
+	}
+
+	data, sw, err := r.transmit(apdu)
+	if err != nil {
+		return nil, err
+	}
+
+	// the reader's status word doesn't carry the tag's own error code
+	if sw != 0x9000 {
+		return []byte{ISO15693_FLAG_ERROR, 0x0F}, nil
+	}
+
+	rx := append([]byte{0x00}, data...)
+	if len(rx) > replySize {
+		rx = rx[:replySize]
+	}
+
+	return rx, nil
+}
+
+func (r *pcscReader) Connection() string {
+	return pcscReaderPrefix + r.name
+}
+
+func (r *pcscReader) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.disconnect()
+	_ = r.call(pcscCmdReleaseContext, []uint32{r.context, 0})
+
+	return r.conn.Close()
+}
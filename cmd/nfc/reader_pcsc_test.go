@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/wizzomafizzo/mrext/pkg/config"
+)
+
+// fakePcscd answers the pcscd requests made by pcscReader, with a single
+// reader holding tag. Storage card APDUs are sent on to the tag as ISO 15693
+// requests.
+func fakePcscd(t *testing.T, atr []byte, tag *virtualTag) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "pcscd.comm")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		for {
+			header := make([]uint32, 2)
+			if err := binary.Read(conn, binary.LittleEndian, header); err != nil {
+				return
+			}
+
+			fields := make([]uint32, header[0]/4)
+			if err := binary.Read(conn, binary.LittleEndian, fields); err != nil {
+				return
+			}
+
+			var extra []byte
+			switch header[1] {
+			case pcscCmdEstablishContext:
+				fields[1] = 1
+			case pcscCmdConnect:
+				rest := fields[1+pcscMaxNameLength/4:]
+				rest[2], rest[3] = 1, 2
+			case pcscCmdGetReadersState:
+				state := make([]byte, pcscMaxReaders*pcscReaderStateSize)
+				copy(state, "Fake Reader 00 00")
+				binary.LittleEndian.PutUint32(state[128:], 1)
+				binary.LittleEndian.PutUint32(state[132:], pcscStatePresent)
+				copy(state[140:], atr)
+				binary.LittleEndian.PutUint32(state[176:], uint32(len(atr)))
+				_, _ = conn.Write(state)
+				continue
+			case pcscCmdTransmit:
+				apdu := make([]byte, fields[3])
+				if _, err := io.ReadFull(conn, apdu); err != nil {
+					return
+				}
+				extra = fakePcscTransmit(tag, apdu)
+				fields[6] = uint32(len(extra))
+			}
+
+			_ = binary.Write(conn, binary.LittleEndian, fields)
+			_, _ = conn.Write(extra)
+		}
+	}()
+
+	return path
+}
+
+func fakePcscTransmit(tag *virtualTag, apdu []byte) []byte {
+	var tx []byte
+	switch {
+	case bytes.Equal(apdu, []byte{0xFF, 0xCA, 0x00, 0x00, 0x00}):
+		return append(append([]byte(nil), tag.uid...), 0x90, 0x00)
+	case bytes.HasPrefix(apdu, []byte{0xFF, 0xB0, 0x00}) && len(apdu) == 5:
+		tx = []byte{ISO15693_FLAG_HIGH_RATE, ISO15693_READ_BLOCK, apdu[3]}
+	case bytes.HasPrefix(apdu, []byte{0xFF, 0xD6, 0x00}) && len(apdu) > 5:
+		tx = append([]byte{ISO15693_FLAG_HIGH_RATE, ISO15693_WRITE_BLOCK, apdu[3]}, apdu[5:]...)
+	default:
+		return []byte{0x6A, 0x81}
+	}
+
+	rx, err := tag.transceiveISO15693(tx)
+	if err != nil || rx[0]&ISO15693_FLAG_ERROR != 0 {
+		return []byte{0x6A, 0x82}
+	}
+
+	return append(rx[1:], 0x90, 0x00)
+}
+
+func TestPcscReaderISO15693(t *testing.T) {
+	// PC/SC Part 3 ATR of an ISO 15693 part 3 tag
+	atr := []byte{
+		0x3B, 0x8F, 0x80, 0x01, 0x80, 0x4F, 0x0C, 0xA0, 0x00, 0x00,
+		0x03, 0x06, 0x0B, 0x00, 0x14, 0x00, 0x00, 0x00, 0x00, 0x71,
+	}
+
+	blank, err := newVirtualTag("e004010203040506", virtualISO15693, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldSocket := pcscdSocket
+	pcscdSocket = fakePcscd(t, atr, blank)
+	t.Cleanup(func() { pcscdSocket = oldSocket })
+
+	reader, err := openReader(config.NfcConfig{ConnectionString: "pcsc:Fake"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	if got, want := reader.Connection(), "pcsc:Fake Reader 00 00"; got != want {
+		t.Errorf("connection = %q, want %q", got, want)
+	}
+
+	tag, err := waitForTag(reader, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tag.UID != "e004010203040506" || tag.Type != TypeISO15693 {
+		t.Fatalf("tag = %+v", tag)
+	}
+
+	text := "**random:all"
+	if _, err := writeTag(reader, tag, text); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := verifyTag(reader, tag, text); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPcscCardType(t *testing.T) {
+	tests := []struct {
+		name string
+		atr  []byte
+		want string
+	}{
+		{"iso15693", []byte{0x3B, 0x8F, 0x80, 0x01, 0x80, 0x4F, 0x0C, 0xA0, 0x00, 0x00, 0x03, 0x06, 0x0B, 0x00, 0x14}, TypeISO15693},
+		{"iso14443a", []byte{0x3B, 0x8F, 0x80, 0x01, 0x80, 0x4F, 0x0C, 0xA0, 0x00, 0x00, 0x03, 0x06, 0x03, 0x00, 0x03}, ""},
+		{"truncated", []byte{0x3B, 0x8F, 0x80, 0x01, 0x80, 0x4F, 0x0C, 0xA0, 0x00, 0x00, 0x03, 0x06}, ""},
+		{"smart card", []byte{0x3B, 0x80, 0x80, 0x01, 0x01}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := pcscCardType(tt.atr); got != tt.want {
+				t.Errorf("pcscCardType() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
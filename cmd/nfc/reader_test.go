@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/wizzomafizzo/mrext/pkg/config"
+)
+
+func TestVirtualReaderWriteRead(t *testing.T) {
+	tests := []struct {
+		name  string
+		model string
+		text  string
+	}{
+		{"ntag213", virtualNtag213, "**system:snes"},
+		{"ntag215", virtualNtag215, "_Console/SNES||**random:snes"},
+		{"ntag216", virtualNtag216, "Games/NES/Super Mario Bros.nes"},
+		{"ultralight", virtualUltralight, "**system:snes"},
+		{"ultralight c", virtualUltralightC, "Games/NES/Super Mario Bros.nes"},
+		{"mifare", virtualMifare1k, "**random:all"},
+		{"ntag424", virtualNtag424, "_Console/SNES||**random:snes"},
+		{"iso15693", virtualISO15693, "**random:all"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			blank, err := newVirtualTag("04a1b2c3", tt.model, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			reader := newVirtualReader()
+			reader.Insert(blank)
+
+			tag, err := waitForTag(reader, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = identifyTag(reader, tag)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = writeTag(reader, tag, tt.text)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			card, err := pollDevice(reader, Card{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if card.UID != "04a1b2c3" || card.CardType != tag.Type || card.Text != tt.text {
+				t.Errorf("got %+v, want text %q", card, tt.text)
+			}
+		})
+	}
+}
+
+func TestIdentifyTag(t *testing.T) {
+	tests := []struct {
+		model    string
+		wantType string
+		capacity int
+	}{
+		{virtualNtag213, TypeNTAG, NTAG_213_CAPACITY_BYTES},
+		{virtualNtag216, TypeNTAG, NTAG_216_CAPACITY_BYTES},
+		{virtualUltralight, TypeUltralight, ULTRALIGHT_CAPACITY_BYTES},
+		{virtualUltralightC, TypeUltralightC, ULTRALIGHT_C_CAPACITY_BYTES},
+		{virtualMifare1k, TypeMifare, getMifareCapacityInBytes()},
+		{virtualNtag424, TypeNTAG424, 254},
+		{virtualISO15693, TypeISO15693, 112},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.model, func(t *testing.T) {
+			blank, err := newVirtualTag("04a1b2c3", tt.model, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			reader := newVirtualReader()
+			reader.Insert(blank)
+
+			tag, err := waitForTag(reader, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = identifyTag(reader, tag)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tag.Type != tt.wantType {
+				t.Errorf("got type %s, want %s", tag.Type, tt.wantType)
+			}
+
+			capacity, err := getTagCapacity(reader, tag)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if capacity != tt.capacity {
+				t.Errorf("got capacity %d, want %d", capacity, tt.capacity)
+			}
+
+			// identification must leave the tag ready for commands
+			_, err = readTag(reader, tag)
+			if err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestUIDOnlyTags(t *testing.T) {
+	// Amiibo style tag with data that isn't NDEF
+	amiibo, err := newVirtualTag("04a1b2c3d4e5f6", virtualNtag215, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(amiibo.memory[16:], []byte{0xA5, 0x00, 0x00, 0x00, 0x01, 0x02})
+
+	// LEGO Dimensions toy
+	lego, err := newVirtualTag("04b1b2c3d4e5f6", virtualNtag213, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(lego.memory[16:], LEGO_DIMENSIONS_MATCHER)
+
+	// Skylanders style MIFARE Classic with its own keys
+	skylander, err := newVirtualTag("c1b2c3d4", virtualMifare1k, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for sector := 0; sector < mifareBlockCount/4; sector++ {
+		copy(skylander.mifareSectorKey(sector), []byte{0x4b, 0x0b, 0x20, 0x10, 0x7c, 0xcb})
+	}
+
+	unknown, err := newVirtualTag("e0040150", virtualUnknown, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tag := range []*virtualTag{amiibo, lego, skylander, unknown} {
+		t.Run(hex.EncodeToString(tag.uid), func(t *testing.T) {
+			reader := newVirtualReader()
+			reader.Insert(tag)
+
+			card, err := pollDevice(reader, Card{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if card.UID != hex.EncodeToString(tag.uid) || card.Text != "" {
+				t.Errorf("got %+v", card)
+			}
+		})
+	}
+
+	reader := newVirtualReader()
+	reader.Insert(unknown)
+	_, err = writeTag(reader, &Tag{UID: "e0040150"}, "**system:snes")
+	if !errors.Is(err, ErrUnsupportedTag) {
+		t.Errorf("got %v, want unsupported tag error", err)
+	}
+}
+
+func TestVirtualReaderPayloadTooBig(t *testing.T) {
+	blank, err := newVirtualTag("04a1b2c3", virtualNtag213, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader := newVirtualReader()
+	reader.Insert(blank)
+
+	text := make([]byte, NTAG_213_CAPACITY_BYTES)
+	for i := range text {
+		text[i] = 'a'
+	}
+
+	_, err = writeTag(reader, &Tag{UID: "04a1b2c3", Type: TypeNTAG}, string(text))
+	if err == nil {
+		t.Error("expected error writing oversized payload")
+	}
+}
+
+func TestVirtualReaderLaunch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tag.txt")
+	reader, err := openReader(config.NfcConfig{ConnectionString: virtualReaderPrefix + path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader.(*virtualReader).pollDelay = 0
+
+	state := &ServiceState{}
+	launched := make([]string, 0)
+	handler := &cardHandler{
+		cfg:   &config.UserConfig{Nfc: config.NfcConfig{ExitOnRemove: true}},
+		state: state,
+		launch: func(text string, _ bool) error {
+			launched = append(launched, text)
+			return nil
+		},
+	}
+
+	poll := func() {
+		t.Helper()
+		activeCard := state.GetActiveCard()
+		card, err := pollDevice(reader, activeCard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = handler.update(activeCard, card)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// no file means no tag
+	poll()
+
+	err = os.WriteFile(path, []byte("uid=04a1b2c3\ntype=ntag213\ntext=**system:snes\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	poll()
+	poll()
+
+	err = os.Remove(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	poll()
+
+	// card is forgotten after a timeout rather than straight away
+	if state.GetActiveCard().UID == "" {
+		t.Error("expected card to still be active")
+	}
+	card := state.GetActiveCard()
+	card.ScanTime = time.Now().Add(-timeToForgetCard * 2)
+	state.SetActiveCard(card)
+	poll()
+
+	want := []string{"**system:snes", "**system:menu"}
+	if !reflect.DeepEqual(launched, want) {
+		t.Errorf("got %v, want %v", launched, want)
+	}
+}
@@ -0,0 +1,632 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wizzomafizzo/mrext/pkg/config"
+)
+
+// The virtual reader emulates a reader and tags in memory, so the service can
+// be run and tested without any hardware. It's enabled with a connection
+// string of "virtual:" followed by an optional path to a tag file:
+//
+//	connection_string=virtual:/tmp/nfc-virtual.txt
+//
+// The tag file is checked on every poll. Each line is a key=value pair, and
+// the tag is removed from the reader when the file is deleted or empty:
+//
+//	uid=04a1b2c3d4e5f6
+//	type=ntag215
+//	text=**system:snes
+//
+// Supported types are ntag213, ntag215, ntag216, ultralight, ultralight_c,
+// mifare, mifare_blank (not NDEF formatted), ntag424, iso15693 and unknown,
+// a tag which only has a UID.
+//
+// Writes to a virtual tag are kept in memory until the file changes.
+
+const virtualReaderPrefix = "virtual:"
+
+const (
+	virtualNtag213      = "ntag213"
+	virtualNtag215      = "ntag215"
+	virtualNtag216      = "ntag216"
+	virtualUltralight   = "ultralight"
+	virtualUltralightC  = "ultralight_c"
+	virtualMifare1k     = "mifare"
+	virtualMifareBlank  = "mifare_blank"
+	virtualNtag424      = "ntag424"
+	virtualISO15693     = "iso15693"
+	virtualUnknown      = "unknown"
+	mifareBlockCount    = 64
+	iso15693BlockCount  = 29
+	type4NdefFileId     = uint16(0xE104)
+	type4NdefFileLength = 256
+)
+
+var (
+	errVirtualNoTag = errors.New("no tag present")
+	errVirtualNak   = errors.New("tag did not acknowledge command")
+)
+
+// virtualTag holds the raw memory of an emulated tag. Type 2 tags (NTAG and
+// Ultralight) are stored as 4 byte pages, MIFARE Classic as 16 byte blocks,
+// ISO 15693 as 4 byte blocks and Type 4 tags as a set of files.
+type virtualTag struct {
+	uid      []byte
+	model    string
+	cardType string
+	memory   []byte
+	// GET_VERSION reply of Type 2 tags which support it
+	version []byte
+	// Type 2 tags stop responding after an unsupported command, until
+	// they're selected again
+	halted bool
+	// MIFARE sector which has been authenticated, or -1
+	authSector int
+	files      map[uint16][]byte
+	// selected Type 4 file, or 0 if the NDEF application isn't selected
+	selectedFile uint16
+	appSelected  bool
+}
+
+func newVirtualType2(uid []byte, model string) (*virtualTag, error) {
+	var pages int
+	var size byte
+	var productType, storageSize byte
+
+	switch model {
+	case virtualNtag213:
+		pages, size = 45, NTAG_213_IDENTIFIER
+		productType, storageSize = 0x04, 0x0F
+	case virtualNtag215:
+		pages, size = 135, NTAG_215_IDENTIFIER
+		productType, storageSize = 0x04, 0x11
+	case virtualNtag216:
+		pages, size = 231, NTAG_216_IDENTIFIER
+		productType, storageSize = 0x04, 0x13
+	case virtualUltralight:
+		pages, size = 16, ULTRALIGHT_CAPACITY_BYTES/8
+	case virtualUltralightC:
+		pages, size = 48, ULTRALIGHT_C_CAPACITY_BYTES/8
+	default:
+		return nil, fmt.Errorf("unknown NTAG model: %s", model)
+	}
+
+	tag := &virtualTag{
+		uid:      uid,
+		model:    model,
+		cardType: TypeNTAG,
+		memory:   make([]byte, pages*4),
+	}
+
+	if productType != 0 {
+		tag.version = []byte{0x00, 0x04, productType, 0x02, 0x01, 0x00, storageSize, 0x03}
+	}
+
+	copy(tag.memory, uid)
+	// capability container
+	copy(tag.memory[12:], []byte{0xE1, 0x10, size, 0x00})
+	// empty NDEF message
+	copy(tag.memory[16:], []byte{0x03, 0x00, 0xFE})
+
+	return tag, nil
+}
+
+// newVirtualMifare creates a MIFARE Classic 1K card, which is NDEF formatted
+// unless it's blank.
+func newVirtualMifare(uid []byte, blank bool) *virtualTag {
+	tag := &virtualTag{
+		uid:        uid,
+		model:      virtualMifare1k,
+		cardType:   TypeMifare,
+		memory:     make([]byte, mifareBlockCount*MIFARE_BLOCK_SIZE_BYTES),
+		authSector: -1,
+	}
+
+	copy(tag.memory, uid)
+	for sector := 0; sector < mifareBlockCount/4; sector++ {
+		key := mifareNdefKey
+		if blank {
+			key = mifareDefaultKey
+		} else if sector == 0 {
+			key = mifareMadKey
+		}
+		trailer := (sector*4 + 3) * MIFARE_BLOCK_SIZE_BYTES
+		copy(tag.memory[trailer:], key)
+	}
+
+	if blank {
+		tag.model = virtualMifareBlank
+	} else {
+		copy(tag.memory[4*MIFARE_BLOCK_SIZE_BYTES:], []byte{0x03, 0x00, 0xFE})
+	}
+
+	return tag
+}
+
+func newVirtualType4(uid []byte) *virtualTag {
+	cc := []byte{
+		0x00, 0x0F, // CC length
+		0x20,       // mapping version 2.0
+		0x00, 0xFF, // max read size
+		0x00, 0xFF, // max write size
+		0x04, 0x06, // NDEF file control TLV
+		0xE1, 0x04, // NDEF file ID
+		0x01, 0x00, // NDEF file size
+		0x00, 0x00, // free read and write access
+	}
+
+	return &virtualTag{
+		uid:      uid,
+		model:    virtualNtag424,
+		cardType: TypeNTAG424,
+		files: map[uint16][]byte{
+			type4CCFile:     cc,
+			type4NdefFileId: make([]byte, type4NdefFileLength),
+		},
+	}
+}
+
+func newVirtualISO15693(uid []byte) *virtualTag {
+	tag := &virtualTag{
+		uid:      uid,
+		model:    virtualISO15693,
+		cardType: TypeISO15693,
+		memory:   make([]byte, iso15693BlockCount*ISO15693_BLOCK_SIZE),
+	}
+
+	dataSize := (iso15693BlockCount - 1) * ISO15693_BLOCK_SIZE
+	copy(tag.memory, []byte{0xE1, 0x40, byte(dataSize / 8), 0x01})
+	copy(tag.memory[ISO15693_BLOCK_SIZE:], []byte{0x03, 0x00, 0xFE})
+
+	return tag
+}
+
+// newVirtualTag creates a tag of the given model with text written to it as
+// an NDEF message. An empty text leaves the tag blank.
+func newVirtualTag(uid string, model string, text string) (*virtualTag, error) {
+	uidBytes, err := hex.DecodeString(uid)
+	if err != nil {
+		return nil, fmt.Errorf("invalid uid %s: %w", uid, err)
+	}
+
+	var tag *virtualTag
+	switch strings.ToLower(model) {
+	case virtualMifare1k:
+		tag = newVirtualMifare(uidBytes, false)
+	case virtualMifareBlank:
+		tag = newVirtualMifare(uidBytes, true)
+	case virtualNtag424:
+		tag = newVirtualType4(uidBytes)
+	case virtualISO15693:
+		tag = newVirtualISO15693(uidBytes)
+	case virtualUnknown:
+		// responds to polling but no commands
+		tag = &virtualTag{uid: uidBytes, model: virtualUnknown}
+	case "", "ntag":
+		tag, err = newVirtualType2(uidBytes, virtualNtag215)
+	default:
+		tag, err = newVirtualType2(uidBytes, strings.ToLower(model))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if text != "" {
+		err = tag.writeText(text)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return tag, nil
+}
+
+// writeText stores an NDEF message directly in the tag's memory.
+func (t *virtualTag) writeText(text string) error {
+	if t.cardType == TypeNTAG424 {
+		msg, err := MarshalNdefMessage([]NdefRecord{NewTextRecord(text, "en")}, 0)
+		if err != nil {
+			return err
+		}
+
+		file := t.files[type4NdefFileId]
+		if len(msg)+2 > len(file) {
+			return fmt.Errorf("text too big for virtual tag")
+		}
+		binary.BigEndian.PutUint16(file, uint16(len(msg)))
+		copy(file[2:], msg)
+		return nil
+	}
+
+	payload, err := BuildMessage(text)
+	if err != nil {
+		return err
+	}
+
+	var offset int
+	switch t.cardType {
+	case TypeNTAG:
+		offset = 16
+	case TypeMifare:
+		offset = 4 * MIFARE_BLOCK_SIZE_BYTES
+	case TypeISO15693:
+		offset = ISO15693_BLOCK_SIZE
+	default:
+		return fmt.Errorf("can't write text to virtual %s tag", t.model)
+	}
+
+	if offset+len(payload) > len(t.memory) {
+		return fmt.Errorf("text too big for virtual tag")
+	}
+	copy(t.memory[offset:], payload)
+
+	return nil
+}
+
+func (t *virtualTag) mifareSectorKey(sector int) []byte {
+	trailer := (sector*4 + 3) * MIFARE_BLOCK_SIZE_BYTES
+	return t.memory[trailer : trailer+6]
+}
+
+// selected resets the tag's state, like when it's selected by a reader.
+func (t *virtualTag) selected() {
+	t.halted = false
+	t.authSector = -1
+	t.appSelected = false
+	t.selectedFile = 0
+}
+
+func (t *virtualTag) transceiveType2(tx []byte) ([]byte, error) {
+	if t.halted {
+		return nil, errVirtualNak
+	}
+
+	pages := len(t.memory) / 4
+
+	switch {
+	case tx[0] == GET_VERSION_COMMAND && len(tx) == 1 && t.version != nil:
+		return t.version, nil
+	case tx[0] == AUTHENTICATE_COMMAND && len(tx) == 2 && t.model == virtualUltralightC:
+		// first step of 3DES authentication, with a fixed challenge
+		return []byte{0xAF, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}, nil
+	case tx[0] == READ_COMMAND && len(tx) == 2 && int(tx[1]) < pages:
+		// reads 4 pages, rolling over to the start of memory
+		var reply []byte
+		for i := 0; i < 4; i++ {
+			p := (int(tx[1]) + i) % pages
+			reply = append(reply, t.memory[p*4:p*4+4]...)
+		}
+		return reply, nil
+	case tx[0] == WRITE_COMMAND && len(tx) == 6 && tx[1] == 2:
+		// only the lock bytes can be written, and bits can't be cleared
+		t.memory[10] |= tx[4]
+		t.memory[11] |= tx[5]
+		return []byte{0x0A}, nil
+	case tx[0] == WRITE_COMMAND && len(tx) == 6 && tx[1] >= 3 && int(tx[1]) < pages:
+		page := int(tx[1])
+		if t.memory[10] == 0xFF && t.memory[11] == 0xFF {
+			// static lock bytes set, the whole tag is treated as read
+			// only
+			t.halted = true
+			return nil, errVirtualNak
+		}
+		if page == 3 {
+			// capability container is one time programmable
+			for i := 0; i < 4; i++ {
+				t.memory[12+i] |= tx[2+i]
+			}
+		} else {
+			copy(t.memory[page*4:], tx[2:6])
+		}
+		return []byte{0x0A}, nil
+	default:
+		t.halted = true
+		return nil, errVirtualNak
+	}
+}
+
+func (t *virtualTag) transceiveMifare(tx []byte) ([]byte, error) {
+	if len(tx) < 2 || int(tx[1]) >= mifareBlockCount {
+		return nil, errVirtualNak
+	}
+	block := int(tx[1])
+	sector := block / 4
+
+	switch {
+	case tx[0] == 0x60 && len(tx) >= 8:
+		if !bytes.Equal(tx[2:8], t.mifareSectorKey(sector)) {
+			t.authSector = -1
+			return nil, errVirtualNak
+		}
+		t.authSector = sector
+		return nil, nil
+	case tx[0] == 0x30 && t.authSector == sector:
+		offset := block * MIFARE_BLOCK_SIZE_BYTES
+		return t.memory[offset : offset+MIFARE_BLOCK_SIZE_BYTES], nil
+	case tx[0] == 0xA0 && len(tx) == 18 && t.authSector == sector && block != 0:
+		copy(t.memory[block*MIFARE_BLOCK_SIZE_BYTES:], tx[2:])
+		return nil, nil
+	default:
+		return nil, errVirtualNak
+	}
+}
+
+func (t *virtualTag) transceiveType4(tx []byte) ([]byte, error) {
+	var (
+		statusOk           = []byte{0x90, 0x00}
+		statusNotFound     = []byte{0x6A, 0x82}
+		statusWrongParams  = []byte{0x6B, 0x00}
+		statusNotSupported = []byte{0x6D, 0x00}
+	)
+
+	if len(tx) < 5 {
+		return statusWrongParams, nil
+	}
+
+	offset := int(tx[2])<<8 | int(tx[3])
+	file := t.files[t.selectedFile]
+
+	switch tx[1] {
+	case 0xA4:
+		if tx[2] == 0x04 {
+			aid := tx[5:]
+			t.appSelected = len(aid) >= len(ndefApplicationId) &&
+				bytes.Equal(aid[:len(ndefApplicationId)], ndefApplicationId)
+			if !t.appSelected {
+				return statusNotFound, nil
+			}
+			return statusOk, nil
+		}
+
+		if len(tx) < 7 || !t.appSelected {
+			return statusNotFound, nil
+		}
+		id := binary.BigEndian.Uint16(tx[5:7])
+		if _, ok := t.files[id]; !ok {
+			return statusNotFound, nil
+		}
+		t.selectedFile = id
+		return statusOk, nil
+	case 0xB0:
+		length := int(tx[4])
+		if file == nil || offset+length > len(file) {
+			return statusWrongParams, nil
+		}
+		return append(append([]byte{}, file[offset:offset+length]...), statusOk...), nil
+	case 0xD6:
+		data := tx[5:]
+		if file == nil || t.selectedFile == type4CCFile || offset+len(data) > len(file) {
+			return statusWrongParams, nil
+		}
+		copy(file[offset:], data)
+		return statusOk, nil
+	default:
+		return statusNotSupported, nil
+	}
+}
+
+func (t *virtualTag) transceiveISO15693(tx []byte) ([]byte, error) {
+	var (
+		errorNotSupported = []byte{ISO15693_FLAG_ERROR, 0x01}
+		errorBlock        = []byte{ISO15693_FLAG_ERROR, 0x10}
+	)
+
+	if len(tx) < 3 {
+		return errorNotSupported, nil
+	}
+
+	block := int(tx[2])
+	if block >= len(t.memory)/ISO15693_BLOCK_SIZE {
+		return errorBlock, nil
+	}
+	offset := block * ISO15693_BLOCK_SIZE
+
+	switch {
+	case tx[1] == ISO15693_READ_BLOCK:
+		return append([]byte{0x00}, t.memory[offset:offset+ISO15693_BLOCK_SIZE]...), nil
+	case tx[1] == ISO15693_WRITE_BLOCK && len(tx) == 3+ISO15693_BLOCK_SIZE:
+		copy(t.memory[offset:], tx[3:])
+		return []byte{0x00}, nil
+	default:
+		return errorNotSupported, nil
+	}
+}
+
+func (t *virtualTag) transceive(tx []byte, replySize int) ([]byte, error) {
+	if len(tx) < 1 {
+		return nil, errVirtualNak
+	}
+
+	var reply []byte
+	var err error
+
+	switch t.cardType {
+	case TypeNTAG:
+		reply, err = t.transceiveType2(tx)
+	case TypeMifare:
+		reply, err = t.transceiveMifare(tx)
+	case TypeNTAG424:
+		reply, err = t.transceiveType4(tx)
+	case TypeISO15693:
+		reply, err = t.transceiveISO15693(tx)
+	default:
+		return nil, errVirtualNak
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(reply) > replySize {
+		reply = reply[:replySize]
+	}
+	return append([]byte{}, reply...), nil
+}
+
+type virtualReader struct {
+	mu sync.Mutex
+	// path to the tag file, or empty if tags are only inserted directly
+	path     string
+	fileData []byte
+	tag      *virtualTag
+	// how long a poll waits when there's no tag, like a real reader would
+	pollDelay time.Duration
+	closed    bool
+}
+
+func openVirtualReader(cfg config.NfcConfig) (Reader, error) {
+	path := strings.TrimPrefix(cfg.ConnectionString, virtualReaderPrefix)
+	logger.Info("opened virtual reader: %s", path)
+	return &virtualReader{
+		path:      path,
+		pollDelay: timesToPoll * periodBetweenPolls,
+	}, nil
+}
+
+func newVirtualReader() *virtualReader {
+	return &virtualReader{}
+}
+
+// Insert places a tag on the reader, replacing any current tag.
+func (r *virtualReader) Insert(tag *virtualTag) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tag = tag
+}
+
+// Remove takes the current tag off the reader.
+func (r *virtualReader) Remove() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tag = nil
+}
+
+// parseVirtualTagFile parses the contents of a tag file, returning nil if
+// the file doesn't describe a tag.
+func parseVirtualTagFile(data []byte) (*virtualTag, error) {
+	values := make(map[string]string)
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid line in tag file: %s", line)
+		}
+		values[strings.ToLower(strings.TrimSpace(key))] = strings.TrimSpace(value)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if values["uid"] == "" {
+		return nil, nil
+	}
+
+	return newVirtualTag(values["uid"], values["type"], values["text"])
+}
+
+func (r *virtualReader) syncFile() error {
+	if r.path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(r.path)
+	if errors.Is(err, os.ErrNotExist) {
+		data = nil
+	} else if err != nil {
+		return err
+	}
+
+	if r.tag != nil && bytes.Equal(data, r.fileData) {
+		return nil
+	}
+	r.fileData = data
+
+	tag, err := parseVirtualTagFile(data)
+	if err != nil {
+		r.tag = nil
+		return err
+	}
+	r.tag = tag
+
+	return nil
+}
+
+func (r *virtualReader) Poll() (*Tag, error) {
+	r.mu.Lock()
+
+	if r.closed {
+		r.mu.Unlock()
+		return nil, ErrReaderDisconnected
+	}
+
+	err := r.syncFile()
+	if err != nil {
+		r.mu.Unlock()
+		return nil, fmt.Errorf("error reading virtual tag file: %w", err)
+	}
+
+	if r.tag == nil {
+		delay := r.pollDelay
+		r.mu.Unlock()
+		time.Sleep(delay)
+		return nil, nil
+	}
+	defer r.mu.Unlock()
+
+	r.tag.selected()
+
+	return &Tag{
+		UID:  hex.EncodeToString(r.tag.uid),
+		Type: r.tag.cardType,
+	}, nil
+}
+
+func (r *virtualReader) Transceive(tx []byte, replySize int) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.tag == nil {
+		return nil, errVirtualNoTag
+	}
+
+	return r.tag.transceive(tx, replySize)
+}
+
+func (r *virtualReader) Reselect() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.tag == nil {
+		return errVirtualNoTag
+	}
+
+	r.tag.selected()
+	return nil
+}
+
+func (r *virtualReader) Connection() string {
+	return virtualReaderPrefix + r.path
+}
+
+func (r *virtualReader) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	return nil
+}
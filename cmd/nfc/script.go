@@ -0,0 +1,437 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bendahl/uinput"
+	"github.com/wizzomafizzo/mrext/pkg/config"
+)
+
+// Card text is a script of commands separated by "||", which are run in
+// order. Any command understood by the launcher can be used, along with
+// these script commands which control how the script runs:
+//
+//	**delay:<ms>                   pause for a number of milliseconds
+//	**wait:core=<name>[,timeout=<ms>]
+//	                               wait until a core is running, "menu"
+//	                               waits for the main menu
+//	**input:<key>[,<key>...]       press a sequence of keys, see below
+//	**on_error:stop|continue       what to do when a later command fails,
+//	                               scripts stop on the first error by default
+//
+// Keys are named (like "enter", "f12" or "a"), raw key codes, or combos
+// joined with "+" like "leftalt+f12". A "delay=<ms>" entry in the key list
+// pauses between key presses. For example, launching an arcade core, waiting
+// for it to load, inserting a coin and pressing start:
+//
+//	_Arcade/Pac-Man||**wait:core=pacman||**delay:2000||**input:coin,delay=500,start
+//
+// Scripts with delay, wait or input commands run in the background, so the
+// reader keeps polling. They're cancelled when the card is removed or
+// another card is scanned.
+
+const (
+	scriptDelay   = "delay"
+	scriptWait    = "wait"
+	scriptInput   = "input"
+	scriptOnError = "on_error"
+
+	onErrorStop     = "stop"
+	onErrorContinue = "continue"
+
+	// defaultWaitTimeout is how long a wait command waits if no timeout is
+	// given.
+	defaultWaitTimeout = 30 * time.Second
+	// maxScriptDelay stops a typo on a card from leaving a script running
+	// for a very long time.
+	maxScriptDelay = 5 * time.Minute
+	// inputKeyGap is the pause between each key in an input sequence.
+	inputKeyGap     = 100 * time.Millisecond
+	waitPollPeriod  = 250 * time.Millisecond
+	menuCoreName    = "menu"
+	inputDelayEntry = "delay="
+)
+
+var inputKeyNames = map[string]int{
+	"esc": uinput.KeyEsc, "enter": uinput.KeyEnter, "space": uinput.KeySpace,
+	"tab": uinput.KeyTab, "backspace": uinput.KeyBackspace,
+	"up": uinput.KeyUp, "down": uinput.KeyDown,
+	"left": uinput.KeyLeft, "right": uinput.KeyRight,
+	"leftshift": uinput.KeyLeftshift, "rightshift": uinput.KeyRightshift,
+	"leftctrl": uinput.KeyLeftctrl, "rightctrl": uinput.KeyRightctrl,
+	"leftalt": uinput.KeyLeftalt, "rightalt": uinput.KeyRightalt,
+	"leftmeta": uinput.KeyLeftmeta, "minus": uinput.KeyMinus,
+	"equal": uinput.KeyEqual, "home": uinput.KeyHome, "end": uinput.KeyEnd,
+	"pageup": uinput.KeyPageup, "pagedown": uinput.KeyPagedown,
+	"insert": uinput.KeyInsert, "delete": uinput.KeyDelete,
+	"scrolllock": uinput.KeyScrolllock,
+
+	"f1": uinput.KeyF1, "f2": uinput.KeyF2, "f3": uinput.KeyF3,
+	"f4": uinput.KeyF4, "f5": uinput.KeyF5, "f6": uinput.KeyF6,
+	"f7": uinput.KeyF7, "f8": uinput.KeyF8, "f9": uinput.KeyF9,
+	"f10": uinput.KeyF10, "f11": uinput.KeyF11, "f12": uinput.KeyF12,
+	"a": uinput.KeyA, "b": uinput.KeyB, "c": uinput.KeyC, "d": uinput.KeyD,
+	"e": uinput.KeyE, "f": uinput.KeyF, "g": uinput.KeyG, "h": uinput.KeyH,
+	"i": uinput.KeyI, "j": uinput.KeyJ, "k": uinput.KeyK, "l": uinput.KeyL,
+	"m": uinput.KeyM, "n": uinput.KeyN, "o": uinput.KeyO, "p": uinput.KeyP,
+	"q": uinput.KeyQ, "r": uinput.KeyR, "s": uinput.KeyS, "t": uinput.KeyT,
+	"u": uinput.KeyU, "v": uinput.KeyV, "w": uinput.KeyW, "x": uinput.KeyX,
+	"y": uinput.KeyY, "z": uinput.KeyZ,
+	"0": uinput.Key0, "1": uinput.Key1, "2": uinput.Key2, "3": uinput.Key3,
+	"4": uinput.Key4, "5": uinput.Key5, "6": uinput.Key6, "7": uinput.Key7,
+	"8": uinput.Key8, "9": uinput.Key9,
+	// MiSTer and arcade core defaults
+	"osd":   uinput.KeyF12,
+	"menu":  uinput.KeyEsc,
+	"coin":  uinput.Key5,
+	"start": uinput.Key1,
+}
+
+// scriptStep is a single command in a card script. Launcher commands are
+// stored as-is in text.
+type scriptStep struct {
+	cmd  string
+	text string
+	// delay and wait commands
+	duration time.Duration
+	// wait command
+	core string
+	// input command, each entry is a combo of keys to press together, or
+	// nil for a pause of inputDelays at the same index
+	keys        [][]int
+	inputDelays []time.Duration
+	// on_error command
+	onError string
+}
+
+type cardScript []scriptStep
+
+var errScriptCancelled = errors.New("script cancelled")
+
+// background returns true if a script has commands which wait, so it should
+// run in the background.
+func (s cardScript) background() bool {
+	for _, step := range s {
+		switch step.cmd {
+		case scriptDelay, scriptWait, scriptInput:
+			return true
+		}
+	}
+	return false
+}
+
+// parseScriptDuration parses a number of milliseconds.
+func parseScriptDuration(ms string) (time.Duration, error) {
+	n, err := strconv.Atoi(strings.TrimSpace(ms))
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid delay: %s", ms)
+	}
+
+	d := time.Duration(n) * time.Millisecond
+	if d > maxScriptDelay {
+		return 0, fmt.Errorf("delay too long: %s", ms)
+	}
+
+	return d, nil
+}
+
+func parseInputKey(name string) (int, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+
+	if code, ok := inputKeyNames[name]; ok {
+		return code, nil
+	}
+
+	// single digits are key names, longer numbers are raw key codes like
+	// the **key command uses
+	if len(name) > 1 {
+		if code, err := strconv.Atoi(name); err == nil && code > 0 {
+			return code, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown key: %s", name)
+}
+
+func parseInputSequence(args string) ([][]int, []time.Duration, error) {
+	keys := make([][]int, 0)
+	delays := make([]time.Duration, 0)
+
+	for _, entry := range strings.Split(args, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if strings.HasPrefix(strings.ToLower(entry), inputDelayEntry) {
+			d, err := parseScriptDuration(entry[len(inputDelayEntry):])
+			if err != nil {
+				return nil, nil, err
+			}
+			keys = append(keys, nil)
+			delays = append(delays, d)
+			continue
+		}
+
+		combo := make([]int, 0)
+		for _, name := range strings.Split(entry, "+") {
+			code, err := parseInputKey(name)
+			if err != nil {
+				return nil, nil, err
+			}
+			combo = append(combo, code)
+		}
+		keys = append(keys, combo)
+		delays = append(delays, 0)
+	}
+
+	if len(keys) == 0 {
+		return nil, nil, errors.New("no keys to press")
+	}
+
+	return keys, delays, nil
+}
+
+func parseWaitArgs(args string) (string, time.Duration, error) {
+	core := ""
+	timeout := defaultWaitTimeout
+
+	for _, arg := range strings.Split(args, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(arg), "=")
+		if !ok {
+			return "", 0, fmt.Errorf("invalid wait argument: %s", arg)
+		}
+
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "core":
+			core = strings.TrimSpace(value)
+		case "timeout":
+			d, err := parseScriptDuration(value)
+			if err != nil {
+				return "", 0, err
+			}
+			timeout = d
+		default:
+			return "", 0, fmt.Errorf("unknown wait argument: %s", key)
+		}
+	}
+
+	if core == "" {
+		return "", 0, errors.New("no core to wait for")
+	}
+
+	return core, timeout, nil
+}
+
+// parseScript splits card text into script steps. The whole script is
+// checked before anything runs, so a mistake on a card doesn't leave it half
+// finished.
+func parseScript(text string) (cardScript, error) {
+	script := make(cardScript, 0)
+
+	for i, part := range strings.Split(text, "||") {
+		step := scriptStep{text: part}
+
+		trimmed := strings.TrimSpace(part)
+		if strings.HasPrefix(trimmed, "**") {
+			cmd, args, _ := strings.Cut(strings.TrimPrefix(trimmed, "**"), ":")
+			cmd = strings.ToLower(strings.TrimSpace(cmd))
+
+			var err error
+			switch cmd {
+			case scriptDelay:
+				step.cmd = cmd
+				step.duration, err = parseScriptDuration(args)
+			case scriptWait:
+				step.cmd = cmd
+				step.core, step.duration, err = parseWaitArgs(args)
+			case scriptInput:
+				step.cmd = cmd
+				step.keys, step.inputDelays, err = parseInputSequence(args)
+			case scriptOnError:
+				step.cmd = cmd
+				step.onError = strings.ToLower(strings.TrimSpace(args))
+				if step.onError != onErrorStop && step.onError != onErrorContinue {
+					err = fmt.Errorf("invalid on_error value: %s", args)
+				}
+			}
+			if err != nil {
+				return nil, fmt.Errorf("command %d (%s): %w", i+1, trimmed, err)
+			}
+		}
+
+		script = append(script, step)
+	}
+
+	return script, nil
+}
+
+// scriptKeyboard is the part of input.Keyboard used by scripts.
+type scriptKeyboard interface {
+	Press(key int)
+	Combo(keys ...int)
+}
+
+// coreTracker reports the name of the running core, or an empty string when
+// the menu is running.
+type coreTracker interface {
+	ActiveCore() string
+}
+
+// coreNameTracker reads the running core from the same file MiSTer updates
+// for the play time tracker.
+type coreNameTracker struct{}
+
+func (coreNameTracker) ActiveCore() string {
+	data, err := os.ReadFile(config.CoreNameFile)
+	if err != nil {
+		return ""
+	}
+
+	name := strings.TrimSpace(string(data))
+	if name == config.MenuCore {
+		return ""
+	}
+
+	return name
+}
+
+// scriptRunner runs card scripts. Launcher commands are handed to launch.
+type scriptRunner struct {
+	kbd     scriptKeyboard
+	tracker coreTracker
+	launch  func(text string) error
+	after   func(d time.Duration) <-chan time.Time
+	now     func() time.Time
+}
+
+func newScriptRunner(kbd scriptKeyboard, launch func(text string) error) *scriptRunner {
+	return &scriptRunner{
+		kbd:     kbd,
+		tracker: coreNameTracker{},
+		launch:  launch,
+		after:   time.After,
+		now:     time.Now,
+	}
+}
+
+// pause waits for a duration, or returns errScriptCancelled if the script is
+// cancelled first.
+func (r *scriptRunner) pause(d time.Duration, cancel <-chan struct{}) error {
+	select {
+	case <-cancel:
+		return errScriptCancelled
+	case <-r.after(d):
+		return nil
+	}
+}
+
+func (r *scriptRunner) waitForCore(core string, timeout time.Duration, cancel <-chan struct{}) error {
+	want := core
+	if strings.EqualFold(want, menuCoreName) {
+		want = ""
+	}
+
+	deadline := r.now().Add(timeout)
+	for {
+		if strings.EqualFold(r.tracker.ActiveCore(), want) {
+			return nil
+		}
+
+		if !r.now().Before(deadline) {
+			return fmt.Errorf("timed out waiting for core: %s", core)
+		}
+
+		err := r.pause(waitPollPeriod, cancel)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (r *scriptRunner) pressKeys(keys [][]int, delays []time.Duration, cancel <-chan struct{}) error {
+	for i, combo := range keys {
+		if combo == nil {
+			err := r.pause(delays[i], cancel)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		if i > 0 && keys[i-1] != nil {
+			err := r.pause(inputKeyGap, cancel)
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(combo) == 1 {
+			r.kbd.Press(combo[0])
+		} else {
+			r.kbd.Combo(combo...)
+		}
+	}
+
+	return nil
+}
+
+func (r *scriptRunner) runStep(step scriptStep, cancel <-chan struct{}) error {
+	switch step.cmd {
+	case scriptDelay:
+		return r.pause(step.duration, cancel)
+	case scriptWait:
+		return r.waitForCore(step.core, step.duration, cancel)
+	case scriptInput:
+		return r.pressKeys(step.keys, step.inputDelays, cancel)
+	default:
+		return r.launch(step.text)
+	}
+}
+
+// Run runs each step of a script in order. By default the script stops at
+// the first error. After an "on_error:continue" step, errors are logged and
+// the script carries on, but an error is still returned at the end. Closing
+// cancel stops the script straight away with errScriptCancelled.
+func (r *scriptRunner) Run(script cardScript, cancel <-chan struct{}) error {
+	onError := onErrorStop
+	failed := 0
+	var lastErr error
+
+	for i, step := range script {
+		if step.cmd == scriptOnError {
+			onError = step.onError
+			continue
+		}
+
+		select {
+		case <-cancel:
+			return errScriptCancelled
+		default:
+		}
+
+		err := r.runStep(step, cancel)
+		if err == nil {
+			continue
+		}
+
+		if onError == onErrorStop || errors.Is(err, errScriptCancelled) {
+			return err
+		}
+
+		logger.Warn("script command %d failed, continuing: %s", i+1, err)
+		failed++
+		lastErr = err
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d script commands failed, last error: %w", failed, lastErr)
+	}
+
+	return nil
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bendahl/uinput"
+)
+
+type fakeKeyboard struct {
+	pressed [][]int
+}
+
+func (k *fakeKeyboard) Press(key int) {
+	k.pressed = append(k.pressed, []int{key})
+}
+
+func (k *fakeKeyboard) Combo(keys ...int) {
+	k.pressed = append(k.pressed, keys)
+}
+
+// fakeTracker reports each core in turn, then keeps reporting the last one.
+type fakeTracker struct {
+	cores []string
+}
+
+func (t *fakeTracker) ActiveCore() string {
+	core := t.cores[0]
+	if len(t.cores) > 1 {
+		t.cores = t.cores[1:]
+	}
+	return core
+}
+
+// fakeRunner returns a script runner which records everything it does to
+// the returned log, with a clock that only moves when it sleeps.
+func fakeRunner(kbd *fakeKeyboard, tracker *fakeTracker, failing string) (*scriptRunner, *[]string) {
+	log := make([]string, 0)
+	now := time.Unix(0, 0)
+
+	runner := &scriptRunner{
+		kbd:     kbd,
+		tracker: tracker,
+		launch: func(text string) error {
+			log = append(log, "launch "+text)
+			if text == failing {
+				return errors.New("launch failed")
+			}
+			return nil
+		},
+		after: func(d time.Duration) <-chan time.Time {
+			log = append(log, "sleep "+d.String())
+			now = now.Add(d)
+			c := make(chan time.Time, 1)
+			c <- now
+			return c
+		},
+		now: func() time.Time {
+			return now
+		},
+	}
+
+	return runner, &log
+}
+
+func TestParseScript(t *testing.T) {
+	script, err := parseScript("_Arcade/Pac-Man||**wait:core=pacman,timeout=5000||**delay:2000||**input:coin,delay=500,leftalt+f12,28||**on_error:continue")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := cardScript{
+		{text: "_Arcade/Pac-Man"},
+		{cmd: scriptWait, text: "**wait:core=pacman,timeout=5000", core: "pacman", duration: 5 * time.Second},
+		{cmd: scriptDelay, text: "**delay:2000", duration: 2 * time.Second},
+		{
+			cmd:         scriptInput,
+			text:        "**input:coin,delay=500,leftalt+f12,28",
+			keys:        [][]int{{uinput.Key5}, nil, {uinput.KeyLeftalt, uinput.KeyF12}, {28}},
+			inputDelays: []time.Duration{0, 500 * time.Millisecond, 0, 0},
+		},
+		{cmd: scriptOnError, text: "**on_error:continue", onError: onErrorContinue},
+	}
+
+	if !reflect.DeepEqual(script, want) {
+		t.Errorf("got %+v\nwant %+v", script, want)
+	}
+
+	// launcher commands are passed through untouched
+	script, err = parseScript("**system:snes||**random:all")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(script) != 2 || script[0].cmd != "" || script[1].text != "**random:all" {
+		t.Errorf("got %+v", script)
+	}
+}
+
+func TestParseScriptErrors(t *testing.T) {
+	tests := []string{
+		"**delay:soon",
+		"**delay:-5",
+		"**delay:999999999",
+		"**wait:snes",
+		"**wait:core=",
+		"**wait:core=snes,timeout=never",
+		"**wait:core=snes,retries=3",
+		"**input:",
+		"**input:notakey",
+		"**input:enter,delay=x",
+		"**on_error:maybe",
+		"**system:snes||**delay:x",
+	}
+
+	for _, text := range tests {
+		_, err := parseScript(text)
+		if err == nil {
+			t.Errorf("%s: expected error", text)
+		}
+	}
+}
+
+func TestRunScript(t *testing.T) {
+	kbd := &fakeKeyboard{}
+	tracker := &fakeTracker{cores: []string{"", "", "PacMan"}}
+	runner, log := fakeRunner(kbd, tracker, "")
+
+	script, err := parseScript("_Arcade/Pac-Man||**wait:core=pacman||**delay:2000||**input:coin,delay=500,start,start")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = runner.Run(script, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantLog := []string{
+		"launch _Arcade/Pac-Man",
+		"sleep 250ms",
+		"sleep 250ms",
+		"sleep 2s",
+		"sleep 500ms",
+		"sleep 100ms",
+	}
+	if !reflect.DeepEqual(*log, wantLog) {
+		t.Errorf("got log %v, want %v", *log, wantLog)
+	}
+
+	wantKeys := [][]int{{uinput.Key5}, {uinput.Key1}, {uinput.Key1}}
+	if !reflect.DeepEqual(kbd.pressed, wantKeys) {
+		t.Errorf("got keys %v, want %v", kbd.pressed, wantKeys)
+	}
+}
+
+func TestRunScriptWaitTimeout(t *testing.T) {
+	kbd := &fakeKeyboard{}
+	tracker := &fakeTracker{cores: []string{"SNES"}}
+	runner, log := fakeRunner(kbd, tracker, "")
+
+	script, err := parseScript("**wait:core=menu,timeout=1000||**input:enter")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = runner.Run(script, nil)
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("got %v, want timeout error", err)
+	}
+	if len(*log) != 4 || len(kbd.pressed) != 0 {
+		t.Errorf("got log %v, keys %v", *log, kbd.pressed)
+	}
+
+	tracker.cores = []string{""}
+	*log = (*log)[:0]
+	err = runner.Run(script, nil)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRunScriptOnError(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		wantLog []string
+		wantErr bool
+	}{
+		{
+			name:    "stop by default",
+			text:    "bad||**system:snes",
+			wantLog: []string{"launch bad"},
+			wantErr: true,
+		},
+		{
+			name:    "continue",
+			text:    "**on_error:continue||bad||**system:snes",
+			wantLog: []string{"launch bad", "launch **system:snes"},
+			wantErr: true,
+		},
+		{
+			name:    "stop again",
+			text:    "**on_error:continue||bad||**on_error:stop||bad||**system:snes",
+			wantLog: []string{"launch bad", "launch bad"},
+			wantErr: true,
+		},
+		{
+			name:    "no errors",
+			text:    "**on_error:continue||**system:snes",
+			wantLog: []string{"launch **system:snes"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runner, log := fakeRunner(&fakeKeyboard{}, &fakeTracker{cores: []string{""}}, "bad")
+
+			script, err := parseScript(tt.text)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = runner.Run(script, nil)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v", err)
+			}
+			if !reflect.DeepEqual(*log, tt.wantLog) {
+				t.Errorf("got log %v, want %v", *log, tt.wantLog)
+			}
+		})
+	}
+}
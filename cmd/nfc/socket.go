@@ -0,0 +1,405 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/wizzomafizzo/mrext/pkg/config"
+	"github.com/wizzomafizzo/mrext/pkg/nfcctl"
+	"github.com/wizzomafizzo/mrext/pkg/utils"
+)
+
+// readerJob is a socket command which takes over the reader until a card is
+// placed on it, instead of the card being launched.
+type readerJob struct {
+	cmd      string
+	text     string
+	deadline time.Time
+	messages chan nfcctl.Message
+	// skip lists UIDs of cards a batch write won't write to
+	skip          []string
+	lastDuplicate string
+}
+
+func newReaderJob(cmd string, text string) *readerJob {
+	return &readerJob{
+		cmd:      cmd,
+		text:     text,
+		deadline: time.Now().Add(nfcctl.JobTimeout),
+		messages: make(chan nfcctl.Message, 4),
+	}
+}
+
+func (s *ServiceState) StartJob(job *readerJob) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.job != nil {
+		return fmt.Errorf("reader is busy with %s command", s.job.cmd)
+	}
+	s.job = job
+	return nil
+}
+
+func (s *ServiceState) GetJob() *readerJob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.job
+}
+
+// JobProgress sends a progress message to the client of a job, if it's
+// still the current job.
+func (s *ServiceState) JobProgress(job *readerJob, msg nfcctl.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.job != job {
+		return
+	}
+	select {
+	case job.messages <- msg:
+	default:
+	}
+}
+
+// FinishJob sends the final message to the client of a job and frees up the
+// reader. Does nothing if the job was already finished or cancelled.
+func (s *ServiceState) FinishJob(job *readerJob, msg nfcctl.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if job == nil || s.job != job {
+		return
+	}
+	s.job = nil
+	select {
+	case job.messages <- msg:
+	default:
+	}
+	close(job.messages)
+}
+
+// CancelJob cancels the current job, returning false if there was none.
+func (s *ServiceState) CancelJob() bool {
+	job := s.GetJob()
+	if job == nil {
+		return false
+	}
+	s.FinishJob(job, nfcctl.Message{Event: nfcctl.EventCancelled})
+	return true
+}
+
+func (s *ServiceState) SetConnection(connection string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.connection = connection
+}
+
+func (s *ServiceState) Status() nfcctl.Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := nfcctl.Status{
+		LauncherEnabled: !s.disableLauncher,
+		ReaderConnected: s.connection != "",
+		Connection:      s.connection,
+	}
+
+	if s.job != nil {
+		status.Job = s.job.cmd
+	}
+
+	if s.lastScanned.UID != "" {
+		status.LastScan = ctlCard(s.lastScanned)
+	}
+
+	return status
+}
+
+func ctlCard(card Card) *nfcctl.Card {
+	return &nfcctl.Card{
+		UID:      card.UID,
+		Type:     card.CardType,
+		Text:     card.Text,
+		ScanTime: card.ScanTime,
+	}
+}
+
+// runJob polls the reader on behalf of the current job. Only errors which
+// need the reader to be reopened are returned, anything else is sent to the
+// job's client.
+func runJob(reader Reader, state *ServiceState, job *readerJob) error {
+	if time.Now().After(job.deadline) {
+		state.FinishJob(job, nfcctl.ErrorMessage(nfcctl.ErrTimedOut))
+		return nil
+	}
+
+	switch job.cmd {
+	case nfcctl.CmdWrite, nfcctl.CmdWriteLock, nfcctl.CmdFormat, nfcctl.CmdErase, nfcctl.CmdBatchWrite:
+		tag, err := reader.Poll()
+		if errors.Is(err, ErrReaderDisconnected) {
+			return err
+		} else if err != nil {
+			state.FinishJob(job, nfcctl.ErrorMessage(err))
+			return nil
+		}
+
+		if tag == nil {
+			return nil
+		}
+
+		if utils.Contains(job.skip, tag.UID) {
+			if tag.UID != job.lastDuplicate {
+				logger.Info("skipping already written card: %s", tag.UID)
+				job.lastDuplicate = tag.UID
+				state.JobProgress(job, nfcctl.Message{
+					Event: nfcctl.EventDuplicate,
+					Card:  &nfcctl.Card{UID: tag.UID, Type: tag.Type},
+				})
+			}
+			return nil
+		}
+
+		err = identifyTag(reader, tag)
+		if err != nil {
+			state.FinishJob(job, nfcctl.ErrorMessage(err))
+			return nil
+		}
+
+		logger.Info("running %s on card: %s", job.cmd, tag.UID)
+		state.JobProgress(job, nfcctl.Message{
+			Event: nfcctl.EventWriting,
+			Card:  &nfcctl.Card{UID: tag.UID, Type: tag.Type},
+		})
+
+		text, err := programTag(reader, tag, job.cmd, job.text)
+		if err != nil {
+			logger.Error("error running %s on card: %s", job.cmd, err)
+			state.FinishJob(job, nfcctl.ErrorMessage(err))
+			return nil
+		}
+
+		card := Card{
+			CardType: tag.Type,
+			UID:      tag.UID,
+			Text:     text,
+			ScanTime: time.Now(),
+		}
+
+		// the card is still on the reader, don't launch it when the
+		// service takes over again
+		state.SetActiveCard(card)
+
+		logger.Info("successfully ran %s on card: %s", job.cmd, text)
+		state.FinishJob(job, nfcctl.Message{Event: nfcctl.EventWritten, Card: ctlCard(card)})
+	case nfcctl.CmdReadNext:
+		activeCard := state.GetActiveCard()
+		card, err := pollDevice(reader, activeCard)
+		if errors.Is(err, ErrReaderDisconnected) {
+			return err
+		} else if err != nil {
+			state.FinishJob(job, nfcctl.ErrorMessage(err))
+			return nil
+		}
+
+		state.SetActiveCard(card)
+
+		if card.UID != "" && card.UID != activeCard.UID {
+			state.FinishJob(job, nfcctl.Message{Event: nfcctl.EventRead, Card: ctlCard(card)})
+		}
+	default:
+		state.FinishJob(job, nfcctl.ErrorMessage(fmt.Errorf("unknown job: %s", job.cmd)))
+	}
+
+	return nil
+}
+
+// legacyStatus is the reply to an unversioned status command, which is still
+// used by older clients.
+func legacyStatus(state *ServiceState) string {
+	lastScanned := state.GetLastScanned()
+	if lastScanned.UID == "" {
+		return fmt.Sprintf("0,,%t,", !state.IsLauncherDisabled())
+	}
+	return fmt.Sprintf(
+		"%d,%s,%t,%s",
+		lastScanned.ScanTime.Unix(),
+		lastScanned.UID,
+		!state.IsLauncherDisabled(),
+		lastScanned.Text,
+	)
+}
+
+// handleLegacyCommand handles the commands which existed before the control
+// socket had a protocol version, replying the way they used to. Returns false
+// if cmd isn't one of them.
+func handleLegacyCommand(state *ServiceState, conn net.Conn, cmd string) bool {
+	payload := ""
+
+	switch cmd {
+	case nfcctl.CmdStatus:
+		payload = legacyStatus(state)
+	case nfcctl.CmdDisable:
+		state.DisableLauncher()
+		logger.Info("launcher disabled")
+	case nfcctl.CmdEnable:
+		state.EnableLauncher()
+		logger.Info("launcher enabled")
+	default:
+		return false
+	}
+
+	_, err := conn.Write([]byte(payload))
+	if err != nil {
+		logger.Error("error writing to connection: %s", err)
+	}
+
+	return true
+}
+
+func handleConnection(state *ServiceState, conn net.Conn) {
+	send := func(msg nfcctl.Message) error {
+		data, err := nfcctl.Encode(msg)
+		if err != nil {
+			return err
+		}
+		_, err = conn.Write(data)
+		return err
+	}
+
+	buf := make([]byte, 4096)
+
+	n, err := conn.Read(buf)
+	if err != nil {
+		logger.Error("error reading from connection: %s", err)
+		return
+	}
+
+	if n == 0 {
+		return
+	}
+	logger.Debug("received %d bytes", n)
+
+	cmd, args, versioned := nfcctl.ParseCommand(string(buf[:n]))
+	if !versioned && handleLegacyCommand(state, conn, cmd) {
+		return
+	}
+
+	var reply nfcctl.Message
+
+	switch cmd {
+	case nfcctl.CmdStatus:
+		status := state.Status()
+		reply = nfcctl.Message{Event: nfcctl.EventStatus, Status: &status}
+	case nfcctl.CmdLastScan:
+		reply = nfcctl.Message{Event: nfcctl.EventCard}
+		if lastScanned := state.GetLastScanned(); lastScanned.UID != "" {
+			reply.Card = ctlCard(lastScanned)
+		}
+	case nfcctl.CmdDisable:
+		state.DisableLauncher()
+		logger.Info("launcher disabled")
+		reply = nfcctl.Message{Event: nfcctl.EventOk}
+	case nfcctl.CmdEnable:
+		state.EnableLauncher()
+		logger.Info("launcher enabled")
+		reply = nfcctl.Message{Event: nfcctl.EventOk}
+	case nfcctl.CmdCancel:
+		if state.CancelJob() {
+			logger.Info("cancelled reader job")
+		}
+		reply = nfcctl.Message{Event: nfcctl.EventOk}
+	case nfcctl.CmdWrite, nfcctl.CmdWriteLock, nfcctl.CmdFormat, nfcctl.CmdErase, nfcctl.CmdReadNext,
+		nfcctl.CmdBatchWrite:
+		text := args
+		var skip []string
+
+		if cmd == nfcctl.CmdBatchWrite {
+			var batch nfcctl.BatchArgs
+			err := json.Unmarshal([]byte(args), &batch)
+			if err != nil {
+				reply = nfcctl.ErrorMessage(fmt.Errorf("invalid batch arguments: %w", err))
+				break
+			}
+			text, skip = batch.Text, batch.Skip
+		}
+
+		if (cmd == nfcctl.CmdWrite || cmd == nfcctl.CmdWriteLock || cmd == nfcctl.CmdBatchWrite) && text == "" {
+			reply = nfcctl.ErrorMessage(errors.New("no text to write"))
+			break
+		}
+
+		job := newReaderJob(cmd, text)
+		job.skip = skip
+		err := state.StartJob(job)
+		if err != nil {
+			reply = nfcctl.ErrorMessage(err)
+			break
+		}
+		logger.Info("waiting for card to %s", cmd)
+
+		err = send(nfcctl.Message{Event: nfcctl.EventWaiting})
+		for err == nil {
+			msg, ok := <-job.messages
+			if !ok {
+				return
+			}
+			err = send(msg)
+		}
+
+		logger.Error("error writing to connection: %s", err)
+		// nobody is listening for the result anymore
+		state.FinishJob(job, nfcctl.Message{Event: nfcctl.EventCancelled})
+		return
+	default:
+		logger.Warn("unknown command: %s", cmd)
+		reply = nfcctl.ErrorMessage(fmt.Errorf("unknown command: %s", cmd))
+	}
+
+	err = send(reply)
+	if err != nil {
+		logger.Error("error writing to connection: %s", err)
+	}
+}
+
+// startSocket listens for commands on the control socket. See the nfcctl
+// package for the protocol.
+func startSocket(state *ServiceState) (func() error, error) {
+	// clean up after an unclean shutdown
+	_ = os.Remove(config.NfcSocket)
+
+	socket, err := net.Listen("unix", config.NfcSocket)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		for {
+			if state.ShouldStopService() {
+				break
+			}
+
+			conn, err := socket.Accept()
+			if err != nil {
+				logger.Error("error accepting connection: %s", err)
+				return
+			}
+
+			go func(conn net.Conn) {
+				logger.Debug("new socket connection")
+
+				defer func(conn net.Conn) {
+					err := conn.Close()
+					if err != nil {
+						logger.Warn("error closing connection: %s", err)
+					}
+				}(conn)
+
+				handleConnection(state, conn)
+			}(conn)
+		}
+	}()
+
+	return socket.Close, nil
+}
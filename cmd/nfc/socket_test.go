@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/wizzomafizzo/mrext/pkg/nfcctl"
+)
+
+type testClient struct {
+	t       *testing.T
+	conn    net.Conn
+	scanner *bufio.Scanner
+}
+
+// sendCommand connects a client to the socket handler and sends it a
+// command.
+func sendCommand(t *testing.T, state *ServiceState, cmd string) *testClient {
+	t.Helper()
+
+	client, server := net.Pipe()
+	go func() {
+		handleConnection(state, server)
+		_ = server.Close()
+	}()
+
+	_, err := client.Write([]byte(cmd + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testClient{t: t, conn: client, scanner: bufio.NewScanner(client)}
+}
+
+func (c *testClient) next() nfcctl.Message {
+	c.t.Helper()
+
+	_ = c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if !c.scanner.Scan() {
+		c.t.Fatalf("no message received: %v", c.scanner.Err())
+	}
+
+	var msg nfcctl.Message
+	err := json.Unmarshal(c.scanner.Bytes(), &msg)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	return msg
+}
+
+func (c *testClient) expect(event string) nfcctl.Message {
+	c.t.Helper()
+	msg := c.next()
+	if msg.Event != event {
+		c.t.Fatalf("got %+v, want %s event", msg, event)
+	}
+	return msg
+}
+
+func TestSocketWrite(t *testing.T) {
+	state := &ServiceState{}
+	reader := newVirtualReader()
+
+	client := sendCommand(t, state, "write **system:snes")
+	client.expect(nfcctl.EventWaiting)
+
+	// no card yet
+	err := runJob(reader, state, state.GetJob())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.GetJob() == nil {
+		t.Fatal("expected job to still be waiting")
+	}
+
+	busy := sendCommand(t, state, "read-next")
+	busy.expect(nfcctl.EventError)
+
+	tag, err := newVirtualTag("04a1b2c3", virtualNtag213, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader.Insert(tag)
+
+	err = runJob(reader, state, state.GetJob())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := client.expect(nfcctl.EventWriting)
+	if msg.Card.UID != "04a1b2c3" {
+		t.Errorf("got uid %s", msg.Card.UID)
+	}
+
+	msg = client.expect(nfcctl.EventWritten)
+	if msg.Card.Text != "**system:snes" {
+		t.Errorf("got text %s", msg.Card.Text)
+	}
+
+	if state.GetJob() != nil {
+		t.Error("expected job to be finished")
+	}
+
+	// written card shouldn't be launched while it's still on the reader
+	activeCard := state.GetActiveCard()
+	card, err := pollDevice(reader, activeCard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if card != activeCard {
+		t.Errorf("expected active card to be kept, got %+v", card)
+	}
+
+	card, err = pollDevice(reader, Card{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if card.Text != "**system:snes" {
+		t.Errorf("read back %q", card.Text)
+	}
+
+	lastScan := sendCommand(t, state, "last-scan")
+	msg = lastScan.expect(nfcctl.EventCard)
+	if msg.Card == nil || msg.Card.UID != "04a1b2c3" {
+		t.Errorf("got last scan %+v", msg.Card)
+	}
+}
+
+func TestSocketBatchWrite(t *testing.T) {
+	state := &ServiceState{}
+	reader := newVirtualReader()
+
+	written, err := newVirtualTag("04a1b2c3", virtualNtag213, "**system:snes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader.Insert(written)
+
+	client := sendCommand(t, state, `batch-write {"text":"**system:nes","skip":["04a1b2c3"]}`)
+	client.expect(nfcctl.EventWaiting)
+
+	// already written card is only reported once
+	for i := 0; i < 2; i++ {
+		err = runJob(reader, state, state.GetJob())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	msg := client.expect(nfcctl.EventDuplicate)
+	if msg.Card.UID != "04a1b2c3" {
+		t.Errorf("got duplicate %+v", msg.Card)
+	}
+
+	blank, err := newVirtualTag("04d4e5f6", virtualNtag213, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader.Insert(blank)
+
+	err = runJob(reader, state, state.GetJob())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client.expect(nfcctl.EventWriting)
+	msg = client.expect(nfcctl.EventWritten)
+	if msg.Card.UID != "04d4e5f6" || msg.Card.Text != "**system:nes" {
+		t.Errorf("got card %+v", msg.Card)
+	}
+
+	bad := sendCommand(t, state, "batch-write not json")
+	bad.expect(nfcctl.EventError)
+}
+
+func TestSocketReadNextCancel(t *testing.T) {
+	state := &ServiceState{}
+	reader := newVirtualReader()
+
+	client := sendCommand(t, state, "read-next")
+	client.expect(nfcctl.EventWaiting)
+
+	status := sendCommand(t, state, nfcctl.Version+" "+nfcctl.CmdStatus)
+	msg := status.expect(nfcctl.EventStatus)
+	if msg.Status.Job != nfcctl.CmdReadNext {
+		t.Errorf("got job %q", msg.Status.Job)
+	}
+
+	cancel := sendCommand(t, state, "cancel")
+	cancel.expect(nfcctl.EventOk)
+	client.expect(nfcctl.EventCancelled)
+
+	// a late result from the reader is ignored
+	tag, err := newVirtualTag("04a1b2c3", virtualNtag213, "**system:nes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader.Insert(tag)
+
+	job := newReaderJob(nfcctl.CmdReadNext, "")
+	err = runJob(reader, state, job)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client = sendCommand(t, state, "read-next")
+	client.expect(nfcctl.EventWaiting)
+
+	// the card above was still scanned, so only a new card is reported
+	tag, err = newVirtualTag("04d4e5f6", virtualNtag213, "**system:nes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader.Insert(tag)
+
+	err = runJob(reader, state, state.GetJob())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg = client.expect(nfcctl.EventRead)
+	if msg.Card.Text != "**system:nes" {
+		t.Errorf("got text %q", msg.Card.Text)
+	}
+}
+
+func TestSocketJobTimeout(t *testing.T) {
+	state := &ServiceState{}
+	reader := newVirtualReader()
+
+	client := sendCommand(t, state, "write **system:snes")
+	client.expect(nfcctl.EventWaiting)
+
+	job := state.GetJob()
+	job.deadline = time.Now().Add(-time.Second)
+
+	err := runJob(reader, state, job)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := client.expect(nfcctl.EventError)
+	if !errors.Is(msg.Err(), nfcctl.ErrTimedOut) {
+		t.Errorf("got %q, want timeout error", msg.Error)
+	}
+}
+
+func TestSocketErrors(t *testing.T) {
+	state := &ServiceState{}
+
+	for _, cmd := range []string{"write", "foo"} {
+		client := sendCommand(t, state, cmd)
+		client.expect(nfcctl.EventError)
+	}
+}
+
+func TestSocketLegacyCommands(t *testing.T) {
+	state := &ServiceState{}
+
+	reply := func(cmd string) string {
+		client := sendCommand(t, state, cmd)
+		_ = client.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		data, err := io.ReadAll(client.conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	if got := reply("disable"); got != "" {
+		t.Errorf("disable: got %q", got)
+	}
+	if got := reply("status"); got != "0,,false," {
+		t.Errorf("status: got %q", got)
+	}
+	if got := reply("enable"); got != "" {
+		t.Errorf("enable: got %q", got)
+	}
+
+	state.lastScanned = Card{UID: "04a1", Text: "**system:snes", ScanTime: time.Unix(1700000000, 0)}
+	if got := reply("status"); got != "1700000000,04a1,true,**system:snes" {
+		t.Errorf("status: got %q", got)
+	}
+
+	client := sendCommand(t, state, nfcctl.Version+" "+nfcctl.CmdStatus)
+	msg := client.expect(nfcctl.EventStatus)
+	if msg.Status == nil || !msg.Status.LauncherEnabled || msg.Status.LastScan.UID != "04a1" {
+		t.Errorf("got status %+v", msg.Status)
+	}
+}
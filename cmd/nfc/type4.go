@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// NTAG 424 DNA and other ISO 14443-4 tags store NDEF data in files, which
+// are accessed with ISO 7816-4 commands. Only plain NDEF files are supported,
+// files which require authentication are treated as protected.
+// NFCForum-TS-Type-4-Tag_2.0
+
+var ndefApplicationId = []byte{0xD2, 0x76, 0x00, 0x00, 0x85, 0x01, 0x01}
+
+const (
+	type4CCFile      = uint16(0xE103)
+	type4MaxChunk    = 0xF0
+	type4AccessFree  = byte(0x00)
+	type4StatusOk    = uint16(0x9000)
+	type4NdefTlvType = byte(0x04)
+)
+
+type type4CC struct {
+	maxRead     int
+	maxWrite    int
+	fileId      uint16
+	maxSize     int
+	readAccess  byte
+	writeAccess byte
+}
+
+// transceiveApdu sends a command APDU and returns the response data, with the
+// status word checked and removed.
+func transceiveApdu(reader Reader, apdu []byte, replySize int) ([]byte, error) {
+	rx, err := reader.Transceive(apdu, replySize+2)
+	if err != nil {
+		return nil, fmt.Errorf("comm error: %w", err)
+	}
+
+	if len(rx) < 2 {
+		return nil, fmt.Errorf("invalid response: % x", rx)
+	}
+
+	status := binary.BigEndian.Uint16(rx[len(rx)-2:])
+	if status != type4StatusOk {
+		return nil, fmt.Errorf("command %02x failed with status %04x", apdu[1], status)
+	}
+
+	return rx[:len(rx)-2], nil
+}
+
+func selectType4File(reader Reader, fileId uint16) error {
+	_, err := transceiveApdu(reader, []byte{0x00, 0xA4, 0x00, 0x0C, 0x02, byte(fileId >> 8), byte(fileId)}, 0)
+	return err
+}
+
+func readType4Binary(reader Reader, offset int, length int) ([]byte, error) {
+	return transceiveApdu(reader, []byte{0x00, 0xB0, byte(offset >> 8), byte(offset), byte(length)}, length)
+}
+
+func updateType4Binary(reader Reader, offset int, data []byte) error {
+	apdu := []byte{0x00, 0xD6, byte(offset >> 8), byte(offset), byte(len(data))}
+	_, err := transceiveApdu(reader, append(apdu, data...), 0)
+	return err
+}
+
+// selectType4Ndef selects the NDEF application and file, returning the
+// capability container.
+func selectType4Ndef(reader Reader) (type4CC, error) {
+	var cc type4CC
+
+	apdu := []byte{0x00, 0xA4, 0x04, 0x00, byte(len(ndefApplicationId))}
+	apdu = append(apdu, ndefApplicationId...)
+	_, err := transceiveApdu(reader, append(apdu, 0x00), 0)
+	if err != nil {
+		return cc, fmt.Errorf("no NDEF application: %w", err)
+	}
+
+	err = selectType4File(reader, type4CCFile)
+	if err != nil {
+		return cc, err
+	}
+
+	data, err := readType4Binary(reader, 0, 15)
+	if err != nil {
+		return cc, err
+	}
+
+	if len(data) < 15 || data[7] != type4NdefTlvType {
+		return cc, fmt.Errorf("invalid capability container: % x", data)
+	}
+
+	cc = type4CC{
+		maxRead:     int(binary.BigEndian.Uint16(data[3:5])),
+		maxWrite:    int(binary.BigEndian.Uint16(data[5:7])),
+		fileId:      binary.BigEndian.Uint16(data[9:11]),
+		maxSize:     int(binary.BigEndian.Uint16(data[11:13])),
+		readAccess:  data[13],
+		writeAccess: data[14],
+	}
+
+	return cc, selectType4File(reader, cc.fileId)
+}
+
+func chunkSize(max int) int {
+	if max <= 0 || max > type4MaxChunk {
+		return type4MaxChunk
+	}
+	return max
+}
+
+// getType4Capacity returns the maximum size of an NDEF message on the tag.
+func getType4Capacity(reader Reader) (int, error) {
+	cc, err := selectType4Ndef(reader)
+	if err != nil {
+		return 0, err
+	}
+	return cc.maxSize - 2, nil
+}
+
+// readType4 reads the NDEF message from a Type 4 tag, wrapped in a TLV
+// block like the data from other tag types.
+func readType4(reader Reader) ([]byte, error) {
+	cc, err := selectType4Ndef(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if cc.readAccess != type4AccessFree {
+		return nil, errTagProtected
+	}
+
+	data, err := readType4Binary(reader, 0, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	length := int(binary.BigEndian.Uint16(data))
+	if length > cc.maxSize-2 {
+		return nil, fmt.Errorf("invalid NDEF length: %d", length)
+	}
+
+	msg := make([]byte, 0, length)
+	for len(msg) < length {
+		size := chunkSize(cc.maxRead)
+		if length-len(msg) < size {
+			size = length - len(msg)
+		}
+
+		chunk, err := readType4Binary(reader, 2+len(msg), size)
+		if err != nil {
+			return nil, err
+		}
+		msg = append(msg, chunk...)
+	}
+
+	header, err := CalculateNdefHeader(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	blocks := append(header, msg...)
+	return append(blocks, NDEF_END...), nil
+}
+
+func writeType4(reader Reader, text string) ([]byte, error) {
+	msg, err := MarshalNdefMessage([]NdefRecord{NewTextRecord(text, "en")}, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	cc, err := selectType4Ndef(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if cc.writeAccess != type4AccessFree {
+		return nil, fmt.Errorf("%w: NDEF file is write protected", errTagProtected)
+	}
+
+	if len(msg) > cc.maxSize-2 {
+		return nil, fmt.Errorf("Payload too big for card: [%d/%d] bytes used\n", len(msg), cc.maxSize-2)
+	}
+
+	// the length is cleared first so a failed write doesn't leave a
+	// partial message on the tag
+	err = updateType4Binary(reader, 0, []byte{0x00, 0x00})
+	if err != nil {
+		return nil, err
+	}
+
+	for i, chunk := range chunkBy(msg, chunkSize(cc.maxWrite)) {
+		err = updateType4Binary(reader, 2+i*chunkSize(cc.maxWrite), chunk)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	length := make([]byte, 2)
+	binary.BigEndian.PutUint16(length, uint16(len(msg)))
+	err = updateType4Binary(reader, 0, length)
+	if err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
@@ -0,0 +1,95 @@
+package main
+
+const (
+	GET_VERSION_COMMAND  = byte(0x60)
+	AUTHENTICATE_COMMAND = byte(0x1A)
+
+	ULTRALIGHT_CAPACITY_BYTES   = 48
+	ULTRALIGHT_C_CAPACITY_BYTES = 144
+)
+
+// tagSelector is implemented by readers which can select the last polled tag
+// again, after a failed command has put it back into the idle state.
+type tagSelector interface {
+	Reselect() error
+}
+
+func reselectTag(reader Reader) error {
+	if selector, ok := reader.(tagSelector); ok {
+		return selector.Reselect()
+	}
+	return nil
+}
+
+// identifyType2Tag tells apart NTAG and Ultralight tags, which can't be
+// distinguished by their ATQA and SAK.
+// https://www.nxp.com/docs/en/application-note/AN10833.pdf page 12
+func identifyType2Tag(reader Reader) (string, error) {
+	version, err := reader.Transceive([]byte{GET_VERSION_COMMAND}, 8)
+	if err == nil && len(version) >= 8 {
+		// byte 2 is the product type
+		if version[2] == 0x03 {
+			return TypeUltralight, nil
+		}
+		return TypeNTAG, nil
+	}
+
+	// The original Ultralight and Ultralight C don't support GET_VERSION,
+	// only the C responds to the first step of authentication.
+	err = reselectTag(reader)
+	if err != nil {
+		return "", err
+	}
+
+	auth, err := reader.Transceive([]byte{AUTHENTICATE_COMMAND, 0x00}, 9)
+	isUltralightC := err == nil && len(auth) > 0 && auth[0] == 0xAF
+
+	err = reselectTag(reader)
+	if err != nil {
+		return "", err
+	}
+
+	if isUltralightC {
+		return TypeUltralightC, nil
+	}
+	return TypeUltralight, nil
+}
+
+// getUltralightCapacity returns the user memory size of an Ultralight tag.
+// The capability container is used if it's been set, otherwise the size of
+// the smallest tag in the family is assumed.
+func getUltralightCapacity(reader Reader, tagType string) (int, error) {
+	rx, err := comm(reader, []byte{READ_COMMAND, 0x03}, 16)
+	if err != nil {
+		return 0, err
+	}
+
+	// https://github.com/adafruit/Adafruit_MFRC630/blob/master/docs/NTAG.md#capability-container
+	if rx[0] == 0xE1 && rx[2] != 0x00 {
+		return int(rx[2]) * 8, nil
+	}
+
+	if tagType == TypeUltralightC {
+		return ULTRALIGHT_C_CAPACITY_BYTES, nil
+	}
+	return ULTRALIGHT_CAPACITY_BYTES, nil
+}
+
+func readUltralight(reader Reader, tagType string) ([]byte, error) {
+	capacity, err := getUltralightCapacity(reader, tagType)
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("Ultralight has %d bytes", capacity)
+
+	return readType2Pages(reader, capacity/4)
+}
+
+func writeUltralight(reader Reader, text string, tagType string) ([]byte, error) {
+	capacity, err := getUltralightCapacity(reader, tagType)
+	if err != nil {
+		return nil, err
+	}
+
+	return writeType2Pages(reader, text, capacity)
+}
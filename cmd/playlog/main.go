@@ -71,9 +71,19 @@ func tryAddStartup() error {
 		return err
 	}
 
-	if !startup.Exists("mrext/" + appName) {
+	migrated, err := startup.MigrateService(appName)
+	if err != nil {
+		return err
+	} else if migrated {
+		err = startup.Save()
+		if err != nil {
+			return err
+		}
+	}
+
+	if !startup.HasSupervised(appName) {
 		if utils.YesOrNoPrompt("PlayLog must be set to run on MiSTer startup. Add it now?") {
-			err = startup.AddService("mrext/" + appName)
+			err = startup.AddSupervised(appName)
 			if err != nil {
 				return err
 			}
@@ -89,10 +99,11 @@ func tryAddStartup() error {
 }
 
 func main() {
-	svcOpt := flag.String("service", "", "manage playlog service (start, stop, restart, status)")
+	svcOpt := flag.String("service", "", "manage playlog service (start, stop, restart, status, supervise)")
 	flag.Parse()
 
 	logger := service.NewLogger(appName)
+	service.HandleSupervise(logger, svcOpt)
 
 	cfg, err := config.LoadUserConfig(appName, &config.UserConfig{
 		PlayLog: config.PlayLogConfig{
@@ -122,7 +133,7 @@ func main() {
 	if err != nil {
 		logger.Error("error checking recents option: %s", err)
 		fmt.Println("Could not read the MiSTer.ini file. Make sure the \"recents\" option is enabled if playlog doesn't work.")
-	} else if recents {
+	} else if !recents {
 		logger.Error("recents option not enabled, exiting...")
 		fmt.Println("The \"recents\" option must be enabled for playlog to work. Configure it in the MiSTer.ini file and reboot.")
 		os.Exit(1)
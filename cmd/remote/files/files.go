@@ -0,0 +1,430 @@
+// Package files implements a general file manager for the SD card and any
+// attached USB drives, including CIFS mounts on the SD card.
+//
+// Every path sent to the API must be absolute and inside one of the roots.
+// Symlinks are followed when checking this, so a link can't be used to reach
+// the rest of the filesystem.
+package files
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/wizzomafizzo/mrext/pkg/config"
+	"github.com/wizzomafizzo/mrext/pkg/service"
+)
+
+var (
+	errOutsideRoots = errors.New("path is outside of allowed folders")
+	errProtected    = errors.New("path is protected")
+)
+
+// roots are the folders which can be managed. Defaults to the SD card and
+// each USB drive from the list of games folders.
+var roots = defaultRoots()
+
+// protected are the files MiSTer needs to boot, which can't be changed.
+var protected = []string{
+	config.SdFolder + "/MiSTer",
+	config.SdFolder + "/menu.rbf",
+	config.LinuxFolder,
+}
+
+func defaultRoots() []string {
+	roots := []string{config.SdFolder}
+	for _, folder := range config.GamesFolders {
+		folder = strings.TrimSuffix(folder, "/games")
+		if !withinAny(folder, roots) {
+			roots = append(roots, folder)
+		}
+	}
+	return roots
+}
+
+func within(path string, root string) bool {
+	return path == root || strings.HasPrefix(path, strings.TrimSuffix(root, "/")+"/")
+}
+
+func withinAny(path string, roots []string) bool {
+	for _, root := range roots {
+		if within(path, root) {
+			return true
+		}
+	}
+	return false
+}
+
+// evalExisting resolves symlinks in the part of a path which exists, and
+// appends the rest unchanged.
+func evalExisting(path string) (string, error) {
+	rest := ""
+	for {
+		real, err := filepath.EvalSymlinks(path)
+		if err == nil {
+			return filepath.Join(real, rest), nil
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+
+		parent := filepath.Dir(path)
+		if parent == path {
+			return "", err
+		}
+		rest = filepath.Join(filepath.Base(path), rest)
+		path = parent
+	}
+}
+
+// resolvePath cleans a path from a request and checks it's inside one of
+// the roots, both as given and with symlinks followed.
+func resolvePath(path string) (string, error) {
+	if !filepath.IsAbs(path) {
+		return "", fmt.Errorf("%w: path must be absolute", errOutsideRoots)
+	}
+
+	path = filepath.Clean(path)
+	if !withinAny(path, roots) {
+		return "", errOutsideRoots
+	}
+
+	real, err := evalExisting(path)
+	if err != nil {
+		return "", err
+	}
+
+	realRoots := make([]string, 0, len(roots))
+	for _, root := range roots {
+		realRoot, err := filepath.EvalSymlinks(root)
+		if err == nil {
+			realRoots = append(realRoots, realRoot)
+		}
+	}
+
+	if !withinAny(real, realRoots) {
+		return "", errOutsideRoots
+	}
+
+	return path, nil
+}
+
+// checkWritable returns an error if a path can't be deleted, replaced or
+// moved, which is the roots themselves and files MiSTer needs to boot. Like
+// resolvePath, the path is checked both as given and with symlinks followed.
+func checkWritable(path string) error {
+	for _, root := range roots {
+		if path == root {
+			return fmt.Errorf("%w: %s", errProtected, path)
+		}
+	}
+
+	if withinAny(path, protected) {
+		return fmt.Errorf("%w: %s", errProtected, path)
+	}
+
+	real, err := evalExisting(path)
+	if err != nil {
+		return err
+	}
+
+	realProtected := make([]string, 0, len(protected))
+	for _, p := range protected {
+		realP, err := evalExisting(p)
+		if err == nil {
+			realProtected = append(realProtected, realP)
+		}
+	}
+
+	if withinAny(real, realProtected) {
+		return fmt.Errorf("%w: %s", errProtected, path)
+	}
+
+	return nil
+}
+
+// httpError writes an error with a status code to match its cause.
+func httpError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, errOutsideRoots), errors.Is(err, errProtected):
+		status = http.StatusForbidden
+	case errors.Is(err, fs.ErrNotExist):
+		status = http.StatusNotFound
+	case errors.Is(err, fs.ErrExist), errors.Is(err, errUploadOffset):
+		status = http.StatusConflict
+	case errors.Is(err, errInvalidRequest):
+		status = http.StatusBadRequest
+	}
+	http.Error(w, err.Error(), status)
+}
+
+type Entry struct {
+	Name     string    `json:"name"`
+	Path     string    `json:"path"`
+	IsDir    bool      `json:"isDir"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+func listFolder(path string) ([]Entry, error) {
+	if path == "" {
+		entries := make([]Entry, 0, len(roots))
+		for _, root := range roots {
+			info, err := os.Stat(root)
+			if err != nil || !info.IsDir() {
+				continue
+			}
+			entries = append(entries, Entry{
+				Name:     root,
+				Path:     root,
+				IsDir:    true,
+				Modified: info.ModTime(),
+			})
+		}
+		return entries, nil
+	}
+
+	path, err := resolvePath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]Entry, 0, len(files))
+	for _, file := range files {
+		info, err := file.Info()
+		if err != nil {
+			continue
+		}
+
+		entry := Entry{
+			Name:     file.Name(),
+			Path:     filepath.Join(path, file.Name()),
+			IsDir:    file.IsDir(),
+			Modified: info.ModTime(),
+		}
+		if !entry.IsDir {
+			entry.Size = info.Size()
+		}
+
+		entries = append(entries, entry)
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].IsDir != entries[j].IsDir {
+			return entries[i].IsDir
+		}
+		return strings.ToLower(entries[i].Name) < strings.ToLower(entries[j].Name)
+	})
+
+	return entries, nil
+}
+
+// HandleList lists the contents of a folder, or the available roots if no
+// path is given.
+func HandleList(logger *service.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		entries, err := listFolder(r.URL.Query().Get("path"))
+		if err != nil {
+			httpError(w, err)
+			logger.Error("files list: %s", err)
+			return
+		}
+
+		err = json.NewEncoder(w).Encode(entries)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logger.Error("files list: encoding response: %s", err)
+			return
+		}
+	}
+}
+
+// writeZip streams a folder to w as a zip file. Files are stored without
+// compression, most games are already compressed and it's much faster on
+// the MiSTer's CPU.
+func writeZip(w io.Writer, folder string) error {
+	zw := zip.NewWriter(w)
+
+	err := filepath.WalkDir(folder, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if path == folder {
+			return nil
+		}
+
+		rel, err := filepath.Rel(folder, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			_, err := zw.CreateHeader(&zip.FileHeader{Name: rel + "/", Modified: info.ModTime()})
+			return err
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		header, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		header.Name = rel
+		header.Method = zip.Store
+
+		fw, err := zw.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = io.Copy(fw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return zw.Close()
+}
+
+// HandleDownload streams a file, with support for range requests so
+// downloads can be resumed. Folders are downloaded as a zip file.
+func HandleDownload(logger *service.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		path, err := resolvePath(r.URL.Query().Get("path"))
+		if err != nil {
+			httpError(w, err)
+			logger.Error("files download: %s", err)
+			return
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			httpError(w, err)
+			logger.Error("files download: %s", err)
+			return
+		}
+
+		name := filepath.Base(path)
+
+		if info.IsDir() {
+			logger.Info("files download: zipping folder: %s", path)
+			w.Header().Set("Content-Type", "application/zip")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".zip"))
+
+			// headers are already sent, an error can only be logged
+			err := writeZip(w, path)
+			if err != nil {
+				logger.Error("files download: writing zip: %s", err)
+			}
+			return
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			httpError(w, err)
+			logger.Error("files download: %s", err)
+			return
+		}
+		defer f.Close()
+
+		logger.Info("files download: %s", path)
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+		http.ServeContent(w, r, name, info.ModTime(), f)
+	}
+}
+
+type pathArgs struct {
+	Path string `json:"path"`
+}
+
+func decodeArgs(r *http.Request, args interface{}) error {
+	err := json.NewDecoder(r.Body).Decode(args)
+	if err != nil {
+		return fmt.Errorf("%w: %s", errInvalidRequest, err)
+	}
+	return nil
+}
+
+// HandleCreateFolder creates a folder and any missing parents.
+func HandleCreateFolder(logger *service.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var args pathArgs
+		err := decodeArgs(r, &args)
+		if err == nil {
+			args.Path, err = resolvePath(args.Path)
+		}
+		if err != nil {
+			httpError(w, err)
+			logger.Error("files create folder: %s", err)
+			return
+		}
+
+		logger.Info("files create folder: %s", args.Path)
+		err = os.MkdirAll(args.Path, 0755)
+		if err != nil {
+			httpError(w, err)
+			logger.Error("files create folder: %s", err)
+			return
+		}
+	}
+}
+
+// HandleDelete deletes a file or a folder and everything in it.
+func HandleDelete(logger *service.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var args pathArgs
+		err := decodeArgs(r, &args)
+		if err == nil {
+			args.Path, err = resolvePath(args.Path)
+		}
+		if err == nil {
+			err = checkWritable(args.Path)
+		}
+		if err == nil {
+			_, err = os.Lstat(args.Path)
+		}
+		if err != nil {
+			httpError(w, err)
+			logger.Error("files delete: %s", err)
+			return
+		}
+
+		logger.Info("files delete: %s", args.Path)
+		err = os.RemoveAll(args.Path)
+		if err != nil {
+			httpError(w, err)
+			logger.Error("files delete: %s", err)
+			return
+		}
+	}
+}
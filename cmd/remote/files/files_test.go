@@ -0,0 +1,387 @@
+package files
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/wizzomafizzo/mrext/pkg/service"
+)
+
+// testRoots replaces the roots with two temporary drives for the length of
+// a test.
+func testRoots(t *testing.T) (string, string) {
+	t.Helper()
+
+	tmp := t.TempDir()
+	sd := filepath.Join(tmp, "fat")
+	usb := filepath.Join(tmp, "usb0")
+	for _, dir := range []string{sd, usb, filepath.Join(tmp, "outside")} {
+		err := os.Mkdir(dir, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	oldRoots := roots
+	roots = []string{sd, usb}
+	t.Cleanup(func() {
+		roots = oldRoots
+	})
+
+	return sd, usb
+}
+
+func writeFile(t *testing.T, path string, data string) {
+	t.Helper()
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err == nil {
+		err = os.WriteFile(path, []byte(data), 0644)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestDefaultRoots(t *testing.T) {
+	got := defaultRoots()
+	want := []string{"/media/fat", "/media/usb0", "/media/usb1", "/media/usb2", "/media/usb3", "/media/usb4", "/media/usb5"}
+	sort.Strings(got)
+	sort.Strings(want)
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("got roots %v, want %v", got, want)
+	}
+}
+
+func TestResolvePath(t *testing.T) {
+	sd, usb := testRoots(t)
+	outside := filepath.Join(filepath.Dir(sd), "outside")
+
+	err := os.Symlink(outside, filepath.Join(sd, "escape"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink(filepath.Join(usb, "games"), filepath.Join(sd, "usbgames"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	allowed := map[string]string{
+		sd + "/games/SNES/Zelda.sfc":      sd + "/games/SNES/Zelda.sfc",
+		sd + "/games/../Scripts/x.sh":     sd + "/Scripts/x.sh",
+		usb + "/games/NES/":               usb + "/games/NES",
+		sd + "/usbgames/NES/Zelda.nes":    sd + "/usbgames/NES/Zelda.nes",
+		sd:                                sd,
+		sd + "/new/folder/does/not/exist": sd + "/new/folder/does/not/exist",
+	}
+	for path, want := range allowed {
+		got, err := resolvePath(path)
+		if err != nil {
+			t.Errorf("%s: %s", path, err)
+		} else if got != want {
+			t.Errorf("%s: got %s, want %s", path, got, want)
+		}
+	}
+
+	denied := []string{
+		"",
+		"games/SNES",
+		sd + "/../outside",
+		sd + "/games/../../outside/x",
+		sd + "/escape",
+		sd + "/escape/new.txt",
+		sd + "extra",
+		"/etc/passwd",
+	}
+	for _, path := range denied {
+		_, err := resolvePath(path)
+		if !errors.Is(err, errOutsideRoots) {
+			t.Errorf("%q: got %v, want outside roots error", path, err)
+		}
+	}
+}
+
+func TestCheckWritable(t *testing.T) {
+	sd, _ := testRoots(t)
+
+	oldProtected := protected
+	protected = []string{sd + "/MiSTer", sd + "/linux"}
+	t.Cleanup(func() {
+		protected = oldProtected
+	})
+
+	writeFile(t, filepath.Join(sd, "MiSTer"), "main")
+	writeFile(t, filepath.Join(sd, "linux/linux.img"), "linux")
+	writeFile(t, filepath.Join(sd, "games/SNES/Zelda.sfc"), "zelda")
+
+	err := os.Symlink(filepath.Join(sd, "MiSTer"), filepath.Join(sd, "main"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink(filepath.Join(sd, "linux"), filepath.Join(sd, "Scripts"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	allowed := []string{
+		sd + "/games/SNES/Zelda.sfc",
+		sd + "/games/new.sfc",
+	}
+	for _, path := range allowed {
+		if err := checkWritable(path); err != nil {
+			t.Errorf("%s: %s", path, err)
+		}
+	}
+
+	denied := []string{
+		sd,
+		sd + "/MiSTer",
+		sd + "/linux/linux.img",
+		sd + "/main",
+		sd + "/Scripts/linux.img",
+		sd + "/Scripts/new.img",
+	}
+	for _, path := range denied {
+		if err := checkWritable(path); !errors.Is(err, errProtected) {
+			t.Errorf("%s: got %v, want protected error", path, err)
+		}
+	}
+}
+
+func TestUpload(t *testing.T) {
+	sd, _ := testRoots(t)
+	path := filepath.Join(sd, "games", "SNES", "Zelda.sfc")
+	data := "0123456789"
+
+	u, err := startUpload(path, int64(len(data)), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = u.writeChunk(0, strings.NewReader(data[:4]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// resent chunk
+	err = u.writeChunk(0, strings.NewReader(data[:4]))
+	if !errors.Is(err, errUploadOffset) {
+		t.Errorf("got %v, want offset error", err)
+	}
+
+	// connection dropped, start again and resume where it left off
+	u, err = startUpload(path, int64(len(data)), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Offset != 4 {
+		t.Fatalf("resumed at %d, want 4", u.Offset)
+	}
+
+	err = u.writeChunk(4, strings.NewReader(data[4:]+"extra"))
+	if !errors.Is(err, errInvalidRequest) {
+		t.Errorf("got %v, want chunk too large error", err)
+	}
+	if u.Offset != 4 {
+		t.Errorf("offset moved to %d after bad chunk", u.Offset)
+	}
+
+	err = u.writeChunk(4, strings.NewReader(data[4:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !u.Complete {
+		t.Error("expected upload to be complete")
+	}
+	if got := readFile(t, path); got != data {
+		t.Errorf("got %q", got)
+	}
+	if _, err := os.Stat(partialPath(path)); !errors.Is(err, fs.ErrNotExist) {
+		t.Error("partial file was left behind")
+	}
+	if _, err := getUpload(u.ID); err == nil {
+		t.Error("finished upload is still active")
+	}
+
+	_, err = startUpload(path, 1, false)
+	if !errors.Is(err, fs.ErrExist) {
+		t.Errorf("got %v, want exists error", err)
+	}
+
+	_, err = startUpload(filepath.Join(sd, "..", "evil"), 1, true)
+	if !errors.Is(err, errOutsideRoots) {
+		t.Errorf("got %v, want outside roots error", err)
+	}
+}
+
+func TestUploadHandlers(t *testing.T) {
+	sd, _ := testRoots(t)
+	logger := service.NewLogger("test")
+	path := filepath.Join(sd, "upload.txt")
+
+	rec := httptest.NewRecorder()
+	body := `{"path":"` + path + `","size":5}`
+	HandleStartUpload(logger)(rec, httptest.NewRequest("POST", "/files/uploads", strings.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body.String())
+	}
+
+	id := uploadId(path)
+	req := httptest.NewRequest("PUT", "/files/uploads/"+id+"?offset=2", strings.NewReader("hello"))
+	rec = httptest.NewRecorder()
+	router(HandleUploadChunk(logger), "PUT").ServeHTTP(rec, req)
+	if rec.Code != http.StatusConflict {
+		t.Errorf("got status %d, want conflict", rec.Code)
+	}
+
+	req = httptest.NewRequest("PUT", "/files/uploads/"+id+"?offset=0", strings.NewReader("hello"))
+	rec = httptest.NewRecorder()
+	router(HandleUploadChunk(logger), "PUT").ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"complete":true`) {
+		t.Errorf("got status %d: %s", rec.Code, rec.Body.String())
+	}
+
+	if got := readFile(t, path); got != "hello" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	sd, usb := testRoots(t)
+	writeFile(t, filepath.Join(sd, "games/SNES/Zelda.sfc"), "zelda")
+	writeFile(t, filepath.Join(sd, "games/SNES/Hacks/Mario.sfc"), "mario")
+
+	var last Transfer
+	report := func(progress Transfer) {
+		last = progress
+	}
+
+	copyTo := filepath.Join(usb, "games/SNES")
+	transfer, err := prepareTransfer(OpCopy, filepath.Join(sd, "games/SNES"), copyTo, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = transfer.run(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !last.Done || last.Error != "" || last.Copied != 10 || last.Total != 10 {
+		t.Errorf("got final progress %+v", last)
+	}
+	if got := readFile(t, filepath.Join(copyTo, "Hacks/Mario.sfc")); got != "mario" {
+		t.Errorf("got %q", got)
+	}
+	if got := readFile(t, filepath.Join(sd, "games/SNES/Zelda.sfc")); got != "zelda" {
+		t.Errorf("source changed to %q", got)
+	}
+
+	_, err = prepareTransfer(OpCopy, filepath.Join(sd, "games/SNES"), copyTo, false)
+	if !errors.Is(err, fs.ErrExist) {
+		t.Errorf("got %v, want exists error", err)
+	}
+
+	_, err = prepareTransfer(OpMove, filepath.Join(sd, "games"), filepath.Join(sd, "games/SNES/games"), false)
+	if !errors.Is(err, errInvalidRequest) {
+		t.Errorf("got %v, want error moving folder into itself", err)
+	}
+
+	_, err = prepareTransfer(OpMove, usb, filepath.Join(sd, "usb"), false)
+	if !errors.Is(err, errProtected) {
+		t.Errorf("got %v, want error moving root", err)
+	}
+
+	moveTo := filepath.Join(sd, "Zelda.sfc")
+	transfer, err = prepareTransfer(OpMove, filepath.Join(copyTo, "Zelda.sfc"), moveTo, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = transfer.run(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := readFile(t, moveTo); got != "zelda" {
+		t.Errorf("got %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(copyTo, "Zelda.sfc")); !errors.Is(err, fs.ErrNotExist) {
+		t.Error("moved file still exists")
+	}
+}
+
+func TestDownload(t *testing.T) {
+	sd, _ := testRoots(t)
+	logger := service.NewLogger("test")
+	writeFile(t, filepath.Join(sd, "games/NES/Zelda.nes"), "0123456789")
+	writeFile(t, filepath.Join(sd, "games/NES/Hacks/Mario.nes"), "mario")
+
+	req := httptest.NewRequest("GET", "/files/download?path="+sd+"/games/NES/Zelda.nes", nil)
+	req.Header.Set("Range", "bytes=4-")
+	rec := httptest.NewRecorder()
+	HandleDownload(logger)(rec, req)
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != "456789" {
+		t.Errorf("got status %d: %q", rec.Code, rec.Body.String())
+	}
+
+	req = httptest.NewRequest("GET", "/files/download?path="+sd+"/games/NES", nil)
+	rec = httptest.NewRecorder()
+	HandleDownload(logger)(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d", rec.Code)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := make(map[string]string)
+	for _, f := range zr.File {
+		if strings.HasSuffix(f.Name, "/") {
+			continue
+		}
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(r)
+		files[f.Name] = string(data)
+	}
+	if len(files) != 2 || files["Hacks/Mario.nes"] != "mario" || files["Zelda.nes"] != "0123456789" {
+		t.Errorf("got zip files %v", files)
+	}
+
+	req = httptest.NewRequest("GET", "/files/download?path="+sd+"/../outside", nil)
+	rec = httptest.NewRecorder()
+	HandleDownload(logger)(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("got status %d, want forbidden", rec.Code)
+	}
+}
+
+// router routes upload requests so the handler gets its URL variables.
+func router(handler http.HandlerFunc, method string) http.Handler {
+	r := mux.NewRouter()
+	r.HandleFunc("/files/uploads/{id}", handler).Methods(method)
+	return r
+}
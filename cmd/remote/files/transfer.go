@@ -0,0 +1,287 @@
+package files
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/wizzomafizzo/mrext/cmd/remote/websocket"
+	"github.com/wizzomafizzo/mrext/pkg/service"
+)
+
+// Copies and moves run in the background, since they can take a long time
+// between drives. Progress is broadcast to websocket clients as
+// "fileTransfer:" followed by a JSON encoded Transfer.
+
+const (
+	OpCopy = "copy"
+	OpMove = "move"
+)
+
+const progressInterval = 500 * time.Millisecond
+
+type Transfer struct {
+	ID     string `json:"id"`
+	Op     string `json:"op"`
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Copied int64  `json:"copied"`
+	Total  int64  `json:"total"`
+	Done   bool   `json:"done"`
+	Error  string `json:"error,omitempty"`
+}
+
+func newTransferId() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// prepareTransfer checks a copy or move can be made before it's started.
+func prepareTransfer(op string, from string, to string, overwrite bool) (*Transfer, error) {
+	from, err := resolvePath(from)
+	if err != nil {
+		return nil, err
+	}
+
+	to, err = resolvePath(to)
+	if err != nil {
+		return nil, err
+	}
+
+	if op == OpMove {
+		err := checkWritable(from)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := os.Lstat(from); err != nil {
+		return nil, err
+	}
+
+	if from == to || within(to, from) {
+		return nil, fmt.Errorf("%w: can't %s a folder into itself", errInvalidRequest, op)
+	}
+
+	if _, err := os.Lstat(to); err == nil {
+		if !overwrite {
+			return nil, fmt.Errorf("%s: %w", to, fs.ErrExist)
+		}
+		err := checkWritable(to)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &Transfer{ID: newTransferId(), Op: op, From: from, To: to}, nil
+}
+
+// progressWriter counts bytes copied and reports them at most once per
+// progressInterval.
+type progressWriter struct {
+	transfer   *Transfer
+	report     func(Transfer)
+	lastReport time.Time
+}
+
+func (p *progressWriter) add(n int64) {
+	p.transfer.Copied += n
+	if time.Since(p.lastReport) >= progressInterval {
+		p.lastReport = time.Now()
+		p.report(*p.transfer)
+	}
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	p.add(int64(len(b)))
+	return len(b), nil
+}
+
+func copyFile(from string, to string, mode fs.FileMode, progress *progressWriter) error {
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(to, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode.Perm())
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(io.MultiWriter(dst, progress), src)
+	if err != nil {
+		_ = dst.Close()
+		return err
+	}
+
+	return dst.Close()
+}
+
+func copyTree(from string, to string, progress *progressWriter) error {
+	return filepath.WalkDir(from, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(from, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(to, rel)
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm()|0700)
+		case info.Mode()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case info.Mode().IsRegular():
+			return copyFile(path, target, info.Mode(), progress)
+		default:
+			return nil
+		}
+	})
+}
+
+func treeSize(path string) int64 {
+	var total int64
+	_ = filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				total += info.Size()
+			}
+		}
+		return nil
+	})
+	return total
+}
+
+// run carries out the transfer, calling report with its progress and once
+// more when it's done. Moves on the same drive are a rename, moves between
+// drives are copied and then the original is deleted.
+func (t *Transfer) run(report func(Transfer)) error {
+	progress := &progressWriter{transfer: t, report: report, lastReport: time.Now()}
+
+	err := func() error {
+		if _, err := os.Lstat(t.To); err == nil {
+			err := os.RemoveAll(t.To)
+			if err != nil {
+				return err
+			}
+		}
+
+		err := os.MkdirAll(filepath.Dir(t.To), 0755)
+		if err != nil {
+			return err
+		}
+
+		if t.Op == OpMove {
+			err := os.Rename(t.From, t.To)
+			if err == nil || !errors.Is(err, syscall.EXDEV) {
+				return err
+			}
+		}
+
+		t.Total = treeSize(t.From)
+		report(*t)
+
+		err = copyTree(t.From, t.To, progress)
+		if err != nil {
+			return err
+		}
+
+		if t.Op == OpMove {
+			return os.RemoveAll(t.From)
+		}
+
+		return nil
+	}()
+
+	t.Done = true
+	if err != nil {
+		t.Error = err.Error()
+	} else {
+		t.Copied = t.Total
+	}
+	report(*t)
+
+	return err
+}
+
+func handleTransfer(logger *service.Logger, op string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var args struct {
+			From      string `json:"from"`
+			To        string `json:"to"`
+			Overwrite bool   `json:"overwrite"`
+		}
+
+		err := decodeArgs(r, &args)
+		if err != nil {
+			httpError(w, err)
+			logger.Error("files %s: %s", op, err)
+			return
+		}
+
+		transfer, err := prepareTransfer(op, args.From, args.To, args.Overwrite)
+		if err != nil {
+			httpError(w, err)
+			logger.Error("files %s: %s", op, err)
+			return
+		}
+
+		logger.Info("files %s: %s -> %s", op, transfer.From, transfer.To)
+
+		go func(t Transfer) {
+			err := t.run(func(progress Transfer) {
+				data, err := json.Marshal(progress)
+				if err != nil {
+					logger.Error("files %s: encoding progress: %s", op, err)
+					return
+				}
+				websocket.Broadcast(logger, "fileTransfer:"+string(data))
+			})
+			if err != nil {
+				logger.Error("files %s: %s", op, err)
+			} else {
+				logger.Info("files %s: finished %s", op, t.To)
+			}
+		}(*transfer)
+
+		err = json.NewEncoder(w).Encode(transfer)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logger.Error("files %s: encoding response: %s", op, err)
+			return
+		}
+	}
+}
+
+// HandleCopy starts copying a file or folder in the background.
+func HandleCopy(logger *service.Logger) http.HandlerFunc {
+	return handleTransfer(logger, OpCopy)
+}
+
+// HandleMove starts moving a file or folder in the background.
+func HandleMove(logger *service.Logger) http.HandlerFunc {
+	return handleTransfer(logger, OpMove)
+}
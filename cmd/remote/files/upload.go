@@ -0,0 +1,308 @@
+package files
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/wizzomafizzo/mrext/pkg/service"
+)
+
+// Uploads are sent in chunks, each appended to a partial file next to the
+// destination. The upload ID is derived from the destination path, so an
+// interrupted upload can be resumed by starting it again, even after the
+// server has restarted. The partial file is renamed into place once all of
+// it has arrived.
+
+var (
+	errInvalidRequest = errors.New("invalid request")
+	errUploadOffset   = errors.New("chunk offset doesn't match upload")
+)
+
+type upload struct {
+	mu        sync.Mutex
+	ID        string `json:"id"`
+	Path      string `json:"path"`
+	Size      int64  `json:"size"`
+	Offset    int64  `json:"offset"`
+	Overwrite bool   `json:"-"`
+	Complete  bool   `json:"complete"`
+}
+
+var uploads = struct {
+	mu     sync.Mutex
+	active map[string]*upload
+}{active: make(map[string]*upload)}
+
+func uploadId(path string) string {
+	sum := sha1.Sum([]byte(path))
+	return hex.EncodeToString(sum[:8])
+}
+
+func partialPath(path string) string {
+	return filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".upload")
+}
+
+func getUpload(id string) (*upload, error) {
+	uploads.mu.Lock()
+	defer uploads.mu.Unlock()
+	u, ok := uploads.active[id]
+	if !ok {
+		return nil, fmt.Errorf("upload %s: %w", id, fs.ErrNotExist)
+	}
+	return u, nil
+}
+
+func removeUpload(id string) {
+	uploads.mu.Lock()
+	defer uploads.mu.Unlock()
+	delete(uploads.active, id)
+}
+
+// startUpload begins a new upload or resumes an existing one to the same
+// path, returning where the next chunk should start.
+func startUpload(path string, size int64, overwrite bool) (*upload, error) {
+	if size < 0 {
+		return nil, fmt.Errorf("%w: invalid size", errInvalidRequest)
+	}
+
+	path, err := resolvePath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		if !overwrite {
+			return nil, fmt.Errorf("%s: %w", path, fs.ErrExist)
+		}
+		err := checkWritable(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	u := &upload{
+		ID:        uploadId(path),
+		Path:      path,
+		Size:      size,
+		Overwrite: overwrite,
+	}
+
+	info, err := os.Stat(partialPath(path))
+	if err == nil && info.Size() <= size {
+		u.Offset = info.Size()
+	} else {
+		err := os.WriteFile(partialPath(path), nil, 0644)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	uploads.mu.Lock()
+	uploads.active[u.ID] = u
+	uploads.mu.Unlock()
+
+	if u.Offset == u.Size {
+		err := u.finish()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return u, nil
+}
+
+func (u *upload) finish() error {
+	if _, err := os.Stat(u.Path); err == nil && !u.Overwrite {
+		return fmt.Errorf("%s: %w", u.Path, fs.ErrExist)
+	}
+
+	err := os.Rename(partialPath(u.Path), u.Path)
+	if err != nil {
+		return err
+	}
+
+	u.Complete = true
+	removeUpload(u.ID)
+	return nil
+}
+
+// writeChunk appends a chunk of data to the upload. The offset must match
+// the amount already received, so a chunk which is sent twice isn't
+// written twice.
+func (u *upload) writeChunk(offset int64, r io.Reader) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.Complete {
+		return fmt.Errorf("%w: upload is already complete", errUploadOffset)
+	}
+
+	if offset != u.Offset {
+		return fmt.Errorf("%w: expected offset %d", errUploadOffset, u.Offset)
+	}
+
+	f, err := os.OpenFile(partialPath(u.Path), os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Seek(offset, io.SeekStart)
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	// read one byte past the end to find chunks which are too big
+	n, err := io.Copy(f, io.LimitReader(r, u.Size-offset+1))
+	if err == nil && offset+n > u.Size {
+		err = fmt.Errorf("%w: chunk is larger than the rest of the upload", errInvalidRequest)
+	}
+	if err != nil {
+		// throw away the partial chunk so the client can resend it
+		_ = f.Truncate(offset)
+		_ = f.Close()
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	u.Offset += n
+
+	if u.Offset == u.Size {
+		return u.finish()
+	}
+
+	return nil
+}
+
+func (u *upload) cancel() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	removeUpload(u.ID)
+	err := os.Remove(partialPath(u.Path))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func writeUpload(w http.ResponseWriter, logger *service.Logger, u *upload) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	err := json.NewEncoder(w).Encode(u)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		logger.Error("files upload: encoding response: %s", err)
+	}
+}
+
+// HandleStartUpload starts or resumes an upload.
+func HandleStartUpload(logger *service.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var args struct {
+			Path      string `json:"path"`
+			Size      int64  `json:"size"`
+			Overwrite bool   `json:"overwrite"`
+		}
+
+		err := decodeArgs(r, &args)
+		if err != nil {
+			httpError(w, err)
+			logger.Error("files upload: %s", err)
+			return
+		}
+
+		u, err := startUpload(args.Path, args.Size, args.Overwrite)
+		if err != nil {
+			httpError(w, err)
+			logger.Error("files upload: %s", err)
+			return
+		}
+
+		logger.Info("files upload: %s at offset %d/%d", u.Path, u.Offset, u.Size)
+		writeUpload(w, logger, u)
+	}
+}
+
+// HandleUploadChunk appends the request body to an upload, at the offset
+// given in the offset query parameter.
+func HandleUploadChunk(logger *service.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, err := getUpload(mux.Vars(r)["id"])
+		if err != nil {
+			httpError(w, err)
+			logger.Error("files upload chunk: %s", err)
+			return
+		}
+
+		offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+		if err != nil {
+			httpError(w, fmt.Errorf("%w: invalid offset", errInvalidRequest))
+			logger.Error("files upload chunk: invalid offset: %s", err)
+			return
+		}
+
+		err = u.writeChunk(offset, r.Body)
+		if err != nil {
+			httpError(w, err)
+			logger.Error("files upload chunk: %s", err)
+			return
+		}
+
+		if u.Complete {
+			logger.Info("files upload: completed %s", u.Path)
+		}
+
+		writeUpload(w, logger, u)
+	}
+}
+
+// HandleUploadStatus returns how much of an upload has been received.
+func HandleUploadStatus(logger *service.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, err := getUpload(mux.Vars(r)["id"])
+		if err != nil {
+			httpError(w, err)
+			logger.Error("files upload status: %s", err)
+			return
+		}
+
+		writeUpload(w, logger, u)
+	}
+}
+
+// HandleCancelUpload stops an upload and deletes what was received.
+func HandleCancelUpload(logger *service.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, err := getUpload(mux.Vars(r)["id"])
+		if err == nil {
+			err = u.cancel()
+		}
+		if err != nil {
+			httpError(w, err)
+			logger.Error("files cancel upload: %s", err)
+			return
+		}
+
+		logger.Info("files upload: cancelled %s", u.Path)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"sync"
 
 	"github.com/wizzomafizzo/mrext/cmd/remote/menu"
+	"github.com/wizzomafizzo/mrext/cmd/remote/saves"
 	"github.com/wizzomafizzo/mrext/cmd/remote/systems"
 	"github.com/wizzomafizzo/mrext/cmd/remote/websocket"
 	"github.com/wizzomafizzo/mrext/pkg/gamesdb"
@@ -22,6 +23,8 @@ type SearchResultGame struct {
 	System systems.System `json:"system"`
 	Name   string         `json:"name"`
 	Path   string         `json:"path"`
+	// Saves is the number of saves and savestates for the game.
+	Saves int `json:"saves"`
 }
 
 type SearchResults struct {
@@ -222,6 +225,11 @@ func Search(logger *service.Logger) http.HandlerFunc {
 			results = results[:pageSize]
 		}
 
+		countSaves := saves.CountForGames()
+		for i := range results {
+			results[i].Saves = countSaves(results[i].System.Id, results[i].Path)
+		}
+
 		err = json.NewEncoder(w).Encode(&SearchResults{
 			Data:     results,
 			Total:    total,
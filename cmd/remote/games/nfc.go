@@ -2,42 +2,84 @@ package games
 
 import (
 	"encoding/json"
-	"fmt"
+	"errors"
 	"net/http"
 	"os"
 	"os/exec"
+	"strings"
 
+	"github.com/wizzomafizzo/mrext/cmd/remote/websocket"
 	"github.com/wizzomafizzo/mrext/pkg/config"
+	"github.com/wizzomafizzo/mrext/pkg/nfcctl"
 	"github.com/wizzomafizzo/mrext/pkg/service"
 )
 
 type NfcState struct {
-	Available bool   `json:"installed"`
-	Running   bool   `json:"running"`
-	Name      string `json:"name"`
+	Available bool           `json:"installed"`
+	Running   bool           `json:"running"`
+	Name      string         `json:"name"`
+	Status    *nfcctl.Status `json:"status"`
 }
 
+const (
+	taptoName = "tapto"
+	taptoPid  = "/tmp/tapto/tapto.pid"
+)
+
+// getNfcState finds the installed NFC app. The NFC service is preferred, but
+// TapTo is still supported through its script, without the features of the
+// service's control socket.
 func getNfcState() NfcState {
 	state := NfcState{}
 
-	bin := config.ScriptsFolder + "/tapto.sh"
-	pid := "/tmp/tapto/tapto.pid"
-
-	if _, err := os.Stat(bin); err == nil {
+	if _, err := os.Stat(config.ScriptsFolder + "/nfc.sh"); err == nil {
 		state.Available = true
-	} else {
+		state.Name = "nfc"
+
+		status, err := nfcctl.GetStatus()
+		if err == nil {
+			state.Running = true
+			state.Status = &status
+		}
+
 		return state
 	}
 
-	state.Name = "tapto"
+	if _, err := os.Stat(config.ScriptsFolder + "/" + taptoName + ".sh"); err == nil {
+		state.Available = true
+		state.Name = taptoName
 
-	if _, err := os.Stat(pid); err == nil {
-		state.Running = true
+		if _, err := os.Stat(taptoPid); err == nil {
+			state.Running = true
+		}
 	}
 
 	return state
 }
 
+// runTapto runs the TapTo script with the given arguments, if TapTo is the
+// installed NFC app. Returns false if it isn't.
+func runTapto(logger *service.Logger, w http.ResponseWriter, name string, args ...string) bool {
+	state := getNfcState()
+	if state.Name != taptoName {
+		return false
+	}
+
+	if !state.Running {
+		http.Error(w, "tapto service not running", http.StatusServiceUnavailable)
+		return true
+	}
+
+	cmd := exec.Command(config.ScriptsFolder+"/"+taptoName+".sh", args...)
+	err := cmd.Run()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		logger.Error("tapto %s: run command: %s", name, err)
+	}
+
+	return true
+}
+
 func NfcStatus(logger *service.Logger) http.HandlerFunc {
 	return func(w http.ResponseWriter, _ *http.Request) {
 		payload := getNfcState()
@@ -45,12 +87,61 @@ func NfcStatus(logger *service.Logger) http.HandlerFunc {
 		err := json.NewEncoder(w).Encode(payload)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
-			logger.Error("tapto status: encoding response: %s", err)
+			logger.Error("nfc status: encoding response: %s", err)
 			return
 		}
 	}
 }
 
+// streamNfcCommand runs a command which waits for a card in the background,
+// broadcasting each message from the NFC service to websocket clients with
+// the given prefix. Returns once the service has accepted the command.
+func streamNfcCommand(logger *service.Logger, prefix string, cmd string) error {
+	broadcast := func(msg nfcctl.Message) {
+		data, err := json.Marshal(msg)
+		if err != nil {
+			logger.Error("nfc %s: encoding message: %s", prefix, err)
+			return
+		}
+		websocket.Broadcast(logger, prefix+":"+string(data))
+	}
+
+	started := make(chan error, 1)
+
+	go func() {
+		accepted := false
+
+		msg, err := nfcctl.Stream(cmd, func(msg nfcctl.Message) {
+			if !accepted {
+				accepted = true
+				started <- nil
+			}
+			broadcast(msg)
+		})
+
+		if !accepted {
+			started <- err
+			return
+		}
+
+		if err != nil && msg.Event == "" {
+			msg = nfcctl.ErrorMessage(err)
+		}
+		broadcast(msg)
+	}()
+
+	return <-started
+}
+
+func writeNfcError(logger *service.Logger, w http.ResponseWriter, name string, err error) {
+	if errors.Is(err, nfcctl.ErrServiceNotRunning) {
+		http.Error(w, "nfc service not running", http.StatusServiceUnavailable)
+	} else {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+	logger.Error("nfc %s: %s", name, err)
+}
+
 func NfcWrite(logger *service.Logger) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var args struct {
@@ -60,56 +151,74 @@ func NfcWrite(logger *service.Logger) http.HandlerFunc {
 		err := json.NewDecoder(r.Body).Decode(&args)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
-			logger.Error("tapto write: decoding request: %s", err)
+			logger.Error("nfc write: decoding request: %s", err)
 			return
 		}
 
-		state := getNfcState()
-
-		if !state.Available {
-			http.Error(w, "tapto app not found", http.StatusInternalServerError)
+		if args.Path == "" {
+			http.Error(w, "no text to write", http.StatusBadRequest)
 			return
 		}
 
-		if !state.Running {
-			http.Error(w, "tapto service not running", http.StatusInternalServerError)
+		// the command is sent as a single line to the nfc service
+		if strings.ContainsAny(args.Path, "\r\n") {
+			http.Error(w, "text cannot contain line breaks", http.StatusBadRequest)
 			return
 		}
 
-		nfcBin := fmt.Sprintf(config.ScriptsFolder+"/%s.sh", state.Name)
-
-		cmd := exec.Command(nfcBin, "-write", args.Path)
-		err = cmd.Run()
+		if runTapto(logger, w, "write", "-write", args.Path) {
+			return
+		}
 
+		err = streamNfcCommand(logger, "nfcWrite", nfcctl.CmdWrite+" "+args.Path)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			logger.Error("tapto write: run command: %s", err)
+			writeNfcError(logger, w, "write", err)
 			return
 		}
 	}
 }
 
-func NfcCancel(logger *service.Logger) http.HandlerFunc {
+func NfcReadNext(logger *service.Logger) http.HandlerFunc {
 	return func(w http.ResponseWriter, _ *http.Request) {
-		state := getNfcState()
-
-		if !state.Available {
-			http.Error(w, "tapto app not found", http.StatusInternalServerError)
+		err := streamNfcCommand(logger, "nfcRead", nfcctl.CmdReadNext)
+		if err != nil {
+			writeNfcError(logger, w, "read", err)
 			return
 		}
+	}
+}
 
-		if !state.Running {
+func NfcLastScan(logger *service.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		card, err := nfcctl.LastScan()
+		if err != nil {
+			writeNfcError(logger, w, "last scan", err)
 			return
 		}
 
-		nfcBin := fmt.Sprintf(config.ScriptsFolder+"/%s.sh", state.Name)
-
-		cmd := exec.Command(nfcBin, "-service", "restart")
-		err := cmd.Run()
-
+		err = json.NewEncoder(w).Encode(card)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
-			logger.Error("tapto cancel: run command: %s", err)
+			logger.Error("nfc last scan: encoding response: %s", err)
+			return
+		}
+	}
+}
+
+func NfcCancel(logger *service.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		if state := getNfcState(); state.Name == taptoName {
+			if state.Running {
+				runTapto(logger, w, "cancel", "-service", "restart")
+			}
+			return
+		}
+
+		err := nfcctl.Cancel()
+		if errors.Is(err, nfcctl.ErrServiceNotRunning) {
+			return
+		} else if err != nil {
+			writeNfcError(logger, w, "cancel", err)
 			return
 		}
 	}
@@ -0,0 +1,104 @@
+package games
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/wizzomafizzo/mrext/pkg/config"
+	"github.com/wizzomafizzo/mrext/pkg/nfclog"
+	"github.com/wizzomafizzo/mrext/pkg/service"
+)
+
+// parseNfcHistoryFilter reads scan log filters from the query string.
+func parseNfcHistoryFilter(r *http.Request) (nfclog.Filter, error) {
+	query := r.URL.Query()
+
+	filter := nfclog.Filter{
+		UID:    query.Get("uid"),
+		Result: query.Get("result"),
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 0 {
+			return filter, fmt.Errorf("invalid limit: %s", limit)
+		}
+		filter.Limit = n
+	}
+
+	if since := query.Get("since"); since != "" {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			return filter, fmt.Errorf("invalid since time: %s", since)
+		}
+		filter.Since = t
+	}
+
+	return filter, nil
+}
+
+func HandleNfcHistory(logger *service.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filter, err := parseNfcHistoryFilter(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		entries, err := nfclog.Read(config.NfcScanLogFile, filter)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logger.Error("nfc history: %s", err)
+			return
+		}
+
+		err = json.NewEncoder(w).Encode(entries)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logger.Error("nfc history: encoding response: %s", err)
+			return
+		}
+	}
+}
+
+func HandleExportNfcHistory(logger *service.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filter, err := parseNfcHistoryFilter(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = "csv"
+		}
+		if format != "csv" && format != "json" {
+			http.Error(w, "format must be csv or json", http.StatusBadRequest)
+			return
+		}
+
+		entries, err := nfclog.Read(config.NfcScanLogFile, filter)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logger.Error("export nfc history: %s", err)
+			return
+		}
+
+		w.Header().Set("Content-Disposition", "attachment; filename=nfc_scans."+format)
+		if format == "json" {
+			w.Header().Set("Content-Type", "application/json")
+			err = nfclog.WriteJSON(w, entries)
+		} else {
+			w.Header().Set("Content-Type", "text/csv")
+			err = nfclog.WriteCSV(w, entries)
+		}
+		if err != nil {
+			logger.Error("export nfc history: %s", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package games
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/wizzomafizzo/mrext/pkg/config"
+	"github.com/wizzomafizzo/mrext/pkg/nfcmap"
+	"github.com/wizzomafizzo/mrext/pkg/service"
+)
+
+// guards read-modify-write of the mappings file between requests
+var nfcMappingsMu sync.Mutex
+
+type NfcMappingPayload struct {
+	Id int `json:"id"`
+	nfcmap.Mapping
+	Errors nfcmap.ValidationErrors `json:"errors"`
+}
+
+type NfcMappingErrorsPayload struct {
+	Errors nfcmap.ValidationErrors `json:"errors"`
+}
+
+func writeValidationErrors(w http.ResponseWriter, status int, errs nfcmap.ValidationErrors) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(NfcMappingErrorsPayload{Errors: errs})
+}
+
+func HandleListNfcMappings(logger *service.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		nfcMappingsMu.Lock()
+		mappings, err := nfcmap.ReadMappings(config.NfcDatabaseFile)
+		nfcMappingsMu.Unlock()
+		var errs nfcmap.ValidationErrors
+		if errors.As(err, &errs) {
+			logger.Warn("list nfc mappings: %s", err)
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logger.Error("list nfc mappings: %s", err)
+			return
+		}
+
+		payload := make([]NfcMappingPayload, 0, len(mappings))
+		for i, m := range mappings {
+			_, errs := nfcmap.NewRule(m, m.Line)
+			payload = append(payload, NfcMappingPayload{
+				Id:      i,
+				Mapping: m,
+				Errors:  errs,
+			})
+		}
+
+		err = json.NewEncoder(w).Encode(payload)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logger.Error("list nfc mappings: encoding response: %s", err)
+			return
+		}
+	}
+}
+
+// updateNfcMappings decodes and validates a mapping from the request, then
+// hands the current mappings to update for changes before saving them. The
+// file isn't changed if it has rows which can't be parsed, since they would
+// be lost.
+func updateNfcMappings(
+	logger *service.Logger,
+	w http.ResponseWriter,
+	r *http.Request,
+	decode bool,
+	update func(mappings []nfcmap.Mapping, m nfcmap.Mapping) ([]nfcmap.Mapping, int, bool),
+) {
+	var m nfcmap.Mapping
+	if decode {
+		err := json.NewDecoder(r.Body).Decode(&m)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			logger.Error("nfc mappings: decoding request: %s", err)
+			return
+		}
+	}
+
+	nfcMappingsMu.Lock()
+	defer nfcMappingsMu.Unlock()
+
+	mappings, err := nfcmap.ReadMappings(config.NfcDatabaseFile)
+	var parseErrs nfcmap.ValidationErrors
+	if errors.As(err, &parseErrs) {
+		writeValidationErrors(w, http.StatusConflict, parseErrs)
+		logger.Error("nfc mappings: database has unparsable rows: %s", err)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		logger.Error("nfc mappings: reading database: %s", err)
+		return
+	}
+
+	mappings, id, ok := update(mappings, m)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	if decode {
+		_, errs := nfcmap.NewRule(m, nfcmap.MappingLines(mappings)[id])
+		if len(errs) > 0 {
+			writeValidationErrors(w, http.StatusBadRequest, errs)
+			return
+		}
+	}
+
+	err = nfcmap.WriteMappings(config.NfcDatabaseFile, mappings)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		logger.Error("nfc mappings: writing database: %s", err)
+		return
+	}
+}
+
+func mappingId(r *http.Request, mappings []nfcmap.Mapping) (int, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil || id < 0 || id >= len(mappings) {
+		return 0, false
+	}
+	return id, true
+}
+
+func HandleAddNfcMapping(logger *service.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		updateNfcMappings(logger, w, r, true, func(mappings []nfcmap.Mapping, m nfcmap.Mapping) ([]nfcmap.Mapping, int, bool) {
+			return append(mappings, m), len(mappings), true
+		})
+	}
+}
+
+func HandleEditNfcMapping(logger *service.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		updateNfcMappings(logger, w, r, true, func(mappings []nfcmap.Mapping, m nfcmap.Mapping) ([]nfcmap.Mapping, int, bool) {
+			id, ok := mappingId(r, mappings)
+			if !ok {
+				return mappings, 0, false
+			}
+			// columns the client doesn't know about are kept unless the
+			// request replaces them
+			if m.Extra == nil {
+				m.Extra = mappings[id].Extra
+			}
+			mappings[id] = m
+			return mappings, id, true
+		})
+	}
+}
+
+func HandleDeleteNfcMapping(logger *service.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		updateNfcMappings(logger, w, r, false, func(mappings []nfcmap.Mapping, _ nfcmap.Mapping) ([]nfcmap.Mapping, int, bool) {
+			id, ok := mappingId(r, mappings)
+			if !ok {
+				return mappings, 0, false
+			}
+			return append(mappings[:id], mappings[id+1:]...), id, true
+		})
+	}
+}
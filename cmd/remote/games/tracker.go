@@ -7,6 +7,7 @@ import (
 	"os"
 	"path/filepath"
 
+	"github.com/wizzomafizzo/mrext/cmd/remote/screenshots"
 	"github.com/wizzomafizzo/mrext/cmd/remote/websocket"
 	"github.com/wizzomafizzo/mrext/pkg/config"
 	"github.com/wizzomafizzo/mrext/pkg/mister"
@@ -34,9 +35,11 @@ func (f *fakeDb) AddEvent(ev tracker.EventAction) error {
 	case tracker.EventActionGameStart:
 		websocket.Broadcast(f.logger, "gameRunning:"+ev.Target)
 		SendAnnounceGame(f.cfg, f.logger, &ev)
+		screenshots.RecordEvent(ev)
 	case tracker.EventActionGameStop:
 		websocket.Broadcast(f.logger, "gameRunning:")
 		SendAnnounceGame(f.cfg, f.logger, &ev)
+		screenshots.RecordEvent(ev)
 	case tracker.EventActionMenuNavigation:
 		websocket.Broadcast(f.logger, "menuNavigation:"+ev.Target)
 	}
@@ -107,17 +110,20 @@ type PlayingPayload struct {
 	GameName   string `json:"gameName"`
 }
 
+// CurrentPlaying returns the active core and game from the tracker.
+func CurrentPlaying(tr *tracker.Tracker) PlayingPayload {
+	return PlayingPayload{
+		Core:       tr.ActiveCore,
+		System:     tr.ActiveSystem,
+		SystemName: tr.ActiveSystemName,
+		Game:       tr.ActiveGame,
+		GameName:   tr.ActiveGameName,
+	}
+}
+
 func HandlePlaying(tr *tracker.Tracker) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		playing := PlayingPayload{
-			Core:       tr.ActiveCore,
-			System:     tr.ActiveSystem,
-			SystemName: tr.ActiveSystemName,
-			Game:       tr.ActiveGame,
-			GameName:   tr.ActiveGameName,
-		}
-
-		err := json.NewEncoder(w).Encode(playing)
+		err := json.NewEncoder(w).Encode(CurrentPlaying(tr))
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
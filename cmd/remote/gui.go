@@ -22,7 +22,17 @@ func tryAddStartup(stdscr *goncurses.Window) error {
 		logger.Error("failed to load startup file: %s", err)
 	}
 
-	if !startup.Exists("mrext/" + appName) {
+	migrated, err := startup.MigrateService(appName)
+	if err != nil {
+		logger.Error("failed to move startup entry to supervisor: %s", err)
+	} else if migrated {
+		err = startup.Save()
+		if err != nil {
+			logger.Error("failed to save startup: %s", err)
+		}
+	}
+
+	if !startup.HasSupervised(appName) {
 		win, err := curses.NewWindow(stdscr, 6, 43, "", -1)
 		if err != nil {
 			return err
@@ -71,7 +81,7 @@ func tryAddStartup(stdscr *goncurses.Window) error {
 		}
 
 		if selected == 0 {
-			err = startup.AddService("mrext/" + appName)
+			err = startup.AddSupervised(appName)
 			if err != nil {
 				return err
 			}
@@ -98,8 +108,8 @@ func tryNonInteractiveAddToStartup(print bool) {
 		return
 	}
 
-	if !startup.Exists("mrext/" + appName) {
-		err = startup.AddService("mrext/" + appName)
+	if startup.Exists("mrext/"+appName) || !startup.HasSupervised(appName) {
+		err = startup.AddSupervised(appName)
 		if err != nil {
 			logger.Error("failed to add to startup: %s", err)
 			if print {
@@ -283,10 +293,8 @@ func removeFromStartup() error {
 		return err
 	}
 
-	startupName := "mrext/" + appName
-
-	if startup.Exists(startupName) {
-		err := startup.Remove(startupName)
+	if startup.Exists("mrext/"+appName) || startup.HasSupervised(appName) {
+		err := startup.RemoveSupervised(appName)
 		if err != nil {
 			logger.Error("failed to remove startup: %s", err)
 			return err
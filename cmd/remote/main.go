@@ -14,9 +14,13 @@ import (
 	"time"
 
 	"github.com/wizzomafizzo/mrext/cmd/remote/control"
+	"github.com/wizzomafizzo/mrext/cmd/remote/files"
 	"github.com/wizzomafizzo/mrext/cmd/remote/games"
 	"github.com/wizzomafizzo/mrext/cmd/remote/menu"
 	"github.com/wizzomafizzo/mrext/cmd/remote/music"
+	"github.com/wizzomafizzo/mrext/cmd/remote/peers"
+	"github.com/wizzomafizzo/mrext/cmd/remote/playlists"
+	"github.com/wizzomafizzo/mrext/cmd/remote/saves"
 	"github.com/wizzomafizzo/mrext/cmd/remote/screenshots"
 	"github.com/wizzomafizzo/mrext/cmd/remote/scripts"
 	"github.com/wizzomafizzo/mrext/cmd/remote/settings"
@@ -25,6 +29,7 @@ import (
 	"github.com/wizzomafizzo/mrext/cmd/remote/websocket"
 	"github.com/wizzomafizzo/mrext/pkg/input"
 	"github.com/wizzomafizzo/mrext/pkg/mister"
+	"github.com/wizzomafizzo/mrext/pkg/playlist"
 	"github.com/wizzomafizzo/mrext/pkg/tracker"
 
 	gc "github.com/rthornton128/goncurses"
@@ -135,7 +140,18 @@ func startService(logger *service.Logger, cfg *config.UserConfig) (func() error,
 		return nil, err
 	}
 
-	runStartupTasks(logger, cfg, trk)
+	player := playlist.NewPlayer(
+		logger,
+		playlist.LaunchEntry(cfg),
+		time.Duration(cfg.Playlists.DefaultDuration)*time.Second,
+	)
+
+	stopPlaylistSocket, err := playlist.StartSocket(logger, player)
+	if err != nil {
+		logger.Error("failed to start playlist socket: %s", err)
+	}
+
+	runStartupTasks(logger, cfg, trk, player)
 
 	var stopMdns func() error
 	if cfg.Remote.MdnsService {
@@ -145,7 +161,7 @@ func startService(logger *service.Logger, cfg *config.UserConfig) (func() error,
 	}
 
 	router := mux.NewRouter()
-	setupApi(router.PathPrefix("/api").Subrouter(), kbd, trk, logger, cfg)
+	setupApi(router.PathPrefix("/api").Subrouter(), kbd, trk, player, logger, cfg)
 	router.PathPrefix("/").Handler(http.HandlerFunc(appHandler))
 
 	corsHandler := cors.New(cors.Options{
@@ -156,9 +172,10 @@ func startService(logger *service.Logger, cfg *config.UserConfig) (func() error,
 	srv := &http.Server{
 		Handler: corsHandler.Handler(router),
 		Addr:    ":" + fmt.Sprint(appPort),
-		// TODO: this will not work for large file uploads
-		WriteTimeout: 15 * time.Second,
-		ReadTimeout:  15 * time.Second,
+		// no read or write timeouts, file transfers can take a long time
+		// on a slow network
+		ReadHeaderTimeout: 15 * time.Second,
+		IdleTimeout:       60 * time.Second,
 	}
 
 	go func() {
@@ -183,6 +200,13 @@ func startService(logger *service.Logger, cfg *config.UserConfig) (func() error,
 			logger.Error("failed to stop tracker: %s", err)
 		}
 
+		if stopPlaylistSocket != nil {
+			err = stopPlaylistSocket()
+			if err != nil {
+				logger.Error("failed to stop playlist socket: %s", err)
+			}
+		}
+
 		err = srv.Close()
 		if err != nil {
 			logger.Error("failed to shutdown server: %s", err)
@@ -192,12 +216,13 @@ func startService(logger *service.Logger, cfg *config.UserConfig) (func() error,
 	}, nil
 }
 
-func setupApi(sub *mux.Router, kbd input.Keyboard, trk *tracker.Tracker, logger *service.Logger, cfg *config.UserConfig) {
+func setupApi(sub *mux.Router, kbd input.Keyboard, trk *tracker.Tracker, player *playlist.Player, logger *service.Logger, cfg *config.UserConfig) {
 	sub.HandleFunc("/ws", websocket.Handle(logger, wsConnectPayload(trk), wsMsgHandler(kbd)))
 
 	sub.HandleFunc("/screenshots", screenshots.AllScreenshots(logger)).Methods("GET")
 	sub.HandleFunc("/screenshots", screenshots.TakeScreenshot(logger)).Methods("POST")
 	sub.HandleFunc("/screenshots/{core}/{image}", screenshots.ViewScreenshot(logger)).Methods("GET")
+	sub.HandleFunc("/screenshots/{core}/{image}/thumbnail", screenshots.ViewThumbnail(logger)).Methods("GET")
 	sub.HandleFunc("/screenshots/{core}/{image}", screenshots.DeleteScreenshot(logger)).Methods("DELETE")
 
 	sub.HandleFunc("/systems", systems.ListSystems(logger)).Methods("GET")
@@ -216,6 +241,14 @@ func setupApi(sub *mux.Router, kbd input.Keyboard, trk *tracker.Tracker, logger
 	sub.HandleFunc("/music/playlist", music.AllPlaylists(logger)).Methods("GET")
 	sub.HandleFunc("/music/playlist/{playlist}", music.SetPlaylist(logger)).Methods("POST")
 
+	sub.HandleFunc("/playlists", playlists.HandleListPlaylists(logger)).Methods("GET")
+	sub.HandleFunc("/playlists/player", playlists.HandlePlayerStatus(logger, player)).Methods("GET")
+	sub.HandleFunc("/playlists/player/{action}", playlists.HandlePlayerControl(logger, player)).Methods("POST")
+	sub.HandleFunc("/playlists/{name}", playlists.HandleLoadPlaylist(logger)).Methods("GET")
+	sub.HandleFunc("/playlists/{name}", playlists.HandleSavePlaylist(logger)).Methods("PUT")
+	sub.HandleFunc("/playlists/{name}", playlists.HandleDeletePlaylist(logger)).Methods("DELETE")
+	sub.HandleFunc("/playlists/{name}/play", playlists.HandlePlayPlaylist(logger, player)).Methods("POST")
+
 	sub.HandleFunc("/games/search", games.Search(logger)).Methods("POST")
 	sub.HandleFunc("/games/search/systems", games.ListSystems(logger)).Methods("GET")
 	sub.HandleFunc("/games/launch", games.LaunchGame(logger, cfg)).Methods("POST")
@@ -237,6 +270,26 @@ func setupApi(sub *mux.Router, kbd input.Keyboard, trk *tracker.Tracker, logger
 	sub.HandleFunc("/menu/files/rename", menu.HandleRenameFile(logger)).Methods("POST")
 	sub.HandleFunc("/menu/files/delete", menu.HandleDeleteFile(logger)).Methods("POST")
 
+	sub.HandleFunc("/files", files.HandleList(logger)).Methods("GET")
+	sub.HandleFunc("/files/download", files.HandleDownload(logger)).Methods("GET")
+	sub.HandleFunc("/files/folder", files.HandleCreateFolder(logger)).Methods("POST")
+	sub.HandleFunc("/files/delete", files.HandleDelete(logger)).Methods("POST")
+	sub.HandleFunc("/files/copy", files.HandleCopy(logger)).Methods("POST")
+	sub.HandleFunc("/files/move", files.HandleMove(logger)).Methods("POST")
+	sub.HandleFunc("/files/uploads", files.HandleStartUpload(logger)).Methods("POST")
+	sub.HandleFunc("/files/uploads/{id}", files.HandleUploadStatus(logger)).Methods("GET")
+	sub.HandleFunc("/files/uploads/{id}", files.HandleUploadChunk(logger)).Methods("PUT")
+	sub.HandleFunc("/files/uploads/{id}", files.HandleCancelUpload(logger)).Methods("DELETE")
+
+	sub.HandleFunc("/saves", saves.HandleList(logger)).Methods("GET")
+	sub.HandleFunc("/saves/download", saves.HandleDownload(logger)).Methods("GET")
+	sub.HandleFunc("/saves/upload", saves.HandleUpload(logger)).Methods("PUT")
+	sub.HandleFunc("/saves/delete", saves.HandleDelete(logger)).Methods("POST")
+	sub.HandleFunc("/saves/backups", saves.HandleListBackups(logger)).Methods("GET")
+	sub.HandleFunc("/saves/backups/restore", saves.HandleRestoreBackup(logger)).Methods("POST")
+	sub.HandleFunc("/saves/snapshots", saves.HandleListSnapshots(logger)).Methods("GET")
+	sub.HandleFunc("/saves/snapshots/restore", saves.HandleRestoreSnapshot(logger)).Methods("POST")
+
 	sub.HandleFunc("/scripts/launch/{filename}", scripts.HandleLaunchScript(logger, kbd)).Methods("POST")
 	sub.HandleFunc("/scripts/list", scripts.HandleListScripts(logger)).Methods("GET")
 	sub.HandleFunc("/scripts/console", scripts.HandleOpenScriptsConsole(logger, kbd)).Methods("POST")
@@ -244,6 +297,7 @@ func setupApi(sub *mux.Router, kbd input.Keyboard, trk *tracker.Tracker, logger
 
 	sub.HandleFunc("/settings/inis", settings.HandleListInis(logger)).Methods("GET")
 	sub.HandleFunc("/settings/inis", settings.HandleSetActiveIni(logger)).Methods("PUT")
+	sub.HandleFunc("/settings/inis/schema", settings.HandleIniSchema(logger)).Methods("GET")
 	sub.HandleFunc("/settings/inis/1", settings.HandleLoadIni(logger, 1)).Methods("GET")
 	sub.HandleFunc("/settings/inis/1", settings.HandleSaveIni(logger, 1)).Methods("PUT")
 	sub.HandleFunc("/settings/inis/2", settings.HandleLoadIni(logger, 2)).Methods("GET")
@@ -252,6 +306,48 @@ func setupApi(sub *mux.Router, kbd input.Keyboard, trk *tracker.Tracker, logger
 	sub.HandleFunc("/settings/inis/3", settings.HandleSaveIni(logger, 3)).Methods("PUT")
 	sub.HandleFunc("/settings/inis/4", settings.HandleLoadIni(logger, 4)).Methods("GET")
 	sub.HandleFunc("/settings/inis/4", settings.HandleSaveIni(logger, 4)).Methods("PUT")
+	sub.HandleFunc("/settings/inis/{id:[1-4]}/defaults", settings.HandleIniDefaultsDiff(logger)).Methods("GET")
+	sub.HandleFunc("/settings/inis/{id:[1-4]}/sections", settings.HandleListIniSections(logger)).Methods("GET")
+	sub.HandleFunc("/settings/inis/{id:[1-4]}/sections/{section}", settings.HandleLoadIniSection(logger)).Methods("GET")
+	sub.HandleFunc("/settings/inis/{id:[1-4]}/sections/{section}", settings.HandleSaveIniSection(logger)).Methods("PUT")
+	sub.HandleFunc("/settings/inis/{id:[1-4]}/sections/{section}", settings.HandleDeleteIniSection(logger)).Methods("DELETE")
+
+	sub.HandleFunc("/settings/history", settings.HandleListHistoryFiles(logger)).Methods("GET")
+	sub.HandleFunc("/settings/history/{file}", settings.HandleListHistory(logger)).Methods("GET")
+	sub.HandleFunc("/settings/history/{file}/diff", settings.HandleDiffHistory(logger)).Methods("GET")
+	sub.HandleFunc("/settings/history/{file}/{version}", settings.HandleViewHistoryVersion(logger)).Methods("GET")
+	sub.HandleFunc("/settings/history/{file}/{version}/rollback", settings.HandleRollbackHistory(logger)).Methods("POST")
+
+	sub.HandleFunc("/settings/profiles/export", settings.HandleExportProfile(logger)).Methods("GET")
+	sub.HandleFunc("/settings/profiles/preview", settings.HandlePreviewProfile(logger)).Methods("POST")
+	sub.HandleFunc("/settings/profiles/import", settings.HandleImportProfile(logger)).Methods("POST")
+	sub.HandleFunc("/settings/profiles/push", settings.HandlePushProfile(logger)).Methods("POST")
+
+	sub.HandleFunc("/settings/network", settings.HandleNetworkStatus(logger)).Methods("GET")
+	sub.HandleFunc("/settings/network/wifi", settings.HandleListSavedWifi(logger)).Methods("GET")
+	sub.HandleFunc("/settings/network/wifi", settings.HandleAddWifi(logger)).Methods("POST")
+	sub.HandleFunc("/settings/network/wifi/scan", settings.HandleScanWifi(logger)).Methods("GET")
+	sub.HandleFunc("/settings/network/wifi/priority", settings.HandlePrioritizeWifi(logger)).Methods("PUT")
+	sub.HandleFunc("/settings/network/wifi/{ssid}", settings.HandleRemoveWifi(logger)).Methods("DELETE")
+	sub.HandleFunc("/settings/network/ip/{interface}", settings.HandleLoadIPConfig(logger)).Methods("GET")
+	sub.HandleFunc("/settings/network/ip/{interface}", settings.HandleSaveIPConfig(logger)).Methods("PUT")
+
+	sub.HandleFunc("/settings/uboot", settings.HandleListKernelArgs(logger)).Methods("GET")
+	sub.HandleFunc("/settings/uboot/args/{name}", settings.HandleSetKernelArg(logger)).Methods("PUT")
+	sub.HandleFunc("/settings/uboot/args/{name}", settings.HandleDeleteKernelArg(logger)).Methods("DELETE")
+
+	sub.HandleFunc("/settings/downloader/dbs", settings.HandleListDownloaderDbs(logger)).Methods("GET")
+	sub.HandleFunc("/settings/downloader/dbs/{id:.+}", settings.HandleSetDownloaderDb(logger)).Methods("PUT")
+	sub.HandleFunc("/settings/downloader/dbs/{id:.+}", settings.HandleDeleteDownloaderDb(logger)).Methods("DELETE")
+
+	sub.HandleFunc("/settings/updates", settings.HandleListUpdates(logger)).Methods("GET")
+	sub.HandleFunc("/settings/updates", settings.HandleStartUpdate(logger)).Methods("POST")
+	sub.HandleFunc("/settings/updates/current", settings.HandleCancelUpdate(logger)).Methods("DELETE")
+	sub.HandleFunc("/settings/updates/{id}", settings.HandleViewUpdate(logger)).Methods("GET")
+	sub.HandleFunc("/settings/updates/{id}/log", settings.HandleUpdateLog(logger)).Methods("GET")
+
+	sub.HandleFunc("/settings/services", settings.HandleListServices(logger)).Methods("GET")
+	sub.HandleFunc("/settings/services/{name}/crash", settings.HandleServiceCrashLog(logger)).Methods("GET")
 
 	sub.HandleFunc("/settings/cores/menu", settings.HandleSetMenuBackgroundMode(logger)).Methods("PUT")
 	sub.HandleFunc("/settings/remote/restart", settings.HandleRestartRemote(logger, cfg)).Methods("POST")
@@ -261,9 +357,28 @@ func setupApi(sub *mux.Router, kbd input.Keyboard, trk *tracker.Tracker, logger
 	sub.HandleFunc("/settings/system/reboot", settings.HandleReboot(logger)).Methods("POST")
 	sub.HandleFunc("/settings/system/generate-mac", settings.HandleGenerateMac(logger)).Methods("GET")
 
+	trust, err := peers.ParseTrust(cfg.Remote.TrustPeer)
+	if err != nil {
+		logger.Error("parse trusted peers: %s", err)
+	}
+	pl := peers.New(trust, func() games.PlayingPayload { return games.CurrentPlaying(trk) })
+	sub.HandleFunc("/peers", peers.HandleListPeers(logger, pl)).Methods("GET")
+	sub.HandleFunc("/peers/playing", peers.HandlePlaying(logger, pl)).Methods("GET")
+	sub.HandleFunc("/peers/sync", peers.HandleReceiveSync(logger, pl)).Methods("POST")
+	sub.HandleFunc("/peers/{peer}/sync", peers.HandleSync(logger, pl)).Methods("POST")
+	sub.HandleFunc("/peers/{peer}/api/{path:.*}", peers.HandleProxy(logger, pl))
+
 	sub.HandleFunc("/nfc/status", games.NfcStatus(logger)).Methods("GET")
 	sub.HandleFunc("/nfc/write", games.NfcWrite(logger)).Methods("POST")
 	sub.HandleFunc("/nfc/cancel", games.NfcCancel(logger)).Methods("POST")
+	sub.HandleFunc("/nfc/read", games.NfcReadNext(logger)).Methods("POST")
+	sub.HandleFunc("/nfc/last-scan", games.NfcLastScan(logger)).Methods("GET")
+	sub.HandleFunc("/nfc/history", games.HandleNfcHistory(logger)).Methods("GET")
+	sub.HandleFunc("/nfc/history/export", games.HandleExportNfcHistory(logger)).Methods("GET")
+	sub.HandleFunc("/nfc/mappings", games.HandleListNfcMappings(logger)).Methods("GET")
+	sub.HandleFunc("/nfc/mappings", games.HandleAddNfcMapping(logger)).Methods("POST")
+	sub.HandleFunc("/nfc/mappings/{id}", games.HandleEditNfcMapping(logger)).Methods("PUT")
+	sub.HandleFunc("/nfc/mappings/{id}", games.HandleDeleteNfcMapping(logger)).Methods("DELETE")
 
 	sub.HandleFunc("/sysinfo", settings.HandleSystemInfo(logger, cfg, appVersion)).Methods("GET")
 }
@@ -288,10 +403,17 @@ func appHandler(rw http.ResponseWriter, req *http.Request) {
 }
 
 func main() {
-	svcOpt := flag.String("service", "", "manage playlog service (start, stop, restart, status)")
+	svcOpt := flag.String("service", "", "manage playlog service (start, stop, restart, status, supervise)")
 	uninstallOpt := flag.Bool("uninstall", false, "uninstall MiSTer Remote")
+	exportProfileOpt := flag.String("export-profile", "", "export settings profile to zip file")
+	importProfileOpt := flag.String("import-profile", "", "import settings profile from zip file")
+	pushProfileOpt := flag.String("push-profile", "", "export settings profile and import it on another MiSTer running Remote")
+	partsOpt := flag.String("parts", "", "profile parts to export or import, comma separated (inis, apps, nfc, uboot, wallpaper, favorites, playlists)")
+	previewOpt := flag.Bool("preview", false, "show changes an imported profile would make without importing it")
 	flag.Parse()
 
+	service.HandleSupervise(logger, svcOpt)
+
 	cfg, err := config.LoadUserConfig(appName, &config.UserConfig{
 		Remote: config.RemoteConfig{
 			MdnsService: true,
@@ -305,6 +427,10 @@ func main() {
 		os.Exit(1)
 	}
 
+	if cfg.Remote.HistoryKeep > 0 {
+		mister.DefaultHistory.Keep = cfg.Remote.HistoryKeep
+	}
+
 	err = os.MkdirAll(config.MrextConfigFolder, 0755)
 	if err != nil {
 		logger.Error("error creating config folder: %s", err)
@@ -312,6 +438,15 @@ func main() {
 		os.Exit(1)
 	}
 
+	ran, err := profileCommand(*exportProfileOpt, *importProfileOpt, *pushProfileOpt, *partsOpt, *previewOpt)
+	if err != nil {
+		logger.Error("profile: %s", err)
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	} else if ran {
+		os.Exit(0)
+	}
+
 	svc, err := service.NewService(service.ServiceArgs{
 		Name:   appName,
 		Logger: logger,
@@ -0,0 +1,520 @@
+package peers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/wizzomafizzo/mrext/cmd/remote/games"
+	"github.com/wizzomafizzo/mrext/pkg/mister"
+	"github.com/wizzomafizzo/mrext/pkg/profiles"
+	"github.com/wizzomafizzo/mrext/pkg/service"
+	"github.com/wizzomafizzo/mrext/pkg/utils"
+)
+
+// Peers are other MiSTers running Remote which were found on the network
+// with mDNS. A peer must be trusted in remote.ini by its IP before it can
+// be controlled, shown in now playing or synced with:
+//
+//	[remote]
+//	trust_peer = 192.168.1.10
+//	trust_peer = 192.168.1.20:playing,sync
+//
+// Hostnames aren't trusted, any device on the network can advertise
+// itself with a peer's hostname.
+
+const (
+	// PermControl allows API calls to be proxied to a peer.
+	PermControl = "control"
+	// PermPlaying includes a peer in the aggregated now playing list.
+	PermPlaying = "playing"
+	// PermSync allows state to be synced to and from a peer.
+	PermSync = "sync"
+	// ProxyHeader is set to the sender's hostname on requests made to a
+	// peer. Requests with it set can't be proxied again, so two peers can't
+	// loop forever.
+	ProxyHeader = "X-Mrext-Peer"
+	peerTimeout = 5 * time.Second
+)
+
+var AllPerms = []string{PermControl, PermPlaying, PermSync}
+
+// SyncParts are the profile parts which can be synced between peers.
+var SyncParts = []string{profiles.PartFavorites, profiles.PartNfc, profiles.PartPlaylists}
+
+// Trust maps a peer IP to the permissions it has.
+type Trust map[string][]string
+
+// ParseTrust reads trust_peer entries in the form host[:perm,perm]. A host
+// with no permissions listed is given all of them. Invalid entries are
+// skipped and the first error is returned with the valid ones.
+func ParseTrust(entries []string) (Trust, error) {
+	trust := make(Trust)
+	var firstErr error
+
+	for _, entry := range entries {
+		host, list, _ := strings.Cut(strings.TrimSpace(entry), ":")
+		host = strings.TrimSpace(host)
+		if host == "" {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("trust_peer has no host: %q", entry)
+			}
+			continue
+		}
+
+		ip := net.ParseIP(host)
+		if ip == nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("trust_peer must be an IP address: %q", entry)
+			}
+			continue
+		}
+
+		perms := make([]string, 0, len(AllPerms))
+		valid := true
+		for _, perm := range strings.Split(list, ",") {
+			perm = strings.ToLower(strings.TrimSpace(perm))
+			if perm == "" {
+				continue
+			} else if !utils.Contains(AllPerms, perm) {
+				if firstErr == nil {
+					firstErr = fmt.Errorf("trust_peer has unknown permission: %q", perm)
+				}
+				valid = false
+				break
+			} else if !utils.Contains(perms, perm) {
+				perms = append(perms, perm)
+			}
+		}
+		if !valid {
+			continue
+		} else if len(perms) == 0 {
+			perms = append(perms, AllPerms...)
+		}
+
+		trust[ip.String()] = perms
+	}
+
+	return trust, firstErr
+}
+
+// Perms returns the permissions a peer has, matched by its IP.
+func (t Trust) Perms(peer mister.MdnsClient) []string {
+	if ip := net.ParseIP(peer.IP); ip != nil {
+		if perms, ok := t[ip.String()]; ok {
+			return perms
+		}
+	}
+	return []string{}
+}
+
+// Allowed returns true if a peer has the given permission.
+func (t Trust) Allowed(peer mister.MdnsClient, perm string) bool {
+	return utils.Contains(t.Perms(peer), perm)
+}
+
+type Peers struct {
+	Trust Trust
+	// Hostname is this MiSTer's hostname, sent to peers.
+	Hostname string
+	// Discover returns the peers currently found on the network.
+	Discover func() []mister.MdnsClient
+	// Address returns the host and port of a peer's Remote server.
+	Address func(peer mister.MdnsClient) string
+	// Playing returns what's running on this MiSTer.
+	Playing func() games.PlayingPayload
+	// Profiles is where synced state is read from and written to.
+	Profiles profiles.Layout
+	Client   *http.Client
+}
+
+func New(trust Trust, playing func() games.PlayingPayload) *Peers {
+	hostname, _ := os.Hostname()
+	return &Peers{
+		Trust:    trust,
+		Hostname: hostname,
+		Discover: mister.Mdns.GetClients,
+		Address: func(peer mister.MdnsClient) string {
+			return net.JoinHostPort(peer.IP, strconv.Itoa(profiles.PeerPort))
+		},
+		Playing:  playing,
+		Profiles: profiles.Default,
+		Client:   &http.Client{Timeout: peerTimeout},
+	}
+}
+
+// Find returns a discovered peer by its hostname or IP.
+func (p *Peers) Find(name string) (mister.MdnsClient, bool) {
+	for _, peer := range p.Discover() {
+		if peer.IP != "" && (strings.EqualFold(peer.Hostname, name) || peer.IP == name) {
+			return peer, true
+		}
+	}
+	return mister.MdnsClient{}, false
+}
+
+// sender returns the peer which made a request. Senders which haven't been
+// discovered are returned with only their IP set, so they can still be
+// trusted by IP.
+func (p *Peers) sender(r *http.Request) mister.MdnsClient {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	for _, peer := range p.Discover() {
+		if peer.IP == ip {
+			return peer
+		}
+	}
+
+	return mister.MdnsClient{IP: ip}
+}
+
+func (p *Peers) url(peer mister.MdnsClient, path string, query url.Values) string {
+	u := url.URL{
+		Scheme:   "http",
+		Host:     p.Address(peer),
+		Path:     path,
+		RawQuery: query.Encode(),
+	}
+	return u.String()
+}
+
+// findTrusted looks up the peer in the request path and checks it has the
+// given permission, writing an error response if not.
+func (p *Peers) findTrusted(w http.ResponseWriter, r *http.Request, logger *service.Logger, perm string, area string) (mister.MdnsClient, bool) {
+	name := mux.Vars(r)["peer"]
+
+	peer, ok := p.Find(name)
+	if !ok {
+		http.Error(w, "peer not found", http.StatusNotFound)
+		logger.Error("%s: peer not found: %s", area, name)
+		return peer, false
+	}
+
+	if !p.Trust.Allowed(peer, perm) {
+		http.Error(w, "peer is not trusted for "+perm, http.StatusForbidden)
+		logger.Error("%s: peer is not trusted for %s: %s", area, perm, name)
+		return peer, false
+	}
+
+	return peer, true
+}
+
+type Peer struct {
+	Hostname string   `json:"hostname"`
+	Version  string   `json:"version"`
+	IP       string   `json:"ip"`
+	Trust    []string `json:"trust"`
+}
+
+type ListPeersPayload struct {
+	Peers []Peer `json:"peers"`
+}
+
+func HandleListPeers(logger *service.Logger, p *Peers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		discovered := p.Discover()
+
+		payload := ListPeersPayload{
+			Peers: make([]Peer, len(discovered)),
+		}
+
+		for i, peer := range discovered {
+			payload.Peers[i] = Peer{
+				Hostname: peer.Hostname,
+				Version:  peer.Version,
+				IP:       peer.IP,
+				Trust:    p.Trust.Perms(peer),
+			}
+		}
+
+		err := json.NewEncoder(w).Encode(payload)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logger.Error("encode list peers response: %s", err)
+			return
+		}
+	}
+}
+
+// HandleProxy forwards a request to the same API path on a peer, e.g.
+// /api/peers/MiSTer-lounge.local/api/games/launch is sent to
+// /api/games/launch on MiSTer-lounge.local.
+func HandleProxy(logger *service.Logger, p *Peers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(ProxyHeader) != "" {
+			http.Error(w, "proxied requests can't be proxied again", http.StatusForbidden)
+			logger.Error("proxy peer: request from %s was already proxied", r.Header.Get(ProxyHeader))
+			return
+		}
+
+		peer, ok := p.findTrusted(w, r, logger, PermControl, "proxy peer")
+		if !ok {
+			return
+		}
+
+		path := "/api/" + mux.Vars(r)["path"]
+		logger.Info("proxy peer: %s %s to %s (%s)", r.Method, path, peer.Hostname, peer.IP)
+
+		proxy := &httputil.ReverseProxy{
+			Director: func(req *http.Request) {
+				req.URL.Scheme = "http"
+				req.URL.Host = p.Address(peer)
+				req.URL.Path = path
+				req.URL.RawPath = ""
+				req.Host = req.URL.Host
+				req.Header.Set(ProxyHeader, p.Hostname)
+			},
+			ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				logger.Error("proxy peer: %s", err)
+			},
+		}
+
+		proxy.ServeHTTP(w, r)
+	}
+}
+
+type PeerPlaying struct {
+	Hostname string `json:"hostname"`
+	IP       string `json:"ip"`
+	// Self is true for the MiSTer which handled the request.
+	Self bool `json:"self"`
+	// Error is set if the peer couldn't be reached.
+	Error string `json:"error,omitempty"`
+	games.PlayingPayload
+}
+
+type PlayingPayload struct {
+	Playing []PeerPlaying `json:"playing"`
+}
+
+func (p *Peers) fetchPlaying(peer mister.MdnsClient) (games.PlayingPayload, error) {
+	var playing games.PlayingPayload
+
+	req, err := http.NewRequest(http.MethodGet, p.url(peer, "/api/games/playing", nil), nil)
+	if err != nil {
+		return playing, err
+	}
+	req.Header.Set(ProxyHeader, p.Hostname)
+
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return playing, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return playing, fmt.Errorf("peer returned %s", resp.Status)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&playing)
+	return playing, err
+}
+
+// HandlePlaying returns what's running on this MiSTer and every peer
+// trusted for now playing. Peers are queried at the same time and any which
+// can't be reached are included with an error.
+func HandlePlaying(logger *service.Logger, p *Peers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		payload := PlayingPayload{
+			Playing: []PeerPlaying{{
+				Hostname:       p.Hostname,
+				Self:           true,
+				PlayingPayload: p.Playing(),
+			}},
+		}
+
+		var trusted []mister.MdnsClient
+		for _, peer := range p.Discover() {
+			if peer.IP != "" && p.Trust.Allowed(peer, PermPlaying) {
+				trusted = append(trusted, peer)
+			}
+		}
+
+		results := make([]PeerPlaying, len(trusted))
+		var wg sync.WaitGroup
+		for i, peer := range trusted {
+			wg.Add(1)
+			go func(i int, peer mister.MdnsClient) {
+				defer wg.Done()
+
+				result := PeerPlaying{
+					Hostname: peer.Hostname,
+					IP:       peer.IP,
+				}
+
+				playing, err := p.fetchPlaying(peer)
+				if err != nil {
+					logger.Error("peers playing: %s: %s", peer.Hostname, err)
+					result.Error = err.Error()
+				} else {
+					result.PlayingPayload = playing
+				}
+
+				results[i] = result
+			}(i, peer)
+		}
+		wg.Wait()
+
+		payload.Playing = append(payload.Playing, results...)
+
+		err := json.NewEncoder(w).Encode(payload)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logger.Error("encode peers playing: %s", err)
+			return
+		}
+	}
+}
+
+// syncParts checks the requested parts can be synced, defaulting to all of
+// them if none are given.
+func syncParts(parts []string) ([]string, error) {
+	for _, part := range parts {
+		if !utils.Contains(SyncParts, part) {
+			return nil, fmt.Errorf("part can't be synced: %s", part)
+		}
+	}
+
+	if len(parts) == 0 {
+		return SyncParts, nil
+	}
+
+	return parts, nil
+}
+
+type SyncRequest struct {
+	Parts []string `json:"parts"`
+}
+
+// HandleSync sends this MiSTer's favorites, NFC mappings and playlists to a
+// peer. Files are added or replaced on the peer, never deleted.
+func HandleSync(logger *service.Logger, p *Peers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var args SyncRequest
+		err := json.NewDecoder(r.Body).Decode(&args)
+		if err != nil && !errors.Is(err, io.EOF) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			logger.Error("decode sync peer request: %s", err)
+			return
+		}
+
+		parts, err := syncParts(args.Parts)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			logger.Error("sync peer: %s", err)
+			return
+		}
+
+		peer, ok := p.findTrusted(w, r, logger, PermSync, "sync peer")
+		if !ok {
+			return
+		}
+
+		profile, err := p.Profiles.Export(parts)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logger.Error("sync peer: %s", err)
+			return
+		}
+
+		logger.Info("sync peer: to %s (%s), parts %v", peer.Hostname, peer.IP, parts)
+
+		result, err := profiles.Send(
+			profile,
+			p.url(peer, "/api/peers/sync", url.Values{"parts": {strings.Join(parts, ",")}}),
+			http.Header{ProxyHeader: {p.Hostname}},
+		)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			logger.Error("sync peer: %s", err)
+			return
+		}
+
+		err = json.NewEncoder(w).Encode(result)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logger.Error("encode sync peer: %s", err)
+			return
+		}
+	}
+}
+
+// HandleReceiveSync imports state synced from a peer. The sender must be
+// trusted for sync and only sync parts are imported.
+func HandleReceiveSync(logger *service.Logger, p *Peers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sender := p.sender(r)
+		if !p.Trust.Allowed(sender, PermSync) {
+			http.Error(w, "sender is not trusted for sync", http.StatusForbidden)
+			logger.Error("receive sync: sender is not trusted for sync: %s", sender.IP)
+			return
+		}
+
+		parts, err := profiles.ParseParts(r.URL.Query().Get("parts"))
+		if err == nil {
+			parts, err = syncParts(parts)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			logger.Error("receive sync: %s", err)
+			return
+		}
+
+		data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, profiles.MaxSize))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			logger.Error("receive sync: reading profile: %s", err)
+			return
+		}
+
+		profile, err := profiles.Read(bytes.NewReader(data), int64(len(data)))
+		if errors.Is(err, profiles.ErrInvalidProfile) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			logger.Error("receive sync: %s", err)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logger.Error("receive sync: %s", err)
+			return
+		}
+
+		name := sender.Hostname
+		if name == "" {
+			name = sender.IP
+		}
+		logger.Info("receive sync: from %s, parts %v", name, parts)
+
+		changes, err := p.Profiles.Import(profile, parts, fmt.Sprintf("peer (%s)", name))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logger.Error("receive sync: %s", err)
+			return
+		}
+
+		err = json.NewEncoder(w).Encode(profiles.ImportResult{
+			Manifest: profile.Manifest,
+			Changes:  changes,
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logger.Error("encode receive sync: %s", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package peers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/wizzomafizzo/mrext/cmd/remote/games"
+	"github.com/wizzomafizzo/mrext/pkg/mister"
+	"github.com/wizzomafizzo/mrext/pkg/profiles"
+	"github.com/wizzomafizzo/mrext/pkg/service"
+)
+
+type testRemote struct {
+	peers  *Peers
+	server *httptest.Server
+	// discovered is the list of peers returned by Discover.
+	discovered []mister.MdnsClient
+}
+
+// newTestRemote starts a Remote server with the peer routes. Peers are
+// matched to servers by hostname, since every server is on 127.0.0.1 and
+// requests between them are always sent from 127.0.0.1.
+func newTestRemote(t *testing.T, hostname string, trust []string, servers map[string]*testRemote) *testRemote {
+	t.Helper()
+
+	parsed, err := ParseTrust(trust)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root := t.TempDir()
+	tr := &testRemote{}
+	tr.peers = &Peers{
+		Trust:    parsed,
+		Hostname: hostname,
+		Discover: func() []mister.MdnsClient { return tr.discovered },
+		Address: func(peer mister.MdnsClient) string {
+			u, _ := url.Parse(servers[peer.Hostname].server.URL)
+			return u.Host
+		},
+		Playing: func() games.PlayingPayload {
+			return games.PlayingPayload{Core: "core-" + hostname}
+		},
+		Profiles: profiles.Layout{
+			Sd:          root,
+			NfcDatabase: filepath.Join(root, "nfc.csv"),
+			Favorites:   filepath.Join(root, "_@Favorites"),
+			Playlists:   filepath.Join(root, "playlists"),
+			History:     &mister.History{Folder: filepath.Join(root, "history")},
+		},
+		Client: http.DefaultClient,
+	}
+
+	logger := service.NewLogger("peers-test")
+	router := mux.NewRouter()
+	sub := router.PathPrefix("/api").Subrouter()
+	sub.HandleFunc("/games/playing", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(tr.peers.Playing())
+	}).Methods("GET")
+	sub.HandleFunc("/echo", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(hostname + " " + r.URL.RawQuery + " " + r.Header.Get(ProxyHeader)))
+	})
+	sub.HandleFunc("/peers", HandleListPeers(logger, tr.peers)).Methods("GET")
+	sub.HandleFunc("/peers/playing", HandlePlaying(logger, tr.peers)).Methods("GET")
+	sub.HandleFunc("/peers/sync", HandleReceiveSync(logger, tr.peers)).Methods("POST")
+	sub.HandleFunc("/peers/{peer}/sync", HandleSync(logger, tr.peers)).Methods("POST")
+	sub.HandleFunc("/peers/{peer}/api/{path:.*}", HandleProxy(logger, tr.peers))
+
+	tr.server = httptest.NewServer(router)
+	t.Cleanup(tr.server.Close)
+	servers[hostname] = tr
+
+	return tr
+}
+
+func get(t *testing.T, url string) (int, string) {
+	t.Helper()
+
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var buf bytes.Buffer
+	_, _ = buf.ReadFrom(resp.Body)
+	return resp.StatusCode, buf.String()
+}
+
+func TestParseTrust(t *testing.T) {
+	trust, err := ParseTrust([]string{
+		"192.168.1.10",
+		"192.168.1.20:playing, sync",
+		"192.168.1.30:bogus",
+	})
+	if err == nil {
+		t.Error("got no error for unknown permission")
+	}
+
+	_, err = ParseTrust([]string{"MiSTer-Lounge.local"})
+	if err == nil {
+		t.Error("got no error for hostname")
+	}
+
+	tests := []struct {
+		peer mister.MdnsClient
+		want []string
+	}{
+		{mister.MdnsClient{Hostname: "lounge", IP: "192.168.1.10"}, AllPerms},
+		{mister.MdnsClient{Hostname: "other", IP: "192.168.1.20"}, []string{PermPlaying, PermSync}},
+		{mister.MdnsClient{Hostname: "office", IP: "192.168.1.30"}, []string{}},
+		// a spoofed hostname isn't trusted
+		{mister.MdnsClient{Hostname: "192.168.1.10", IP: "192.168.1.21"}, []string{}},
+		{mister.MdnsClient{Hostname: "lounge"}, []string{}},
+	}
+
+	for _, tt := range tests {
+		if got := trust.Perms(tt.peer); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%+v: got %v want %v", tt.peer, got, tt.want)
+		}
+	}
+}
+
+func TestPeers(t *testing.T) {
+	servers := make(map[string]*testRemote)
+	office := newTestRemote(t, "office", []string{"127.0.0.2", "127.0.0.3:sync"}, servers)
+	lounge := newTestRemote(t, "lounge", []string{"127.0.0.1"}, servers)
+	bedroom := newTestRemote(t, "bedroom", nil, servers)
+
+	office.discovered = []mister.MdnsClient{
+		{Hostname: "lounge", IP: "127.0.0.2"},
+		{Hostname: "bedroom", IP: "127.0.0.3"},
+	}
+	lounge.discovered = []mister.MdnsClient{{Hostname: "office", IP: "127.0.0.1"}}
+	bedroom.discovered = []mister.MdnsClient{{Hostname: "office", IP: "127.0.0.1"}}
+
+	t.Run("proxy", func(t *testing.T) {
+		code, body := get(t, office.server.URL+"/api/peers/lounge/api/echo?a=1")
+		if code != http.StatusOK || body != "lounge a=1 office" {
+			t.Errorf("got %d %q", code, body)
+		}
+
+		code, _ = get(t, office.server.URL+"/api/peers/bedroom/api/echo")
+		if code != http.StatusForbidden {
+			t.Errorf("got %d for untrusted peer", code)
+		}
+
+		code, _ = get(t, office.server.URL+"/api/peers/attic/api/echo")
+		if code != http.StatusNotFound {
+			t.Errorf("got %d for unknown peer", code)
+		}
+
+		code, _ = get(t, office.server.URL+"/api/peers/lounge/api/peers/office/api/echo")
+		if code != http.StatusForbidden {
+			t.Errorf("got %d for proxy loop", code)
+		}
+	})
+
+	t.Run("playing", func(t *testing.T) {
+		code, body := get(t, office.server.URL+"/api/peers/playing")
+		if code != http.StatusOK {
+			t.Fatalf("got %d %q", code, body)
+		}
+
+		var payload PlayingPayload
+		err := json.Unmarshal([]byte(body), &payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got []string
+		for _, playing := range payload.Playing {
+			got = append(got, playing.Hostname+"="+playing.Core)
+		}
+		want := []string{"office=core-office", "lounge=core-lounge"}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v want %v", got, want)
+		}
+		if !payload.Playing[0].Self || payload.Playing[1].Self {
+			t.Error("wrong peer marked as self")
+		}
+	})
+
+	t.Run("sync", func(t *testing.T) {
+		src := office.peers.Profiles
+		for path, data := range map[string]string{
+			filepath.Join(src.Favorites, "Sonic.mgl"): "<mistergamedescription/>",
+			filepath.Join(src.Playlists, "party.csv"): "path\n",
+			src.NfcDatabase:                            "match_uid,text\n",
+			filepath.Join(src.Sd, "MiSTer.ini"):        "[MiSTer]\n",
+			filepath.Join(src.Favorites, "notes.txt"):  "",
+			filepath.Join(src.Playlists, "unused.txt"): "",
+		} {
+			_ = os.MkdirAll(filepath.Dir(path), 0755)
+			err := os.WriteFile(path, []byte(data), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		post := func(peer string, body string) int {
+			resp, err := http.Post(office.server.URL+"/api/peers/"+peer+"/sync", "application/json", bytes.NewBufferString(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = resp.Body.Close()
+			return resp.StatusCode
+		}
+
+		if code := post("lounge", `{"parts":["inis"]}`); code != http.StatusBadRequest {
+			t.Errorf("got %d for non-sync part", code)
+		}
+
+		if code := post("lounge", `{"parts":["favorites","playlists"]}`); code != http.StatusOK {
+			t.Fatalf("got %d syncing to lounge", code)
+		}
+		dst := lounge.peers.Profiles
+		if data, err := os.ReadFile(filepath.Join(dst.Favorites, "Sonic.mgl")); err != nil || string(data) != "<mistergamedescription/>" {
+			t.Errorf("favorite wasn't synced: %q %v", data, err)
+		}
+		if _, err := os.Stat(filepath.Join(dst.Playlists, "party.csv")); err != nil {
+			t.Errorf("playlist wasn't synced: %v", err)
+		}
+		if _, err := os.Stat(dst.NfcDatabase); err == nil {
+			t.Error("unselected nfc database was synced")
+		}
+		if _, err := os.Stat(filepath.Join(dst.Sd, "MiSTer.ini")); err == nil {
+			t.Error("ini was synced")
+		}
+
+		// bedroom doesn't trust office to sync
+		if code := post("bedroom", `{}`); code != http.StatusBadGateway {
+			t.Errorf("got %d syncing to untrusting peer", code)
+		}
+		if _, err := os.Stat(bedroom.peers.Profiles.NfcDatabase); err == nil {
+			t.Error("nfc database was synced to untrusting peer")
+		}
+	})
+}
@@ -0,0 +1,186 @@
+package playlists
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+
+	"github.com/gorilla/mux"
+	"github.com/wizzomafizzo/mrext/pkg/playlist"
+	"github.com/wizzomafizzo/mrext/pkg/service"
+)
+
+// httpError writes err with a status matching the playlist error, or 500 for
+// anything unexpected.
+func httpError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		status = http.StatusNotFound
+	case errors.Is(err, playlist.ErrNotPlaying),
+		errors.Is(err, playlist.ErrNothingToResume),
+		errors.Is(err, playlist.ErrEmptyPlaylist):
+		status = http.StatusConflict
+	case errors.Is(err, playlist.ErrInvalidName), errors.Is(err, playlist.ErrUnknownMode):
+		status = http.StatusBadRequest
+	}
+	http.Error(w, err.Error(), status)
+}
+
+type PlaylistSummary struct {
+	Name    string `json:"name"`
+	Entries int    `json:"entries"`
+}
+
+func HandleListPlaylists(logger *service.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		names, err := playlist.ListPlaylists()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logger.Error("list playlists: %s", err)
+			return
+		}
+
+		summaries := make([]PlaylistSummary, 0)
+		for _, name := range names {
+			pl, err := playlist.LoadPlaylist(name)
+			if err != nil {
+				logger.Warn("list playlists: skipping %s: %s", name, err)
+				continue
+			}
+
+			summaries = append(summaries, PlaylistSummary{
+				Name:    pl.Name,
+				Entries: len(pl.Entries),
+			})
+		}
+
+		err = json.NewEncoder(w).Encode(summaries)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logger.Error("list playlists: encoding response: %s", err)
+			return
+		}
+	}
+}
+
+func HandleLoadPlaylist(logger *service.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["name"]
+
+		pl, err := playlist.LoadPlaylist(name)
+		if err != nil {
+			httpError(w, err)
+			logger.Error("load playlist: %s", err)
+			return
+		}
+
+		err = json.NewEncoder(w).Encode(pl)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logger.Error("load playlist: encoding response: %s", err)
+			return
+		}
+	}
+}
+
+func HandleSavePlaylist(logger *service.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var args struct {
+			Entries []playlist.Entry `json:"entries"`
+		}
+
+		err := json.NewDecoder(r.Body).Decode(&args)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			logger.Error("save playlist: decoding request: %s", err)
+			return
+		}
+
+		pl := playlist.Playlist{
+			Name:    playlist.CleanName(mux.Vars(r)["name"]),
+			Entries: args.Entries,
+		}
+
+		err = pl.Save()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			logger.Error("save playlist: %s", err)
+			return
+		}
+	}
+}
+
+func HandleDeletePlaylist(logger *service.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := playlist.DeletePlaylist(mux.Vars(r)["name"])
+		if err != nil {
+			httpError(w, err)
+			logger.Error("delete playlist: %s", err)
+			return
+		}
+	}
+}
+
+func HandlePlayPlaylist(logger *service.Logger, player *playlist.Player) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var args playlist.Options
+
+		if r.ContentLength != 0 {
+			err := json.NewDecoder(r.Body).Decode(&args)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				logger.Error("play playlist: decoding request: %s", err)
+				return
+			}
+		}
+
+		err := player.Play(mux.Vars(r)["name"], args)
+		if err != nil {
+			httpError(w, err)
+			logger.Error("play playlist: %s", err)
+			return
+		}
+	}
+}
+
+func HandlePlayerStatus(logger *service.Logger, player *playlist.Player) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := json.NewEncoder(w).Encode(player.Status())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logger.Error("playlist status: encoding response: %s", err)
+			return
+		}
+	}
+}
+
+// HandlePlayerControl runs one of the playback controls: next, previous,
+// stop or resume.
+func HandlePlayerControl(logger *service.Logger, player *playlist.Player) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		action := mux.Vars(r)["action"]
+
+		var err error
+		switch action {
+		case "next":
+			err = player.Next()
+		case "previous":
+			err = player.Previous()
+		case "stop":
+			err = player.Stop()
+		case "resume":
+			err = player.Resume(false)
+		default:
+			http.NotFound(w, r)
+			return
+		}
+
+		if err != nil {
+			httpError(w, err)
+			logger.Error("playlist %s: %s", action, err)
+			return
+		}
+	}
+}
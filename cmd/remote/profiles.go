@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/wizzomafizzo/mrext/pkg/profiles"
+)
+
+func printChanges(changes []profiles.FileChange, diffs bool) {
+	for _, change := range changes {
+		fmt.Printf("%-9s  %s/%s\n", change.Status, change.Part, change.Name)
+		if diffs && change.Diff != "" {
+			fmt.Println(change.Diff)
+		}
+	}
+}
+
+func exportProfile(path string, parts []string) error {
+	if len(parts) == 0 {
+		parts = profiles.AllParts
+	}
+
+	profile, err := profiles.Default.Export(parts)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	err = profile.Write(&buf)
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(path, buf.Bytes(), 0644)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Exported %d files to %s.\n", len(profile.Manifest.Files), path)
+	return nil
+}
+
+func importProfile(path string, parts []string, preview bool) error {
+	profile, err := profiles.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Profile from %s, created %s.\n", profile.Manifest.Hostname, profile.Manifest.Created.Format("2006-01-02 15:04:05"))
+
+	if preview {
+		changes, err := profiles.Default.Preview(profile, parts)
+		if err != nil {
+			return err
+		}
+		printChanges(changes, true)
+		return nil
+	}
+
+	changes, err := profiles.Default.Import(profile, parts, appName)
+	if err != nil {
+		return err
+	}
+	printChanges(changes, false)
+
+	return nil
+}
+
+func pushProfile(host string, parts []string) error {
+	exportParts := parts
+	if len(exportParts) == 0 {
+		exportParts = profiles.AllParts
+	}
+
+	profile, err := profiles.Default.Export(exportParts)
+	if err != nil {
+		return err
+	}
+
+	result, err := profiles.Push(profile, host, parts)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Pushed profile to %s.\n", host)
+	printChanges(result.Changes, false)
+
+	return nil
+}
+
+// profileCommand runs a profile command from the command line, returning
+// false if none was given.
+func profileCommand(exportPath string, importPath string, pushHost string, partsOpt string, preview bool) (bool, error) {
+	if exportPath == "" && importPath == "" && pushHost == "" {
+		return false, nil
+	}
+
+	parts, err := profiles.ParseParts(partsOpt)
+	if err != nil {
+		return true, err
+	}
+
+	switch {
+	case exportPath != "":
+		return true, exportProfile(exportPath, parts)
+	case importPath != "":
+		return true, importProfile(importPath, parts, preview)
+	default:
+		return true, pushProfile(pushHost, parts)
+	}
+}
@@ -0,0 +1,211 @@
+package saves
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/wizzomafizzo/mrext/pkg/games"
+	"github.com/wizzomafizzo/mrext/pkg/saves"
+	"github.com/wizzomafizzo/mrext/pkg/service"
+)
+
+// maxUploadSize is well above the largest save file of any core.
+const maxUploadSize = 64 * 1024 * 1024
+
+var layout = saves.Default
+
+func httpError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, saves.ErrOutsideSaves):
+		status = http.StatusForbidden
+	case errors.Is(err, saves.ErrBackupNotFound),
+		errors.Is(err, saves.ErrSnapshotNotFound),
+		errors.Is(err, fs.ErrNotExist):
+		status = http.StatusNotFound
+	}
+	http.Error(w, err.Error(), status)
+}
+
+func writeJson(w http.ResponseWriter, logger *service.Logger, area string, payload interface{}) {
+	err := json.NewEncoder(w).Encode(payload)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		logger.Error("%s: encoding response: %s", area, err)
+	}
+}
+
+type listSavesPayload struct {
+	Files []saves.File `json:"files"`
+	// Folders are where new saves and savestates for the system go, by
+	// kind.
+	Folders map[string]string `json:"folders"`
+}
+
+// HandleList lists saves and savestates for a system, or for a single game
+// if its path is given.
+func HandleList(logger *service.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		system, err := games.LookupSystem(r.URL.Query().Get("system"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			logger.Error("list saves: %s", err)
+			return
+		}
+
+		var files []saves.File
+		if game := r.URL.Query().Get("game"); game != "" {
+			files, err = layout.ListGame(*system, game)
+		} else {
+			files, err = layout.ListSystem(*system)
+		}
+		if err != nil {
+			httpError(w, err)
+			logger.Error("list saves: %s", err)
+			return
+		}
+
+		writeJson(w, logger, "list saves", listSavesPayload{
+			Files:   files,
+			Folders: layout.Folders(*system),
+		})
+	}
+}
+
+// HandleDownload sends a save file as an attachment.
+func HandleDownload(logger *service.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		path, _, err := layout.Resolve(r.URL.Query().Get("path"))
+		if err != nil {
+			httpError(w, err)
+			logger.Error("download save: %s", err)
+			return
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			httpError(w, err)
+			logger.Error("download save: %s", err)
+			return
+		}
+		defer f.Close()
+
+		info, err := f.Stat()
+		if err != nil {
+			httpError(w, err)
+			logger.Error("download save: %s", err)
+			return
+		}
+
+		name := filepath.Base(path)
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+		http.ServeContent(w, r, name, info.ModTime(), f)
+	}
+}
+
+// HandleUpload replaces a save file with the request body, or creates it if
+// it doesn't exist. The existing save is backed up first.
+func HandleUpload(logger *service.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Query().Get("path")
+		logger.Info("upload save: %s", path)
+
+		err := layout.Write(path, http.MaxBytesReader(w, r.Body, maxUploadSize))
+		if err != nil {
+			httpError(w, err)
+			logger.Error("upload save: %s", err)
+			return
+		}
+	}
+}
+
+type pathArgs struct {
+	Path string `json:"path"`
+	ID   string `json:"id"`
+}
+
+func decodePathArgs(w http.ResponseWriter, r *http.Request, logger *service.Logger, area string) (pathArgs, bool) {
+	var args pathArgs
+	err := json.NewDecoder(r.Body).Decode(&args)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		logger.Error("%s: decoding request: %s", area, err)
+		return args, false
+	}
+	return args, true
+}
+
+// HandleDelete deletes a save file, after backing it up.
+func HandleDelete(logger *service.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		args, ok := decodePathArgs(w, r, logger, "delete save")
+		if !ok {
+			return
+		}
+
+		logger.Info("delete save: %s", args.Path)
+		err := layout.Delete(args.Path)
+		if err != nil {
+			httpError(w, err)
+			logger.Error("delete save: %s", err)
+			return
+		}
+	}
+}
+
+// HandleListBackups lists the backups of a save file, newest first.
+func HandleListBackups(logger *service.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		backups, err := layout.ListBackups(r.URL.Query().Get("path"))
+		if err != nil {
+			httpError(w, err)
+			logger.Error("list save backups: %s", err)
+			return
+		}
+
+		writeJson(w, logger, "list save backups", backups)
+	}
+}
+
+// HandleRestoreBackup replaces a save file with one of its backups.
+func HandleRestoreBackup(logger *service.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		args, ok := decodePathArgs(w, r, logger, "restore save backup")
+		if !ok {
+			return
+		}
+
+		logger.Info("restore save backup: %s from %s", args.Path, args.ID)
+		err := layout.RestoreBackup(args.Path, args.ID)
+		if err != nil {
+			httpError(w, err)
+			logger.Error("restore save backup: %s", err)
+			return
+		}
+	}
+}
+
+// CountForGames returns a function which counts the saves and savestates of
+// a game. Counts are loaded once per system and cached, for looking up a
+// page of search results.
+func CountForGames() func(systemId string, gamePath string) int {
+	counts := make(map[string]map[string]int)
+
+	return func(systemId string, gamePath string) int {
+		systemCounts, ok := counts[systemId]
+		if !ok {
+			system, err := games.GetSystem(systemId)
+			if err != nil {
+				return 0
+			}
+			systemCounts = layout.CountByGame(*system)
+			counts[systemId] = systemCounts
+		}
+		return systemCounts[saves.GameName(gamePath)]
+	}
+}
@@ -0,0 +1,66 @@
+package saves
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/wizzomafizzo/mrext/pkg/games"
+	"github.com/wizzomafizzo/mrext/pkg/service"
+)
+
+// Snapshots are taken by the savesnap service when a game is stopped, Remote
+// only lists and restores them.
+
+// HandleListSnapshots lists the snapshots of a game, newest first.
+func HandleListSnapshots(logger *service.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		system, err := games.LookupSystem(r.URL.Query().Get("system"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			logger.Error("list save snapshots: %s", err)
+			return
+		}
+
+		snapshots, err := layout.ListSnapshots(system.Id, r.URL.Query().Get("game"))
+		if err != nil {
+			httpError(w, err)
+			logger.Error("list save snapshots: %s", err)
+			return
+		}
+
+		writeJson(w, logger, "list save snapshots", snapshots)
+	}
+}
+
+// HandleRestoreSnapshot restores every save in a snapshot of a game.
+func HandleRestoreSnapshot(logger *service.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var args struct {
+			System string `json:"system"`
+			Game   string `json:"game"`
+			ID     string `json:"id"`
+		}
+
+		err := json.NewDecoder(r.Body).Decode(&args)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			logger.Error("restore save snapshot: decoding request: %s", err)
+			return
+		}
+
+		system, err := games.LookupSystem(args.System)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			logger.Error("restore save snapshot: %s", err)
+			return
+		}
+
+		logger.Info("restore save snapshot: %s/%s from %s", system.Id, args.Game, args.ID)
+		err = layout.RestoreSnapshot(system.Id, args.Game, args.ID)
+		if err != nil {
+			httpError(w, err)
+			logger.Error("restore save snapshot: %s", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package screenshots
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wizzomafizzo/mrext/pkg/config"
+	"github.com/wizzomafizzo/mrext/pkg/games"
+)
+
+// The index stores what's known about each screenshot when it's first seen,
+// by its path in the screenshots folder. Sessions are only kept in memory,
+// so this is the only record of which game a screenshot belongs to.
+
+// MiSTer names screenshots <time>-<game>.png
+const screenshotTimeFormat = "20060102_150405"
+
+var (
+	indexFile = config.ScreenshotsIndexFile
+	indexMu   sync.Mutex
+)
+
+func loadIndex() map[string]ScreenshotPayload {
+	index := make(map[string]ScreenshotPayload)
+
+	data, err := os.ReadFile(indexFile)
+	if err != nil {
+		return index
+	}
+
+	// a broken index is rebuilt from the screenshots folder
+	_ = json.Unmarshal(data, &index)
+	return index
+}
+
+func saveIndex(index map[string]ScreenshotPayload) error {
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(indexFile), 0755)
+	if err != nil {
+		return err
+	}
+
+	tmp := indexFile + ".tmp"
+	err = os.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, indexFile)
+}
+
+// coreSystem returns the system a core's screenshots folder belongs to, if
+// it's a known console core. Some systems share a core, so systems named
+// after the core are checked first.
+func coreSystem(core string) (games.System, bool) {
+	for _, system := range games.Systems {
+		if strings.EqualFold(system.Id, core) {
+			return system, true
+		}
+	}
+	for _, system := range games.Systems {
+		if system.SetName == "" && len(system.Folder) > 0 && strings.EqualFold(system.Folder[0], core) {
+			return system, true
+		}
+	}
+	for _, system := range games.Systems {
+		if strings.EqualFold(system.SetName, core) {
+			return system, true
+		}
+	}
+	return games.System{}, false
+}
+
+// newScreenshot reads what it can about a screenshot from its filename, and
+// links it to the game session it was taken in.
+func newScreenshot(core string, filename string, modified time.Time) ScreenshotPayload {
+	screenshot := ScreenshotPayload{
+		Game:     filename,
+		Filename: filename,
+		Path:     core + "/" + filename,
+		Core:     core,
+		Modified: modified,
+		Taken:    modified,
+	}
+
+	gp := strings.SplitN(filename, "-", 2)
+	screenshot.Game = gp[0]
+	if len(gp) > 1 && len(gp[1]) > 4 {
+		screenshot.Game = gp[1][:len(gp[1])-4]
+	}
+
+	taken, err := time.ParseInLocation(screenshotTimeFormat, gp[0], time.Local)
+	if err == nil {
+		screenshot.Taken = taken
+	}
+
+	if session, ok := sessions.at(screenshot.Taken); ok {
+		screenshot.Game = session.Game
+		screenshot.GamePath = session.GamePath
+		screenshot.SystemId = session.SystemId
+		screenshot.SystemName = session.SystemName
+		screenshot.Session = session.ID
+	} else if system, ok := coreSystem(core); ok {
+		screenshot.SystemId = system.Id
+		screenshot.SystemName = system.Name
+	}
+
+	return screenshot
+}
+
+// listScreenshots returns every screenshot in the core subfolders of the
+// screenshots folder, adding new ones to the index.
+func listScreenshots() ([]ScreenshotPayload, error) {
+	indexMu.Lock()
+	defer indexMu.Unlock()
+
+	index := loadIndex()
+	changed := false
+	seen := make(map[string]bool)
+	screenshots := make([]ScreenshotPayload, 0)
+
+	err := filepath.WalkDir(screenshotsFolder, func(path string, info fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() || !strings.HasSuffix(info.Name(), ".png") {
+			return nil
+		}
+
+		rel := strings.Replace(path, screenshotsFolder+"/", "", 1)
+		if strings.Count(rel, "/") != 1 {
+			return nil
+		}
+
+		fd, err := info.Info()
+		if err != nil {
+			return err
+		}
+
+		screenshot, ok := index[rel]
+		if !ok {
+			core := strings.Split(rel, "/")[0]
+			screenshot = newScreenshot(core, info.Name(), fd.ModTime())
+			index[rel] = screenshot
+			changed = true
+		}
+		screenshot.Modified = fd.ModTime()
+
+		seen[rel] = true
+		screenshots = append(screenshots, screenshot)
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		err = nil
+	}
+
+	for path := range index {
+		if !seen[path] {
+			delete(index, path)
+			changed = true
+		}
+	}
+
+	if changed {
+		if saveErr := saveIndex(index); saveErr != nil && err == nil {
+			err = saveErr
+		}
+	}
+
+	return screenshots, err
+}
+
+type screenshotFilter struct {
+	SystemId string
+	Core     string
+	Game     string
+	Session  string
+	Since    time.Time
+	Until    time.Time
+}
+
+func (f screenshotFilter) match(s ScreenshotPayload) bool {
+	switch {
+	case f.SystemId != "" && !strings.EqualFold(f.SystemId, s.SystemId):
+		return false
+	case f.Core != "" && !strings.EqualFold(f.Core, s.Core):
+		return false
+	case f.Game != "" && !strings.Contains(strings.ToLower(s.Game), strings.ToLower(f.Game)):
+		return false
+	case f.Session != "" && f.Session != s.Session:
+		return false
+	case !f.Since.IsZero() && s.Taken.Before(f.Since):
+		return false
+	case !f.Until.IsZero() && s.Taken.After(f.Until):
+		return false
+	}
+	return true
+}
+
+// filterScreenshots returns matching screenshots, newest first.
+func filterScreenshots(screenshots []ScreenshotPayload, f screenshotFilter) []ScreenshotPayload {
+	filtered := make([]ScreenshotPayload, 0, len(screenshots))
+	for _, s := range screenshots {
+		if f.match(s) {
+			filtered = append(filtered, s)
+		}
+	}
+
+	sort.SliceStable(filtered, func(i, j int) bool {
+		return filtered[i].Taken.After(filtered[j].Taken)
+	})
+
+	return filtered
+}
@@ -3,11 +3,9 @@ package screenshots
 import (
 	"encoding/json"
 	"github.com/wizzomafizzo/mrext/pkg/service"
-	"io/fs"
 	"net/http"
 	"os"
 	"path/filepath"
-	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -15,7 +13,7 @@ import (
 	"github.com/wizzomafizzo/mrext/pkg/config"
 )
 
-const screenshotsFolder = config.SdFolder + "/screenshots"
+var screenshotsFolder = config.SdFolder + "/screenshots"
 
 type ScreenshotPayload struct {
 	Game     string    `json:"game"`
@@ -23,51 +21,50 @@ type ScreenshotPayload struct {
 	Path     string    `json:"path"`
 	Core     string    `json:"core"`
 	Modified time.Time `json:"modified"`
+	// Taken is when the screenshot was captured, from its filename.
+	Taken      time.Time `json:"taken"`
+	SystemId   string    `json:"systemId"`
+	SystemName string    `json:"systemName"`
+	// GamePath and Session are only known for screenshots taken while
+	// Remote was running.
+	GamePath string `json:"gamePath"`
+	Session  string `json:"session"`
+}
+
+func parseFilterTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, value)
 }
 
 func AllScreenshots(logger *service.Logger) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		var screenshots []ScreenshotPayload
-
-		err := filepath.WalkDir(screenshotsFolder, func(path string, info fs.DirEntry, err error) error {
-			if err != nil {
-				return err
-			}
-
-			if !info.IsDir() && strings.HasSuffix(info.Name(), ".png") {
-				path := strings.Replace(path, screenshotsFolder+"/", "", 1)
-				if strings.Count(path, "/") == 1 {
-					core := strings.Split(path, "/")[0]
-
-					fd, err := info.Info()
-					if err != nil {
-						return err
-					}
-
-					gp := strings.SplitN(info.Name(), "-", 2)
-					game := gp[0]
-					if len(gp) > 1 && len(gp[1]) > 4 {
-						game = gp[1][:len(gp[1])-4]
-					}
-
-					screenshots = append(screenshots, ScreenshotPayload{
-						Game:     game,
-						Filename: info.Name(),
-						Path:     path,
-						Core:     core,
-						Modified: fd.ModTime(),
-					})
-				}
-			}
+		query := r.URL.Query()
+		filter := screenshotFilter{
+			SystemId: query.Get("system"),
+			Core:     query.Get("core"),
+			Game:     query.Get("game"),
+			Session:  query.Get("session"),
+		}
 
-			return nil
-		})
+		var err error
+		filter.Since, err = parseFilterTime(query.Get("since"))
+		if err == nil {
+			filter.Until, err = parseFilterTime(query.Get("until"))
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			logger.Error("all screenshots: %s", err)
+			return
+		}
 
+		screenshots, err := listScreenshots()
 		if err != nil {
 			logger.Error("all screenshots: %s", err)
 		}
 
-		err = json.NewEncoder(w).Encode(screenshots)
+		err = json.NewEncoder(w).Encode(filterScreenshots(screenshots, filter))
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			logger.Error("all screenshots: %s", err)
@@ -148,5 +145,7 @@ func DeleteScreenshot(logger *service.Logger) http.HandlerFunc {
 			logger.Error("delete screenshot: %s", err)
 			return
 		}
+
+		removeThumbnail(core, image)
 	}
 }
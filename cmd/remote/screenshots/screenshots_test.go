@@ -0,0 +1,246 @@
+package screenshots
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wizzomafizzo/mrext/pkg/tracker"
+)
+
+func testFolders(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+
+	oldFolder, oldIndex, oldThumbs, oldSessions := screenshotsFolder, indexFile, thumbnailsFolder, sessions
+	oldDelay := indexDelay
+	screenshotsFolder = filepath.Join(dir, "screenshots")
+	indexFile = filepath.Join(dir, "config", "screenshots.json")
+	thumbnailsFolder = filepath.Join(dir, "config", "thumbnails")
+	sessions = &sessionLog{}
+	// background indexing would outlive the test folders
+	indexDelay = time.Hour
+
+	t.Cleanup(func() {
+		screenshotsFolder, indexFile, thumbnailsFolder, sessions = oldFolder, oldIndex, oldThumbs, oldSessions
+		indexDelay = oldDelay
+	})
+}
+
+func writePng(t *testing.T, path string, width int, height int) {
+	t.Helper()
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		img.Set(x, 0, color.RGBA{R: 255, A: 255})
+	}
+
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	err = png.Encode(f, img)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func localTime(t *testing.T, value string) time.Time {
+	t.Helper()
+	parsed, err := time.ParseInLocation(screenshotTimeFormat, value, time.Local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
+
+func gameEvent(action int, ts time.Time, target string, path string) tracker.EventAction {
+	ev := tracker.EventAction{
+		Timestamp:  ts,
+		Action:     action,
+		Target:     target,
+		TargetPath: path,
+	}
+	ev.ActiveCore.Core = "SNES"
+	return ev
+}
+
+func TestSessionAt(t *testing.T) {
+	log := &sessionLog{}
+	start := localTime(t, "20230812_090000").Add(300 * time.Millisecond)
+
+	log.record(gameEvent(tracker.EventActionGameStart, start, "SNES/Zelda (USA).sfc", "/media/fat/games/SNES/Zelda (USA).sfc"))
+	log.record(gameEvent(tracker.EventActionCoreStart, start.Add(time.Minute), "SNES", ""))
+	// starting a new game ends the last one
+	log.record(gameEvent(tracker.EventActionGameStart, start.Add(time.Hour), "SNES/Mario (USA).sfc", ""))
+	log.record(gameEvent(tracker.EventActionGameStop, start.Add(2*time.Hour), "SNES/Mario (USA).sfc", ""))
+
+	tests := []struct {
+		at   time.Time
+		game string
+	}{
+		{start.Truncate(time.Second), "Zelda (USA)"},
+		{start.Add(30 * time.Minute), "Zelda (USA)"},
+		{start.Add(time.Hour + time.Minute), "Mario (USA)"},
+		{start.Add(2*time.Hour + time.Second), "Mario (USA)"},
+		{start.Add(-time.Minute), ""},
+		{start.Add(3 * time.Hour), ""},
+	}
+
+	for _, tt := range tests {
+		session, ok := log.at(tt.at)
+		if ok != (tt.game != "") || session.Game != tt.game {
+			t.Errorf("%s: got %q, want %q", tt.at, session.Game, tt.game)
+		}
+		if ok && (session.SystemId != "SNES" || session.SystemName == "") {
+			t.Errorf("%s: got system %q %q", tt.at, session.SystemId, session.SystemName)
+		}
+	}
+}
+
+func TestListScreenshots(t *testing.T) {
+	testFolders(t)
+
+	start := localTime(t, "20230812_090000")
+	RecordEvent(gameEvent(tracker.EventActionGameStart, start, "SNES/Zelda (USA).sfc", "/media/fat/games/SNES/Zelda (USA).sfc"))
+	RecordEvent(gameEvent(tracker.EventActionGameStop, start.Add(time.Hour), "SNES/Zelda (USA).sfc", ""))
+
+	writePng(t, filepath.Join(screenshotsFolder, "SNES", "20230812_091500-zelda.png"), 4, 4)
+	writePng(t, filepath.Join(screenshotsFolder, "SNES", "20230701_120000-Mario.png"), 4, 4)
+	writePng(t, filepath.Join(screenshotsFolder, "AO486", "20230721_212410-screen.png"), 4, 4)
+	writePng(t, filepath.Join(screenshotsFolder, "AO486", "nested", "20230721_212410-screen.png"), 4, 4)
+
+	all, err := listScreenshots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 3 {
+		t.Fatalf("got %d screenshots, want 3", len(all))
+	}
+
+	zelda := filterScreenshots(all, screenshotFilter{Session: start.Format("20060102-150405")})
+	if len(zelda) != 1 {
+		t.Fatalf("got %d screenshots in session", len(zelda))
+	}
+	if zelda[0].Game != "Zelda (USA)" || zelda[0].GamePath != "/media/fat/games/SNES/Zelda (USA).sfc" || zelda[0].SystemId != "SNES" {
+		t.Errorf("got screenshot %+v", zelda[0])
+	}
+
+	// taken before the session, so only the filename and core are known
+	mario := filterScreenshots(all, screenshotFilter{Game: "mario"})
+	if len(mario) != 1 || mario[0].SystemId != "SNES" || mario[0].Session != "" || mario[0].Game != "Mario" {
+		t.Errorf("got screenshots %+v", mario)
+	}
+
+	got := make([]string, 0)
+	for _, s := range filterScreenshots(all, screenshotFilter{Since: localTime(t, "20230720_000000")}) {
+		got = append(got, s.Path)
+	}
+	want := "SNES/20230812_091500-zelda.png,AO486/20230721_212410-screen.png"
+	if strings.Join(got, ",") != want {
+		t.Errorf("got %v, want %s", got, want)
+	}
+
+	// metadata is kept after sessions are forgotten, and deleted
+	// screenshots are removed from the index
+	sessions = &sessionLog{}
+	err = os.Remove(filepath.Join(screenshotsFolder, "SNES", "20230701_120000-Mario.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	all, err = listScreenshots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(filterScreenshots(all, screenshotFilter{Game: "zelda (usa)", SystemId: "snes"})) != 1 {
+		t.Errorf("lost session metadata: %+v", all)
+	}
+	if index := loadIndex(); len(index) != 2 {
+		t.Errorf("got %d index entries, want 2", len(index))
+	}
+}
+
+func TestMakeThumbnail(t *testing.T) {
+	testFolders(t)
+
+	writePng(t, filepath.Join(screenshotsFolder, "SNES", "shot.png"), 640, 480)
+
+	path, err := makeThumbnail("SNES", "shot.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, format, err := image.DecodeConfig(f)
+	_ = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format != "jpeg" || cfg.Width != thumbnailWidth || cfg.Height != 240 {
+		t.Errorf("got %s %dx%d", format, cfg.Width, cfg.Height)
+	}
+
+	// cached thumbnail is reused
+	cached := time.Now().Add(time.Hour)
+	err = os.Chtimes(path, cached, cached)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = makeThumbnail("SNES", "shot.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(path); err != nil || !info.ModTime().Equal(cached) {
+		t.Error("thumbnail was regenerated")
+	}
+
+	_, err = makeThumbnail("SNES", "missing.png")
+	if !os.IsNotExist(err) {
+		t.Errorf("got %v, want not exist", err)
+	}
+}
+
+func TestIndexOnSessionEnd(t *testing.T) {
+	testFolders(t)
+	indexDelay = 0
+
+	start := localTime(t, "20230812_090000")
+	RecordEvent(gameEvent(tracker.EventActionGameStart, start, "SNES/Zelda (USA).sfc", "/media/fat/games/SNES/Zelda (USA).sfc"))
+	writePng(t, filepath.Join(screenshotsFolder, "SNES", "20230812_091500-zelda.png"), 4, 4)
+	RecordEvent(gameEvent(tracker.EventActionGameStop, start.Add(time.Hour), "SNES/Zelda (USA).sfc", ""))
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		indexMu.Lock()
+		index := loadIndex()
+		indexMu.Unlock()
+
+		if s, ok := index["SNES/20230812_091500-zelda.png"]; ok {
+			if s.Session != start.Format("20060102-150405") || s.Game != "Zelda (USA)" {
+				t.Errorf("got screenshot %+v", s)
+			}
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("screenshot wasn't indexed when the session ended")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,132 @@
+package screenshots
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wizzomafizzo/mrext/pkg/games"
+	"github.com/wizzomafizzo/mrext/pkg/tracker"
+	"github.com/wizzomafizzo/mrext/pkg/utils"
+)
+
+// Sessions are the periods a game was running, recorded from tracker events
+// while Remote is running. New screenshots are matched to the session active
+// when they were taken, so they can be linked to the game instead of only
+// the core. Screenshots are indexed when a session ends, so they stay linked
+// even if the gallery isn't opened before the session is forgotten.
+
+const (
+	maxSessions = 100
+	// screenshot times are only accurate to the second, and the file may be
+	// written just after the game stops
+	sessionSlack = 2 * time.Second
+)
+
+// indexDelay is how long after a session ends its screenshots are indexed.
+var indexDelay = sessionSlack + time.Second
+
+type Session struct {
+	ID         string
+	Core       string
+	SystemId   string
+	SystemName string
+	Game       string
+	GamePath   string
+	Start      time.Time
+	End        time.Time
+}
+
+type sessionLog struct {
+	mu       sync.Mutex
+	sessions []Session
+}
+
+var sessions = &sessionLog{}
+
+func newSession(ev tracker.EventAction) Session {
+	session := Session{
+		ID:         ev.Timestamp.Format("20060102-150405"),
+		Core:       ev.ActiveCore.Core,
+		SystemId:   ev.ActiveCore.System,
+		SystemName: ev.ActiveCore.SystemName,
+		Game:       ev.ActiveGame.Name,
+		GamePath:   ev.TargetPath,
+		Start:      ev.Timestamp,
+	}
+
+	// game IDs are <system>/<filename>, arcade games are the core name
+	if i := strings.Index(ev.Target, "/"); i > 0 {
+		session.SystemId = ev.Target[:i]
+		if session.Game == "" {
+			session.Game = utils.RemoveFileExt(filepath.Base(ev.Target[i+1:]))
+		}
+	} else if session.Game == "" {
+		session.Game = ev.Target
+	}
+
+	if system, err := games.GetSystem(session.SystemId); err == nil {
+		session.SystemName = system.Name
+	}
+
+	return session
+}
+
+// record updates the sessions from a tracker event, returning true if it
+// ended a session.
+func (s *sessionLog) record(ev tracker.EventAction) bool {
+	if ev.Action != tracker.EventActionGameStart && ev.Action != tracker.EventActionGameStop {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ended := false
+	if n := len(s.sessions); n > 0 && s.sessions[n-1].End.IsZero() {
+		s.sessions[n-1].End = ev.Timestamp
+		ended = true
+	}
+
+	if ev.Action == tracker.EventActionGameStart {
+		s.sessions = append(s.sessions, newSession(ev))
+		if len(s.sessions) > maxSessions {
+			s.sessions = s.sessions[len(s.sessions)-maxSessions:]
+		}
+	}
+
+	return ended
+}
+
+// at returns the session which was active at a time.
+func (s *sessionLog) at(t time.Time) (Session, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := len(s.sessions) - 1; i >= 0; i-- {
+		session := s.sessions[i]
+		if t.Before(session.Start.Truncate(time.Second)) {
+			continue
+		}
+		if session.End.IsZero() || !t.After(session.End.Add(sessionSlack)) {
+			return session, true
+		}
+		// sessions don't overlap, so no earlier session can match
+		return Session{}, false
+	}
+
+	return Session{}, false
+}
+
+// RecordEvent records the start and end of game sessions from tracker
+// events. Other events are ignored. When a session ends, screenshots taken
+// during it are indexed in the background.
+func RecordEvent(ev tracker.EventAction) {
+	if sessions.record(ev) {
+		time.AfterFunc(indexDelay, func() {
+			// any error is reported when the screenshots are next listed
+			_, _ = listScreenshots()
+		})
+	}
+}
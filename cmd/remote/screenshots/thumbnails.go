@@ -0,0 +1,128 @@
+package screenshots
+
+import (
+	"image"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/image/draw"
+
+	"github.com/wizzomafizzo/mrext/pkg/config"
+	"github.com/wizzomafizzo/mrext/pkg/service"
+)
+
+// Thumbnails are small JPEG copies of screenshots for the gallery, made the
+// first time they're requested and cached until the screenshot changes.
+
+const (
+	thumbnailWidth   = 320
+	thumbnailQuality = 80
+)
+
+var (
+	thumbnailsFolder = config.ScreenshotThumbnailsFolder
+	// a gallery requests lots of thumbnails at once, don't decode them all
+	// at the same time
+	thumbnailSem = make(chan struct{}, 2)
+)
+
+func thumbnailPath(core string, image string) string {
+	return filepath.Join(thumbnailsFolder, core, strings.TrimSuffix(image, filepath.Ext(image))+".jpg")
+}
+
+// makeThumbnail returns the path to a screenshot's thumbnail, creating it if
+// it doesn't exist or is older than the screenshot.
+func makeThumbnail(core string, filename string) (string, error) {
+	src := filepath.Join(screenshotsFolder, core, filename)
+	dst := thumbnailPath(core, filename)
+
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		return "", err
+	}
+
+	if dstInfo, err := os.Stat(dst); err == nil && !dstInfo.ModTime().Before(srcInfo.ModTime()) {
+		return dst, nil
+	}
+
+	thumbnailSem <- struct{}{}
+	defer func() { <-thumbnailSem }()
+
+	f, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	img, err := png.Decode(f)
+	if err != nil {
+		return "", err
+	}
+
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width > thumbnailWidth {
+		height = height * thumbnailWidth / width
+		width = thumbnailWidth
+	}
+	if height < 1 {
+		height = 1
+	}
+
+	thumb := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.ApproxBiLinear.Scale(thumb, thumb.Bounds(), img, bounds, draw.Src, nil)
+
+	err = os.MkdirAll(filepath.Dir(dst), 0755)
+	if err != nil {
+		return "", err
+	}
+
+	tmp := dst + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return "", err
+	}
+
+	err = jpeg.Encode(out, thumb, &jpeg.Options{Quality: thumbnailQuality})
+	if err != nil {
+		_ = out.Close()
+		_ = os.Remove(tmp)
+		return "", err
+	}
+
+	err = out.Close()
+	if err != nil {
+		_ = os.Remove(tmp)
+		return "", err
+	}
+
+	return dst, os.Rename(tmp, dst)
+}
+
+func removeThumbnail(core string, filename string) {
+	_ = os.Remove(thumbnailPath(core, filename))
+}
+
+func ViewThumbnail(logger *service.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+
+		path, err := makeThumbnail(vars["core"], vars["image"])
+		if os.IsNotExist(err) {
+			http.NotFound(w, r)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logger.Error("view thumbnail: %s", err)
+			return
+		}
+
+		w.Header().Set("Cache-Control", "max-age=86400")
+		http.ServeFile(w, r, path)
+	}
+}
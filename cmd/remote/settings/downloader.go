@@ -0,0 +1,226 @@
+package settings
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/wizzomafizzo/mrext/pkg/mister"
+	"github.com/wizzomafizzo/mrext/pkg/service"
+)
+
+type DownloaderDbPayload struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Homepage    string `json:"homepage"`
+	Category    string `json:"category"`
+	// Catalog is true if the database is in the bundled catalog, otherwise
+	// it's a custom entry in downloader.ini.
+	Catalog bool `json:"catalog"`
+	// Enabled is true if the database is in downloader.ini.
+	Enabled bool `json:"enabled"`
+	// URL is the db_url in downloader.ini, or the catalog URL if it's not
+	// enabled.
+	URL        string `json:"url"`
+	CatalogURL string `json:"catalogUrl"`
+	Filter     string `json:"filter"`
+}
+
+type DownloaderDbsPayload struct {
+	Dbs []DownloaderDbPayload `json:"dbs"`
+}
+
+// downloaderDbsPayload lists every catalog database, then custom databases
+// in the order they're in downloader.ini.
+func downloaderDbsPayload(d *mister.DownloaderIni) (DownloaderDbsPayload, error) {
+	catalog, err := mister.DownloaderCatalog()
+	if err != nil {
+		return DownloaderDbsPayload{}, err
+	}
+
+	payload := DownloaderDbsPayload{Dbs: make([]DownloaderDbPayload, 0)}
+	listed := make(map[string]bool)
+
+	for _, c := range catalog {
+		item := DownloaderDbPayload{
+			ID:          c.ID,
+			Name:        c.Name,
+			Description: c.Description,
+			Homepage:    c.Homepage,
+			Category:    c.Category,
+			Catalog:     true,
+			URL:         c.URL,
+			CatalogURL:  c.URL,
+		}
+
+		if db, ok := d.Db(c.ID); ok {
+			item.Enabled = true
+			item.URL = db.URL
+			item.Filter = db.Filter
+			listed[strings.ToLower(db.ID)] = true
+		}
+
+		payload.Dbs = append(payload.Dbs, item)
+	}
+
+	for _, db := range d.ListDbs() {
+		if listed[strings.ToLower(db.ID)] {
+			continue
+		}
+
+		payload.Dbs = append(payload.Dbs, DownloaderDbPayload{
+			ID:      db.ID,
+			Name:    db.ID,
+			Enabled: true,
+			URL:     db.URL,
+			Filter:  db.Filter,
+		})
+	}
+
+	return payload, nil
+}
+
+func writeDownloaderDbs(w http.ResponseWriter, logger *service.Logger, d *mister.DownloaderIni) {
+	payload, err := downloaderDbsPayload(d)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		logger.Error("list downloader dbs: %s", err)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(payload)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		logger.Error("encode downloader dbs: %s", err)
+		return
+	}
+}
+
+// HandleListDownloaderDbs returns the databases in the catalog and
+// downloader.ini, and which are enabled.
+func HandleListDownloaderDbs(logger *service.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		d, err := mister.LoadDownloaderIni()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logger.Error("load downloader.ini: %s", err)
+			return
+		}
+
+		writeDownloaderDbs(w, logger, d)
+	}
+}
+
+type SetDownloaderDbRequest struct {
+	// URL is required for custom databases. Catalog databases use the
+	// catalog URL if it's empty.
+	URL    string `json:"url"`
+	Filter string `json:"filter"`
+}
+
+type DownloaderDbValidationResponse struct {
+	Errors []mister.DownloaderDbError `json:"errors"`
+}
+
+// HandleSetDownloaderDb enables a database in downloader.ini or changes its
+// options.
+func HandleSetDownloaderDb(logger *service.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var args SetDownloaderDbRequest
+		err := json.NewDecoder(r.Body).Decode(&args)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			logger.Error("decode set downloader db request: %s", err)
+			return
+		}
+
+		db := mister.DownloaderDb{
+			ID:     mux.Vars(r)["id"],
+			URL:    strings.TrimSpace(args.URL),
+			Filter: strings.TrimSpace(args.Filter),
+		}
+
+		if db.URL == "" {
+			catalog, err := mister.DownloaderCatalog()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				logger.Error("read downloader catalog: %s", err)
+				return
+			}
+			for _, c := range catalog {
+				if strings.EqualFold(c.ID, db.ID) {
+					db.URL = c.URL
+				}
+			}
+		}
+
+		d, err := mister.LoadDownloaderIni()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logger.Error("load downloader.ini: %s", err)
+			return
+		}
+
+		err = d.SetDb(db)
+		if de, ok := err.(*mister.DownloaderDbError); ok {
+			logger.Error("validate downloader db: %s", err)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			err := json.NewEncoder(w).Encode(DownloaderDbValidationResponse{Errors: []mister.DownloaderDbError{*de}})
+			if err != nil {
+				logger.Error("encode downloader db validation errors: %s", err)
+			}
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logger.Error("set downloader db: %s", err)
+			return
+		}
+
+		err = d.Save(remoteAuthor(r))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logger.Error("save downloader.ini: %s", err)
+			return
+		}
+		logger.Info("set downloader db: %s %s", db.ID, db.URL)
+
+		writeDownloaderDbs(w, logger, d)
+	}
+}
+
+// HandleDeleteDownloaderDb disables a database by removing it from
+// downloader.ini.
+func HandleDeleteDownloaderDb(logger *service.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+
+		d, err := mister.LoadDownloaderIni()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logger.Error("load downloader.ini: %s", err)
+			return
+		}
+
+		if !d.HasDb(id) {
+			http.Error(w, "downloader db not found", http.StatusNotFound)
+			logger.Error("delete downloader db: not found: %s", id)
+			return
+		}
+
+		err = d.RemoveDb(id)
+		if err == nil {
+			err = d.Save(remoteAuthor(r))
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logger.Error("save downloader.ini: %s", err)
+			return
+		}
+		logger.Info("delete downloader db: %s", id)
+
+		writeDownloaderDbs(w, logger, d)
+	}
+}
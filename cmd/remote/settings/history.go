@@ -0,0 +1,190 @@
+package settings
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"github.com/wizzomafizzo/mrext/pkg/mister"
+	"github.com/wizzomafizzo/mrext/pkg/service"
+)
+
+// remoteAuthor is the author recorded in config file history for changes
+// made by a Remote client.
+func remoteAuthor(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return fmt.Sprintf("remote (%s)", host)
+}
+
+func historyError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, mister.ErrUnknownHistoryFile),
+		errors.Is(err, mister.ErrHistoryVersionNotFound):
+		status = http.StatusNotFound
+	}
+	http.Error(w, err.Error(), status)
+}
+
+// requestHistoryPath returns the path of the file from the id in the request
+// path.
+func requestHistoryPath(w http.ResponseWriter, r *http.Request, logger *service.Logger) (string, bool) {
+	path, err := mister.HistoryFilePath(mux.Vars(r)["file"])
+	if err != nil {
+		historyError(w, err)
+		logger.Error("get history file: %s", err)
+		return "", false
+	}
+	return path, true
+}
+
+// HandleListHistoryFiles lists every file which has its history kept, with
+// the number of versions of each.
+func HandleListHistoryFiles(logger *service.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ids, err := mister.HistoryFileIds()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logger.Error("list history files: %s", err)
+			return
+		}
+
+		files := make([]mister.HistoryFile, 0, len(ids))
+		for _, id := range ids {
+			path, err := mister.HistoryFilePath(id)
+			if err != nil {
+				logger.Error("list history files: %s", err)
+				continue
+			}
+
+			versions, err := mister.DefaultHistory.Versions(path)
+			if err != nil {
+				logger.Error("list history files: %s", err)
+			}
+
+			files = append(files, mister.HistoryFile{
+				ID:       id,
+				Filename: filepath.Base(path),
+				Path:     path,
+				Versions: len(versions),
+			})
+		}
+
+		err = json.NewEncoder(w).Encode(files)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logger.Error("encode history files: %s", err)
+			return
+		}
+	}
+}
+
+// HandleListHistory lists every version of a file, newest first.
+func HandleListHistory(logger *service.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		path, ok := requestHistoryPath(w, r, logger)
+		if !ok {
+			return
+		}
+
+		versions, err := mister.DefaultHistory.Versions(path)
+		if err != nil {
+			historyError(w, err)
+			logger.Error("list history: %s", err)
+			return
+		}
+
+		err = json.NewEncoder(w).Encode(versions)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logger.Error("encode history: %s", err)
+			return
+		}
+	}
+}
+
+// HandleViewHistoryVersion returns the contents of a version of a file.
+func HandleViewHistoryVersion(logger *service.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		path, ok := requestHistoryPath(w, r, logger)
+		if !ok {
+			return
+		}
+
+		_, data, err := mister.DefaultHistory.Read(path, mux.Vars(r)["version"])
+		if err != nil {
+			historyError(w, err)
+			logger.Error("view history version: %s", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = w.Write(data)
+	}
+}
+
+// HandleDiffHistory returns the changes between two versions of a file, or
+// between a version and the current file, as a unified diff.
+func HandleDiffHistory(logger *service.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		path, ok := requestHistoryPath(w, r, logger)
+		if !ok {
+			return
+		}
+
+		from := r.URL.Query().Get("from")
+		if from == "" {
+			http.Error(w, "from version is required", http.StatusBadRequest)
+			logger.Error("diff history: from version is required")
+			return
+		}
+
+		diff, err := mister.DefaultHistory.Diff(path, from, r.URL.Query().Get("to"))
+		if err != nil {
+			historyError(w, err)
+			logger.Error("diff history: %s", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/x-diff; charset=utf-8")
+		_, _ = w.Write([]byte(diff))
+	}
+}
+
+// HandleRollbackHistory replaces a file with one of its versions.
+func HandleRollbackHistory(logger *service.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		path, ok := requestHistoryPath(w, r, logger)
+		if !ok {
+			return
+		}
+
+		id := mux.Vars(r)["version"]
+		logger.Info("rollback history: %s to %s", path, id)
+
+		err := mister.DefaultHistory.Rollback(path, id, remoteAuthor(r))
+		if err != nil {
+			historyError(w, err)
+			logger.Error("rollback history: %s", err)
+			return
+		}
+
+		if strings.HasPrefix(mux.Vars(r)["file"], "ini") {
+			err = mister.RelaunchIfInMenu()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				logger.Error("relaunch mister: %s", err)
+				return
+			}
+		}
+	}
+}
@@ -31,6 +31,10 @@ func HandleSaveIni(logger *service.Logger, reqId int) http.HandlerFunc {
 			return
 		}
 
+		if !validateIniRequest(w, logger, args) {
+			return
+		}
+
 		mi, err := mister.GetMisterIni(reqId)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -63,12 +67,14 @@ func HandleSaveIni(logger *service.Logger, reqId int) http.HandlerFunc {
 
 			err := mi.SetKey(key, value)
 			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
 				logger.Error("update mister.ini: %s", err)
+				return
 			}
 			logger.Info("update mister.ini: %s=%s", key, value)
 		}
 
-		err = mi.Save()
+		err = mi.SaveAs(remoteAuthor(r))
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			logger.Error("save mister.ini: %s", err)
@@ -102,18 +108,13 @@ func HandleLoadIni(logger *service.Logger, reqId int) http.HandlerFunc {
 			return
 		}
 
-		section, err := mi.File.GetSection(mister.MainIniSection)
+		payload, err := mi.SectionValues(mister.MainIniSection)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			logger.Error("get mister.ini section: %s", err)
 			return
 		}
 
-		payload := make(map[string]string)
-		for _, key := range section.Keys() {
-			payload[key.Name()] = key.Value()
-		}
-
 		hostname, err := os.Hostname()
 		if err != nil {
 			hostname = ""
@@ -0,0 +1,249 @@
+package settings
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/wizzomafizzo/mrext/pkg/mister"
+	"github.com/wizzomafizzo/mrext/pkg/service"
+)
+
+func networkError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, mister.ErrNoWifiInterface), errors.Is(err, mister.ErrWifiNetworkNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, mister.ErrInvalidWifiNetwork), errors.Is(err, mister.ErrInvalidNetworkConfig):
+		status = http.StatusBadRequest
+	}
+	http.Error(w, err.Error(), status)
+}
+
+type NetworkStatusPayload struct {
+	Links []mister.LinkStatus `json:"links"`
+}
+
+func HandleNetworkStatus(logger *service.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		links, err := mister.GetLinkStatus()
+		if err != nil {
+			networkError(w, err)
+			logger.Error("network status: %s", err)
+			return
+		}
+
+		err = json.NewEncoder(w).Encode(NetworkStatusPayload{Links: links})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logger.Error("encode network status: %s", err)
+			return
+		}
+	}
+}
+
+type WifiScanPayload struct {
+	Networks []mister.WifiScanResult `json:"networks"`
+}
+
+func HandleScanWifi(logger *service.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		results, err := mister.ScanWifiNetworks()
+		if err != nil {
+			networkError(w, err)
+			logger.Error("scan wifi: %s", err)
+			return
+		}
+
+		err = json.NewEncoder(w).Encode(WifiScanPayload{Networks: results})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logger.Error("encode wifi scan: %s", err)
+			return
+		}
+	}
+}
+
+type SavedWifiPayload struct {
+	Networks []mister.WifiNetwork `json:"networks"`
+}
+
+func writeSavedWifi(w http.ResponseWriter, logger *service.Logger, wc *mister.WpaConfig) {
+	err := json.NewEncoder(w).Encode(SavedWifiPayload{Networks: wc.SortedNetworks()})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		logger.Error("encode saved wifi networks: %s", err)
+		return
+	}
+}
+
+// updateWifi reads the saved networks, applies a change, saves them and
+// reloads wpa_supplicant, then writes the new list of networks.
+func updateWifi(w http.ResponseWriter, r *http.Request, logger *service.Logger, area string, update func(wc *mister.WpaConfig) error) {
+	wc, err := mister.ReadWpaConfig()
+	if err != nil {
+		networkError(w, err)
+		logger.Error("%s: %s", area, err)
+		return
+	}
+
+	err = update(wc)
+	if err != nil {
+		networkError(w, err)
+		logger.Error("%s: %s", area, err)
+		return
+	}
+
+	err = wc.Save(remoteAuthor(r))
+	if err != nil {
+		networkError(w, err)
+		logger.Error("%s: %s", area, err)
+		return
+	}
+
+	// wpa_supplicant may not be running, it'll use the new config on boot
+	err = mister.ReloadWifi()
+	if err != nil {
+		logger.Error("%s: reload wifi: %s", area, err)
+	}
+
+	writeSavedWifi(w, logger, wc)
+}
+
+func HandleListSavedWifi(logger *service.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		wc, err := mister.ReadWpaConfig()
+		if err != nil {
+			networkError(w, err)
+			logger.Error("list saved wifi: %s", err)
+			return
+		}
+
+		writeSavedWifi(w, logger, wc)
+	}
+}
+
+type AddWifiRequest struct {
+	SSID string `json:"ssid"`
+	// Password is empty for open networks.
+	Password string `json:"password"`
+	Hidden   bool   `json:"hidden"`
+}
+
+// HandleAddWifi saves a network, replacing any with the same SSID.
+func HandleAddWifi(logger *service.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var args AddWifiRequest
+		err := json.NewDecoder(r.Body).Decode(&args)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			logger.Error("decode add wifi request: %s", err)
+			return
+		}
+
+		logger.Info("add wifi: %s", args.SSID)
+		updateWifi(w, r, logger, "add wifi", func(wc *mister.WpaConfig) error {
+			return wc.SetNetwork(args.SSID, args.Password, args.Hidden)
+		})
+	}
+}
+
+func HandleRemoveWifi(logger *service.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ssid := mux.Vars(r)["ssid"]
+
+		logger.Info("remove wifi: %s", ssid)
+		updateWifi(w, r, logger, "remove wifi", func(wc *mister.WpaConfig) error {
+			return wc.RemoveNetwork(ssid)
+		})
+	}
+}
+
+type PrioritizeWifiRequest struct {
+	// SSIDs are put first in this order, highest priority first.
+	SSIDs []string `json:"ssids"`
+}
+
+func HandlePrioritizeWifi(logger *service.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var args PrioritizeWifiRequest
+		err := json.NewDecoder(r.Body).Decode(&args)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			logger.Error("decode prioritize wifi request: %s", err)
+			return
+		}
+
+		updateWifi(w, r, logger, "prioritize wifi", func(wc *mister.WpaConfig) error {
+			return wc.Prioritize(args.SSIDs)
+		})
+	}
+}
+
+func HandleLoadIPConfig(logger *service.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		dc, err := mister.ReadDhcpcdConfig()
+		if err != nil {
+			networkError(w, err)
+			logger.Error("load ip config: %s", err)
+			return
+		}
+
+		err = json.NewEncoder(w).Encode(dc.Get(mux.Vars(r)["interface"]))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logger.Error("encode ip config: %s", err)
+			return
+		}
+	}
+}
+
+// HandleSaveIPConfig switches an interface between DHCP and a static IP
+// address.
+func HandleSaveIPConfig(logger *service.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var ipc mister.IPConfig
+		err := json.NewDecoder(r.Body).Decode(&ipc)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			logger.Error("decode save ip config request: %s", err)
+			return
+		}
+		ipc.Interface = mux.Vars(r)["interface"]
+
+		dc, err := mister.ReadDhcpcdConfig()
+		if err != nil {
+			networkError(w, err)
+			logger.Error("save ip config: %s", err)
+			return
+		}
+
+		err = dc.Set(ipc)
+		if err != nil {
+			networkError(w, err)
+			logger.Error("save ip config: %s", err)
+			return
+		}
+
+		err = dc.Save(remoteAuthor(r))
+		if err != nil {
+			networkError(w, err)
+			logger.Error("save ip config: %s", err)
+			return
+		}
+		logger.Info("save ip config: %s dhcp=%t address=%s", ipc.Interface, ipc.DHCP, ipc.Address)
+
+		err = mister.RenewIP(ipc.Interface)
+		if err != nil {
+			logger.Error("save ip config: renew ip: %s", err)
+		}
+
+		err = json.NewEncoder(w).Encode(dc.Get(ipc.Interface))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logger.Error("encode ip config: %s", err)
+			return
+		}
+	}
+}
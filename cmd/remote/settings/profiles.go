@@ -0,0 +1,231 @@
+package settings
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/wizzomafizzo/mrext/pkg/mister"
+	"github.com/wizzomafizzo/mrext/pkg/profiles"
+	"github.com/wizzomafizzo/mrext/pkg/service"
+	"github.com/wizzomafizzo/mrext/pkg/utils"
+)
+
+// requestParts returns the profile parts from the request query, or false
+// if any are invalid.
+func requestParts(w http.ResponseWriter, r *http.Request, logger *service.Logger, area string) ([]string, bool) {
+	parts, err := profiles.ParseParts(r.URL.Query().Get("parts"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		logger.Error("%s: %s", area, err)
+		return nil, false
+	}
+	return parts, true
+}
+
+// readRequestProfile reads a profile archive from the request body.
+func readRequestProfile(w http.ResponseWriter, r *http.Request, logger *service.Logger, area string) (*profiles.Profile, bool) {
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, profiles.MaxSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		logger.Error("%s: reading profile: %s", area, err)
+		return nil, false
+	}
+
+	profile, err := profiles.Read(bytes.NewReader(data), int64(len(data)))
+	if errors.Is(err, profiles.ErrInvalidProfile) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		logger.Error("%s: %s", area, err)
+		return nil, false
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		logger.Error("%s: %s", area, err)
+		return nil, false
+	}
+
+	return profile, true
+}
+
+// HandleExportProfile sends a profile of this MiSTer's settings as a zip
+// file. All parts are included if none are given.
+func HandleExportProfile(logger *service.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts, ok := requestParts(w, r, logger, "export profile")
+		if !ok {
+			return
+		} else if len(parts) == 0 {
+			parts = profiles.AllParts
+		}
+
+		profile, err := profiles.Default.Export(parts)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logger.Error("export profile: %s", err)
+			return
+		}
+
+		hostname, _ := os.Hostname()
+		filename := fmt.Sprintf("%s_%s.zip", hostname, time.Now().Format("20060102_150405"))
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+
+		err = profile.Write(w)
+		if err != nil {
+			logger.Error("export profile: %s", err)
+			return
+		}
+	}
+}
+
+// HandlePreviewProfile returns what importing a profile would change,
+// without changing anything.
+func HandlePreviewProfile(logger *service.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts, ok := requestParts(w, r, logger, "preview profile")
+		if !ok {
+			return
+		}
+
+		profile, ok := readRequestProfile(w, r, logger, "preview profile")
+		if !ok {
+			return
+		}
+
+		changes, err := profiles.Default.Preview(profile, parts)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logger.Error("preview profile: %s", err)
+			return
+		}
+
+		err = json.NewEncoder(w).Encode(profiles.ImportResult{
+			Manifest: profile.Manifest,
+			Changes:  changes,
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logger.Error("encode profile preview: %s", err)
+			return
+		}
+	}
+}
+
+// HandleImportProfile imports the selected parts of a profile, or every
+// part if none are given.
+func HandleImportProfile(logger *service.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts, ok := requestParts(w, r, logger, "import profile")
+		if !ok {
+			return
+		}
+
+		profile, ok := readRequestProfile(w, r, logger, "import profile")
+		if !ok {
+			return
+		}
+
+		logger.Info("import profile: from %s, parts %v", profile.Manifest.Hostname, parts)
+
+		changes, err := profiles.Default.Import(profile, parts, remoteAuthor(r))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logger.Error("import profile: %s", err)
+			return
+		}
+
+		for _, change := range changes {
+			if change.Status != profiles.StatusUnchanged &&
+				utils.Contains([]string{profiles.PartInis, profiles.PartWallpaper}, change.Part) {
+				err = mister.RelaunchIfInMenu()
+				if err != nil {
+					logger.Error("relaunch mister: %s", err)
+				}
+				break
+			}
+		}
+
+		err = json.NewEncoder(w).Encode(profiles.ImportResult{
+			Manifest: profile.Manifest,
+			Changes:  changes,
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logger.Error("encode profile import: %s", err)
+			return
+		}
+	}
+}
+
+type PushProfileRequest struct {
+	// Peer is the hostname or IP of a peer found on the network.
+	Peer  string   `json:"peer"`
+	Parts []string `json:"parts"`
+}
+
+// HandlePushProfile exports a profile and imports it on a Remote peer.
+func HandlePushProfile(logger *service.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var args PushProfileRequest
+		err := json.NewDecoder(r.Body).Decode(&args)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			logger.Error("decode push profile request: %s", err)
+			return
+		}
+
+		var peer *mister.MdnsClient
+		for _, client := range mister.Mdns.GetClients() {
+			if client.IP != "" && (client.Hostname == args.Peer || client.IP == args.Peer) {
+				c := client
+				peer = &c
+				break
+			}
+		}
+		if peer == nil {
+			http.Error(w, "peer not found", http.StatusNotFound)
+			logger.Error("push profile: peer not found: %s", args.Peer)
+			return
+		}
+
+		for _, part := range args.Parts {
+			if !utils.Contains(profiles.AllParts, part) {
+				http.Error(w, "unknown part: "+part, http.StatusBadRequest)
+				logger.Error("push profile: unknown part: %s", part)
+				return
+			}
+		}
+
+		parts := args.Parts
+		if len(parts) == 0 {
+			parts = profiles.AllParts
+		}
+
+		profile, err := profiles.Default.Export(parts)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logger.Error("push profile: %s", err)
+			return
+		}
+
+		logger.Info("push profile: to %s (%s), parts %v", peer.Hostname, peer.IP, parts)
+
+		result, err := profiles.Push(profile, peer.IP, args.Parts)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			logger.Error("push profile: %s", err)
+			return
+		}
+
+		err = json.NewEncoder(w).Encode(result)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logger.Error("encode push profile: %s", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package settings
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/wizzomafizzo/mrext/pkg/mister"
+	"github.com/wizzomafizzo/mrext/pkg/service"
+)
+
+type IniValidationResponse struct {
+	Errors []mister.IniValueError `json:"errors"`
+}
+
+// validateIniRequest checks every value in a save request against the ini
+// schema. If any are invalid, a 400 response listing each invalid key is
+// written and false is returned.
+func validateIniRequest(w http.ResponseWriter, logger *service.Logger, args SaveIniRequest) bool {
+	errs := mister.ValidateIniValues(args)
+	if len(errs) == 0 {
+		return true
+	}
+
+	for _, err := range errs {
+		logger.Error("validate mister.ini: %s", err.Error())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	err := json.NewEncoder(w).Encode(IniValidationResponse{Errors: errs})
+	if err != nil {
+		logger.Error("encode mister.ini validation errors: %s", err)
+	}
+
+	return false
+}
+
+// HandleIniSchema returns the type, allowed values, default and description
+// of every MiSTer.ini key.
+func HandleIniSchema(logger *service.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := json.NewEncoder(w).Encode(mister.IniSchema)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logger.Error("encode mister.ini schema: %s", err)
+			return
+		}
+	}
+}
+
+// HandleIniDefaultsDiff returns every key in a section of an .ini file which
+// isn't set to its default value. The main section is used if no section is
+// given.
+func HandleIniDefaultsDiff(logger *service.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		mi, ok := loadRequestIni(w, r, logger)
+		if !ok {
+			return
+		}
+
+		name := r.URL.Query().Get("section")
+		if name == "" {
+			name = mister.MainIniSection
+		}
+
+		if !mi.HasSection(name) {
+			http.Error(w, "section does not exist", http.StatusNotFound)
+			logger.Error("diff mister.ini defaults: section does not exist: %s", name)
+			return
+		}
+
+		diffs, err := mi.DiffDefaults(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logger.Error("diff mister.ini defaults: %s", err)
+			return
+		}
+
+		err = json.NewEncoder(w).Encode(diffs)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logger.Error("encode mister.ini defaults diff: %s", err)
+			return
+		}
+	}
+}
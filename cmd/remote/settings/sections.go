@@ -0,0 +1,218 @@
+package settings
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+
+	"github.com/wizzomafizzo/mrext/pkg/mister"
+	"github.com/wizzomafizzo/mrext/pkg/service"
+)
+
+type IniSection struct {
+	Name   string            `json:"name"`
+	Type   string            `json:"type"`
+	Values map[string]string `json:"values"`
+}
+
+// loadRequestIni loads the .ini file from the id in the request path.
+func loadRequestIni(w http.ResponseWriter, r *http.Request, logger *service.Logger) (*mister.MisterIni, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		logger.Error("parse ini id: %s", err)
+		return nil, false
+	}
+
+	mi, err := mister.GetMisterIni(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		logger.Error("get mister.ini: %s", err)
+		return nil, false
+	}
+
+	err = mi.Load()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		logger.Error("load mister.ini: %s", err)
+		return nil, false
+	}
+
+	return &mi, true
+}
+
+// HandleListIniSections returns every section of an .ini file with its
+// values, or only the sections which apply to a core.
+func HandleListIniSections(logger *service.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		mi, ok := loadRequestIni(w, r, logger)
+		if !ok {
+			return
+		}
+
+		var names []string
+		var err error
+		if core := r.URL.Query().Get("core"); core != "" {
+			names, err = mi.CoreSections(core)
+		} else {
+			names, err = mi.Sections()
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logger.Error("list mister.ini sections: %s", err)
+			return
+		}
+
+		sections := make([]IniSection, 0, len(names))
+		for _, name := range names {
+			values, err := mi.SectionValues(name)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				logger.Error("list mister.ini sections: %s", err)
+				return
+			}
+
+			sections = append(sections, IniSection{
+				Name:   name,
+				Type:   mister.SectionType(name),
+				Values: values,
+			})
+		}
+
+		err = json.NewEncoder(w).Encode(sections)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logger.Error("encode mister.ini sections: %s", err)
+			return
+		}
+	}
+}
+
+func HandleLoadIniSection(logger *service.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		mi, ok := loadRequestIni(w, r, logger)
+		if !ok {
+			return
+		}
+
+		name := mux.Vars(r)["section"]
+		if !mi.HasSection(name) {
+			http.Error(w, "section does not exist", http.StatusNotFound)
+			logger.Error("load mister.ini section: section does not exist: %s", name)
+			return
+		}
+
+		values, err := mi.SectionValues(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logger.Error("load mister.ini section: %s", err)
+			return
+		}
+
+		err = json.NewEncoder(w).Encode(values)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logger.Error("encode mister.ini section: %s", err)
+			return
+		}
+	}
+}
+
+// HandleSaveIniSection sets keys in a section, creating the section if it
+// doesn't exist. Keys set to an empty value are removed.
+func HandleSaveIniSection(logger *service.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var args SaveIniRequest
+
+		err := json.NewDecoder(r.Body).Decode(&args)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			logger.Error("decode save ini section request: %s", err)
+			return
+		}
+
+		if !validateIniRequest(w, logger, args) {
+			return
+		}
+
+		mi, ok := loadRequestIni(w, r, logger)
+		if !ok {
+			return
+		}
+
+		name := mux.Vars(r)["section"]
+		logger.Info("save ini section request: %d [%s]", mi.Id, name)
+
+		err = mi.NewSection(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			logger.Error("update mister.ini section: %s", err)
+			return
+		}
+
+		for key, value := range args {
+			err := mi.SetSectionKey(name, key, value)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				logger.Error("update mister.ini section: %s", err)
+				return
+			}
+			logger.Info("update mister.ini section: [%s] %s=%s", name, key, value)
+		}
+
+		err = mi.SaveAs(remoteAuthor(r))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logger.Error("save mister.ini: %s", err)
+			return
+		}
+
+		err = mister.RelaunchIfInMenu()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logger.Error("relaunch mister: %s", err)
+			return
+		}
+	}
+}
+
+func HandleDeleteIniSection(logger *service.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		mi, ok := loadRequestIni(w, r, logger)
+		if !ok {
+			return
+		}
+
+		name := mux.Vars(r)["section"]
+		logger.Info("delete ini section request: %d [%s]", mi.Id, name)
+
+		if !mi.HasSection(name) {
+			http.Error(w, "section does not exist", http.StatusNotFound)
+			logger.Error("delete mister.ini section: section does not exist: %s", name)
+			return
+		}
+
+		err := mi.DeleteSection(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			logger.Error("delete mister.ini section: %s", err)
+			return
+		}
+
+		err = mi.SaveAs(remoteAuthor(r))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logger.Error("save mister.ini: %s", err)
+			return
+		}
+
+		err = mister.RelaunchIfInMenu()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logger.Error("relaunch mister: %s", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package settings
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/gorilla/mux"
+	"github.com/wizzomafizzo/mrext/pkg/config"
+	"github.com/wizzomafizzo/mrext/pkg/service"
+)
+
+// HandleListServices returns the status of the service supervisor and every
+// service it runs.
+func HandleListServices(logger *service.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status, err := service.ReadSupervisorStatus()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logger.Error("read supervisor status: %s", err)
+			return
+		}
+
+		err = json.NewEncoder(w).Encode(status)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logger.Error("encode supervisor status: %s", err)
+			return
+		}
+	}
+}
+
+// HandleServiceCrashLog returns the log written when a service last crashed.
+func HandleServiceCrashLog(logger *service.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["name"]
+
+		status, err := service.ReadSupervisorStatus()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logger.Error("read supervisor status: %s", err)
+			return
+		}
+
+		svc, ok := status.Service(name)
+		if !ok || svc.LastCrashLog == "" || filepath.Dir(svc.LastCrashLog) != config.CrashLogsFolder {
+			http.Error(w, "crash log not found", http.StatusNotFound)
+			logger.Error("service crash log: not found: %s", name)
+			return
+		}
+
+		data, err := os.ReadFile(svc.LastCrashLog)
+		if os.IsNotExist(err) {
+			http.Error(w, "crash log not found", http.StatusNotFound)
+			logger.Error("service crash log: not found: %s", svc.LastCrashLog)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logger.Error("read crash log: %s", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, err = w.Write(data)
+		if err != nil {
+			logger.Error("write crash log: %s", err)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package settings
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/wizzomafizzo/mrext/pkg/mister"
+	"github.com/wizzomafizzo/mrext/pkg/service"
+)
+
+type UBootArg struct {
+	mister.KernelArg
+	// Known is true if the arg is in the kernel params schema.
+	Known bool `json:"known"`
+	// Active is true if Linux was booted with the arg set the same way.
+	Active bool `json:"active"`
+}
+
+type UBootPayload struct {
+	Args   []UBootArg                 `json:"args"`
+	Params []mister.KernelParamSchema `json:"params"`
+	// RebootRequired is true if u-boot.txt has changes which only apply after
+	// a reboot.
+	RebootRequired bool `json:"rebootRequired"`
+}
+
+func ubootPayload(logger *service.Logger, f *mister.UBootFile) UBootPayload {
+	boot, err := mister.BootKernelArgs()
+	if err != nil {
+		logger.Error("read boot kernel args: %s", err)
+	}
+
+	payload := UBootPayload{
+		Args:   make([]UBootArg, 0),
+		Params: mister.KernelParams,
+	}
+
+	for _, arg := range f.KernelArgs() {
+		_, known := mister.GetKernelParamSchema(arg.Name)
+		active := mister.IsKernelArgActive(arg, boot)
+		payload.Args = append(payload.Args, UBootArg{
+			KernelArg: arg,
+			Known:     known,
+			Active:    active,
+		})
+
+		if boot != nil && !active {
+			payload.RebootRequired = true
+		}
+	}
+
+	return payload
+}
+
+func writeUBootPayload(w http.ResponseWriter, logger *service.Logger, payload UBootPayload) {
+	err := json.NewEncoder(w).Encode(payload)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		logger.Error("encode u-boot params: %s", err)
+		return
+	}
+}
+
+// HandleListKernelArgs returns the kernel args set in u-boot.txt, the known
+// kernel params and if a reboot is needed to apply them.
+func HandleListKernelArgs(logger *service.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		f, err := mister.ReadUBootFile()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logger.Error("read u-boot.txt: %s", err)
+			return
+		}
+
+		writeUBootPayload(w, logger, ubootPayload(logger, f))
+	}
+}
+
+type SetKernelArgRequest struct {
+	// Value is the value of the arg. Args with no value, like quiet, are set
+	// by leaving it out.
+	Value *string `json:"value"`
+}
+
+type KernelArgValidationResponse struct {
+	Errors []mister.KernelArgError `json:"errors"`
+}
+
+// HandleSetKernelArg adds a kernel arg to u-boot.txt or replaces its value.
+func HandleSetKernelArg(logger *service.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var args SetKernelArgRequest
+		err := json.NewDecoder(r.Body).Decode(&args)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			logger.Error("decode set kernel arg request: %s", err)
+			return
+		}
+
+		arg := mister.KernelArg{Name: mux.Vars(r)["name"], Flag: args.Value == nil}
+		if args.Value != nil {
+			arg.Value = *args.Value
+		}
+
+		err = mister.ValidateKernelArg(arg)
+		if ke, ok := err.(*mister.KernelArgError); ok {
+			logger.Error("validate kernel arg: %s", err)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			err := json.NewEncoder(w).Encode(KernelArgValidationResponse{Errors: []mister.KernelArgError{*ke}})
+			if err != nil {
+				logger.Error("encode kernel arg validation errors: %s", err)
+			}
+			return
+		}
+
+		f, err := mister.ReadUBootFile()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logger.Error("read u-boot.txt: %s", err)
+			return
+		}
+
+		f.SetKernelArgs(mister.SetKernelArg(f.KernelArgs(), arg))
+
+		err = f.Save(remoteAuthor(r))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logger.Error("save u-boot.txt: %s", err)
+			return
+		}
+		logger.Info("set kernel arg: %s", arg.String())
+
+		writeUBootPayload(w, logger, ubootPayload(logger, f))
+	}
+}
+
+// HandleDeleteKernelArg removes a kernel arg from u-boot.txt.
+func HandleDeleteKernelArg(logger *service.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["name"]
+
+		f, err := mister.ReadUBootFile()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logger.Error("read u-boot.txt: %s", err)
+			return
+		}
+
+		existing := f.KernelArgs()
+		args, removed := mister.RemoveKernelArg(existing, name)
+		if !removed {
+			http.Error(w, "kernel arg not found", http.StatusNotFound)
+			logger.Error("delete kernel arg: not found: %s", name)
+			return
+		}
+		f.SetKernelArgs(args)
+
+		err = f.Save(remoteAuthor(r))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logger.Error("save u-boot.txt: %s", err)
+			return
+		}
+		logger.Info("delete kernel arg: %s", name)
+
+		payload := ubootPayload(logger, f)
+
+		// removed args aren't listed, so check if they were used on boot
+		boot, _ := mister.BootKernelArgs()
+		for _, arg := range existing {
+			if arg.Name == name && mister.IsKernelArgActive(arg, boot) {
+				payload.RebootRequired = true
+			}
+		}
+
+		writeUBootPayload(w, logger, payload)
+	}
+}
@@ -0,0 +1,182 @@
+package settings
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/wizzomafizzo/mrext/cmd/remote/websocket"
+	"github.com/wizzomafizzo/mrext/pkg/mister"
+	"github.com/wizzomafizzo/mrext/pkg/service"
+)
+
+// Updates run in the background. Each line of output is broadcast to
+// websocket clients as "updateLog:" followed by a JSON encoded
+// UpdateLogLine, and the run itself as "updateRun:" when it starts and
+// finishes.
+
+func updateError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, mister.ErrUnknownUpdater):
+		status = http.StatusBadRequest
+	case errors.Is(err, mister.ErrUpdateRunning):
+		status = http.StatusConflict
+	case errors.Is(err, mister.ErrNoUpdateRunning), errors.Is(err, mister.ErrUpdateRunNotFound):
+		status = http.StatusNotFound
+	}
+	http.Error(w, err.Error(), status)
+}
+
+type UpdateLogLine struct {
+	ID   string `json:"id"`
+	Line string `json:"line"`
+}
+
+func broadcastUpdate(logger *service.Logger, prefix string, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		logger.Error("update: encoding %s: %s", prefix, err)
+		return
+	}
+	websocket.Broadcast(logger, prefix+":"+string(data))
+}
+
+type UpdatesPayload struct {
+	// Current is the running update, or null.
+	Current *mister.UpdateRun  `json:"current"`
+	Runs    []mister.UpdateRun `json:"runs"`
+	// LastSuccessfulRun is when downloader last finished without errors,
+	// including runs started outside Remote.
+	LastSuccessfulRun string `json:"lastSuccessfulRun"`
+}
+
+func HandleListUpdates(logger *service.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		runs, err := mister.DefaultUpdater.Runs()
+		if err != nil {
+			updateError(w, err)
+			logger.Error("list updates: %s", err)
+			return
+		}
+
+		payload := UpdatesPayload{Runs: runs}
+		if current, ok := mister.DefaultUpdater.Current(); ok {
+			payload.Current = &current
+		}
+
+		lastRun, err := mister.GetLastUpdateTime()
+		if err != nil {
+			logger.Error("list updates: last update time: %s", err)
+		} else if !lastRun.IsZero() {
+			payload.LastSuccessfulRun = lastRun.Format(time.RFC3339)
+		}
+
+		err = json.NewEncoder(w).Encode(payload)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logger.Error("encode updates: %s", err)
+			return
+		}
+	}
+}
+
+type StartUpdateRequest struct {
+	// Updater is downloader or update_all.
+	Updater string `json:"updater"`
+}
+
+// HandleStartUpdate runs downloader or update_all in the background.
+func HandleStartUpdate(logger *service.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var args StartUpdateRequest
+		err := json.NewDecoder(r.Body).Decode(&args)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			logger.Error("decode start update request: %s", err)
+			return
+		}
+
+		run, err := mister.DefaultUpdater.Start(
+			args.Updater,
+			remoteAuthor(r),
+			func(run mister.UpdateRun, line string) {
+				broadcastUpdate(logger, "updateLog", UpdateLogLine{ID: run.ID, Line: line})
+			},
+			func(run mister.UpdateRun) {
+				if run.Error != "" {
+					logger.Error("update %s: %s", run.ID, run.Error)
+				} else {
+					logger.Info("update %s: finished", run.ID)
+				}
+				broadcastUpdate(logger, "updateRun", run)
+			},
+		)
+		if err != nil {
+			updateError(w, err)
+			logger.Error("start update: %s", err)
+			return
+		}
+		logger.Info("update %s: started %s", run.ID, run.Updater)
+		broadcastUpdate(logger, "updateRun", run)
+
+		err = json.NewEncoder(w).Encode(run)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logger.Error("encode update run: %s", err)
+			return
+		}
+	}
+}
+
+// HandleCancelUpdate stops the running update.
+func HandleCancelUpdate(logger *service.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := mister.DefaultUpdater.Cancel()
+		if err != nil {
+			updateError(w, err)
+			logger.Error("cancel update: %s", err)
+			return
+		}
+		logger.Info("cancel update")
+	}
+}
+
+func HandleViewUpdate(logger *service.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		run, _, err := mister.DefaultUpdater.Run(mux.Vars(r)["id"])
+		if err != nil {
+			updateError(w, err)
+			logger.Error("view update: %s", err)
+			return
+		}
+
+		err = json.NewEncoder(w).Encode(run)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logger.Error("encode update run: %s", err)
+			return
+		}
+	}
+}
+
+// HandleUpdateLog returns the output of an update, as much as has been
+// written if it's still running.
+func HandleUpdateLog(logger *service.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, data, err := mister.DefaultUpdater.Run(mux.Vars(r)["id"])
+		if err != nil {
+			updateError(w, err)
+			logger.Error("update log: %s", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, err = w.Write(data)
+		if err != nil {
+			logger.Error("write update log: %s", err)
+		}
+	}
+}
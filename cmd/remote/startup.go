@@ -4,6 +4,7 @@ import (
 	"github.com/wizzomafizzo/mrext/pkg/config"
 	"github.com/wizzomafizzo/mrext/pkg/metadata"
 	"github.com/wizzomafizzo/mrext/pkg/mister"
+	"github.com/wizzomafizzo/mrext/pkg/playlist"
 	"github.com/wizzomafizzo/mrext/pkg/service"
 	"github.com/wizzomafizzo/mrext/pkg/tracker"
 	"github.com/wizzomafizzo/mrext/pkg/utils"
@@ -72,8 +73,20 @@ func setupSSHKeys(logger *service.Logger, cfg *config.UserConfig) {
 	}
 }
 
-func runStartupTasks(logger *service.Logger, cfg *config.UserConfig, trk *tracker.Tracker) {
+func resumePlaylist(logger *service.Logger, cfg *config.UserConfig, player *playlist.Player) {
+	if !cfg.Playlists.ResumeOnStart {
+		return
+	}
+
+	err := player.Resume(true)
+	if err != nil {
+		logger.Error("failed to resume playlist: %s", err)
+	}
+}
+
+func runStartupTasks(logger *service.Logger, cfg *config.UserConfig, trk *tracker.Tracker, player *playlist.Player) {
 	setupSSHKeys(logger, cfg)
+	resumePlaylist(logger, cfg, player)
 
 	go func() {
 		haveInternet := utils.WaitForInternet(30)
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/wizzomafizzo/mrext/pkg/config"
+	"github.com/wizzomafizzo/mrext/pkg/games"
+	"github.com/wizzomafizzo/mrext/pkg/mister"
+	"github.com/wizzomafizzo/mrext/pkg/saves"
+	"github.com/wizzomafizzo/mrext/pkg/service"
+	"github.com/wizzomafizzo/mrext/pkg/tracker"
+	"github.com/wizzomafizzo/mrext/pkg/utils"
+)
+
+const (
+	appName     = "savesnap"
+	defaultKeep = 10
+)
+
+// snapshotDb takes snapshots from tracker events instead of storing them.
+type snapshotDb struct {
+	logger *service.Logger
+	cfg    *config.UserConfig
+}
+
+func (s *snapshotDb) FixPowerLoss() (bool, error) {
+	return false, nil
+}
+
+func (s *snapshotDb) AddEvent(ev tracker.EventAction) error {
+	snapshot, err := saves.Default.SnapshotEvent(ev, saves.SnapshotOptions{
+		Keep:             s.cfg.SaveSnap.Keep,
+		IgnoreSavestates: s.cfg.SaveSnap.IgnoreSavestates,
+	})
+	if err != nil {
+		return fmt.Errorf("error taking snapshot: %s", err)
+	} else if snapshot != nil {
+		s.logger.Info("took snapshot %s of %s/%s (%d files)", snapshot.ID, snapshot.SystemId, snapshot.Game, len(snapshot.Files))
+	}
+	return nil
+}
+
+func (s *snapshotDb) UpdateCore(_ tracker.CoreTime) error {
+	return nil
+}
+
+func (s *snapshotDb) GetCore(_ string) (tracker.CoreTime, error) {
+	return tracker.CoreTime{}, nil
+}
+
+func (s *snapshotDb) UpdateGame(_ tracker.GameTime) error {
+	return nil
+}
+
+func (s *snapshotDb) GetGame(_ string) (tracker.GameTime, error) {
+	return tracker.GameTime{}, nil
+}
+
+func (s *snapshotDb) NoResults(_ error) bool {
+	return true
+}
+
+func startService(logger *service.Logger, cfg *config.UserConfig) (func() error, error) {
+	tr, err := tracker.NewTracker(logger, cfg, &snapshotDb{
+		logger: logger,
+		cfg:    cfg,
+	})
+	if err != nil {
+		logger.Error("error starting tracker: %s", err)
+		os.Exit(1)
+	}
+
+	tr.LoadCore()
+	if !mister.ActiveGameEnabled() {
+		err := mister.SetActiveGame("")
+		if err != nil {
+			tr.Logger.Error("error setting active game: %s", err)
+		}
+	}
+
+	watcher, err := tracker.StartFileWatch(tr)
+	if err != nil {
+		tr.Logger.Error("error starting file watch: %s", err)
+		os.Exit(1)
+	}
+
+	return func() error {
+		err := watcher.Close()
+		if err != nil {
+			tr.Logger.Error("error closing file watcher: %s", err)
+		}
+		tr.StopAll()
+		return nil
+	}, nil
+}
+
+func tryAddStartup() error {
+	var startup mister.Startup
+
+	err := startup.Load()
+	if err != nil {
+		return err
+	}
+
+	migrated, err := startup.MigrateService(appName)
+	if err != nil {
+		return err
+	} else if migrated {
+		err = startup.Save()
+		if err != nil {
+			return err
+		}
+	}
+
+	if !startup.HasSupervised(appName) {
+		if utils.YesOrNoPrompt("SaveSnap must be set to run on MiSTer startup. Add it now?") {
+			err = startup.AddSupervised(appName)
+			if err != nil {
+				return err
+			}
+
+			err = startup.Save()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// parseGame splits a game argument in the form <system>/<game> into a system
+// ID and game name. The game name is its filename without an extension.
+func parseGame(arg string) (string, string, error) {
+	i := strings.Index(arg, "/")
+	if i == -1 {
+		return "", "", fmt.Errorf("game must be in the form <system>/<game>: %s", arg)
+	}
+
+	system, err := games.LookupSystem(arg[:i])
+	if err != nil {
+		return "", "", err
+	}
+
+	game := arg[i+1:]
+	if game == "" {
+		return "", "", fmt.Errorf("missing game name: %s", arg)
+	}
+
+	return system.Id, game, nil
+}
+
+func listSnapshots(arg string) error {
+	systemId, game, err := parseGame(arg)
+	if err != nil {
+		return err
+	}
+
+	snapshots, err := saves.Default.ListSnapshots(systemId, game)
+	if err != nil {
+		return err
+	}
+
+	if len(snapshots) == 0 {
+		fmt.Printf("No snapshots found for %s/%s.\n", systemId, game)
+		return nil
+	}
+
+	for _, snapshot := range snapshots {
+		filenames := make([]string, 0, len(snapshot.Files))
+		for _, file := range snapshot.Files {
+			filenames = append(filenames, file.Filename)
+		}
+		fmt.Printf(
+			"%-18s  %s  %s\n",
+			snapshot.ID,
+			snapshot.Time.Format("2006-01-02 15:04:05"),
+			strings.Join(filenames, ", "),
+		)
+	}
+
+	return nil
+}
+
+func restoreSnapshot(arg string, id string) error {
+	systemId, game, err := parseGame(arg)
+	if err != nil {
+		return err
+	}
+
+	err = saves.Default.RestoreSnapshot(systemId, game, id)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Restored snapshot %s of %s/%s.\n", id, systemId, game)
+	return nil
+}
+
+func main() {
+	svcOpt := flag.String("service", "", "manage savesnap service (start, stop, restart, status, supervise)")
+	listOpt := flag.String("list", "", "list snapshots of a game, in the form <system>/<game>")
+	restoreOpt := flag.String("restore", "", "restore a snapshot of a game, in the form <system>/<game>")
+	idOpt := flag.String("id", "", "ID of snapshot to restore")
+	flag.Parse()
+
+	logger := service.NewLogger(appName)
+	service.HandleSupervise(logger, svcOpt)
+
+	cfg, err := config.LoadUserConfig(appName, &config.UserConfig{
+		SaveSnap: config.SaveSnapConfig{
+			Keep: defaultKeep,
+		},
+	})
+	if err != nil {
+		logger.Error("error loading user config: %s", err)
+		fmt.Println("Error loading config:", err)
+		os.Exit(1)
+	}
+
+	if *listOpt != "" {
+		err := listSnapshots(*listOpt)
+		if err != nil {
+			fmt.Println("Error listing snapshots:", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if *restoreOpt != "" {
+		if *idOpt == "" {
+			fmt.Println("A snapshot ID must be given with -id.")
+			os.Exit(1)
+		}
+
+		err := restoreSnapshot(*restoreOpt, *idOpt)
+		if err != nil {
+			logger.Error("error restoring snapshot: %s", err)
+			fmt.Println("Error restoring snapshot:", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	svc, err := service.NewService(service.ServiceArgs{
+		Name:   appName,
+		Logger: logger,
+		Entry: func() (func() error, error) {
+			return startService(logger, cfg)
+		},
+	})
+	if err != nil {
+		logger.Error("error creating service: %s", err)
+		fmt.Println("Error creating service:", err)
+		os.Exit(1)
+	}
+
+	recents, err := mister.RecentsOptionEnabled()
+	if err != nil {
+		logger.Error("error checking recents option: %s", err)
+		fmt.Println("Could not read the MiSTer.ini file. Make sure the \"recents\" option is enabled if savesnap doesn't work.")
+	} else if !recents {
+		logger.Error("recents option not enabled, exiting...")
+		fmt.Println("The \"recents\" option must be enabled for savesnap to work.")
+		fmt.Println("Configure it in the MiSTer.ini file and run savesnap again.")
+		os.Exit(1)
+	}
+
+	svc.ServiceHandler(svcOpt)
+
+	err = tryAddStartup()
+	if err != nil {
+		logger.Error("error adding startup: %s", err)
+		fmt.Println("Error adding to startup:", err)
+	}
+
+	if !svc.Running() {
+		err := svc.Start()
+		if err != nil {
+			logger.Error("error starting service: %s", err)
+			fmt.Println("Error starting service:", err)
+			os.Exit(1)
+		} else {
+			fmt.Println("Service started successfully.")
+			os.Exit(0)
+		}
+	} else {
+		fmt.Println("Service is running.")
+		os.Exit(0)
+	}
+}
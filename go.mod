@@ -32,7 +32,6 @@ require (
 	github.com/gocarina/gocsv v0.0.0-20230616125104-99d496ca653d
 	github.com/gorilla/mux v1.8.0
 	github.com/gorilla/websocket v1.5.0
-	github.com/hsanjuan/go-ndef v0.0.1
 	github.com/joho/godotenv v1.4.0
 	github.com/libp2p/zeroconf/v2 v2.2.0
 	github.com/rs/cors v1.8.2
@@ -107,6 +107,11 @@ var apps = []app{
 		path: filepath.Join(cwd, "cmd", "samindex"),
 		bin:  "samindex",
 	},
+	{
+		name: "savesnap",
+		path: filepath.Join(cwd, "cmd", "savesnap"),
+		bin:  "savesnap.sh",
+	},
 	{
 		name: "screenshots",
 		path: filepath.Join(cwd, "cmd", "screenshots"),
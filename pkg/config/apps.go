@@ -18,5 +18,23 @@ const ArcadeDBFile = MrextConfigFolder + "/ArcadeDatabase.csv"
 
 const NfcDatabaseFile = SdFolder + "/nfc.csv"
 const NfcLastScanFile = TempFolder + "/NFCSCAN"
+const NfcSocket = TempFolder + "/nfc.sock"
+const NfcScanLogFile = MrextConfigFolder + "/nfc_scans.log"
 
 const GamesDb = ScriptsConfigFolder + "/mrext/games.db"
+
+const SaveBackupsFolder = SdFolder + "/saves_backup"
+
+const ConfigHistoryFolder = MrextConfigFolder + "/history"
+const UpdateRunsFolder = MrextConfigFolder + "/updates"
+
+const ScreenshotsIndexFile = MrextConfigFolder + "/screenshots.json"
+const ScreenshotThumbnailsFolder = MrextConfigFolder + "/thumbnails"
+
+const PlaylistsFolder = SdFolder + "/playlists"
+const PlaylistStateFile = MrextConfigFolder + "/playlist.json"
+const PlaylistSocket = TempFolder + "/playlist.sock"
+
+const SupervisorFile = MrextConfigFolder + "/supervisor.json"
+const SupervisorStatusFile = TempFolder + "/supervisor_status.json"
+const CrashLogsFolder = MrextConfigFolder + "/crashes"
@@ -8,6 +8,9 @@ const TempFolder = "/tmp"
 const LinuxFolder = SdFolder + "/linux"
 const ScriptsFolder = SdFolder + "/Scripts"
 const CifsFolder = SdFolder + "/cifs"
+const SavesFolder = SdFolder + "/saves"
+const SavestatesFolder = SdFolder + "/savestates"
+const FavoritesFolder = SdFolder + "/_@Favorites"
 
 const MenuConfigFile = CoreConfigFolder + "/MENU.CFG"
 
@@ -18,6 +21,8 @@ const MisterIniFileAlt3 = SdFolder + "/MiSTer_alt_3.ini"
 
 const StartupFile = LinuxFolder + "/user-startup.sh"
 const UBootConfigFile = LinuxFolder + "/u-boot.txt"
+const WpaSupplicantFile = LinuxFolder + "/wpa_supplicant.conf"
+const DhcpcdConfigFile = LinuxFolder + "/dhcpcd.conf"
 
 const CoreNameFile = TempFolder + "/CORENAME"
 const CurrentPathFile = TempFolder + "/CURRENTPATH"
@@ -32,6 +37,8 @@ const CmdInterface = "/dev/MiSTer_cmd"
 const SSHConfigFolder = "/root/.ssh"
 const SSHKeysFile = SSHConfigFolder + "/authorized_keys"
 const UserSSHKeysFile = LinuxFolder + "/authorized_keys"
+const DownloaderScript = ScriptsFolder + "/downloader.sh"
+const UpdateAllScript = ScriptsFolder + "/update_all.sh"
 const DownloaderLastRun = ScriptsFolder + "/.config/downloader/downloader.last_successful_run"
 
 // TODO: this can't be hardcoded if we want dynamic arcade folders
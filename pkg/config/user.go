@@ -32,11 +32,24 @@ type LastPlayedConfig struct {
 	DisableRecentFolder bool   `ini:"disable_recent_folder,omitempty"`
 }
 
+type SaveSnapConfig struct {
+	// Keep is the number of snapshots kept for each game.
+	Keep             int  `ini:"keep,omitempty"`
+	IgnoreSavestates bool `ini:"ignore_savestates,omitempty"`
+}
+
 type RemoteConfig struct {
 	MdnsService     bool   `ini:"mdns_service,omitempty"`
 	SyncSSHKeys     bool   `ini:"sync_ssh_keys,omitempty"`
 	CustomLogo      string `ini:"custom_logo,omitempty"`
 	AnnounceGameUrl string `ini:"announce_game_url,omitempty"`
+	// HistoryKeep is the number of versions kept of each config file, such
+	// as MiSTer.ini.
+	HistoryKeep int `ini:"history_keep,omitempty"`
+	// TrustPeer lists peers which can be controlled and synced with, in the
+	// form <ip>[:<permission>,...]. All permissions are given if none are
+	// listed.
+	TrustPeer []string `ini:"trust_peer,omitempty,allowshadow"`
 }
 
 type NfcConfig struct {
@@ -44,6 +57,17 @@ type NfcConfig struct {
 	AllowCommands    bool   `ini:"allow_commands,omitempty"`
 	DisableSounds    bool   `ini:"disable_sounds,omitempty"`
 	ProbeDevice      bool   `ini:"probe_device,omitempty"`
+	ExitOnRemove     bool   `ini:"exit_on_remove,omitempty"`
+	OnRemove         string `ini:"on_remove,omitempty"`
+	DisableScanLog   bool   `ini:"disable_scan_log,omitempty"`
+	// ScanLogSize is the maximum size of the scan log in KB before it's
+	// rotated.
+	ScanLogSize int `ini:"scan_log_size,omitempty"`
+}
+
+type PlaylistsConfig struct {
+	DefaultDuration int  `ini:"default_duration,omitempty"`
+	ResumeOnStart   bool `ini:"resume_on_start,omitempty"`
 }
 
 type SystemsConfig struct {
@@ -59,8 +83,10 @@ type UserConfig struct {
 	Random     RandomConfig     `ini:"random,omitempty"`
 	Search     SearchConfig     `ini:"search,omitempty"`
 	LastPlayed LastPlayedConfig `ini:"lastplayed,omitempty"`
+	SaveSnap   SaveSnapConfig   `ini:"savesnap,omitempty"`
 	Remote     RemoteConfig     `ini:"remote,omitempty"`
 	Nfc        NfcConfig        `ini:"nfc,omitempty"`
+	Playlists  PlaylistsConfig  `ini:"playlists,omitempty"`
 	Systems    SystemsConfig    `ini:"systems,omitempty"`
 }
 
@@ -1,12 +1,103 @@
 package mister
 
 import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+
 	"github.com/wizzomafizzo/mrext/pkg/config"
 	"gopkg.in/ini.v1"
-	"os"
 )
 
-const downloaderIniFile = config.SdFolder + "/downloader.ini"
+// Each section of downloader.ini with a db_url is a database downloader
+// installs files from. The [mister] section holds downloader's own options.
+
+const downloaderOptionsSection = "mister"
+
+var downloaderIniFile = config.SdFolder + "/downloader.ini"
+
+//go:embed downloader_catalog.json
+var downloaderCatalogData []byte
+
+var (
+	downloaderDbIdRe       = regexp.MustCompile(`^[a-zA-Z0-9_\-./]+$`)
+	downloaderFilterTermRe = regexp.MustCompile(`^!?[a-zA-Z0-9_\-]+$`)
+)
+
+// DownloaderCatalogDb is a known community database from the bundled
+// catalog.
+type DownloaderCatalogDb struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	URL         string `json:"url"`
+	Homepage    string `json:"homepage"`
+	// Category is cores, arcade, extras or mrext.
+	Category string `json:"category"`
+}
+
+// DownloaderCatalog returns the known databases from the bundled catalog.
+func DownloaderCatalog() ([]DownloaderCatalogDb, error) {
+	var catalog []DownloaderCatalogDb
+	err := json.Unmarshal(downloaderCatalogData, &catalog)
+	if err != nil {
+		return nil, err
+	}
+	return catalog, nil
+}
+
+// DownloaderDb is a database section of downloader.ini.
+type DownloaderDb struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+	// Filter is the database's own filter terms, e.g. "arcade !cheats". Empty
+	// uses the filter in the [mister] section.
+	Filter string `json:"filter"`
+}
+
+// DownloaderDbError is a problem with a single option of a database.
+type DownloaderDbError struct {
+	ID      string `json:"id"`
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e *DownloaderDbError) Error() string {
+	return fmt.Sprintf("invalid downloader db %s: %s %s", e.ID, e.Field, e.Message)
+}
+
+// ValidateDownloaderDb checks a database can be written to downloader.ini
+// and downloader will be able to read it.
+func ValidateDownloaderDb(db DownloaderDb) error {
+	if !downloaderDbIdRe.MatchString(db.ID) {
+		return &DownloaderDbError{ID: db.ID, Field: "id", Message: "must only contain letters, numbers, _, -, . and /"}
+	} else if strings.EqualFold(db.ID, downloaderOptionsSection) || strings.EqualFold(db.ID, ini.DefaultSection) {
+		return &DownloaderDbError{ID: db.ID, Field: "id", Message: "is reserved"}
+	}
+
+	u, err := url.Parse(db.URL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return &DownloaderDbError{ID: db.ID, Field: "url", Message: "must be an http or https url"}
+	} else if !strings.HasSuffix(u.Path, ".json") && !strings.HasSuffix(u.Path, ".json.zip") {
+		return &DownloaderDbError{ID: db.ID, Field: "url", Message: "must be a .json or .json.zip file"}
+	}
+
+	for _, term := range strings.Fields(db.Filter) {
+		// [mister] includes the terms of the global filter
+		if strings.EqualFold(term, "["+downloaderOptionsSection+"]") {
+			continue
+		} else if !downloaderFilterTermRe.MatchString(term) {
+			return &DownloaderDbError{ID: db.ID, Field: "filter", Message: "has invalid term: " + term}
+		}
+	}
+
+	return nil
+}
 
 type DownloaderIni struct {
 	IniFile *ini.File
@@ -37,8 +128,16 @@ func LoadDownloaderIni() (*DownloaderIni, error) {
 	}, nil
 }
 
-func (d *DownloaderIni) Save() error {
-	return d.IniFile.SaveTo(downloaderIniFile)
+// Save writes downloader.ini. The file as it was is kept in history first,
+// so it can be rolled back.
+func (d *DownloaderIni) Save(author string) error {
+	var buf bytes.Buffer
+	_, err := d.IniFile.WriteTo(&buf)
+	if err != nil {
+		return err
+	}
+
+	return DefaultHistory.Write(downloaderIniFile, buf.Bytes(), author)
 }
 
 func (d *DownloaderIni) AddDb(name, url string) error {
@@ -54,12 +153,80 @@ func (d *DownloaderIni) AddDb(name, url string) error {
 }
 
 func (d *DownloaderIni) RemoveDb(name string) error {
+	if section := d.section(name); section != nil {
+		name = section.Name()
+	}
 	delete(d.Dbs, name)
 	d.IniFile.DeleteSection(name)
 	return nil
 }
 
 func (d *DownloaderIni) HasDb(name string) bool {
-	_, ok := d.Dbs[name]
-	return ok
+	return d.section(name) != nil
+}
+
+// section returns the section of a database. Downloader ignores case in
+// database IDs, so this does too.
+func (d *DownloaderIni) section(id string) *ini.Section {
+	for _, section := range d.IniFile.Sections() {
+		if strings.EqualFold(section.Name(), id) && section.HasKey("db_url") {
+			return section
+		}
+	}
+	return nil
+}
+
+func sectionDb(section *ini.Section) DownloaderDb {
+	return DownloaderDb{
+		ID:     section.Name(),
+		URL:    section.Key("db_url").String(),
+		Filter: section.Key("filter").String(),
+	}
+}
+
+// Db returns a database by its ID.
+func (d *DownloaderIni) Db(id string) (DownloaderDb, bool) {
+	section := d.section(id)
+	if section == nil {
+		return DownloaderDb{}, false
+	}
+	return sectionDb(section), true
+}
+
+// ListDbs returns every database in the order they're in the file.
+func (d *DownloaderIni) ListDbs() []DownloaderDb {
+	dbs := make([]DownloaderDb, 0)
+	for _, section := range d.IniFile.Sections() {
+		if section.HasKey("db_url") {
+			dbs = append(dbs, sectionDb(section))
+		}
+	}
+	return dbs
+}
+
+// SetDb adds a database or replaces its URL and filter. Other options in its
+// section are kept.
+func (d *DownloaderIni) SetDb(db DownloaderDb) error {
+	err := ValidateDownloaderDb(db)
+	if err != nil {
+		return err
+	}
+
+	section := d.section(db.ID)
+	if section == nil {
+		section, err = d.IniFile.NewSection(db.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	section.Key("db_url").SetValue(db.URL)
+	if db.Filter != "" {
+		section.Key("filter").SetValue(db.Filter)
+	} else {
+		section.DeleteKey("filter")
+	}
+	d.Dbs[section.Name()] = db.URL
+
+	return nil
 }
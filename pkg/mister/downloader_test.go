@@ -0,0 +1,143 @@
+package mister
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDownloaderCatalog(t *testing.T) {
+	catalog, err := DownloaderCatalog()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := make(map[string]bool)
+	for _, db := range catalog {
+		if ids[db.ID] {
+			t.Errorf("duplicate catalog db: %s", db.ID)
+		}
+		ids[db.ID] = true
+
+		err := ValidateDownloaderDb(DownloaderDb{ID: db.ID, URL: db.URL})
+		if err != nil {
+			t.Errorf("catalog db: %s", err)
+		}
+		if db.Name == "" || db.Category == "" {
+			t.Errorf("catalog db %s is missing a name or category", db.ID)
+		}
+	}
+}
+
+func TestValidateDownloaderDb(t *testing.T) {
+	tests := []struct {
+		db    DownloaderDb
+		field string
+	}{
+		{DownloaderDb{ID: "mrext/all", URL: "https://github.com/wizzomafizzo/mrext/raw/main/releases/all.json"}, ""},
+		{DownloaderDb{ID: "jtcores", URL: "https://example.com/jtbindb.json.zip?x=1", Filter: "[mister] !cheats arcade"}, ""},
+		{DownloaderDb{ID: "my db", URL: "https://example.com/db.json"}, "id"},
+		{DownloaderDb{ID: "MiSTer", URL: "https://example.com/db.json"}, "id"},
+		{DownloaderDb{ID: "custom", URL: "ftp://example.com/db.json"}, "url"},
+		{DownloaderDb{ID: "custom", URL: "https://example.com/db.zip"}, "url"},
+		{DownloaderDb{ID: "custom", URL: "https://example.com/db.json", Filter: "arcade;rm"}, "filter"},
+	}
+
+	for _, tt := range tests {
+		err := ValidateDownloaderDb(tt.db)
+		if tt.field == "" {
+			if err != nil {
+				t.Errorf("%+v: %s", tt.db, err)
+			}
+			continue
+		}
+
+		de, ok := err.(*DownloaderDbError)
+		if !ok || de.Field != tt.field {
+			t.Errorf("%+v: got %v want invalid %s", tt.db, err, tt.field)
+		}
+	}
+}
+
+func TestDownloaderIniDbs(t *testing.T) {
+	h := useTestHistory(t)
+
+	prev := downloaderIniFile
+	downloaderIniFile = filepath.Join(t.TempDir(), "downloader.ini")
+	t.Cleanup(func() {
+		downloaderIniFile = prev
+	})
+
+	writeTestFile(t, downloaderIniFile, `[mister]
+filter = arcade
+
+[Distribution_MiSTer]
+db_url = https://raw.githubusercontent.com/MiSTer-devel/Distribution_MiSTer/main/db.json.zip
+
+[jtcores]
+db_url = https://raw.githubusercontent.com/jotego/jtcores_mister/main/jtbindb.json.zip
+filter = [mister] !cheats
+`)
+
+	d, err := LoadDownloaderIni()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !d.HasDb("distribution_mister") || d.HasDb("mister") {
+		t.Errorf("got dbs %v", d.Dbs)
+	}
+
+	err = d.SetDb(DownloaderDb{ID: "distribution_mister", URL: "https://example.com/db.json.zip", Filter: "console"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.SetDb(DownloaderDb{ID: "jtcores", URL: "https://raw.githubusercontent.com/jotego/jtcores_mister/main/jtbindb.json.zip"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.SetDb(DownloaderDb{ID: "mrext/all", URL: "https://github.com/wizzomafizzo/mrext/raw/main/releases/all.json", Filter: "remote"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := d.SetDb(DownloaderDb{ID: "bad", URL: "nope"}).(*DownloaderDbError); !ok {
+		t.Error("invalid db was set")
+	}
+	err = d.RemoveDb("JTCORES")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []DownloaderDb{
+		{ID: "Distribution_MiSTer", URL: "https://example.com/db.json.zip", Filter: "console"},
+		{ID: "mrext/all", URL: "https://github.com/wizzomafizzo/mrext/raw/main/releases/all.json", Filter: "remote"},
+	}
+	if got := d.ListDbs(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v want %+v", got, want)
+	}
+
+	err = d.Save("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the original file is kept before it's replaced
+	versions, err := h.Versions(downloaderIniFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || versions[1].Author != HistoryAuthorExternal {
+		t.Errorf("got versions %+v", versions)
+	}
+
+	saved, err := LoadDownloaderIni()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := saved.ListDbs(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got saved %+v want %+v", got, want)
+	}
+	if saved.IniFile.Section("mister").Key("filter").String() != "arcade" {
+		t.Error("mister options weren't kept")
+	}
+}
@@ -0,0 +1,376 @@
+package mister
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wizzomafizzo/mrext/pkg/config"
+	"github.com/wizzomafizzo/mrext/pkg/utils"
+)
+
+// History keeps a version of a config file every time it's saved. Versions
+// are stored in <folder>/<filename>/ as a copy of the file and a JSON
+// manifest with the same ID. If a file was changed outside mrext since its
+// last version, that change is kept as a version too before the file is
+// overwritten.
+
+const (
+	HistoryFileUBoot      = "uboot"
+	HistoryFileDownloader = "downloader"
+	HistoryFileNfc        = "nfc"
+	// HistoryAuthorExternal is the author of changes made outside mrext,
+	// such as in the OSD or a text editor.
+	HistoryAuthorExternal = "external"
+	historyTimeFormat     = "20060102_150405"
+	defaultHistoryKeep    = 20
+)
+
+var (
+	ErrHistoryVersionNotFound = errors.New("history version not found")
+	ErrUnknownHistoryFile     = errors.New("unknown history file")
+)
+
+type HistoryFile struct {
+	// ID is ini1 to ini4 for the MiSTer.ini slots, uboot, downloader or nfc.
+	ID       string `json:"id"`
+	Filename string `json:"filename"`
+	Path     string `json:"path"`
+	Versions int    `json:"versions"`
+}
+
+type HistoryVersion struct {
+	ID   string    `json:"id"`
+	Path string    `json:"path"`
+	Time time.Time `json:"time"`
+	// Author is who made the change, such as remote, mm or external.
+	Author string `json:"author"`
+	// Note describes where the change came from, if it's not a regular
+	// save, e.g. a rollback.
+	Note string `json:"note,omitempty"`
+	Size int    `json:"size"`
+	Hash string `json:"hash"`
+}
+
+type History struct {
+	Folder string
+	// Keep is the number of versions kept of each file, oldest are deleted
+	// first. Zero keeps every version.
+	Keep int
+	// Author is used when no author is given. Defaults to the name of the
+	// running app.
+	Author string
+	mu     sync.Mutex
+}
+
+var DefaultHistory = &History{
+	Folder: config.ConfigHistoryFolder,
+	Keep:   defaultHistoryKeep,
+}
+
+// HistoryFilePath returns the path of a file which has its history kept.
+func HistoryFilePath(id string) (string, error) {
+	switch id {
+	case HistoryFileUBoot:
+		return config.UBootConfigFile, nil
+	case HistoryFileDownloader:
+		return downloaderIniFile, nil
+	case HistoryFileNfc:
+		return config.NfcDatabaseFile, nil
+	}
+
+	if strings.HasPrefix(id, "ini") {
+		n, err := strconv.Atoi(strings.TrimPrefix(id, "ini"))
+		if err == nil && n >= 1 && n <= 4 {
+			inis, err := GetAllWithDefaultMisterIni()
+			if err != nil {
+				return "", err
+			}
+			if n <= len(inis) {
+				return inis[n-1].Path, nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("%w: %s", ErrUnknownHistoryFile, id)
+}
+
+// HistoryFileIds returns the IDs of every file which has its history kept,
+// including only the .ini slots which exist.
+func HistoryFileIds() ([]string, error) {
+	inis, err := GetAllWithDefaultMisterIni()
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(inis)+3)
+	for _, mi := range inis {
+		ids = append(ids, fmt.Sprintf("ini%d", mi.Id))
+	}
+
+	return append(ids, HistoryFileUBoot, HistoryFileDownloader, HistoryFileNfc), nil
+}
+
+func hashData(data []byte) string {
+	h := sha1.Sum(data)
+	return hex.EncodeToString(h[:])
+}
+
+func (h *History) author(author string) string {
+	if author != "" {
+		return author
+	} else if h.Author != "" {
+		return h.Author
+	}
+	return filepath.Base(os.Args[0])
+}
+
+func (h *History) fileFolder(path string) string {
+	return filepath.Join(h.Folder, filepath.Base(path))
+}
+
+func (h *History) versions(path string) ([]HistoryVersion, error) {
+	folder := h.fileFolder(path)
+
+	entries, err := os.ReadDir(folder)
+	if errors.Is(err, fs.ErrNotExist) {
+		return []HistoryVersion{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	versions := make([]HistoryVersion, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(folder, entry.Name()))
+		if err != nil {
+			continue
+		}
+
+		var version HistoryVersion
+		err = json.Unmarshal(data, &version)
+		if err != nil {
+			continue
+		}
+		version.ID = strings.TrimSuffix(entry.Name(), ".json")
+
+		versions = append(versions, version)
+	}
+
+	sort.SliceStable(versions, func(i, j int) bool {
+		if versions[i].Time.Equal(versions[j].Time) {
+			return versions[i].ID > versions[j].ID
+		}
+		return versions[i].Time.After(versions[j].Time)
+	})
+
+	return versions, nil
+}
+
+// Versions returns every version of a file, newest first.
+func (h *History) Versions(path string) ([]HistoryVersion, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.versions(path)
+}
+
+func (h *History) read(path string, id string) (HistoryVersion, []byte, error) {
+	if id == "" || filepath.Base(id) != id || strings.HasPrefix(id, ".") {
+		return HistoryVersion{}, nil, fmt.Errorf("%w: %s", ErrHistoryVersionNotFound, id)
+	}
+
+	versions, err := h.versions(path)
+	if err != nil {
+		return HistoryVersion{}, nil, err
+	}
+
+	for _, version := range versions {
+		if version.ID != id {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(h.fileFolder(path), id))
+		if err != nil {
+			return version, nil, err
+		}
+
+		return version, data, nil
+	}
+
+	return HistoryVersion{}, nil, fmt.Errorf("%w: %s", ErrHistoryVersionNotFound, id)
+}
+
+// Read returns a version of a file and its contents.
+func (h *History) Read(path string, id string) (HistoryVersion, []byte, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.read(path, id)
+}
+
+// record adds a new version of a file, unless its contents are the same as
+// the latest version. Old versions past the retention limit are deleted.
+func (h *History) record(path string, data []byte, author string, note string) error {
+	versions, err := h.versions(path)
+	if err != nil {
+		return err
+	}
+
+	hash := hashData(data)
+	if len(versions) > 0 && versions[0].Hash == hash {
+		return nil
+	}
+
+	folder := h.fileFolder(path)
+	err = os.MkdirAll(folder, 0755)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	id := now.Format(historyTimeFormat)
+	// more than one version in the same second
+	for n := 2; ; n++ {
+		if _, err := os.Stat(filepath.Join(folder, id+".json")); errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+		id = fmt.Sprintf("%s_%d", now.Format(historyTimeFormat), n)
+	}
+
+	manifest, err := json.MarshalIndent(HistoryVersion{
+		ID:     id,
+		Path:   path,
+		Time:   now,
+		Author: author,
+		Note:   note,
+		Size:   len(data),
+		Hash:   hash,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(filepath.Join(folder, id), data, 0644)
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(filepath.Join(folder, id+".json"), manifest, 0644)
+	if err != nil {
+		return err
+	}
+
+	if h.Keep <= 0 || len(versions)+1 <= h.Keep {
+		return nil
+	}
+
+	for _, version := range versions[h.Keep-1:] {
+		_ = os.Remove(filepath.Join(folder, version.ID))
+		err := os.Remove(filepath.Join(folder, version.ID+".json"))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (h *History) write(path string, data []byte, author string, note string) error {
+	current, err := os.ReadFile(path)
+	if err == nil {
+		// keep changes made since the last version
+		err = h.record(path, current, HistoryAuthorExternal, "")
+		if err != nil {
+			return fmt.Errorf("error saving history: %w", err)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	err = os.WriteFile(path, data, 0644)
+	if err != nil {
+		return err
+	}
+
+	err = h.record(path, data, h.author(author), note)
+	if err != nil {
+		return fmt.Errorf("error saving history: %w", err)
+	}
+
+	return nil
+}
+
+// Write replaces the contents of a file and keeps it as a new version. An
+// empty author uses the history's default author.
+func (h *History) Write(path string, data []byte, author string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.write(path, data, author, "")
+}
+
+// Rollback replaces the contents of a file with one of its versions. The
+// rollback is kept as a new version, so it can be undone.
+func (h *History) Rollback(path string, id string, author string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	version, data, err := h.read(path, id)
+	if err != nil {
+		return err
+	}
+
+	return h.write(path, data, author, "rollback to "+version.ID)
+}
+
+// Diff returns the changes between two versions of a file in unified diff
+// format. If to is empty, the version is compared to the current file.
+func (h *History) Diff(path string, from string, to string) (string, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	_, fromData, err := h.read(path, from)
+	if err != nil {
+		return "", err
+	}
+
+	var toData []byte
+	toName := filepath.Base(path)
+	if to == "" {
+		toData, err = os.ReadFile(path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+	} else {
+		_, toData, err = h.read(path, to)
+		if err != nil {
+			return "", err
+		}
+		toName = fmt.Sprintf("%s@%s", toName, to)
+	}
+
+	// u-boot.txt may be saved with windows line endings
+	normalize := func(data []byte) string {
+		return string(bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n")))
+	}
+
+	return utils.UnifiedDiff(
+		fmt.Sprintf("%s@%s", filepath.Base(path), from),
+		toName,
+		normalize(fromData),
+		normalize(toData),
+		3,
+	), nil
+}
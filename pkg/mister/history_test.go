@@ -0,0 +1,168 @@
+package mister
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useTestHistory keeps history in a temporary folder for the rest of a test.
+func useTestHistory(t *testing.T) *History {
+	t.Helper()
+
+	h := &History{Folder: t.TempDir(), Author: "test"}
+	prev := DefaultHistory
+	DefaultHistory = h
+	t.Cleanup(func() {
+		DefaultHistory = prev
+	})
+
+	return h
+}
+
+func readTestFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestHistoryWrite(t *testing.T) {
+	h := useTestHistory(t)
+	h.Keep = 3
+	path := filepath.Join(t.TempDir(), "u-boot.txt")
+
+	err := h.Write(path, []byte("v=1\n"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// changed outside mrext
+	err = os.WriteFile(path, []byte("v=2\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = h.Write(path, []byte("v=3\n"), "remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// no change
+	err = h.Write(path, []byte("v=3\n"), "remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	versions, err := h.Versions(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var authors []string
+	for _, version := range versions {
+		authors = append(authors, version.Author)
+	}
+	if got := strings.Join(authors, ","); got != "remote,external,test" {
+		t.Fatalf("got authors %s", got)
+	}
+
+	err = h.Write(path, []byte("v=4\n"), "mm")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	versions, _ = h.Versions(path)
+	if len(versions) != 3 || versions[2].Author != "external" {
+		t.Fatalf("oldest version wasn't deleted: %+v", versions)
+	}
+
+	_, data, err := h.Read(path, versions[1].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "v=3\n" {
+		t.Errorf("got version contents %q", data)
+	}
+}
+
+func TestHistoryRollbackAndDiff(t *testing.T) {
+	h := useTestHistory(t)
+	path := filepath.Join(t.TempDir(), DefaultIniFilename)
+
+	for _, data := range []string{"[MiSTer]\nvsync_adjust=1\n", "[MiSTer]\nvsync_adjust=2\n"} {
+		err := h.Write(path, []byte(data), "remote")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	versions, _ := h.Versions(path)
+	if len(versions) != 2 {
+		t.Fatalf("got %d versions, want 2", len(versions))
+	}
+	first := versions[1]
+
+	diff, err := h.Diff(path, first.ID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "--- MiSTer.ini@" + first.ID + "\n+++ MiSTer.ini\n@@ -1,2 +1,2 @@\n [MiSTer]\n-vsync_adjust=1\n+vsync_adjust=2\n"
+	if diff != want {
+		t.Errorf("got diff %q want %q", diff, want)
+	}
+
+	err = h.Rollback(path, first.ID, "remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestFile(t, path); got != "[MiSTer]\nvsync_adjust=1\n" {
+		t.Errorf("got rolled back file %q", got)
+	}
+
+	versions, _ = h.Versions(path)
+	if len(versions) != 3 || versions[0].Note != "rollback to "+first.ID {
+		t.Errorf("rollback wasn't recorded: %+v", versions)
+	}
+
+	if diff, _ := h.Diff(path, first.ID, versions[0].ID); diff != "" {
+		t.Errorf("got diff of identical versions %q", diff)
+	}
+
+	for _, id := range []string{"", "missing", "../" + first.ID, first.ID + ".json"} {
+		err := h.Rollback(path, id, "remote")
+		if !errors.Is(err, ErrHistoryVersionNotFound) {
+			t.Errorf("%q: got %v want not found", id, err)
+		}
+	}
+}
+
+func TestIniSaveHistory(t *testing.T) {
+	mi := loadTestIni(t, testIni)
+
+	err := mi.SetKey(KeyVsyncAdjust, "2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = mi.SaveAs("remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	versions, err := DefaultHistory.Versions(mi.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || versions[0].Author != "remote" || versions[1].Author != HistoryAuthorExternal {
+		t.Errorf("got versions %+v", versions)
+	}
+
+	if _, err := os.Stat(mi.Path + ".backup"); err == nil {
+		t.Error("backup file was written")
+	}
+}
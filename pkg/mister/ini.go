@@ -1,6 +1,7 @@
 package mister
 
 import (
+	"bytes"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -12,10 +13,21 @@ import (
 	"github.com/wizzomafizzo/mrext/pkg/config"
 )
 
-// TODO: support getting/setting sections besides main
-
 const ShadowDelimiter = ","
 
+// Besides the main [MiSTer] section, an .ini file can have sections which
+// override settings for a core, e.g. [SNES], or for all cores starting with
+// a name using a wildcard, e.g. [Arcade*]. Video mode sections, e.g.
+// [video=1920x1080@60], override settings for a video mode.
+
+const (
+	SectionTypeMain  = "main"
+	SectionTypeCore  = "core"
+	SectionTypeVideo = "video"
+)
+
+const videoSectionPrefix = "video="
+
 type MisterIni struct {
 	Id          int       `json:"id"`
 	DisplayName string    `json:"displayName"`
@@ -191,27 +203,25 @@ func (mi *MisterIni) Load() error {
 	return nil
 }
 
+// Save writes the ini file, keeping the previous and new contents in its
+// history.
 func (mi *MisterIni) Save() error {
+	return mi.SaveAs("")
+}
+
+// SaveAs writes the ini file, recording the given author in its history.
+func (mi *MisterIni) SaveAs(author string) error {
 	if mi.File == nil {
 		return fmt.Errorf("ini file is not loaded")
 	}
 
-	backupPath := fmt.Sprintf("%s.backup", mi.Path)
-
-	backupData, err := os.ReadFile(mi.Path)
-	if os.IsNotExist(err) {
-		// skip backup if file doesn't exist
-		return mi.File.SaveTo(mi.Path)
-	} else if err != nil {
-		return err
-	}
-
-	err = os.WriteFile(backupPath, backupData, 0644)
+	var buf bytes.Buffer
+	_, err := mi.File.WriteTo(&buf)
 	if err != nil {
 		return err
 	}
 
-	return mi.File.SaveTo(mi.Path)
+	return DefaultHistory.Write(mi.Path, buf.Bytes(), author)
 }
 
 func (mi *MisterIni) IsValidKey(key string) bool {
@@ -222,12 +232,175 @@ func (mi *MisterIni) IsShadowedKey(key string) bool {
 	return utils.Contains(ShadowedIniKeys, key)
 }
 
-func (mi *MisterIni) GetKey(key string) (string, error) {
+// SectionType returns whether a section is the main section, a core section
+// or a video mode section.
+func SectionType(name string) string {
+	if strings.EqualFold(name, MainIniSection) {
+		return SectionTypeMain
+	} else if strings.HasPrefix(strings.ToLower(name), videoSectionPrefix) {
+		return SectionTypeVideo
+	} else {
+		return SectionTypeCore
+	}
+}
+
+// SectionMatchesCore returns true if a core section applies to a core.
+// Section names are case-insensitive and may end with a * wildcard.
+func SectionMatchesCore(section string, core string) bool {
+	if SectionType(section) != SectionTypeCore {
+		return false
+	}
+
+	section = strings.ToLower(section)
+	core = strings.ToLower(core)
+
+	if strings.HasSuffix(section, "*") {
+		return strings.HasPrefix(core, strings.TrimSuffix(section, "*"))
+	}
+
+	return section == core
+}
+
+func validSectionName(name string) error {
+	if strings.TrimSpace(name) == "" {
+		return fmt.Errorf("section name is empty")
+	}
+
+	if name != strings.TrimSpace(name) || strings.ContainsAny(name, "[]\r\n") {
+		return fmt.Errorf("invalid section name: %s", name)
+	}
+
+	if strings.EqualFold(name, ini.DefaultSection) {
+		return fmt.Errorf("invalid section name: %s", name)
+	}
+
+	return nil
+}
+
+// section finds a section by name, ignoring case like MiSTer does. Returns
+// nil if it doesn't exist.
+func (mi *MisterIni) section(name string) *ini.Section {
+	for _, section := range mi.File.Sections() {
+		if strings.EqualFold(section.Name(), name) {
+			return section
+		}
+	}
+	return nil
+}
+
+// Sections returns the names of all sections in the file, in order.
+func (mi *MisterIni) Sections() ([]string, error) {
+	if mi.File == nil {
+		return nil, fmt.Errorf("ini file is not loaded")
+	}
+
+	names := make([]string, 0)
+	for _, section := range mi.File.Sections() {
+		if section.Name() == ini.DefaultSection {
+			continue
+		}
+		names = append(names, section.Name())
+	}
+
+	return names, nil
+}
+
+// CoreSections returns the names of all sections which apply to a core, in
+// order.
+func (mi *MisterIni) CoreSections(core string) ([]string, error) {
+	sections, err := mi.Sections()
+	if err != nil {
+		return nil, err
+	}
+
+	matches := make([]string, 0)
+	for _, name := range sections {
+		if SectionMatchesCore(name, core) {
+			matches = append(matches, name)
+		}
+	}
+
+	return matches, nil
+}
+
+// HasSection returns true if a section exists, ignoring case.
+func (mi *MisterIni) HasSection(name string) bool {
+	return mi.File != nil && mi.section(name) != nil
+}
+
+// NewSection adds an empty section to the end of the file, if it doesn't
+// already exist.
+func (mi *MisterIni) NewSection(name string) error {
+	if mi.File == nil {
+		return fmt.Errorf("ini file is not loaded")
+	}
+
+	err := validSectionName(name)
+	if err != nil {
+		return err
+	}
+
+	if mi.section(name) != nil {
+		return nil
+	}
+
+	_, err = mi.File.NewSection(name)
+	return err
+}
+
+// DeleteSection removes a section and all its keys. The main section can't
+// be deleted.
+func (mi *MisterIni) DeleteSection(name string) error {
+	if mi.File == nil {
+		return fmt.Errorf("ini file is not loaded")
+	}
+
+	if SectionType(name) == SectionTypeMain {
+		return fmt.Errorf("can't delete [%s] section", MainIniSection)
+	}
+
+	section := mi.section(name)
+	if section == nil {
+		return fmt.Errorf("section does not exist: %s", name)
+	}
+
+	mi.File.DeleteSection(section.Name())
+	return nil
+}
+
+// SectionValues returns every key in a section with its value, including
+// keys which aren't known to be valid. Shadowed values are delimited with a
+// comma.
+func (mi *MisterIni) SectionValues(name string) (map[string]string, error) {
+	if mi.File == nil {
+		return nil, fmt.Errorf("ini file is not loaded")
+	}
+
+	section := mi.section(name)
+	if section == nil {
+		return nil, fmt.Errorf("section does not exist: %s", name)
+	}
+
+	values := make(map[string]string)
+	for _, key := range section.Keys() {
+		if mi.IsShadowedKey(key.Name()) {
+			values[key.Name()] = strings.Join(key.StringsWithShadows(ShadowDelimiter), ShadowDelimiter)
+		} else {
+			values[key.Name()] = key.Value()
+		}
+	}
+
+	return values, nil
+}
+
+// GetSectionKey returns the value of a key in a section. Returns an empty
+// string if the section or key doesn't exist.
+func (mi *MisterIni) GetSectionKey(sectionName string, key string) (string, error) {
 	if mi.File == nil {
 		return "", fmt.Errorf("ini file is not loaded")
 	}
 
-	section := mi.File.Section(MainIniSection)
+	section := mi.section(sectionName)
 	if section == nil {
 		return "", nil
 	}
@@ -252,24 +425,38 @@ func (mi *MisterIni) GetKey(key string) (string, error) {
 	}
 }
 
-// SetKey a key to an absolute value, or delete it if value is empty. Supports
-// shadowed keys delimited with a comma.
-func (mi *MisterIni) SetKey(key string, value string) error {
+// SetSectionKey sets a key in a section to an absolute value, or deletes it
+// if value is empty. The section is created if it doesn't exist. Supports
+// shadowed keys delimited with a comma. Values of keys which aren't in the
+// schema are written as is.
+func (mi *MisterIni) SetSectionKey(sectionName string, key string, value string) error {
 	if mi.File == nil {
 		return fmt.Errorf("ini file is not loaded")
 	}
 
-	section := mi.File.Section(MainIniSection)
-	if section == nil {
-		return fmt.Errorf("ini file does not have a [MiSTer] section")
-	}
-
 	if strings.HasPrefix(key, "__") {
 		return nil
 	}
 
-	if !mi.IsValidKey(key) {
-		return fmt.Errorf("invalid ini key: %s", key)
+	var err error
+	if mi.IsValidKey(key) {
+		err = ValidateIniValue(key, value)
+	} else {
+		err = validateUnknownIniValue(key, value)
+	}
+	if err != nil {
+		return err
+	}
+
+	section := mi.section(sectionName)
+	if section == nil && value == "" {
+		return nil
+	} else if section == nil {
+		err := mi.NewSection(sectionName)
+		if err != nil {
+			return err
+		}
+		section = mi.section(sectionName)
 	}
 
 	if section.HasKey(key) && value == "" {
@@ -315,6 +502,17 @@ func (mi *MisterIni) SetKey(key string, value string) error {
 	return nil
 }
 
+// GetKey returns the value of a key in the main section.
+func (mi *MisterIni) GetKey(key string) (string, error) {
+	return mi.GetSectionKey(MainIniSection, key)
+}
+
+// SetKey a key in the main section to an absolute value, or delete it if
+// value is empty. Supports shadowed keys delimited with a comma.
+func (mi *MisterIni) SetKey(key string, value string) error {
+	return mi.SetSectionKey(MainIniSection, key, value)
+}
+
 // AddKey sets a key to a value whether it exists or not and appends to any
 // shadowed values.
 func (mi *MisterIni) AddKey(key string, value string) error {
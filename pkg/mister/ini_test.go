@@ -0,0 +1,194 @@
+package mister
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testIni = `; main settings
+[MiSTer]
+video_mode=8
+; keep this comment
+vsync_adjust=1
+no_merge_vidpid=0x1234
+no_merge_vidpid=0x5678
+
+[SNES]
+video_mode=0
+
+[Arcade*]
+vscale_mode=1
+
+[video=1920x1080@60]
+vsync_adjust=2
+`
+
+func loadTestIni(t *testing.T, data string) *MisterIni {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), DefaultIniFilename)
+	err := os.WriteFile(path, []byte(data), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	useTestHistory(t)
+
+	mi := &MisterIni{Id: 1, Filename: DefaultIniFilename, Path: path}
+	err = mi.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return mi
+}
+
+func TestSectionType(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"MiSTer", SectionTypeMain},
+		{"mister", SectionTypeMain},
+		{"SNES", SectionTypeCore},
+		{"Arcade*", SectionTypeCore},
+		{"video=1920x1080@60", SectionTypeVideo},
+		{"VIDEO=640x480", SectionTypeVideo},
+	}
+
+	for _, tt := range tests {
+		if got := SectionType(tt.name); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSectionMatchesCore(t *testing.T) {
+	tests := []struct {
+		section string
+		core    string
+		want    bool
+	}{
+		{"SNES", "SNES", true},
+		{"snes", "SNES", true},
+		{"SNES", "SNES_Music", false},
+		{"Arcade*", "Arcade-Galaga", true},
+		{"arcade*", "ARCADE", true},
+		{"Arcade*", "SNES", false},
+		{"*", "NES", true},
+		{"MiSTer", "MiSTer", false},
+		{"video=640x480", "video=640x480", false},
+	}
+
+	for _, tt := range tests {
+		if got := SectionMatchesCore(tt.section, tt.core); got != tt.want {
+			t.Errorf("%s, %s: got %v, want %v", tt.section, tt.core, got, tt.want)
+		}
+	}
+}
+
+func TestIniSections(t *testing.T) {
+	mi := loadTestIni(t, testIni)
+
+	sections, err := mi.Sections()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"MiSTer", "SNES", "Arcade*", "video=1920x1080@60"}
+	if !reflect.DeepEqual(sections, want) {
+		t.Errorf("got sections %v, want %v", sections, want)
+	}
+
+	matches, _ := mi.CoreSections("Arcade-Galaga")
+	if !reflect.DeepEqual(matches, []string{"Arcade*"}) {
+		t.Errorf("got core sections %v", matches)
+	}
+
+	values, err := mi.SectionValues("mister")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values[KeyNoMergeVidpid] != "0x1234,0x5678" || values[KeyVideoMode] != "8" {
+		t.Errorf("got values %v", values)
+	}
+
+	if val, err := mi.GetSectionKey("snes", KeyVideoMode); err != nil || val != "0" {
+		t.Errorf("got %q, %v", val, err)
+	}
+	if val, err := mi.GetSectionKey("NES", KeyVideoMode); err != nil || val != "" {
+		t.Errorf("missing section: got %q, %v", val, err)
+	}
+	if _, err := mi.GetSectionKey("SNES", "not_a_key"); err == nil {
+		t.Error("invalid key: got no error")
+	}
+}
+
+func TestIniEditSections(t *testing.T) {
+	mi := loadTestIni(t, testIni)
+
+	steps := []struct {
+		section string
+		key     string
+		value   string
+	}{
+		{"SNES", KeyVideoMode, "1"},
+		{"snes", KeyVsyncAdjust, "2"},
+		{"NES", KeyVideoMode, "3"},
+		{"GBA", KeyVideoMode, ""},
+		{"Arcade*", KeyVscaleMode, ""},
+		{MainIniSection, KeyNoMergeVidpid, "0xaaaa,0xbbbb"},
+	}
+	for _, step := range steps {
+		err := mi.SetSectionKey(step.section, step.key, step.value)
+		if err != nil {
+			t.Fatalf("%+v: %s", step, err)
+		}
+	}
+
+	err := mi.DeleteSection("video=1920x1080@60")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mi.DeleteSection(MainIniSection); err == nil {
+		t.Error("deleted main section")
+	}
+	if err := mi.NewSection("bad]name"); err == nil {
+		t.Error("created invalid section")
+	}
+
+	err = mi.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(mi.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := strings.TrimSpace(string(data))
+
+	want := strings.TrimSpace(`
+; main settings
+[MiSTer]
+video_mode=8
+; keep this comment
+vsync_adjust=1
+no_merge_vidpid=0xaaaa
+no_merge_vidpid=0xbbbb
+
+[SNES]
+video_mode=1
+vsync_adjust=2
+
+[Arcade*]
+
+[NES]
+video_mode=3
+`)
+	if got != want {
+		t.Errorf("got ini:\n%s\nwant:\n%s", got, want)
+	}
+}
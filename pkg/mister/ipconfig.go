@@ -0,0 +1,210 @@
+package mister
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/wizzomafizzo/mrext/pkg/config"
+)
+
+// Static IP addresses are set per interface in dhcpcd.conf on the SD card.
+// An interface with no static block in the file uses DHCP.
+
+var dhcpcdConfigFile = config.DhcpcdConfigFile
+
+type IPConfig struct {
+	Interface string `json:"interface"`
+	DHCP      bool   `json:"dhcp"`
+	// Address is the static IP address in CIDR notation, e.g.
+	// 192.168.1.50/24.
+	Address string   `json:"address"`
+	Gateway string   `json:"gateway"`
+	DNS     []string `json:"dns"`
+}
+
+// Validate checks a static config has a valid address, gateway and DNS
+// servers. DHCP configs are always valid.
+func (c IPConfig) Validate() error {
+	if c.Interface == "" || strings.ContainsAny(c.Interface, " \t\n/") {
+		return fmt.Errorf("%w: invalid interface: %q", ErrInvalidNetworkConfig, c.Interface)
+	} else if c.DHCP {
+		return nil
+	}
+
+	ip, ipNet, err := net.ParseCIDR(c.Address)
+	if err != nil || ip.To4() == nil {
+		return fmt.Errorf("%w: address must be an IPv4 address with prefix, e.g. 192.168.1.50/24", ErrInvalidNetworkConfig)
+	}
+
+	if c.Gateway != "" {
+		gateway := net.ParseIP(c.Gateway)
+		if gateway == nil || gateway.To4() == nil {
+			return fmt.Errorf("%w: invalid gateway: %s", ErrInvalidNetworkConfig, c.Gateway)
+		} else if !ipNet.Contains(gateway) {
+			return fmt.Errorf("%w: gateway %s isn't in %s", ErrInvalidNetworkConfig, c.Gateway, ipNet)
+		}
+	}
+
+	for _, dns := range c.DNS {
+		if net.ParseIP(dns) == nil {
+			return fmt.Errorf("%w: invalid dns server: %s", ErrInvalidNetworkConfig, dns)
+		}
+	}
+
+	return nil
+}
+
+// DhcpcdConfig is a dhcpcd.conf file. Only static blocks of interfaces are
+// changed, every other line is kept as it was read.
+type DhcpcdConfig struct {
+	Path  string
+	lines []string
+}
+
+func ReadDhcpcdConfig() (*DhcpcdConfig, error) {
+	data, err := os.ReadFile(dhcpcdConfigFile)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return ParseDhcpcdConfig(dhcpcdConfigFile, string(data)), nil
+}
+
+func ParseDhcpcdConfig(path string, data string) *DhcpcdConfig {
+	dc := &DhcpcdConfig{Path: path}
+	data = strings.ReplaceAll(data, "\r\n", "\n")
+	if data != "" {
+		dc.lines = strings.Split(strings.TrimSuffix(data, "\n"), "\n")
+	}
+	return dc
+}
+
+// interfaceBlock returns the range of lines in an interface's block,
+// starting with its interface line. The end is the next interface or
+// profile line, or the end of the file.
+func (dc *DhcpcdConfig) interfaceBlock(iface string) (int, int) {
+	start := -1
+	for i, line := range dc.lines {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		isBlock := fields[0] == "interface" || fields[0] == "profile" || fields[0] == "ssid"
+		if start >= 0 && isBlock {
+			return start, i
+		} else if start < 0 && fields[0] == "interface" && len(fields) > 1 && fields[1] == iface {
+			start = i
+		}
+	}
+
+	if start < 0 {
+		return -1, -1
+	}
+	return start, len(dc.lines)
+}
+
+// Get returns the IP config of an interface.
+func (dc *DhcpcdConfig) Get(iface string) IPConfig {
+	ipc := IPConfig{Interface: iface, DHCP: true, DNS: make([]string, 0)}
+
+	start, end := dc.interfaceBlock(iface)
+	if start < 0 {
+		return ipc
+	}
+
+	for _, line := range dc.lines[start+1 : end] {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "static" {
+			continue
+		}
+
+		key, value, _ := strings.Cut(strings.Join(fields[1:], " "), "=")
+		switch key {
+		case "ip_address":
+			ipc.Address = value
+			ipc.DHCP = false
+		case "routers":
+			ipc.Gateway = strings.Fields(value + " ")[0]
+		case "domain_name_servers":
+			ipc.DNS = strings.Fields(value)
+		}
+	}
+
+	return ipc
+}
+
+// Set replaces the static options of an interface. A DHCP config removes
+// them, and the interface line too if nothing else is set for it.
+func (dc *DhcpcdConfig) Set(ipc IPConfig) error {
+	err := ipc.Validate()
+	if err != nil {
+		return err
+	}
+
+	var block []string
+	if !ipc.DHCP {
+		block = append(block, "interface "+ipc.Interface, "static ip_address="+ipc.Address)
+		if ipc.Gateway != "" {
+			block = append(block, "static routers="+ipc.Gateway)
+		}
+		if len(ipc.DNS) > 0 {
+			block = append(block, "static domain_name_servers="+strings.Join(ipc.DNS, " "))
+		}
+	}
+
+	start, end := dc.interfaceBlock(ipc.Interface)
+	if start < 0 {
+		if len(block) > 0 {
+			if len(dc.lines) > 0 && strings.TrimSpace(dc.lines[len(dc.lines)-1]) != "" {
+				dc.lines = append(dc.lines, "")
+			}
+			dc.lines = append(dc.lines, block...)
+		}
+		return nil
+	}
+
+	// keep any options in the block which aren't static
+	var other []string
+	hasOther := false
+	for _, line := range dc.lines[start+1 : end] {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || fields[0] != "static" {
+			other = append(other, line)
+			hasOther = hasOther || len(fields) > 0
+		}
+	}
+	if len(block) > 0 {
+		block = append(block, other...)
+	} else if hasOther {
+		block = append([]string{dc.lines[start]}, other...)
+	}
+
+	lines := append([]string{}, dc.lines[:start]...)
+	lines = append(lines, block...)
+	dc.lines = append(lines, dc.lines[end:]...)
+
+	return nil
+}
+
+func (dc *DhcpcdConfig) String() string {
+	if len(dc.lines) == 0 {
+		return ""
+	}
+	return strings.Join(dc.lines, "\n") + "\n"
+}
+
+// Save writes the file and keeps it in history.
+func (dc *DhcpcdConfig) Save(author string) error {
+	return DefaultHistory.Write(dc.Path, []byte(dc.String()), author)
+}
+
+// RenewIP asks dhcpcd to apply the config of an interface, if it's running.
+func RenewIP(iface string) error {
+	output, err := runCommand("dhcpcd", "-n", iface)
+	if err != nil {
+		return fmt.Errorf("dhcpcd: %s: %w", strings.TrimSpace(string(output)), err)
+	}
+	return nil
+}
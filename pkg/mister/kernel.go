@@ -0,0 +1,231 @@
+package mister
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Kernel args are set in the v= param of u-boot.txt and passed to Linux on
+// boot, so changes only apply after a reboot. Args are kept in the order
+// they're written, and args with no value (flags) are kept as they are.
+
+const (
+	KernelTypeInt = "int"
+	// KernelTypeQuirks is a comma separated list of vid:pid:flags, each a hex
+	// number, e.g. 0x0079:0x0011:0x04.
+	KernelTypeQuirks = "quirks"
+	// KernelTypeVideo is a framebuffer mode, e.g. HDMI-A-1:1280x720@60.
+	KernelTypeVideo = "video"
+)
+
+var kernelCmdlineFile = "/proc/cmdline"
+
+var (
+	kernelArgNameRe = regexp.MustCompile(`^[\w.\-]+$`)
+	usbQuirkRe      = regexp.MustCompile(`^0x[0-9a-fA-F]{1,4}:0x[0-9a-fA-F]{1,4}:0x[0-9a-fA-F]{1,8}$`)
+	videoModeRe     = regexp.MustCompile(`^[\w\-]+:\d+x\d+[\w\-]*(@\d+)?[\w\-]*$`)
+)
+
+type KernelArg struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+	// Flag is true for args with no value, like quiet.
+	Flag bool `json:"flag"`
+}
+
+func (a KernelArg) String() string {
+	if a.Flag {
+		return a.Name
+	} else if strings.ContainsAny(a.Value, " \t") {
+		return fmt.Sprintf("%s=\"%s\"", a.Name, a.Value)
+	}
+	return fmt.Sprintf("%s=%s", a.Name, a.Value)
+}
+
+// ParseKernelArgs splits kernel args on whitespace, except inside quotes.
+func ParseKernelArgs(input string) []KernelArg {
+	var tokens []string
+	var token strings.Builder
+	quoted := false
+
+	for _, r := range input {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			token.WriteRune(r)
+		case !quoted && (r == ' ' || r == '\t' || r == '\r' || r == '\n'):
+			if token.Len() > 0 {
+				tokens = append(tokens, token.String())
+				token.Reset()
+			}
+		default:
+			token.WriteRune(r)
+		}
+	}
+	if token.Len() > 0 {
+		tokens = append(tokens, token.String())
+	}
+
+	args := make([]KernelArg, 0, len(tokens))
+	for _, token := range tokens {
+		token = strings.ReplaceAll(token, "\"", "")
+		name, value, ok := strings.Cut(token, "=")
+		args = append(args, KernelArg{Name: name, Value: value, Flag: !ok})
+	}
+
+	return args
+}
+
+// FormatKernelArgs joins kernel args in order, quoting values with spaces.
+func FormatKernelArgs(args []KernelArg) string {
+	pairs := make([]string, 0, len(args))
+	for _, arg := range args {
+		pairs = append(pairs, arg.String())
+	}
+	return strings.Join(pairs, " ")
+}
+
+// SetKernelArg replaces an arg with the same name, or adds it to the end.
+func SetKernelArg(args []KernelArg, arg KernelArg) []KernelArg {
+	updated := make([]KernelArg, 0, len(args)+1)
+	found := false
+
+	for _, existing := range args {
+		if existing.Name != arg.Name {
+			updated = append(updated, existing)
+		} else if !found {
+			updated = append(updated, arg)
+			found = true
+		}
+	}
+
+	if !found {
+		updated = append(updated, arg)
+	}
+
+	return updated
+}
+
+// RemoveKernelArg removes every arg with the given name, returning false if
+// there were none.
+func RemoveKernelArg(args []KernelArg, name string) ([]KernelArg, bool) {
+	updated := make([]KernelArg, 0, len(args))
+	for _, arg := range args {
+		if arg.Name != name {
+			updated = append(updated, arg)
+		}
+	}
+	return updated, len(updated) != len(args)
+}
+
+type KernelParamSchema struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	// Min and Max are the range of int params.
+	Min         int    `json:"min"`
+	Max         int    `json:"max"`
+	Description string `json:"description"`
+}
+
+// KernelParams are the kernel args known to be useful on a MiSTer. Any other
+// arg can still be set, but its value isn't checked.
+var KernelParams = []KernelParamSchema{
+	{Name: "loglevel", Type: KernelTypeInt, Min: 0, Max: 7, Description: "Kernel log level shown on the console, 0 is least."},
+	{Name: "consoleblank", Type: KernelTypeInt, Min: 0, Max: 86400, Description: "Seconds before the Linux console is blanked, 0 to disable."},
+	{Name: "usbhid.jspoll", Type: KernelTypeInt, Min: 1, Max: 255, Description: "Joystick polling interval in milliseconds."},
+	{Name: "usbhid.mousepoll", Type: KernelTypeInt, Min: 1, Max: 255, Description: "Mouse polling interval in milliseconds."},
+	{Name: "usbhid.kbpoll", Type: KernelTypeInt, Min: 1, Max: 255, Description: "Keyboard polling interval in milliseconds."},
+	{Name: "xpad.cpoll", Type: KernelTypeInt, Min: 1, Max: 255, Description: "Xbox controller polling interval in milliseconds."},
+	{Name: "usbhid.quirks", Type: KernelTypeQuirks, Description: "USB HID quirks as vid:pid:flags, comma separated."},
+	{Name: "video", Type: KernelTypeVideo, Description: "Linux framebuffer video mode, e.g. HDMI-A-1:1280x720@60."},
+}
+
+func GetKernelParamSchema(name string) (KernelParamSchema, bool) {
+	for _, schema := range KernelParams {
+		if schema.Name == name {
+			return schema, true
+		}
+	}
+	return KernelParamSchema{}, false
+}
+
+func (s KernelParamSchema) Validate(value string) error {
+	switch s.Type {
+	case KernelTypeInt:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return errors.New("must be a whole number")
+		} else if n < s.Min || n > s.Max {
+			return fmt.Errorf("must be between %d and %d", s.Min, s.Max)
+		}
+	case KernelTypeQuirks:
+		for _, quirk := range strings.Split(value, ",") {
+			if !usbQuirkRe.MatchString(quirk) {
+				return fmt.Errorf("quirk must be vid:pid:flags in hex: %s", quirk)
+			}
+		}
+	case KernelTypeVideo:
+		if !videoModeRe.MatchString(value) {
+			return errors.New("must be connector:mode, e.g. HDMI-A-1:1280x720@60")
+		}
+	}
+	return nil
+}
+
+// KernelArgError is a problem with a single kernel arg.
+type KernelArgError struct {
+	Name    string `json:"name"`
+	Value   string `json:"value"`
+	Message string `json:"message"`
+}
+
+func (e *KernelArgError) Error() string {
+	return fmt.Sprintf("invalid kernel arg %s: %s", e.Name, e.Message)
+}
+
+// ValidateKernelArg checks an arg can be written to u-boot.txt without
+// breaking other args, and its value is allowed if it's a known param.
+func ValidateKernelArg(arg KernelArg) error {
+	if !kernelArgNameRe.MatchString(arg.Name) {
+		return &KernelArgError{Name: arg.Name, Value: arg.Value, Message: "name must only contain letters, numbers, _, - and ."}
+	} else if strings.ContainsAny(arg.Value, "\"\r\n") {
+		return &KernelArgError{Name: arg.Name, Value: arg.Value, Message: "value can't contain quotes or new lines"}
+	}
+
+	schema, ok := GetKernelParamSchema(arg.Name)
+	if !ok {
+		return nil
+	} else if arg.Flag {
+		return &KernelArgError{Name: arg.Name, Message: "must have a value"}
+	}
+
+	err := schema.Validate(arg.Value)
+	if err != nil {
+		return &KernelArgError{Name: arg.Name, Value: arg.Value, Message: err.Error()}
+	}
+
+	return nil
+}
+
+// BootKernelArgs returns the args Linux was booted with.
+func BootKernelArgs() ([]KernelArg, error) {
+	data, err := os.ReadFile(kernelCmdlineFile)
+	if err != nil {
+		return nil, err
+	}
+	return ParseKernelArgs(string(data)), nil
+}
+
+// IsKernelArgActive returns true if an arg was set the same way on boot.
+func IsKernelArgActive(arg KernelArg, boot []KernelArg) bool {
+	for _, bootArg := range boot {
+		if bootArg == arg {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,134 @@
+package mister
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseKernelArgs(t *testing.T) {
+	input := `loglevel=4 quiet  usbhid.quirks=0x1:0x2:0x4 name="two words" "video=HDMI-A-1:1280x720@60"`
+
+	args := ParseKernelArgs(input)
+	want := []KernelArg{
+		{Name: "loglevel", Value: "4"},
+		{Name: "quiet", Flag: true},
+		{Name: "usbhid.quirks", Value: "0x1:0x2:0x4"},
+		{Name: "name", Value: "two words"},
+		{Name: "video", Value: "HDMI-A-1:1280x720@60"},
+	}
+	if !reflect.DeepEqual(args, want) {
+		t.Fatalf("got %+v want %+v", args, want)
+	}
+
+	wantFormat := `loglevel=4 quiet usbhid.quirks=0x1:0x2:0x4 name="two words" video=HDMI-A-1:1280x720@60`
+	if got := FormatKernelArgs(args); got != wantFormat {
+		t.Errorf("got %q want %q", got, wantFormat)
+	}
+
+	args = SetKernelArg(args, KernelArg{Name: "loglevel", Value: "7"})
+	args = SetKernelArg(args, KernelArg{Name: "xpad.cpoll", Value: "1"})
+	args, removed := RemoveKernelArg(args, "quiet")
+	if !removed {
+		t.Error("quiet wasn't removed")
+	}
+	if _, removed := RemoveKernelArg(args, "quiet"); removed {
+		t.Error("removed missing arg")
+	}
+
+	wantFormat = `loglevel=7 usbhid.quirks=0x1:0x2:0x4 name="two words" video=HDMI-A-1:1280x720@60 xpad.cpoll=1`
+	if got := FormatKernelArgs(args); got != wantFormat {
+		t.Errorf("got %q want %q", got, wantFormat)
+	}
+}
+
+func TestValidateKernelArg(t *testing.T) {
+	tests := []struct {
+		arg   KernelArg
+		valid bool
+	}{
+		{KernelArg{Name: "loglevel", Value: "4"}, true},
+		{KernelArg{Name: "loglevel", Value: "8"}, false},
+		{KernelArg{Name: "loglevel", Flag: true}, false},
+		{KernelArg{Name: "usbhid.jspoll", Value: "fast"}, false},
+		{KernelArg{Name: "usbhid.quirks", Value: "0x0079:0x0011:0x04,0x045e:0x028e:0x400"}, true},
+		{KernelArg{Name: "usbhid.quirks", Value: "0x0079:0x0011"}, false},
+		{KernelArg{Name: "video", Value: "HDMI-A-1:1280x720@60"}, true},
+		{KernelArg{Name: "video", Value: "720p"}, false},
+		{KernelArg{Name: "quiet", Flag: true}, true},
+		{KernelArg{Name: "custom.param", Value: "anything"}, true},
+		{KernelArg{Name: "bad name", Value: "1"}, false},
+		{KernelArg{Name: "a=b", Value: "1"}, false},
+		{KernelArg{Name: "custom", Value: `"quoted"`}, false},
+	}
+
+	for _, tt := range tests {
+		err := ValidateKernelArg(tt.arg)
+		if tt.valid && err != nil {
+			t.Errorf("%+v: got error %s", tt.arg, err)
+		} else if !tt.valid {
+			var ke *KernelArgError
+			if !errors.As(err, &ke) {
+				t.Errorf("%+v: got %v want kernel arg error", tt.arg, err)
+			}
+		}
+	}
+}
+
+func TestUBootFile(t *testing.T) {
+	useTestHistory(t)
+
+	path := filepath.Join(t.TempDir(), "u-boot.txt")
+	f := ParseUBootFile(path, "# my settings\r\nethaddr=02:03:04:05:06:07\r\nsomething odd\r\nv=loglevel=4 quiet\r\n")
+
+	if value, ok := f.Get(UBootKernelParam); !ok || value != "loglevel=4 quiet" {
+		t.Errorf("got kernel param %q", value)
+	}
+
+	f.SetKernelArgs(SetKernelArg(f.KernelArgs(), KernelArg{Name: "usbhid.jspoll", Value: "1"}))
+	f.Set("fb_mode", "1")
+
+	err := f.Save("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "# my settings\nethaddr=02:03:04:05:06:07\nsomething odd\nv=loglevel=4 quiet usbhid.jspoll=1\nfb_mode=1\n"
+	if got := readTestFile(t, path); got != want {
+		t.Errorf("got %q want %q", got, want)
+	}
+
+	f.SetKernelArgs(nil)
+	f.Delete("fb_mode")
+	want = "# my settings\nethaddr=02:03:04:05:06:07\nsomething odd\n"
+	if got := f.String(); got != want {
+		t.Errorf("got %q want %q", got, want)
+	}
+}
+
+func TestBootKernelArgs(t *testing.T) {
+	prev := kernelCmdlineFile
+	kernelCmdlineFile = filepath.Join(t.TempDir(), "cmdline")
+	t.Cleanup(func() {
+		kernelCmdlineFile = prev
+	})
+
+	err := os.WriteFile(kernelCmdlineFile, []byte("console=ttyS0,115200 loglevel=4 usbhid.jspoll=1\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	boot, err := BootKernelArgs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !IsKernelArgActive(KernelArg{Name: "loglevel", Value: "4"}, boot) {
+		t.Error("loglevel=4 should be active")
+	}
+	if IsKernelArgActive(KernelArg{Name: "loglevel", Value: "7"}, boot) {
+		t.Error("loglevel=7 shouldn't be active")
+	}
+}
@@ -2,7 +2,9 @@ package mister
 
 import (
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
@@ -485,6 +487,34 @@ func LaunchRandomGame(cfg *config.UserConfig, systems []games.System) error {
 	return fmt.Errorf("failed to find a random game")
 }
 
+// sendPlaylistCommand passes a command to the playlist player running in the
+// Remote service.
+func sendPlaylistCommand(cmd string) error {
+	conn, err := net.Dial("unix", config.PlaylistSocket)
+	if err != nil {
+		return fmt.Errorf("playlist player not running: %s", err)
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(cmd))
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	resp := string(buf[:n])
+	if s.HasPrefix(resp, "error: ") {
+		return fmt.Errorf("%s", s.TrimPrefix(resp, "error: "))
+	}
+
+	return nil
+}
+
 func LaunchToken(cfg *config.UserConfig, manual bool, kbd input.Keyboard, text string) error {
 	// detection can never be perfect, but these characters are illegal in
 	// windows filenames and heavily avoided in linux. use them to mark that
@@ -561,6 +591,12 @@ func LaunchToken(cfg *config.UserConfig, manual bool, kbd input.Keyboard, text s
 			}
 
 			return SetActiveIni(id, true)
+		case "playlist":
+			if args == "" {
+				return fmt.Errorf("no playlist specified")
+			}
+
+			return sendPlaylistCommand("play " + args)
 		case "get":
 			go func() {
 				_, _ = http.Get(args)
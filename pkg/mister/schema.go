@@ -0,0 +1,464 @@
+package mister
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The schema describes the type and allowed values of each MiSTer.ini key,
+// matching how Main parses them. Values which Main would ignore or clamp are
+// rejected instead, so a typo doesn't silently do nothing.
+
+const (
+	IniTypeBool   = "bool"
+	IniTypeInt    = "int"
+	IniTypeFloat  = "float"
+	IniTypeHex    = "hex"
+	IniTypeEnum   = "enum"
+	IniTypeString = "string"
+)
+
+const (
+	IniGroupVideo  = "video"
+	IniGroupAudio  = "audio"
+	IniGroupInput  = "input"
+	IniGroupMenu   = "menu"
+	IniGroupSystem = "system"
+)
+
+type IniOption struct {
+	Value string `json:"value"`
+	Label string `json:"label"`
+}
+
+type IniKeySchema struct {
+	Key   string `json:"key"`
+	Type  string `json:"type"`
+	Group string `json:"group"`
+	// Min and Max are the range of int, float and hex keys.
+	Min     float64     `json:"min"`
+	Max     float64     `json:"max"`
+	Options []IniOption `json:"options,omitempty"`
+	Default string      `json:"default"`
+	// Shadowed keys can be set more than once, values are delimited with a
+	// comma.
+	Shadowed    bool   `json:"shadowed"`
+	Description string `json:"description"`
+}
+
+func boolKey(key string, group string, def string, desc string) IniKeySchema {
+	return IniKeySchema{Key: key, Type: IniTypeBool, Group: group, Min: 0, Max: 1, Default: def, Description: desc}
+}
+
+func intKey(key string, group string, min float64, max float64, def string, desc string) IniKeySchema {
+	return IniKeySchema{Key: key, Type: IniTypeInt, Group: group, Min: min, Max: max, Default: def, Description: desc}
+}
+
+func floatKey(key string, group string, min float64, max float64, def string, desc string) IniKeySchema {
+	return IniKeySchema{Key: key, Type: IniTypeFloat, Group: group, Min: min, Max: max, Default: def, Description: desc}
+}
+
+func hexKey(key string, group string, bits int, desc string) IniKeySchema {
+	return IniKeySchema{Key: key, Type: IniTypeHex, Group: group, Min: 0, Max: float64(uint64(1)<<bits - 1), Default: "", Description: desc}
+}
+
+func enumKey(key string, group string, def string, desc string, options ...IniOption) IniKeySchema {
+	return IniKeySchema{Key: key, Type: IniTypeEnum, Group: group, Options: options, Default: def, Description: desc}
+}
+
+func stringKey(key string, group string, def string, desc string) IniKeySchema {
+	return IniKeySchema{Key: key, Type: IniTypeString, Group: group, Default: def, Description: desc}
+}
+
+func shadowed(schema IniKeySchema) IniKeySchema {
+	schema.Shadowed = true
+	return schema
+}
+
+func opt(value string, label string) IniOption {
+	return IniOption{Value: value, Label: label}
+}
+
+func playerControllerKey(key string) IniKeySchema {
+	return stringKey(key, IniGroupInput, "", "Name or VID:PID of the controller always assigned to this player.")
+}
+
+// IniSchema describes every valid MiSTer.ini key, in the same order as
+// ValidIniKeys.
+var IniSchema = []IniKeySchema{
+	boolKey(KeyYpbpr, IniGroupVideo, "0", "Output YPbPr on the VGA port. Replaced by vga_mode."),
+	boolKey(KeyCompositeSync, IniGroupVideo, "0", "Output composite sync on HSync for the VGA port."),
+	boolKey(KeyForcedScandoubler, IniGroupVideo, "0", "Scandouble 15kHz cores on the VGA port."),
+	boolKey(KeyVgaScaler, IniGroupVideo, "0", "Use the scaler for the VGA port, the same as HDMI."),
+	boolKey(KeyVgaSog, IniGroupVideo, "0", "Sync on green for the VGA port."),
+	hexKey(KeyKeyrahMode, IniGroupInput, 32, "VID and PID of a Keyrah interface to use with original keyboards."),
+	enumKey(KeyResetCombo, IniGroupInput, "0", "Keyboard combo which resets the core.",
+		opt("0", "LCtrl+LAlt+RAlt"),
+		opt("1", "LCtrl+LGUI+RGUI"),
+		opt("2", "LCtrl+LAlt+Del"),
+		opt("3", "LCtrl+LAlt+RAlt or LCtrl+LGUI+RGUI"),
+	),
+	boolKey(KeyKeyMenuAsRgui, IniGroupInput, "0", "Use the Menu key as the right GUI key instead of opening the OSD."),
+	stringKey(KeyVideoMode, IniGroupVideo, "", "HDMI output resolution, as a preset number or custom modeline."),
+	stringKey(KeyVideoModePal, IniGroupVideo, "", "HDMI output resolution for PAL cores."),
+	stringKey(KeyVideoModeNtsc, IniGroupVideo, "", "HDMI output resolution for NTSC cores."),
+	intKey(KeyVideoInfo, IniGroupVideo, 0, 10, "0", "Seconds to show video resolution info when it changes."),
+	enumKey(KeyVsyncAdjust, IniGroupVideo, "0", "Match the HDMI refresh rate to the core.",
+		opt("0", "Off"),
+		opt("1", "Automatic, with some lag"),
+		opt("2", "Low lag, may not work on all displays"),
+	),
+	boolKey(KeyHdmiAudio96k, IniGroupAudio, "0", "Output HDMI audio at 96kHz instead of 48kHz."),
+	enumKey(KeyDviMode, IniGroupVideo, "2", "Output DVI instead of HDMI, which disables audio.",
+		opt("0", "HDMI"),
+		opt("1", "DVI"),
+		opt("2", "Automatic"),
+	),
+	enumKey(KeyHdmiLimited, IniGroupVideo, "0", "HDMI color range.",
+		opt("0", "Full range"),
+		opt("1", "Limited range (16-235)"),
+		opt("2", "Limited range for VGA converters (16-255)"),
+	),
+	boolKey(KeyKbdNomouse, IniGroupInput, "0", "Don't use the keyboard to emulate a mouse."),
+	intKey(KeyMouseThrottle, IniGroupInput, 1, 100, "1", "Divide mouse movement to slow it down."),
+	boolKey(KeyBootscreen, IniGroupMenu, "1", "Show the boot screen of cores which have one."),
+	enumKey(KeyVscaleMode, IniGroupVideo, "0", "How the image is scaled vertically.",
+		opt("0", "Fit to screen"),
+		opt("1", "Integer scale"),
+		opt("2", "Integer scale, 0.5 steps"),
+		opt("3", "Integer scale, 0.25 steps"),
+		opt("4", "Integer scale using core resolution"),
+		opt("5", "Integer scale using core resolution, keep aspect ratio"),
+	),
+	intKey(KeyVscaleBorder, IniGroupVideo, 0, 399, "0", "Border in pixels around the scaled image."),
+	boolKey(KeyRbfHideDatecode, IniGroupMenu, "0", "Hide the date codes of cores in the menu."),
+	boolKey(KeyMenuPal, IniGroupMenu, "0", "Use PAL instead of NTSC for the menu on the VGA port."),
+	stringKey(KeyBootcore, IniGroupSystem, "", "Core, game or .mgl to launch on startup, or lastcore/lastexactcore."),
+	intKey(KeyBootcoreTimeout, IniGroupSystem, 2, 30, "10", "Seconds to wait before launching the boot core."),
+	stringKey(KeyFont, IniGroupMenu, "", "Path to a custom font for the menu and OSD."),
+	enumKey(KeyFbSize, IniGroupVideo, "0", "Size of the Linux framebuffer.",
+		opt("0", "Automatic"),
+		opt("1", "Full size"),
+		opt("2", "1/2 of resolution"),
+		opt("4", "1/4 of resolution"),
+	),
+	boolKey(KeyFbTerminal, IniGroupMenu, "1", "Enable the Linux console on the framebuffer."),
+	intKey(KeyOsdTimeout, IniGroupMenu, 0, 3600, "0", "Seconds until the OSD hides itself, 0 to never hide."),
+	boolKey(KeyDirectVideo, IniGroupVideo, "0", "Output the core's video directly over HDMI, for use with analog converters."),
+	enumKey(KeyOsdRotate, IniGroupMenu, "0", "Rotate the OSD for vertical screens.",
+		opt("0", "No rotation"),
+		opt("1", "Rotate right"),
+		opt("2", "Rotate left"),
+	),
+	enumKey(KeyGamepadDefaults, IniGroupInput, "0", "Default button layout of gamepads.",
+		opt("0", "Name-based, like Nintendo"),
+		opt("1", "Position-based, like Xbox"),
+	),
+	boolKey(KeyRecents, IniGroupMenu, "0", "Remember recently loaded files in the OSD."),
+	intKey(KeyControllerInfo, IniGroupInput, 0, 10, "6", "Seconds to show controller button info when a core starts."),
+	floatKey(KeyRefreshMin, IniGroupVideo, 0, 150, "0", "Minimum refresh rate supported by the display, in Hz."),
+	floatKey(KeyRefreshMax, IniGroupVideo, 0, 150, "0", "Maximum refresh rate supported by the display, in Hz."),
+	hexKey(KeyJammaVid, IniGroupInput, 16, "VID of a JAMMA interface."),
+	hexKey(KeyJammaPid, IniGroupInput, 16, "PID of a JAMMA interface."),
+	boolKey(KeySniperMode, IniGroupInput, "0", "Swap the mouse sniper mode and normal speed."),
+	boolKey(KeyBrowseExpand, IniGroupMenu, "1", "Expand long filenames in the file browser."),
+	boolKey(KeyLogo, IniGroupMenu, "1", "Show the MiSTer logo in the menu."),
+	stringKey(KeySharedFolder, IniGroupSystem, "", "Folder shared with cores which support it, such as ao486."),
+	hexKey(KeyNoMergeVid, IniGroupInput, 16, "VID of a device which shouldn't have its inputs merged."),
+	hexKey(KeyNoMergePid, IniGroupInput, 16, "PID of a device which shouldn't have its inputs merged."),
+	shadowed(hexKey(KeyNoMergeVidpid, IniGroupInput, 32, "VID and PID of devices which shouldn't have their inputs merged.")),
+	stringKey(KeyCustomAspectRatio1, IniGroupVideo, "", "Custom aspect ratio available in cores, e.g. 16:9."),
+	stringKey(KeyCustomAspectRatio2, IniGroupVideo, "", "Second custom aspect ratio available in cores."),
+	hexKey(KeySpinnerVid, IniGroupInput, 16, "VID of a spinner device."),
+	hexKey(KeySpinnerPid, IniGroupInput, 16, "PID of a spinner device."),
+	enumKey(KeySpinnerAxis, IniGroupInput, "0", "Axis of a mouse used as a spinner.",
+		opt("0", "X"),
+		opt("1", "Y"),
+		opt("2", "Wheel"),
+	),
+	intKey(KeySpinnerThrottle, IniGroupInput, -10000, 10000, "0", "Spinner speed, negative values reverse direction."),
+	stringKey(KeyAfilterDefault, IniGroupAudio, "", "Default audio filter, relative to the filters_audio folder."),
+	stringKey(KeyVfilterDefault, IniGroupVideo, "", "Default video filter, relative to the filters folder."),
+	stringKey(KeyVfilterVerticalDefault, IniGroupVideo, "", "Default video filter for vertical cores."),
+	stringKey(KeyVfilterScanlinesDefault, IniGroupVideo, "", "Default scanlines filter."),
+	stringKey(KeyShmaskDefault, IniGroupVideo, "", "Default shadow mask, relative to the shadow_masks folder."),
+	intKey(KeyShmaskModeDefault, IniGroupVideo, 0, 255, "0", "Default shadow mask mode."),
+	stringKey(KeyPresetDefault, IniGroupVideo, "", "Default video preset, relative to the presets folder."),
+	boolKey(KeyLogFileEntry, IniGroupSystem, "0", "Log the last loaded file to /tmp/CURRENTPATH."),
+	intKey(KeyBtAutoDisconnect, IniGroupInput, 0, 180, "0", "Minutes until idle Bluetooth controllers are disconnected, 0 to never disconnect."),
+	boolKey(KeyBtResetBeforePair, IniGroupInput, "0", "Reset the Bluetooth adapter before pairing."),
+	stringKey(KeyWaitmount, IniGroupSystem, "", "Devices to wait for before mounting, e.g. a USB drive."),
+	boolKey(KeyRumble, IniGroupInput, "1", "Enable controller rumble."),
+	intKey(KeyWheelForce, IniGroupInput, 0, 100, "50", "Force feedback strength of racing wheels, as a percentage."),
+	intKey(KeyWheelRange, IniGroupInput, 0, 1000, "0", "Rotation range of racing wheels in degrees, 0 for the wheel's default."),
+	boolKey(KeyHdmiGameMode, IniGroupVideo, "0", "Ask the display to use its low latency game mode."),
+	enumKey(KeyVrrMode, IniGroupVideo, "0", "Variable refresh rate mode.",
+		opt("0", "Off"),
+		opt("1", "Automatic"),
+		opt("2", "FreeSync"),
+		opt("3", "VESA HDMI Forum VRR"),
+	),
+	intKey(KeyVrrMinFramerate, IniGroupVideo, 0, 255, "0", "Minimum refresh rate for VRR, 0 to detect."),
+	intKey(KeyVrrMaxFramerate, IniGroupVideo, 0, 255, "0", "Maximum refresh rate for VRR, 0 to detect."),
+	intKey(KeyVrrVesaFramerate, IniGroupVideo, 0, 255, "0", "Refresh rate for VESA VRR, 0 to detect."),
+	intKey(KeyVideoOff, IniGroupVideo, 0, 3600, "0", "Seconds of inactivity in the menu before turning off video, 0 to never turn off."),
+	playerControllerKey(KeyPlayer1Controller),
+	playerControllerKey(KeyPlayer2Controller),
+	playerControllerKey(KeyPlayer3Controller),
+	playerControllerKey(KeyPlayer4Controller),
+	playerControllerKey(KeyPlayer5Controller),
+	playerControllerKey(KeyPlayer6Controller),
+	boolKey(KeyDisableAutofire, IniGroupInput, "0", "Disable autofire in all cores."),
+	intKey(KeyVideoBrightness, IniGroupVideo, 0, 100, "50", "HDMI brightness."),
+	intKey(KeyVideoContrast, IniGroupVideo, 0, 100, "50", "HDMI contrast."),
+	intKey(KeyVideoSaturation, IniGroupVideo, 0, 100, "100", "HDMI saturation."),
+	intKey(KeyVideoHue, IniGroupVideo, 0, 360, "0", "HDMI hue rotation in degrees."),
+	stringKey(KeyVideoGainOffset, IniGroupVideo, "1, 0, 1, 0, 1, 0", "HDMI gain and offset of red, green and blue."),
+	enumKey(KeyHdr, IniGroupVideo, "0", "HDMI high dynamic range mode.",
+		opt("0", "Off"),
+		opt("1", "HLG"),
+		opt("2", "DCI P3"),
+	),
+	intKey(KeyHdrMaxNits, IniGroupVideo, 100, 10000, "1000", "Maximum brightness of HDR output in nits."),
+	intKey(KeyHdrAvgNits, IniGroupVideo, 100, 10000, "250", "Average brightness of HDR output in nits."),
+	enumKey(KeyVgaMode, IniGroupVideo, "rgb", "Output mode of the VGA port.",
+		opt("rgb", "RGB"),
+		opt("ypbpr", "YPbPr"),
+		opt("svideo", "S-Video"),
+		opt("cvbs", "Composite"),
+	),
+	enumKey(KeyNtscMode, IniGroupVideo, "0", "Color encoding of S-Video and composite output.",
+		opt("0", "NTSC"),
+		opt("1", "PAL-60"),
+		opt("2", "PAL-M"),
+	),
+	shadowed(hexKey(KeyControllerUniqueMapping, IniGroupInput, 32, "VID and PID of controllers which have a separate mapping for each controller.")),
+}
+
+// GetIniKeySchema returns the schema of a key.
+func GetIniKeySchema(key string) (IniKeySchema, bool) {
+	for _, schema := range IniSchema {
+		if schema.Key == key {
+			return schema, true
+		}
+	}
+	return IniKeySchema{}, false
+}
+
+func (s IniKeySchema) checkRange(n float64) error {
+	if n < s.Min || n > s.Max {
+		if s.Type == IniTypeHex {
+			return fmt.Errorf("must be between 0x0 and 0x%X", uint64(s.Max))
+		}
+		return fmt.Errorf("must be between %s and %s",
+			strconv.FormatFloat(s.Min, 'f', -1, 64),
+			strconv.FormatFloat(s.Max, 'f', -1, 64))
+	}
+	return nil
+}
+
+// validateOne checks a single value, without splitting shadowed values.
+func (s IniKeySchema) validateOne(value string) error {
+	switch s.Type {
+	case IniTypeBool:
+		if value != "0" && value != "1" {
+			return fmt.Errorf("must be 0 or 1")
+		}
+	case IniTypeInt:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("must be a whole number")
+		}
+		return s.checkRange(float64(n))
+	case IniTypeFloat:
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("must be a number")
+		}
+		return s.checkRange(n)
+	case IniTypeHex:
+		lower := strings.ToLower(value)
+		if !strings.HasPrefix(lower, "0x") {
+			return fmt.Errorf("must be a hex number starting with 0x")
+		}
+		n, err := strconv.ParseUint(lower[2:], 16, 64)
+		if err != nil {
+			return fmt.Errorf("must be a hex number starting with 0x")
+		}
+		return s.checkRange(float64(n))
+	case IniTypeEnum:
+		for _, option := range s.Options {
+			if strings.EqualFold(option.Value, value) {
+				return nil
+			}
+		}
+		values := make([]string, 0, len(s.Options))
+		for _, option := range s.Options {
+			values = append(values, option.Value)
+		}
+		return fmt.Errorf("must be one of: %s", strings.Join(values, ", "))
+	case IniTypeString:
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("must be a single line")
+		}
+	}
+	return nil
+}
+
+// Validate checks a value is allowed for the key. An empty value is always
+// valid, and removes the key.
+func (s IniKeySchema) Validate(value string) error {
+	if value == "" {
+		return nil
+	}
+
+	if !s.Shadowed {
+		return s.validateOne(value)
+	}
+
+	for _, val := range strings.Split(value, ShadowDelimiter) {
+		err := s.validateOne(strings.TrimSpace(val))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// IniValueError is a problem with the value of a single key.
+type IniValueError struct {
+	Key     string `json:"key"`
+	Value   string `json:"value"`
+	Message string `json:"message"`
+}
+
+func (e *IniValueError) Error() string {
+	return fmt.Sprintf("invalid value for %s: %s", e.Key, e.Message)
+}
+
+// ValidateIniValue checks a key is known and its value is allowed.
+func ValidateIniValue(key string, value string) error {
+	schema, ok := GetIniKeySchema(key)
+	if !ok {
+		return &IniValueError{Key: key, Value: value, Message: "unknown key"}
+	}
+
+	err := schema.Validate(value)
+	if err != nil {
+		return &IniValueError{Key: key, Value: value, Message: err.Error()}
+	}
+
+	return nil
+}
+
+// validateUnknownIniValue checks a key which isn't in the schema, like one
+// from a newer MiSTer version, can be written to the file as is. Only the key
+// name and that the value is a single line are checked.
+func validateUnknownIniValue(key string, value string) error {
+	if key == "" || strings.TrimSpace(key) != key || strings.ContainsAny(key, "=:[];#\r\n") {
+		return &IniValueError{Key: key, Value: value, Message: "invalid key name"}
+	}
+
+	if strings.ContainsAny(value, "\r\n") {
+		return &IniValueError{Key: key, Value: value, Message: "must be a single line"}
+	}
+
+	return nil
+}
+
+// ValidateIniValues checks every key in a set of values, returning an error
+// for each invalid key sorted by key. Internal keys starting with __ are
+// skipped, and keys which aren't in the schema are only checked to be safe to
+// write, so keys loaded from the file can be saved back unchanged.
+func ValidateIniValues(values map[string]string) []IniValueError {
+	errs := make([]IniValueError, 0)
+
+	for key, value := range values {
+		if strings.HasPrefix(key, "__") {
+			continue
+		}
+
+		var err error
+		if _, ok := GetIniKeySchema(key); ok {
+			err = ValidateIniValue(key, value)
+		} else {
+			err = validateUnknownIniValue(key, value)
+		}
+		if ve, ok := err.(*IniValueError); ok {
+			errs = append(errs, *ve)
+		}
+	}
+
+	sort.Slice(errs, func(i, j int) bool {
+		return errs[i].Key < errs[j].Key
+	})
+
+	return errs
+}
+
+// IniDefaultDiff is a key which is set to something other than its default.
+type IniDefaultDiff struct {
+	Key     string `json:"key"`
+	Value   string `json:"value"`
+	Default string `json:"default"`
+}
+
+// DiffDefaults returns every key in a section which is set to a value other
+// than its default, in the same order as the schema. Unknown keys are
+// included with an empty default.
+func (mi *MisterIni) DiffDefaults(section string) ([]IniDefaultDiff, error) {
+	values, err := mi.SectionValues(section)
+	if err != nil {
+		return nil, err
+	}
+
+	diffs := make([]IniDefaultDiff, 0)
+
+	for _, schema := range IniSchema {
+		value, ok := values[schema.Key]
+		if !ok {
+			continue
+		}
+		delete(values, schema.Key)
+
+		if isDefaultValue(schema, value) {
+			continue
+		}
+
+		diffs = append(diffs, IniDefaultDiff{Key: schema.Key, Value: value, Default: schema.Default})
+	}
+
+	unknown := make([]string, 0, len(values))
+	for key := range values {
+		unknown = append(unknown, key)
+	}
+	sort.Strings(unknown)
+
+	for _, key := range unknown {
+		diffs = append(diffs, IniDefaultDiff{Key: key, Value: values[key]})
+	}
+
+	return diffs, nil
+}
+
+// isDefaultValue compares values the way Main parses them, so 0x00FF is the
+// same as 0xff and 1.0 is the same as 1.
+func isDefaultValue(schema IniKeySchema, value string) bool {
+	if value == schema.Default {
+		return true
+	}
+
+	switch schema.Type {
+	case IniTypeInt, IniTypeFloat, IniTypeBool:
+		a, errA := strconv.ParseFloat(value, 64)
+		b, errB := strconv.ParseFloat(schema.Default, 64)
+		return errA == nil && errB == nil && a == b
+	case IniTypeEnum:
+		return strings.EqualFold(value, schema.Default)
+	default:
+		return false
+	}
+}
@@ -0,0 +1,181 @@
+package mister
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/wizzomafizzo/mrext/pkg/utils"
+)
+
+func TestIniSchemaCoversKeys(t *testing.T) {
+	if len(IniSchema) != len(ValidIniKeys) {
+		t.Errorf("got %d keys in schema, want %d", len(IniSchema), len(ValidIniKeys))
+	}
+
+	for i, key := range ValidIniKeys {
+		if i < len(IniSchema) && IniSchema[i].Key != key {
+			t.Errorf("schema key %d: got %s want %s", i, IniSchema[i].Key, key)
+		}
+
+		schema, ok := GetIniKeySchema(key)
+		if !ok {
+			t.Errorf("%s: missing from schema", key)
+			continue
+		}
+
+		if schema.Shadowed != utils.Contains(ShadowedIniKeys, key) {
+			t.Errorf("%s: got shadowed %v", key, schema.Shadowed)
+		}
+
+		if schema.Description == "" {
+			t.Errorf("%s: missing description", key)
+		}
+
+		if err := schema.Validate(schema.Default); err != nil {
+			t.Errorf("%s: default %q is invalid: %s", key, schema.Default, err)
+		}
+	}
+}
+
+func TestValidateIniValue(t *testing.T) {
+	tests := []struct {
+		key   string
+		value string
+		valid bool
+	}{
+		// bool
+		{KeyRecents, "1", true},
+		{KeyRecents, "0", true},
+		{KeyRecents, "", true},
+		{KeyRecents, "2", false},
+		{KeyRecents, "true", false},
+		// int
+		{KeyVideoInfo, "0", true},
+		{KeyVideoInfo, "10", true},
+		{KeyVideoInfo, "11", false},
+		{KeyVideoInfo, "-1", false},
+		{KeyVideoInfo, "1.5", false},
+		{KeySpinnerThrottle, "-10000", true},
+		{KeySpinnerThrottle, "-10001", false},
+		{KeyBootcoreTimeout, "1", false},
+		// float
+		{KeyRefreshMin, "49.5", true},
+		{KeyRefreshMin, "150", true},
+		{KeyRefreshMin, "150.1", false},
+		{KeyRefreshMin, "fast", false},
+		// hex
+		{KeyJammaVid, "0x1234", true},
+		{KeyJammaVid, "0XFFFF", true},
+		{KeyJammaVid, "0x10000", false},
+		{KeyJammaVid, "1234", false},
+		{KeyJammaVid, "0xzz", false},
+		{KeyKeyrahMode, "0x18d80002", true},
+		// enum
+		{KeyVsyncAdjust, "2", true},
+		{KeyVsyncAdjust, "3", false},
+		{KeyFbSize, "4", true},
+		{KeyFbSize, "3", false},
+		{KeyVgaMode, "svideo", true},
+		{KeyVgaMode, "SVIDEO", true},
+		{KeyVgaMode, "hdmi", false},
+		// string
+		{KeyVideoMode, "1280,110,40,220,720,5,5,20,74250", true},
+		{KeyBootcore, "lastcore", true},
+		{KeyBootcore, "line\nbreak", false},
+		// shadowed
+		{KeyNoMergeVidpid, "0x12345678,0x87654321", true},
+		{KeyNoMergeVidpid, "0x12345678, 0x87654321", true},
+		{KeyNoMergeVidpid, "0x12345678,nope", false},
+		// unknown
+		{"not_a_key", "1", false},
+	}
+
+	for _, tt := range tests {
+		err := ValidateIniValue(tt.key, tt.value)
+		if tt.valid && err != nil {
+			t.Errorf("%s=%q: got %s want valid", tt.key, tt.value, err)
+		} else if !tt.valid {
+			var ve *IniValueError
+			if !errors.As(err, &ve) {
+				t.Errorf("%s=%q: got %v want IniValueError", tt.key, tt.value, err)
+			} else if ve.Key != tt.key || ve.Message == "" {
+				t.Errorf("%s=%q: got %+v", tt.key, tt.value, ve)
+			}
+		}
+	}
+}
+
+func TestValidateIniValues(t *testing.T) {
+	errs := ValidateIniValues(map[string]string{
+		KeyVsyncAdjust: "9",
+		KeyRecents:     "1",
+		KeyVideoInfo:   "x",
+		"__hostname":   "MiSTer",
+		"new_option":   "1",
+		"bad=key":      "1",
+		"multi_line":   "a\nb",
+	})
+
+	var keys []string
+	for _, err := range errs {
+		keys = append(keys, err.Key)
+	}
+
+	want := []string{"bad=key", "multi_line", KeyVideoInfo, KeyVsyncAdjust}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("got %v want %v", keys, want)
+	}
+}
+
+func TestSetKeyValidates(t *testing.T) {
+	mi := loadTestIni(t, testIni)
+
+	err := mi.SetKey(KeyVsyncAdjust, "5")
+	var ve *IniValueError
+	if !errors.As(err, &ve) {
+		t.Fatalf("got %v want IniValueError", err)
+	}
+
+	value, _ := mi.GetKey(KeyVsyncAdjust)
+	if value != "1" {
+		t.Errorf("got %q want unchanged value", value)
+	}
+
+	// keys missing from the schema are passed through
+	err = mi.SetKey("new_option", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, _ := mi.SectionValues(MainIniSection)
+	if values["new_option"] != "1" {
+		t.Errorf("got %q want unknown key set", values["new_option"])
+	}
+}
+
+func TestDiffDefaults(t *testing.T) {
+	mi := loadTestIni(t, `[MiSTer]
+video_mode=8
+vsync_adjust=0
+rumble=1
+wheel_force=50.0
+vga_mode=RGB
+no_merge_vidpid=0x1234
+no_merge_vidpid=0x5678
+hdr_max_nits=400
+`)
+
+	diffs, err := mi.DiffDefaults(MainIniSection)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []IniDefaultDiff{
+		{Key: KeyVideoMode, Value: "8", Default: ""},
+		{Key: KeyNoMergeVidpid, Value: "0x1234,0x5678", Default: ""},
+		{Key: KeyHdrMaxNits, Value: "400", Default: "1000"},
+	}
+	if !reflect.DeepEqual(diffs, want) {
+		t.Errorf("got %+v want %+v", diffs, want)
+	}
+}
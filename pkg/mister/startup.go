@@ -6,6 +6,7 @@ import (
 	"strings"
 
 	"github.com/wizzomafizzo/mrext/pkg/config"
+	"github.com/wizzomafizzo/mrext/pkg/service"
 )
 
 // TODO: delete entry from startup
@@ -165,3 +166,140 @@ func (s *Startup) Remove(name string) error {
 
 	return fmt.Errorf("startup entry not found: %s", name)
 }
+
+// SupervisorStartupName is the prefix of the startup entries which start the
+// supervisor, which runs the services of mrext apps instead of their own
+// entries. Each supervised app has its own entry, so the supervisor is still
+// started if one of them is uninstalled.
+const SupervisorStartupName = "mrext/" + service.SupervisorName
+
+func supervisorEntryName(name string) string {
+	return SupervisorStartupName + "/" + name
+}
+
+// setSupervisorEntries replaces the supervisor's startup entries with one
+// for each supervised app.
+func (s *Startup) setSupervisorEntries(services []service.SupervisedService) {
+	kept := make([]StartupEntry, 0, len(s.Entries))
+	for _, entry := range s.Entries {
+		if !strings.HasPrefix(entry.Name, SupervisorStartupName+"/") {
+			kept = append(kept, entry)
+		}
+	}
+	s.Entries = kept
+
+	for _, svc := range services {
+		_ = s.Add(
+			supervisorEntryName(svc.Name),
+			fmt.Sprintf("[[ -e %s ]] && %s -service supervise", svc.Path, svc.Path),
+		)
+	}
+}
+
+// HasSupervised returns true if an app's service is run by the supervisor
+// on startup.
+func (s *Startup) HasSupervised(name string) bool {
+	if !s.Exists(supervisorEntryName(name)) {
+		return false
+	}
+
+	services, err := service.LoadSupervised()
+	if err != nil {
+		return false
+	}
+
+	for _, svc := range services {
+		if svc.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AddSupervised runs the running app's service from the supervisor on
+// startup. Its own startup entry is removed if it has one. The supervisor's
+// list of services is saved straight away, the startup file still needs to
+// be saved.
+func (s *Startup) AddSupervised(name string) error {
+	if !service.IsSupervisedApp(name) {
+		return fmt.Errorf("%w: %s", service.ErrNotSupervisedApp, name)
+	}
+
+	path, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	services, err := service.LoadSupervised()
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for i, svc := range services {
+		if svc.Name == name {
+			services[i].Path = path
+			found = true
+		}
+	}
+	if !found {
+		services = append(services, service.SupervisedService{Name: name, Path: path})
+	}
+
+	err = service.SaveSupervised(services)
+	if err != nil {
+		return err
+	}
+
+	if s.Exists("mrext/" + name) {
+		_ = s.Remove("mrext/" + name)
+	}
+	s.setSupervisorEntries(services)
+
+	return nil
+}
+
+// RemoveSupervised stops running an app's service on startup, and removes
+// its supervisor startup entry.
+func (s *Startup) RemoveSupervised(name string) error {
+	services, err := service.LoadSupervised()
+	if err != nil {
+		return err
+	}
+
+	kept := make([]service.SupervisedService, 0, len(services))
+	for _, svc := range services {
+		if svc.Name != name {
+			kept = append(kept, svc)
+		}
+	}
+
+	err = service.SaveSupervised(kept)
+	if err != nil {
+		return err
+	}
+
+	if s.Exists("mrext/" + name) {
+		_ = s.Remove("mrext/" + name)
+	}
+	s.setSupervisorEntries(kept)
+
+	return nil
+}
+
+// MigrateService moves an app's own startup entry, added before the
+// supervisor, to the supervisor. It returns true if the startup file was
+// changed and needs saving.
+func (s *Startup) MigrateService(name string) (bool, error) {
+	if !service.IsSupervisedApp(name) || !s.Exists("mrext/"+name) {
+		return false, nil
+	}
+
+	err := s.AddSupervised(name)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
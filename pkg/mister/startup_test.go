@@ -0,0 +1,38 @@
+package mister
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/wizzomafizzo/mrext/pkg/service"
+)
+
+func TestSetSupervisorEntries(t *testing.T) {
+	s := Startup{Entries: []StartupEntry{
+		{Name: "mrext/remote", Enabled: true, Cmds: []string{"remote"}},
+		{Name: "mrext/supervisor/nfc", Enabled: true, Cmds: []string{"old"}},
+	}}
+
+	s.setSupervisorEntries([]service.SupervisedService{
+		{Name: "nfc", Path: "/media/fat/Scripts/nfc.sh"},
+		{Name: "playlog", Path: "/media/fat/Scripts/playlog.sh"},
+	})
+
+	want := []StartupEntry{
+		{Name: "mrext/remote", Enabled: true, Cmds: []string{"remote"}},
+		{Name: "mrext/supervisor/nfc", Enabled: true, Cmds: []string{
+			"[[ -e /media/fat/Scripts/nfc.sh ]] && /media/fat/Scripts/nfc.sh -service supervise",
+		}},
+		{Name: "mrext/supervisor/playlog", Enabled: true, Cmds: []string{
+			"[[ -e /media/fat/Scripts/playlog.sh ]] && /media/fat/Scripts/playlog.sh -service supervise",
+		}},
+	}
+	if !reflect.DeepEqual(s.Entries, want) {
+		t.Errorf("got entries %+v want %+v", s.Entries, want)
+	}
+
+	s.setSupervisorEntries(nil)
+	if len(s.Entries) != 1 || s.Entries[0].Name != "mrext/remote" {
+		t.Errorf("supervisor entries weren't removed: %+v", s.Entries)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"github.com/wizzomafizzo/mrext/pkg/config"
 	"os"
 	"regexp"
+	"sort"
 	"strings"
 )
 
@@ -14,16 +15,21 @@ const (
 )
 
 func ReadUBootParams() (map[string]string, error) {
-	params := make(map[string]string)
-
 	data, err := os.ReadFile(config.UBootConfigFile)
 	if os.IsNotExist(err) {
-		return params, nil
+		return make(map[string]string), nil
 	} else if err != nil {
-		return params, err
+		return make(map[string]string), err
 	}
 
-	for _, line := range strings.Split(string(data), "\n") {
+	return ParseUBootParams(string(data)), nil
+}
+
+// ParseUBootParams parses the contents of a u-boot.txt file.
+func ParseUBootParams(data string) map[string]string {
+	params := make(map[string]string)
+
+	for _, line := range strings.Split(data, "\n") {
 		line = strings.TrimRight(line, "\r")
 		line = strings.TrimSpace(line)
 
@@ -42,31 +48,159 @@ func ReadUBootParams() (map[string]string, error) {
 		params[parts[0]] = parts[1]
 	}
 
-	return params, nil
+	return params
 }
 
-func WriteUBootParams(params map[string]string) error {
+// FormatUBootParams returns the contents of a u-boot.txt file, sorted by key.
+func FormatUBootParams(params map[string]string) string {
 	var pairs []string
 
 	for key, value := range params {
 		pairs = append(pairs, fmt.Sprintf("%s=%s", key, value))
 	}
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, "\n") + "\n"
+}
 
-	content := strings.Join(pairs, "\n") + "\n"
+func WriteUBootParams(params map[string]string) error {
+	return DefaultHistory.Write(config.UBootConfigFile, []byte(FormatUBootParams(params)), "")
+}
 
-	if _, err := os.Stat(config.UBootConfigFile); err == nil {
-		err = os.Rename(config.UBootConfigFile, config.UBootConfigFile+".backup")
-		if err != nil {
-			return err
+// UBootFile is a u-boot.txt file which keeps every line as it was read, so
+// editing params doesn't lose comments or lines it doesn't understand.
+type UBootFile struct {
+	Path  string
+	lines []string
+}
+
+// ParseUBootFile reads the contents of a u-boot.txt file.
+func ParseUBootFile(path string, data string) *UBootFile {
+	f := &UBootFile{Path: path}
+	data = strings.ReplaceAll(data, "\r\n", "\n")
+	if data != "" {
+		f.lines = strings.Split(strings.TrimSuffix(data, "\n"), "\n")
+	}
+	return f
+}
+
+// ReadUBootFile reads the MiSTer's u-boot.txt file. A missing file is
+// returned empty.
+func ReadUBootFile() (*UBootFile, error) {
+	data, err := os.ReadFile(config.UBootConfigFile)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return ParseUBootFile(config.UBootConfigFile, string(data)), nil
+}
+
+func ubootLineKey(line string) string {
+	key, _, ok := strings.Cut(line, "=")
+	if !ok {
+		return ""
+	}
+	return strings.TrimSpace(key)
+}
+
+// Get returns the value of a param. If it's set more than once, the last
+// one is used, like u-boot does.
+func (f *UBootFile) Get(key string) (string, bool) {
+	value, found := "", false
+	for _, line := range f.lines {
+		if ubootLineKey(line) == key {
+			_, value, _ = strings.Cut(line, "=")
+			value, found = strings.TrimSpace(value), true
 		}
 	}
+	return value, found
+}
 
-	err := os.WriteFile(config.UBootConfigFile, []byte(content), 0644)
-	if err != nil {
-		return err
+// Set replaces the first line of a param and removes any others, or adds
+// it to the end of the file.
+func (f *UBootFile) Set(key string, value string) {
+	line := fmt.Sprintf("%s=%s", key, value)
+	lines := make([]string, 0, len(f.lines)+1)
+	found := false
+
+	for _, existing := range f.lines {
+		if ubootLineKey(existing) != key {
+			lines = append(lines, existing)
+		} else if !found {
+			lines = append(lines, line)
+			found = true
+		}
+	}
+
+	if !found {
+		lines = append(lines, line)
+	}
+
+	f.lines = lines
+}
+
+// Delete removes every line of a param.
+func (f *UBootFile) Delete(key string) {
+	lines := make([]string, 0, len(f.lines))
+	for _, line := range f.lines {
+		if ubootLineKey(line) != key {
+			lines = append(lines, line)
+		}
 	}
+	f.lines = lines
+}
+
+// KernelArgs returns the args in the kernel param, in order.
+func (f *UBootFile) KernelArgs() []KernelArg {
+	value, _ := f.Get(UBootKernelParam)
+	return ParseKernelArgs(value)
+}
+
+// SetKernelArgs replaces the kernel param, removing it if there are no args.
+func (f *UBootFile) SetKernelArgs(args []KernelArg) {
+	if len(args) == 0 {
+		f.Delete(UBootKernelParam)
+	} else {
+		f.Set(UBootKernelParam, FormatKernelArgs(args))
+	}
+}
+
+func (f *UBootFile) String() string {
+	if len(f.lines) == 0 {
+		return ""
+	}
+	return strings.Join(f.lines, "\n") + "\n"
+}
 
-	return nil
+// Save writes the file and keeps it in history.
+func (f *UBootFile) Save(author string) error {
+	return DefaultHistory.Write(f.Path, []byte(f.String()), author)
+}
+
+// MergeUBootParams applies the params of another MiSTer's u-boot.txt on top
+// of existing ones. Kernel args are merged one by one. The MAC address is
+// never copied, because it must be unique on the network.
+func MergeUBootParams(params map[string]string, other map[string]string) map[string]string {
+	merged := make(map[string]string)
+	for key, value := range params {
+		merged[key] = value
+	}
+
+	for key, value := range other {
+		if key == UBootMACParam {
+			continue
+		} else if key != UBootKernelParam {
+			merged[key] = value
+			continue
+		}
+
+		args := parseKernelArgs(merged[UBootKernelParam])
+		for arg, argValue := range parseKernelArgs(value) {
+			args[arg] = argValue
+		}
+		merged[UBootKernelParam] = makeKernelArgs(args)
+	}
+
+	return merged
 }
 
 func parseKernelArgs(input string) map[string]string {
@@ -100,6 +234,7 @@ func makeKernelArgs(params map[string]string) string {
 
 		pairs = append(pairs, fmt.Sprintf("%s=%s", key, value))
 	}
+	sort.Strings(pairs)
 
 	content := strings.Join(pairs, " ")
 
@@ -123,14 +258,14 @@ func GetConfiguredMacAddress() (string, error) {
 // UpdateConfiguredMacAddress updates the ethernet MAC address configured in the u-boot.txt file. Setting a new one if
 // it doesn't exist, or updating the existing one. Any existing u-boot.txt arguments are preserved.
 func UpdateConfiguredMacAddress(newMacAddress string) error {
-	params, err := ReadUBootParams()
+	f, err := ReadUBootFile()
 	if err != nil {
 		return err
 	}
 
-	params[UBootMACParam] = newMacAddress
+	f.Set(UBootMACParam, newMacAddress)
 
-	return WriteUBootParams(params)
+	return f.Save("")
 }
 
 func GetUsbHidQuirks() ([]string, error) {
@@ -152,40 +287,32 @@ func GetUsbHidQuirks() ([]string, error) {
 }
 
 func UpdateUsbHidQuirks(quirks []string) error {
-	params, err := ReadUBootParams()
+	f, err := ReadUBootFile()
 	if err != nil {
 		return err
 	}
 
-	args := make(map[string]string)
-	if v, ok := params[UBootKernelParam]; ok {
-		args = parseKernelArgs(v)
-	}
+	f.SetKernelArgs(SetKernelArg(f.KernelArgs(), KernelArg{
+		Name:  "usbhid.quirks",
+		Value: strings.Join(quirks, ","),
+	}))
 
-	args["usbhid.quirks"] = strings.Join(quirks, ",")
-	params[UBootKernelParam] = makeKernelArgs(args)
-
-	return WriteUBootParams(params)
+	return f.Save("")
 }
 
 func EnableFastUsbPoll() error {
-	params, err := ReadUBootParams()
+	f, err := ReadUBootFile()
 	if err != nil {
 		return err
 	}
 
-	args := make(map[string]string)
-	if v, ok := params[UBootKernelParam]; ok {
-		args = parseKernelArgs(v)
-	}
-
-	args["loglevel"] = "4"
-	args["usbhid.jspoll"] = "1"
-	args["xpad.cpoll"] = "1"
-
-	params[UBootKernelParam] = makeKernelArgs(args)
+	args := f.KernelArgs()
+	args = SetKernelArg(args, KernelArg{Name: "loglevel", Value: "4"})
+	args = SetKernelArg(args, KernelArg{Name: "usbhid.jspoll", Value: "1"})
+	args = SetKernelArg(args, KernelArg{Name: "xpad.cpoll", Value: "1"})
+	f.SetKernelArgs(args)
 
-	return WriteUBootParams(params)
+	return f.Save("")
 }
 
 func IsFastUsbPollActive() (bool, error) {
@@ -1,9 +1,42 @@
 package mister
 
 import (
-	"github.com/wizzomafizzo/mrext/pkg/config"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
+
+	"github.com/wizzomafizzo/mrext/pkg/config"
+)
+
+// Updates are run with the downloader or update_all scripts. Their output is
+// passed on line by line as it's written, and each run is kept in
+// <folder>/<id>.log with a JSON manifest of the run and a summary of what it
+// changed in <folder>/<id>.json. Only one update can run at a time.
+
+const (
+	UpdaterDownloader     = "downloader"
+	UpdaterUpdateAll      = "update_all"
+	defaultUpdateRunsKeep = 20
+)
+
+var (
+	ErrUpdateRunning     = errors.New("update already running")
+	ErrNoUpdateRunning   = errors.New("no update running")
+	ErrUnknownUpdater    = errors.New("unknown updater")
+	ErrUpdateRunNotFound = errors.New("update run not found")
 )
 
 func GetLastUpdateTime() (time.Time, error) {
@@ -16,3 +49,446 @@ func GetLastUpdateTime() (time.Time, error) {
 
 	return file.ModTime(), nil
 }
+
+// UpdateSummary is the list of files changed by an update, as reported at
+// the end of its output.
+type UpdateSummary struct {
+	Installed []string `json:"installed"`
+	Updated   []string `json:"updated"`
+	Removed   []string `json:"removed"`
+	Errors    []string `json:"errors"`
+}
+
+var (
+	ansiEscapeRe    = regexp.MustCompile(`\x1b\[[0-9;?]*[ -/]*[@-~]`)
+	summaryHeaderRe = regexp.MustCompile(`(?i)^(installed|updated|removed|deleted|errors|fetch errors|validation errors|failed)( files)?:$`)
+	summaryItemRe   = regexp.MustCompile(`^-\s+(.+)$`)
+)
+
+// StripAnsi removes terminal color and cursor codes from a line of output.
+func StripAnsi(line string) string {
+	return ansiEscapeRe.ReplaceAllString(line, "")
+}
+
+// summaryParser reads the summary sections of downloader output, e.g.:
+//
+//	Installed:
+//	 - _Console/SNES_20231012.rbf
+//
+// A section ends at the first line which isn't a list item. update_all runs
+// downloader for each of its databases, so the same file may be listed more
+// than once.
+type summaryParser struct {
+	summary UpdateSummary
+	section *[]string
+	seen    map[*[]string]map[string]bool
+}
+
+func newSummaryParser() *summaryParser {
+	p := &summaryParser{
+		summary: UpdateSummary{
+			Installed: make([]string, 0),
+			Updated:   make([]string, 0),
+			Removed:   make([]string, 0),
+			Errors:    make([]string, 0),
+		},
+	}
+	p.seen = map[*[]string]map[string]bool{
+		&p.summary.Installed: {},
+		&p.summary.Updated:   {},
+		&p.summary.Removed:   {},
+		&p.summary.Errors:    {},
+	}
+	return p
+}
+
+func (p *summaryParser) add(line string) {
+	line = strings.TrimSpace(StripAnsi(line))
+
+	if m := summaryHeaderRe.FindStringSubmatch(line); m != nil {
+		switch strings.ToLower(m[1]) {
+		case "installed":
+			p.section = &p.summary.Installed
+		case "updated":
+			p.section = &p.summary.Updated
+		case "removed", "deleted":
+			p.section = &p.summary.Removed
+		default:
+			p.section = &p.summary.Errors
+		}
+		return
+	}
+
+	if p.section == nil {
+		return
+	}
+
+	m := summaryItemRe.FindStringSubmatch(line)
+	if m == nil {
+		p.section = nil
+		return
+	}
+
+	item := strings.TrimSpace(m[1])
+	if !p.seen[p.section][item] {
+		p.seen[p.section][item] = true
+		*p.section = append(*p.section, item)
+	}
+}
+
+// ParseUpdateSummary reads the files changed by an update from its output.
+func ParseUpdateSummary(output string) UpdateSummary {
+	p := newSummaryParser()
+	for _, line := range splitOutputLines(output) {
+		p.add(line)
+	}
+	return p.summary
+}
+
+// splitOutputLines splits output on line feeds and carriage returns, so
+// progress which redraws a single line is read as separate lines.
+func splitOutputLines(output string) []string {
+	output = strings.ReplaceAll(output, "\r\n", "\n")
+	return strings.FieldsFunc(output, func(r rune) bool {
+		return r == '\n' || r == '\r'
+	})
+}
+
+func scanOutputLines(data []byte, atEOF bool) (int, []byte, error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		if data[i] == '\r' {
+			if i+1 == len(data) && !atEOF {
+				// wait to see if it's a \r\n
+				return 0, nil, nil
+			} else if i+1 < len(data) && data[i+1] == '\n' {
+				return i + 2, data[:i], nil
+			}
+		}
+		return i + 1, data[:i], nil
+	}
+
+	if atEOF {
+		return len(data), data, nil
+	}
+
+	return 0, nil, nil
+}
+
+type UpdateRun struct {
+	ID      string `json:"id"`
+	Updater string `json:"updater"`
+	// Author is who started the run, such as remote (<ip>).
+	Author   string    `json:"author"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Running  bool      `json:"running"`
+	// ExitCode is the exit code of the script, or -1 if it was killed or
+	// couldn't be started.
+	ExitCode  int           `json:"exitCode"`
+	Cancelled bool          `json:"cancelled"`
+	Error     string        `json:"error,omitempty"`
+	Lines     int           `json:"lines"`
+	Summary   UpdateSummary `json:"summary"`
+}
+
+type Updater struct {
+	Folder string
+	// Keep is the number of runs kept, oldest are deleted first. Zero keeps
+	// every run.
+	Keep int
+	// Scripts is the path of the script run for each updater.
+	Scripts map[string]string
+	mu      sync.Mutex
+	current *UpdateRun
+	cmd     *exec.Cmd
+}
+
+var DefaultUpdater = &Updater{
+	Folder: config.UpdateRunsFolder,
+	Keep:   defaultUpdateRunsKeep,
+	Scripts: map[string]string{
+		UpdaterDownloader: config.DownloaderScript,
+		UpdaterUpdateAll:  config.UpdateAllScript,
+	},
+}
+
+func (u *Updater) newRunId(now time.Time) string {
+	id := now.Format(historyTimeFormat)
+	for n := 2; ; n++ {
+		if _, err := os.Stat(filepath.Join(u.Folder, id+".json")); errors.Is(err, fs.ErrNotExist) {
+			return id
+		}
+		id = fmt.Sprintf("%s_%d", now.Format(historyTimeFormat), n)
+	}
+}
+
+func (u *Updater) saveRun(run UpdateRun) error {
+	data, err := json.MarshalIndent(run, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(u.Folder, run.ID+".json"), data, 0644)
+}
+
+// Current returns the update which is running, if any.
+func (u *Updater) Current() (UpdateRun, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.current == nil {
+		return UpdateRun{}, false
+	}
+	return *u.current, true
+}
+
+// Start runs an updater in the background. Each line of its output is passed
+// to onLine as it's written, and onDone is called with the finished run once
+// it exits. Either can be nil.
+func (u *Updater) Start(updater string, author string, onLine func(run UpdateRun, line string), onDone func(run UpdateRun)) (UpdateRun, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	script, ok := u.Scripts[updater]
+	if !ok {
+		return UpdateRun{}, fmt.Errorf("%w: %s", ErrUnknownUpdater, updater)
+	} else if u.current != nil {
+		return UpdateRun{}, fmt.Errorf("%w: %s", ErrUpdateRunning, u.current.Updater)
+	}
+
+	if _, err := os.Stat(script); err != nil {
+		return UpdateRun{}, fmt.Errorf("%s: %w", updater, err)
+	}
+
+	err := os.MkdirAll(u.Folder, 0755)
+	if err != nil {
+		return UpdateRun{}, err
+	}
+
+	now := time.Now()
+	run := &UpdateRun{
+		ID:      u.newRunId(now),
+		Updater: updater,
+		Author:  author,
+		Started: now,
+		Running: true,
+		Summary: newSummaryParser().summary,
+	}
+
+	logFile, err := os.Create(filepath.Join(u.Folder, run.ID+".log"))
+	if err != nil {
+		return UpdateRun{}, err
+	}
+
+	// reserve the ID until the run is finished
+	err = u.saveRun(*run)
+	if err != nil {
+		logFile.Close()
+		return UpdateRun{}, err
+	}
+
+	pr, pw := io.Pipe()
+	cmd := exec.Command("bash", script)
+	cmd.Dir = filepath.Dir(script)
+	cmd.Stdout = pw
+	cmd.Stderr = pw
+	// the scripts start other processes, they're all killed on cancel
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	err = cmd.Start()
+	if err != nil {
+		logFile.Close()
+		_ = os.Remove(logFile.Name())
+		_ = os.Remove(filepath.Join(u.Folder, run.ID+".json"))
+		return UpdateRun{}, fmt.Errorf("%s: %w", updater, err)
+	}
+
+	u.current = run
+	u.cmd = cmd
+
+	output := make(chan struct{})
+	go func() {
+		defer close(output)
+		parser := newSummaryParser()
+		scanner := bufio.NewScanner(pr)
+		scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+		scanner.Split(scanOutputLines)
+		for scanner.Scan() {
+			line := StripAnsi(scanner.Text())
+			_, _ = logFile.WriteString(line + "\n")
+			parser.add(line)
+
+			u.mu.Lock()
+			run.Lines++
+			run.Summary = parser.summary
+			snapshot := *run
+			u.mu.Unlock()
+
+			if onLine != nil {
+				onLine(snapshot, line)
+			}
+		}
+		// keep the pipe drained if a line was too long to scan
+		_, _ = io.Copy(io.Discard, pr)
+	}()
+
+	go func() {
+		err := cmd.Wait()
+		_ = pw.Close()
+		<-output
+		_ = logFile.Close()
+
+		u.mu.Lock()
+		run.Running = false
+		run.Finished = time.Now()
+		run.ExitCode = cmd.ProcessState.ExitCode()
+		var exitErr *exec.ExitError
+		if err != nil && !errors.As(err, &exitErr) {
+			run.Error = err.Error()
+		} else if run.ExitCode != 0 && !run.Cancelled {
+			run.Error = fmt.Sprintf("%s exited with code %d", updater, run.ExitCode)
+		}
+		finished := *run
+		u.current = nil
+		u.cmd = nil
+
+		saveErr := u.saveRun(finished)
+		if saveErr == nil {
+			saveErr = u.prune()
+		}
+		if saveErr != nil && finished.Error == "" {
+			finished.Error = fmt.Sprintf("error saving run: %s", saveErr)
+		}
+		u.mu.Unlock()
+
+		if onDone != nil {
+			onDone(finished)
+		}
+	}()
+
+	return *run, nil
+}
+
+// Cancel stops the running update and every process it started.
+func (u *Updater) Cancel() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.current == nil || u.cmd == nil || u.cmd.Process == nil {
+		return ErrNoUpdateRunning
+	}
+
+	u.current.Cancelled = true
+	return syscall.Kill(-u.cmd.Process.Pid, syscall.SIGTERM)
+}
+
+func (u *Updater) runs() ([]UpdateRun, error) {
+	entries, err := os.ReadDir(u.Folder)
+	if errors.Is(err, fs.ErrNotExist) {
+		return []UpdateRun{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	runs := make([]UpdateRun, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(u.Folder, entry.Name()))
+		if err != nil {
+			continue
+		}
+
+		var run UpdateRun
+		err = json.Unmarshal(data, &run)
+		if err != nil {
+			continue
+		}
+		run.ID = strings.TrimSuffix(entry.Name(), ".json")
+
+		if u.current != nil && u.current.ID == run.ID {
+			run = *u.current
+		} else if run.Running {
+			// remote was stopped while it was running
+			run.Running = false
+			run.ExitCode = -1
+			if run.Error == "" {
+				run.Error = "update was interrupted"
+			}
+		}
+
+		runs = append(runs, run)
+	}
+
+	sort.SliceStable(runs, func(i, j int) bool {
+		if runs[i].Started.Equal(runs[j].Started) {
+			return runs[i].ID > runs[j].ID
+		}
+		return runs[i].Started.After(runs[j].Started)
+	})
+
+	return runs, nil
+}
+
+// prune deletes the oldest runs past the retention limit.
+func (u *Updater) prune() error {
+	if u.Keep <= 0 {
+		return nil
+	}
+
+	runs, err := u.runs()
+	if err != nil || len(runs) <= u.Keep {
+		return err
+	}
+
+	for _, run := range runs[u.Keep:] {
+		_ = os.Remove(filepath.Join(u.Folder, run.ID+".log"))
+		err := os.Remove(filepath.Join(u.Folder, run.ID+".json"))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Runs returns every kept run, newest first, including the running update.
+func (u *Updater) Runs() ([]UpdateRun, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.runs()
+}
+
+// Run returns a kept run and its output so far.
+func (u *Updater) Run(id string) (UpdateRun, []byte, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if id == "" || filepath.Base(id) != id || strings.HasPrefix(id, ".") {
+		return UpdateRun{}, nil, fmt.Errorf("%w: %s", ErrUpdateRunNotFound, id)
+	}
+
+	runs, err := u.runs()
+	if err != nil {
+		return UpdateRun{}, nil, err
+	}
+
+	for _, run := range runs {
+		if run.ID != id {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(u.Folder, id+".log"))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return run, nil, err
+		}
+
+		return run, data, nil
+	}
+
+	return UpdateRun{}, nil, fmt.Errorf("%w: %s", ErrUpdateRunNotFound, id)
+}
@@ -0,0 +1,179 @@
+package mister
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useFakeUpdater returns an updater which runs scripts written to a
+// temporary folder instead of the real downloader.
+func useFakeUpdater(t *testing.T, scripts map[string]string) *Updater {
+	t.Helper()
+
+	folder := t.TempDir()
+	u := &Updater{
+		Folder:  filepath.Join(folder, "updates"),
+		Scripts: map[string]string{},
+	}
+	for name, script := range scripts {
+		path := filepath.Join(folder, name+".sh")
+		writeTestFile(t, path, script)
+		u.Scripts[name] = path
+	}
+
+	return u
+}
+
+func waitForRun(t *testing.T, done chan UpdateRun) UpdateRun {
+	t.Helper()
+	select {
+	case run := <-done:
+		return run
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for update to finish")
+		return UpdateRun{}
+	}
+}
+
+func TestParseUpdateSummary(t *testing.T) {
+	got := ParseUpdateSummary(readTestFile(t, "testdata/downloader_output.txt"))
+	want := UpdateSummary{
+		Installed: []string{"_Console/SNES_20231012.rbf", "_Computer/ao486_20231010.rbf", "games/NES/boot1.rom"},
+		Updated:   []string{},
+		Removed:   []string{"_Console/SNES_20230901.rbf"},
+		Errors:    []string{"_Arcade/cores/jtcps1_20231001.rbf"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v want %+v", got, want)
+	}
+}
+
+func TestUpdaterRun(t *testing.T) {
+	fixture, err := filepath.Abs("testdata/downloader_output.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := useFakeUpdater(t, map[string]string{
+		UpdaterDownloader: "printf '\\033[1;32mSTART!\\033[0m\\n'\n" +
+			"printf 'Fetching 1/2\\rFetching 2/2\\r\\n' >&2\n" +
+			"cat '" + fixture + "'\n" +
+			"exit 1\n",
+	})
+
+	var lines []string
+	done := make(chan UpdateRun, 1)
+	run, err := u.Start(UpdaterDownloader, "test", func(run UpdateRun, line string) {
+		lines = append(lines, line)
+	}, func(run UpdateRun) {
+		done <- run
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !run.Running || run.Author != "test" {
+		t.Errorf("got started run %+v", run)
+	}
+
+	finished := waitForRun(t, done)
+	if finished.Running || finished.ExitCode != 1 || finished.Error == "" {
+		t.Errorf("got finished run %+v", finished)
+	}
+	if len(finished.Summary.Installed) != 3 || len(finished.Summary.Errors) != 1 {
+		t.Errorf("got summary %+v", finished.Summary)
+	}
+	if lines[0] != "START!" || lines[1] != "Fetching 1/2" || lines[2] != "Fetching 2/2" {
+		t.Errorf("got lines %q", lines[:3])
+	}
+	if finished.Lines != len(lines) {
+		t.Errorf("got %d lines, run counted %d", len(lines), finished.Lines)
+	}
+
+	if _, ok := u.Current(); ok {
+		t.Error("update still running after it finished")
+	}
+
+	runs, err := u.Runs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 1 || !reflect.DeepEqual(runs[0].Summary, finished.Summary) {
+		t.Errorf("got runs %+v", runs)
+	}
+
+	kept, log, err := u.Run(finished.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kept.ExitCode != 1 || !strings.HasPrefix(string(log), "START!\nFetching 1/2\n") {
+		t.Errorf("got run %+v with log %q", kept, log)
+	}
+
+	if _, _, err := u.Run("../" + finished.ID); !errors.Is(err, ErrUpdateRunNotFound) {
+		t.Errorf("got %v reading run outside folder", err)
+	}
+	if _, err := u.Start("unknown", "test", nil, nil); !errors.Is(err, ErrUnknownUpdater) {
+		t.Errorf("got %v starting unknown updater", err)
+	}
+}
+
+func TestUpdaterCancel(t *testing.T) {
+	u := useFakeUpdater(t, map[string]string{
+		UpdaterDownloader: "echo started\nsleep 30\necho finished\n",
+		UpdaterUpdateAll:  "echo started\n",
+	})
+	u.Keep = 1
+
+	started := make(chan struct{}, 1)
+	done := make(chan UpdateRun, 1)
+	_, err := u.Start(UpdaterDownloader, "test", func(run UpdateRun, line string) {
+		started <- struct{}{}
+	}, func(run UpdateRun) {
+		done <- run
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-started:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for update to start")
+	}
+
+	if _, err := u.Start(UpdaterUpdateAll, "test", nil, nil); !errors.Is(err, ErrUpdateRunning) {
+		t.Errorf("got %v starting a second update", err)
+	}
+
+	err = u.Cancel()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cancelled := waitForRun(t, done)
+	if !cancelled.Cancelled || cancelled.ExitCode != -1 || cancelled.Lines != 1 {
+		t.Errorf("got cancelled run %+v", cancelled)
+	}
+	if err := u.Cancel(); !errors.Is(err, ErrNoUpdateRunning) {
+		t.Errorf("got %v cancelling with nothing running", err)
+	}
+
+	_, err = u.Start(UpdaterUpdateAll, "test", nil, func(run UpdateRun) {
+		done <- run
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForRun(t, done)
+
+	runs, err := u.Runs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 1 || runs[0].Updater != UpdaterUpdateAll {
+		t.Errorf("got runs %+v, want only the newest kept", runs)
+	}
+}
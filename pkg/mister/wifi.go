@@ -0,0 +1,609 @@
+package mister
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wizzomafizzo/mrext/pkg/config"
+)
+
+// Wi-Fi networks are saved in wpa_supplicant.conf on the SD card, which
+// MiSTer Linux uses on boot. Scans and link status come from wpa_cli and iw.
+// Commands are run through runCommand so they can be replaced in tests.
+
+var (
+	ErrNoWifiInterface      = errors.New("no wifi interface found")
+	ErrWifiNetworkNotFound  = errors.New("wifi network not found")
+	ErrInvalidWifiNetwork   = errors.New("invalid wifi network")
+	ErrInvalidNetworkConfig = errors.New("invalid network config")
+)
+
+var (
+	runCommand = func(name string, args ...string) ([]byte, error) {
+		return exec.Command(name, args...).CombinedOutput()
+	}
+	interfaceAddrs = func(name string) ([]string, error) {
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			return nil, err
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		ips := make([]string, 0, len(addrs))
+		for _, addr := range addrs {
+			ips = append(ips, addr.String())
+		}
+		return ips, nil
+	}
+	sysNetFolder      = "/sys/class/net"
+	wpaSupplicantFile = config.WpaSupplicantFile
+	wifiScanWait      = 3 * time.Second
+)
+
+const defaultWpaHeader = "ctrl_interface=/run/wpa_supplicant\nupdate_config=1\n"
+
+// WifiInterface returns the name of the first wireless network interface.
+func WifiInterface() (string, error) {
+	entries, err := os.ReadDir(sysNetFolder)
+	if err != nil {
+		return "", err
+	}
+
+	for _, entry := range entries {
+		if _, err := os.Stat(filepath.Join(sysNetFolder, entry.Name(), "wireless")); err == nil {
+			return entry.Name(), nil
+		}
+	}
+
+	return "", ErrNoWifiInterface
+}
+
+type WifiScanResult struct {
+	SSID  string `json:"ssid"`
+	BSSID string `json:"bssid"`
+	// Frequency is in MHz.
+	Frequency int `json:"frequency"`
+	// Signal is in dBm.
+	Signal int `json:"signal"`
+	// Security is open, wep, wpa or wpa3.
+	Security string `json:"security"`
+}
+
+func wifiSecurity(flags string) string {
+	switch {
+	case strings.Contains(flags, "SAE"):
+		return "wpa3"
+	case strings.Contains(flags, "WPA") || strings.Contains(flags, "RSN"):
+		return "wpa"
+	case strings.Contains(flags, "WEP") || strings.Contains(flags, "Privacy"):
+		return "wep"
+	default:
+		return "open"
+	}
+}
+
+// parseWpaScanResults parses the output of wpa_cli scan_results.
+func parseWpaScanResults(output string) []WifiScanResult {
+	results := make([]WifiScanResult, 0)
+
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Split(strings.TrimRight(line, "\r"), "\t")
+		if len(fields) < 4 {
+			continue
+		}
+
+		freq, err := strconv.Atoi(fields[1])
+		if err != nil {
+			// header line
+			continue
+		}
+		signal, _ := strconv.Atoi(fields[2])
+
+		result := WifiScanResult{
+			BSSID:     fields[0],
+			Frequency: freq,
+			Signal:    signal,
+			Security:  wifiSecurity(fields[3]),
+		}
+		if len(fields) > 4 {
+			result.SSID = fields[4]
+		}
+
+		results = append(results, result)
+	}
+
+	return results
+}
+
+// parseIwScan parses the output of iw dev <interface> scan.
+func parseIwScan(output string) []WifiScanResult {
+	results := make([]WifiScanResult, 0)
+	var current *WifiScanResult
+	var flags []string
+
+	finish := func() {
+		if current != nil {
+			current.Security = wifiSecurity(strings.Join(flags, " "))
+			results = append(results, *current)
+		}
+		flags = nil
+	}
+
+	for _, line := range strings.Split(output, "\n") {
+		trimmed := strings.TrimSpace(line)
+
+		switch {
+		case strings.HasPrefix(line, "BSS "):
+			finish()
+			bssid := strings.TrimPrefix(line, "BSS ")
+			if i := strings.IndexAny(bssid, "( "); i >= 0 {
+				bssid = bssid[:i]
+			}
+			current = &WifiScanResult{BSSID: bssid}
+		case current == nil:
+			continue
+		case strings.HasPrefix(trimmed, "freq:"):
+			freq, _ := strconv.ParseFloat(strings.TrimSpace(strings.TrimPrefix(trimmed, "freq:")), 64)
+			current.Frequency = int(freq)
+		case strings.HasPrefix(trimmed, "signal:"):
+			signal, _ := strconv.ParseFloat(strings.Fields(strings.TrimPrefix(trimmed, "signal:"))[0], 64)
+			current.Signal = int(signal)
+		case strings.HasPrefix(trimmed, "SSID:"):
+			current.SSID = strings.TrimSpace(strings.TrimPrefix(trimmed, "SSID:"))
+		case strings.HasPrefix(trimmed, "RSN:"):
+			flags = append(flags, "RSN")
+		case strings.HasPrefix(trimmed, "WPA:"):
+			flags = append(flags, "WPA")
+		case strings.Contains(trimmed, "Authentication suites:") && strings.Contains(trimmed, "SAE"):
+			flags = append(flags, "SAE")
+		case strings.HasPrefix(trimmed, "capability:") && strings.Contains(trimmed, "Privacy"):
+			flags = append(flags, "Privacy")
+		}
+	}
+	finish()
+
+	return results
+}
+
+// ScanWifiNetworks returns the networks in range, strongest first. Scanning
+// is done through wpa_supplicant if it's running, otherwise iw is used.
+func ScanWifiNetworks() ([]WifiScanResult, error) {
+	iface, err := WifiInterface()
+	if err != nil {
+		return nil, err
+	}
+
+	var results []WifiScanResult
+	if _, err := runCommand("wpa_cli", "-i", iface, "scan"); err == nil {
+		time.Sleep(wifiScanWait)
+		output, err := runCommand("wpa_cli", "-i", iface, "scan_results")
+		if err != nil {
+			return nil, fmt.Errorf("wpa_cli scan_results: %w", err)
+		}
+		results = parseWpaScanResults(string(output))
+	} else {
+		output, err := runCommand("iw", "dev", iface, "scan")
+		if err != nil {
+			return nil, fmt.Errorf("iw scan: %s: %w", strings.TrimSpace(string(output)), err)
+		}
+		results = parseIwScan(string(output))
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Signal > results[j].Signal
+	})
+
+	return results, nil
+}
+
+type WifiNetwork struct {
+	SSID string `json:"ssid"`
+	// Priority is used by wpa_supplicant to pick a network when more than
+	// one is in range, highest first.
+	Priority int `json:"priority"`
+	// Hidden networks are scanned for by SSID.
+	Hidden bool `json:"hidden"`
+	// Open is true if the network has no password.
+	Open bool `json:"open"`
+	// lines are the network block's lines other than ssid, priority and
+	// scan_ssid, kept as they were read.
+	lines []string
+}
+
+// WpaConfig is a wpa_supplicant.conf file. Lines outside network blocks are
+// kept and written before the networks.
+type WpaConfig struct {
+	Path     string
+	header   []string
+	Networks []WifiNetwork
+}
+
+func unquoteWpa(value string) string {
+	if len(value) >= 2 && strings.HasPrefix(value, "\"") && strings.HasSuffix(value, "\"") {
+		return value[1 : len(value)-1]
+	}
+	// unquoted SSIDs are hex encoded
+	if decoded, err := hex.DecodeString(value); err == nil {
+		return string(decoded)
+	}
+	return value
+}
+
+func quoteWpa(value string) string {
+	if strings.ContainsAny(value, "\"\n\r") {
+		return hex.EncodeToString([]byte(value))
+	}
+	return fmt.Sprintf("\"%s\"", value)
+}
+
+// ParseWpaConfig reads the contents of a wpa_supplicant.conf file.
+func ParseWpaConfig(path string, data string) *WpaConfig {
+	wc := &WpaConfig{Path: path, Networks: make([]WifiNetwork, 0)}
+	var current *WifiNetwork
+	open := true
+
+	for _, line := range strings.Split(strings.ReplaceAll(data, "\r\n", "\n"), "\n") {
+		trimmed := strings.TrimSpace(line)
+
+		if current == nil {
+			if strings.HasPrefix(trimmed, "network=") && strings.HasSuffix(trimmed, "{") {
+				current = &WifiNetwork{}
+				open = true
+			} else if trimmed != "" || len(wc.header) > 0 {
+				wc.header = append(wc.header, line)
+			}
+			continue
+		}
+
+		if trimmed == "}" {
+			current.Open = open
+			wc.Networks = append(wc.Networks, *current)
+			current = nil
+			continue
+		}
+
+		key, value, _ := strings.Cut(trimmed, "=")
+		switch key {
+		case "ssid":
+			current.SSID = unquoteWpa(value)
+		case "priority":
+			current.Priority, _ = strconv.Atoi(value)
+		case "scan_ssid":
+			current.Hidden = value == "1"
+		default:
+			if key == "psk" || key == "sae_password" || key == "wep_key0" ||
+				(key == "key_mgmt" && value != "NONE") {
+				open = false
+			}
+			current.lines = append(current.lines, trimmed)
+		}
+	}
+
+	// drop trailing blank lines, they're added back when written
+	for len(wc.header) > 0 && strings.TrimSpace(wc.header[len(wc.header)-1]) == "" {
+		wc.header = wc.header[:len(wc.header)-1]
+	}
+
+	return wc
+}
+
+// ReadWpaConfig reads the saved Wi-Fi networks. A missing file is returned
+// with a default header.
+func ReadWpaConfig() (*WpaConfig, error) {
+	data, err := os.ReadFile(wpaSupplicantFile)
+	if os.IsNotExist(err) {
+		return ParseWpaConfig(wpaSupplicantFile, defaultWpaHeader), nil
+	} else if err != nil {
+		return nil, err
+	}
+	return ParseWpaConfig(wpaSupplicantFile, string(data)), nil
+}
+
+func (wc *WpaConfig) String() string {
+	var sb strings.Builder
+
+	for _, line := range wc.header {
+		sb.WriteString(line)
+		sb.WriteString("\n")
+	}
+
+	for _, network := range wc.Networks {
+		sb.WriteString("\nnetwork={\n")
+		_, _ = fmt.Fprintf(&sb, "\tssid=%s\n", quoteWpa(network.SSID))
+		if network.Hidden {
+			sb.WriteString("\tscan_ssid=1\n")
+		}
+		for _, line := range network.lines {
+			_, _ = fmt.Fprintf(&sb, "\t%s\n", line)
+		}
+		if network.Priority != 0 {
+			_, _ = fmt.Fprintf(&sb, "\tpriority=%d\n", network.Priority)
+		}
+		sb.WriteString("}\n")
+	}
+
+	return sb.String()
+}
+
+// Save writes the file and keeps it in history.
+func (wc *WpaConfig) Save(author string) error {
+	return DefaultHistory.Write(wc.Path, []byte(wc.String()), author)
+}
+
+func (wc *WpaConfig) find(ssid string) int {
+	for i, network := range wc.Networks {
+		if network.SSID == ssid {
+			return i
+		}
+	}
+	return -1
+}
+
+// pbkdf2Sha1 derives a key the same way as wpa_passphrase.
+func pbkdf2Sha1(password []byte, salt []byte, iterations int, keyLen int) []byte {
+	mac := hmac.New(sha1.New, password)
+	var key []byte
+
+	for block := uint32(1); len(key) < keyLen; block++ {
+		mac.Reset()
+		mac.Write(salt)
+		_ = binary.Write(mac, binary.BigEndian, block)
+		u := mac.Sum(nil)
+		t := append([]byte{}, u...)
+
+		for i := 1; i < iterations; i++ {
+			mac.Reset()
+			mac.Write(u)
+			u = mac.Sum(nil)
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+
+		key = append(key, t...)
+	}
+
+	return key[:keyLen]
+}
+
+// WpaPsk returns the raw PSK for a WPA passphrase, so the passphrase itself
+// doesn't need to be saved.
+func WpaPsk(ssid string, passphrase string) string {
+	return hex.EncodeToString(pbkdf2Sha1([]byte(passphrase), []byte(ssid), 4096, 32))
+}
+
+// securityLines returns the lines of a network block with the password
+// replaced. Other lines are kept, apart from the key_mgmt line, which is
+// switched to NONE for an open network and dropped if it was NONE for a
+// network with a password.
+func securityLines(lines []string, psk string) []string {
+	updated := make([]string, 0, len(lines)+1)
+	if psk != "" {
+		updated = append(updated, "psk="+psk)
+	} else {
+		updated = append(updated, "key_mgmt=NONE")
+	}
+
+	for _, line := range lines {
+		key, value, _ := strings.Cut(line, "=")
+		switch {
+		case key == "psk":
+			continue
+		case key == "key_mgmt" && (psk == "" || value == "NONE"):
+			continue
+		}
+		updated = append(updated, line)
+	}
+
+	return updated
+}
+
+// SetNetwork adds a network, or updates the password of one with the same
+// SSID, keeping its other settings. An empty password saves an open network.
+// New networks are given the highest priority.
+func (wc *WpaConfig) SetNetwork(ssid string, password string, hidden bool) error {
+	if ssid == "" || len(ssid) > 32 {
+		return fmt.Errorf("%w: ssid must be 1 to 32 bytes", ErrInvalidWifiNetwork)
+	} else if password != "" && (len(password) < 8 || len(password) > 63) {
+		return fmt.Errorf("%w: password must be 8 to 63 characters", ErrInvalidWifiNetwork)
+	}
+
+	psk := ""
+	if password != "" {
+		psk = WpaPsk(ssid, password)
+	}
+
+	if i := wc.find(ssid); i >= 0 {
+		network := &wc.Networks[i]
+		network.Hidden = hidden
+		network.Open = password == ""
+		network.lines = securityLines(network.lines, psk)
+		return nil
+	}
+
+	network := WifiNetwork{
+		SSID:   ssid,
+		Hidden: hidden,
+		Open:   password == "",
+		lines:  securityLines(nil, psk),
+	}
+	for _, existing := range wc.Networks {
+		if existing.Priority >= network.Priority {
+			network.Priority = existing.Priority + 1
+		}
+	}
+	wc.Networks = append(wc.Networks, network)
+
+	return nil
+}
+
+// RemoveNetwork removes a saved network by its SSID.
+func (wc *WpaConfig) RemoveNetwork(ssid string) error {
+	i := wc.find(ssid)
+	if i < 0 {
+		return fmt.Errorf("%w: %s", ErrWifiNetworkNotFound, ssid)
+	}
+	wc.Networks = append(wc.Networks[:i], wc.Networks[i+1:]...)
+	return nil
+}
+
+// Prioritize sets the order networks are tried in. The given SSIDs are put
+// first in order, followed by any others in their current order.
+func (wc *WpaConfig) Prioritize(ssids []string) error {
+	ordered := make([]WifiNetwork, 0, len(wc.Networks))
+	used := make(map[string]bool)
+
+	for _, ssid := range ssids {
+		i := wc.find(ssid)
+		if i < 0 {
+			return fmt.Errorf("%w: %s", ErrWifiNetworkNotFound, ssid)
+		} else if used[ssid] {
+			continue
+		}
+		ordered = append(ordered, wc.Networks[i])
+		used[ssid] = true
+	}
+
+	rest := make([]WifiNetwork, 0)
+	for _, network := range wc.Networks {
+		if !used[network.SSID] {
+			rest = append(rest, network)
+		}
+	}
+	sort.SliceStable(rest, func(i, j int) bool {
+		return rest[i].Priority > rest[j].Priority
+	})
+	ordered = append(ordered, rest...)
+
+	for i := range ordered {
+		ordered[i].Priority = len(ordered) - i
+	}
+	wc.Networks = ordered
+
+	return nil
+}
+
+// SortedNetworks returns the saved networks, highest priority first.
+func (wc *WpaConfig) SortedNetworks() []WifiNetwork {
+	networks := append([]WifiNetwork{}, wc.Networks...)
+	sort.SliceStable(networks, func(i, j int) bool {
+		return networks[i].Priority > networks[j].Priority
+	})
+	return networks
+}
+
+// ReloadWifi tells wpa_supplicant to reload its config, if it's running.
+func ReloadWifi() error {
+	iface, err := WifiInterface()
+	if err != nil {
+		return err
+	}
+
+	output, err := runCommand("wpa_cli", "-i", iface, "reconfigure")
+	if err != nil {
+		return fmt.Errorf("wpa_cli reconfigure: %s: %w", strings.TrimSpace(string(output)), err)
+	}
+
+	return nil
+}
+
+type LinkStatus struct {
+	Interface string   `json:"interface"`
+	Wireless  bool     `json:"wireless"`
+	Up        bool     `json:"up"`
+	Mac       string   `json:"mac"`
+	IPs       []string `json:"ips"`
+	// SSID, Signal (dBm) and Bitrate (MBit/s) are only set for a connected
+	// wireless interface.
+	SSID    string  `json:"ssid,omitempty"`
+	Signal  int     `json:"signal,omitempty"`
+	Bitrate float64 `json:"bitrate,omitempty"`
+}
+
+// parseIwLink adds the output of iw dev <interface> link to a link status.
+func parseIwLink(output string, status *LinkStatus) {
+	for _, line := range strings.Split(output, "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if !ok {
+			continue
+		}
+
+		value = strings.TrimSpace(value)
+		fields := strings.Fields(value)
+		switch key {
+		case "SSID":
+			status.SSID = value
+		case "signal":
+			if len(fields) > 0 {
+				status.Signal, _ = strconv.Atoi(fields[0])
+			}
+		case "tx bitrate":
+			if len(fields) > 0 {
+				status.Bitrate, _ = strconv.ParseFloat(fields[0], 64)
+			}
+		}
+	}
+}
+
+func readSysNet(iface string, name string) string {
+	data, err := os.ReadFile(filepath.Join(sysNetFolder, iface, name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// GetLinkStatus returns the status of every network interface except
+// loopback.
+func GetLinkStatus() ([]LinkStatus, error) {
+	entries, err := os.ReadDir(sysNetFolder)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]LinkStatus, 0, len(entries))
+	for _, entry := range entries {
+		iface := entry.Name()
+		if iface == "lo" {
+			continue
+		}
+
+		status := LinkStatus{
+			Interface: iface,
+			Up:        readSysNet(iface, "operstate") == "up",
+			Mac:       readSysNet(iface, "address"),
+			IPs:       make([]string, 0),
+		}
+		_, err := os.Stat(filepath.Join(sysNetFolder, iface, "wireless"))
+		status.Wireless = err == nil
+
+		if ips, err := interfaceAddrs(iface); err == nil {
+			status.IPs = append(status.IPs, ips...)
+		}
+
+		if status.Wireless && status.Up {
+			output, err := runCommand("iw", "dev", iface, "link")
+			if err == nil {
+				parseIwLink(string(output), &status)
+			}
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	return statuses, nil
+}
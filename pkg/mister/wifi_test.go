@@ -0,0 +1,334 @@
+package mister
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type fakeCommand struct {
+	output string
+	err    error
+}
+
+// useFakeCommands replaces runCommand with canned output for each command
+// line, and sets up a fake /sys/class/net with eth0 and wlan0.
+func useFakeCommands(t *testing.T, commands map[string]fakeCommand) *[]string {
+	t.Helper()
+
+	var ran []string
+	prevRun, prevAddrs, prevSys, prevWait := runCommand, interfaceAddrs, sysNetFolder, wifiScanWait
+	runCommand = func(name string, args ...string) ([]byte, error) {
+		line := strings.Join(append([]string{name}, args...), " ")
+		ran = append(ran, line)
+		cmd, ok := commands[line]
+		if !ok {
+			return []byte("command not found"), errors.New("exit status 127")
+		}
+		return []byte(cmd.output), cmd.err
+	}
+	interfaceAddrs = func(name string) ([]string, error) {
+		if name == "wlan0" {
+			return []string{"192.168.1.50/24"}, nil
+		}
+		return nil, nil
+	}
+	sysNetFolder = t.TempDir()
+	wifiScanWait = 0
+
+	for path, data := range map[string]string{
+		"lo/operstate":    "unknown",
+		"eth0/operstate":  "down",
+		"eth0/address":    "02:03:04:05:06:07",
+		"wlan0/operstate": "up",
+		"wlan0/address":   "02:03:04:05:06:08",
+	} {
+		writeTestFile(t, filepath.Join(sysNetFolder, path), data+"\n")
+	}
+	err := os.MkdirAll(filepath.Join(sysNetFolder, "wlan0", "wireless"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		runCommand, interfaceAddrs, sysNetFolder, wifiScanWait = prevRun, prevAddrs, prevSys, prevWait
+	})
+
+	return &ran
+}
+
+func writeTestFile(t *testing.T, path string, data string) {
+	t.Helper()
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err == nil {
+		err = os.WriteFile(path, []byte(data), 0644)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestScanWifiNetworks(t *testing.T) {
+	useFakeCommands(t, map[string]fakeCommand{
+		"wpa_cli -i wlan0 scan":         {output: "OK\n"},
+		"wpa_cli -i wlan0 scan_results": {output: readTestFile(t, "testdata/wpa_cli_scan_results.txt")},
+	})
+
+	results, err := ScanWifiNetworks()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []WifiScanResult{
+		{SSID: "HomeNet 5G", BSSID: "02:11:22:33:44:66", Frequency: 5180, Signal: -45, Security: "wpa"},
+		{SSID: "HomeNet", BSSID: "02:11:22:33:44:55", Frequency: 2437, Signal: -67, Security: "wpa"},
+		{SSID: "", BSSID: "02:11:22:33:44:88", Frequency: 2462, Signal: -71, Security: "wpa3"},
+		{SSID: "Cafe", BSSID: "02:11:22:33:44:77", Frequency: 2412, Signal: -80, Security: "open"},
+	}
+	if !reflect.DeepEqual(results, want) {
+		t.Errorf("got %+v want %+v", results, want)
+	}
+}
+
+func TestScanWifiNetworksIw(t *testing.T) {
+	ran := useFakeCommands(t, map[string]fakeCommand{
+		"iw dev wlan0 scan": {output: readTestFile(t, "testdata/iw_scan.txt")},
+	})
+
+	results, err := ScanWifiNetworks()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []WifiScanResult{
+		{SSID: "HomeNet", BSSID: "02:11:22:33:44:55", Frequency: 2437, Signal: -67, Security: "wpa"},
+		{SSID: "OldRouter", BSSID: "02:11:22:33:44:99", Frequency: 2422, Signal: -75, Security: "wep"},
+		{SSID: "Cafe", BSSID: "02:11:22:33:44:77", Frequency: 2412, Signal: -80, Security: "open"},
+	}
+	if !reflect.DeepEqual(results, want) {
+		t.Errorf("got %+v want %+v", results, want)
+	}
+	if (*ran)[0] != "wpa_cli -i wlan0 scan" {
+		t.Errorf("wpa_cli wasn't tried first: %v", *ran)
+	}
+}
+
+func TestWpaConfig(t *testing.T) {
+	useTestHistory(t)
+
+	path := filepath.Join(t.TempDir(), "wpa_supplicant.conf")
+	wc := ParseWpaConfig(path, readTestFile(t, "testdata/wpa_supplicant.conf"))
+
+	var got []string
+	for _, network := range wc.SortedNetworks() {
+		got = append(got, network.SSID)
+	}
+	if !reflect.DeepEqual(got, []string{"Office", "HomeNet"}) {
+		t.Errorf("got networks %v", got)
+	}
+	if !wc.Networks[1].Hidden || wc.Networks[1].Open {
+		t.Errorf("got %+v", wc.Networks[1])
+	}
+
+	if err := wc.SetNetwork("Cafe", "", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := wc.SetNetwork("HomeNet", "password", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := wc.SetNetwork("Short", "pass", false); !errors.Is(err, ErrInvalidWifiNetwork) {
+		t.Errorf("got %v for short password", err)
+	}
+	if err := wc.Prioritize([]string{"HomeNet"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := wc.RemoveNetwork("Office"); err != nil {
+		t.Fatal(err)
+	}
+	if err := wc.RemoveNetwork("Office"); !errors.Is(err, ErrWifiNetworkNotFound) {
+		t.Errorf("got %v removing missing network", err)
+	}
+
+	err := wc.Save("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `ctrl_interface=/run/wpa_supplicant
+update_config=1
+country=GB
+
+network={
+	ssid="HomeNet"
+	psk=eda30ba3b6e5827d0c396f8a7580c1652364e56a452f28bae6cc6151ca8a06a3
+	priority=3
+}
+
+network={
+	ssid="Cafe"
+	key_mgmt=NONE
+	priority=2
+}
+`
+	if got := readTestFile(t, path); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestWpaConfigUpdateNetwork(t *testing.T) {
+	wc := ParseWpaConfig("wpa_supplicant.conf", `network={
+	ssid="HomeNet"
+	scan_ssid=1
+	key_mgmt=WPA-PSK
+	proto=RSN
+	psk="correct horse"
+	priority=4
+}
+
+network={
+	ssid="Cafe"
+	key_mgmt=NONE
+	bssid=00:11:22:33:44:55
+}
+`)
+
+	if err := wc.SetNetwork("HomeNet", "password", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := wc.SetNetwork("Cafe", "password", false); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `
+network={
+	ssid="HomeNet"
+	scan_ssid=1
+	psk=eda30ba3b6e5827d0c396f8a7580c1652364e56a452f28bae6cc6151ca8a06a3
+	key_mgmt=WPA-PSK
+	proto=RSN
+	priority=4
+}
+
+network={
+	ssid="Cafe"
+	psk=7f86e30ace6e279663ab68a09674c57336d1e7f2f6e3a762bd52d5e2e989afaa
+	bssid=00:11:22:33:44:55
+}
+`
+	if got := wc.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	// back to an open network
+	if err := wc.SetNetwork("HomeNet", "", true); err != nil {
+		t.Fatal(err)
+	}
+	if !wc.Networks[0].Open || !reflect.DeepEqual(wc.Networks[0].lines, []string{"key_mgmt=NONE", "proto=RSN"}) {
+		t.Errorf("got %+v", wc.Networks[0])
+	}
+}
+
+func TestWpaPsk(t *testing.T) {
+	// IEEE 802.11i test vector
+	want := "f42c6fc52df0ebef9ebb4b90b38a5f902e83fe1b135a70e23aed762e9710a12e"
+	if got := WpaPsk("IEEE", "password"); got != want {
+		t.Errorf("got %s want %s", got, want)
+	}
+}
+
+func TestGetLinkStatus(t *testing.T) {
+	useFakeCommands(t, map[string]fakeCommand{
+		"iw dev wlan0 link": {output: readTestFile(t, "testdata/iw_link.txt")},
+	})
+
+	statuses, err := GetLinkStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []LinkStatus{
+		{Interface: "eth0", Mac: "02:03:04:05:06:07", IPs: []string{}},
+		{
+			Interface: "wlan0",
+			Wireless:  true,
+			Up:        true,
+			Mac:       "02:03:04:05:06:08",
+			IPs:       []string{"192.168.1.50/24"},
+			SSID:      "HomeNet",
+			Signal:    -67,
+			Bitrate:   72.2,
+		},
+	}
+	if !reflect.DeepEqual(statuses, want) {
+		t.Errorf("got %+v want %+v", statuses, want)
+	}
+}
+
+func TestDhcpcdConfig(t *testing.T) {
+	data := `hostname
+option rapid_commit
+
+interface wlan0
+static ip_address=192.168.1.60/24
+static routers=192.168.1.1
+metric 300
+
+interface eth0
+metric 200
+`
+	dc := ParseDhcpcdConfig("dhcpcd.conf", data)
+
+	want := IPConfig{Interface: "wlan0", Address: "192.168.1.60/24", Gateway: "192.168.1.1", DNS: []string{}}
+	if got := dc.Get("wlan0"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v want %+v", got, want)
+	}
+	if got := dc.Get("eth0"); !got.DHCP {
+		t.Errorf("got %+v for eth0", got)
+	}
+
+	err := dc.Set(IPConfig{Interface: "eth0", Address: "10.0.0.5/8", Gateway: "10.0.0.1", DNS: []string{"1.1.1.1", "8.8.8.8"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dc.Set(IPConfig{Interface: "wlan0", DHCP: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dc.Set(IPConfig{Interface: "usb0", Address: "172.16.0.2/30"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantData := `hostname
+option rapid_commit
+
+interface wlan0
+metric 300
+
+interface eth0
+static ip_address=10.0.0.5/8
+static routers=10.0.0.1
+static domain_name_servers=1.1.1.1 8.8.8.8
+metric 200
+
+interface usb0
+static ip_address=172.16.0.2/30
+`
+	if got := dc.String(); got != wantData {
+		t.Errorf("got:\n%s\nwant:\n%s", got, wantData)
+	}
+
+	for _, ipc := range []IPConfig{
+		{Interface: "eth0", Address: "10.0.0.5"},
+		{Interface: "eth0", Address: "10.0.0.5/8", Gateway: "192.168.1.1"},
+		{Interface: "eth0", Address: "10.0.0.5/8", DNS: []string{"dns.local"}},
+		{Interface: "eth 0", DHCP: true},
+	} {
+		if err := dc.Set(ipc); !errors.Is(err, ErrInvalidNetworkConfig) {
+			t.Errorf("%+v: got %v want invalid config", ipc, err)
+		}
+	}
+}
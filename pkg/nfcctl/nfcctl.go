@@ -0,0 +1,305 @@
+// Package nfcctl implements the control socket protocol of the NFC service.
+//
+// Commands are sent as a single line of text. The service replies with one
+// or more JSON encoded messages, one per line, and closes the connection
+// after the final message. Long-running commands like write first send
+// progress messages while they wait for a card.
+//
+// Commands are prefixed with the protocol version, e.g. "v2 status". The
+// status, enable and disable commands sent without a version keep their
+// original replies for older clients: status replies with a single CSV line
+// of "<scan time>,<uid>,<launcher enabled>,<text>" and enable and disable
+// reply with nothing.
+package nfcctl
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/wizzomafizzo/mrext/pkg/config"
+)
+
+// Version is the prefix of commands which expect JSON replies.
+const Version = "v2"
+
+const (
+	CmdStatus   = "status"
+	CmdLastScan = "last-scan"
+	CmdWrite    = "write"
+	// CmdWriteLock writes to a card and then permanently makes it read only.
+	CmdWriteLock = "write-lock"
+	// CmdFormat NDEF formats a blank MIFARE Classic card.
+	CmdFormat = "format"
+	// CmdErase clears all NDEF data from a card.
+	CmdErase = "erase"
+	// CmdBatchWrite writes to the next card which isn't in a list of UIDs to
+	// skip, for programming many cards in a row.
+	CmdBatchWrite = "batch-write"
+	CmdReadNext   = "read-next"
+	CmdCancel     = "cancel"
+	CmdEnable     = "enable"
+	CmdDisable    = "disable"
+)
+
+const (
+	// EventWaiting is sent when a job is waiting for a card to be placed on
+	// the reader.
+	EventWaiting = "waiting"
+	// EventWriting is sent when a card has been detected and is being
+	// written to, formatted or erased.
+	EventWriting = "writing"
+	// EventDuplicate is sent when a batch write finds a card it was told to
+	// skip, and is waiting for it to be replaced.
+	EventDuplicate = "duplicate"
+
+	EventOk        = "ok"
+	EventError     = "error"
+	EventStatus    = "status"
+	EventCard      = "card"
+	EventWritten   = "written"
+	EventRead      = "read"
+	EventCancelled = "cancelled"
+)
+
+// JobTimeout is how long commands which need a card wait for one.
+const JobTimeout = 30 * time.Second
+
+var (
+	ErrServiceNotRunning = errors.New("nfc service not running")
+	// ErrTimedOut is returned when no card was placed on the reader before
+	// JobTimeout.
+	ErrTimedOut = errors.New("timed out waiting for card")
+	// ErrCancelled is returned when a command was cancelled before it
+	// finished.
+	ErrCancelled = errors.New("cancelled")
+)
+
+type Card struct {
+	UID      string    `json:"uid"`
+	Type     string    `json:"type"`
+	Text     string    `json:"text"`
+	ScanTime time.Time `json:"scanTime"`
+}
+
+type Status struct {
+	LauncherEnabled bool   `json:"launcherEnabled"`
+	ReaderConnected bool   `json:"readerConnected"`
+	Connection      string `json:"connection"`
+	// Job is the command currently waiting for a card, if any.
+	Job      string `json:"job"`
+	LastScan *Card  `json:"lastScan"`
+}
+
+type Message struct {
+	Event  string  `json:"event"`
+	Error  string  `json:"error,omitempty"`
+	Card   *Card   `json:"card,omitempty"`
+	Status *Status `json:"status,omitempty"`
+}
+
+// Final returns true if no more messages will follow this one.
+func (m Message) Final() bool {
+	return m.Event != EventWaiting && m.Event != EventWriting && m.Event != EventDuplicate
+}
+
+// Err returns the message as an error if it's an error event.
+func (m Message) Err() error {
+	switch m.Event {
+	case EventError:
+		if m.Error == ErrTimedOut.Error() {
+			return ErrTimedOut
+		}
+		return errors.New(m.Error)
+	case EventCancelled:
+		return ErrCancelled
+	default:
+		return nil
+	}
+}
+
+func ErrorMessage(err error) Message {
+	return Message{Event: EventError, Error: err.Error()}
+}
+
+// ParseCommand splits a command line into the command name and its
+// argument. Versioned is false if the command had no version prefix.
+func ParseCommand(line string) (cmd string, args string, versioned bool) {
+	line = strings.TrimRight(line, "\r\n")
+	if strings.HasPrefix(line, Version+" ") {
+		line, versioned = strings.TrimPrefix(line, Version+" "), true
+	}
+	cmd, args, _ = strings.Cut(line, " ")
+	return strings.TrimSpace(cmd), args, versioned
+}
+
+// Encode serializes a message as a single line.
+func Encode(msg Message) ([]byte, error) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+var socketPath = config.NfcSocket
+
+// Stream sends a command to the NFC service and calls onMessage for each
+// progress message received. Returns the final message, which will be an
+// error if the command failed.
+func Stream(cmd string, onMessage func(Message)) (Message, error) {
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return Message{}, fmt.Errorf("%w: %s", ErrServiceNotRunning, err)
+	}
+	defer func(conn net.Conn) {
+		_ = conn.Close()
+	}(conn)
+
+	_, err = conn.Write([]byte(Version + " " + cmd + "\n"))
+	if err != nil {
+		return Message{}, err
+	}
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		var msg Message
+		err := json.Unmarshal(scanner.Bytes(), &msg)
+		if err != nil {
+			return Message{}, fmt.Errorf("invalid response: %s", err)
+		}
+
+		if msg.Final() {
+			return msg, msg.Err()
+		}
+
+		if onMessage != nil {
+			onMessage(msg)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return Message{}, err
+	}
+
+	return Message{}, fmt.Errorf("connection closed before response")
+}
+
+// Send sends a command which replies with a single message.
+func Send(cmd string) (Message, error) {
+	return Stream(cmd, nil)
+}
+
+func GetStatus() (Status, error) {
+	msg, err := Send(CmdStatus)
+	if err != nil {
+		return Status{}, err
+	}
+	if msg.Status == nil {
+		return Status{}, fmt.Errorf("missing status in response")
+	}
+	return *msg.Status, nil
+}
+
+// LastScan returns the last card scanned by the service, or nil if no card
+// has been scanned since it started.
+func LastScan() (*Card, error) {
+	msg, err := Send(CmdLastScan)
+	if err != nil {
+		return nil, err
+	}
+	return msg.Card, nil
+}
+
+// Write waits for a card to be placed on the reader and writes text to it,
+// returning the written card.
+func Write(text string, onProgress func(Message)) (*Card, error) {
+	return writeCommand(CmdWrite, text, onProgress)
+}
+
+// WriteAndLock writes text to the next card like Write, then permanently
+// makes the card read only. This can't be undone.
+func WriteAndLock(text string, onProgress func(Message)) (*Card, error) {
+	return writeCommand(CmdWriteLock, text, onProgress)
+}
+
+func writeCommand(cmd string, text string, onProgress func(Message)) (*Card, error) {
+	if strings.ContainsAny(text, "\r\n") {
+		return nil, fmt.Errorf("text cannot contain line breaks")
+	}
+	msg, err := Stream(cmd+" "+text, onProgress)
+	if err != nil {
+		return nil, err
+	}
+	return msg.Card, nil
+}
+
+// BatchArgs are the arguments of a batch write command, sent as JSON.
+type BatchArgs struct {
+	Text string `json:"text"`
+	// Skip is a list of card UIDs which shouldn't be written to, usually
+	// cards which were already written earlier in the batch.
+	Skip []string `json:"skip"`
+}
+
+// BatchWrite waits for a card which isn't in the skip list and writes text
+// to it, returning the written card. Cards in the skip list are reported
+// with a duplicate progress message.
+func BatchWrite(text string, skip []string, onProgress func(Message)) (*Card, error) {
+	args, err := json.Marshal(BatchArgs{Text: text, Skip: skip})
+	if err != nil {
+		return nil, err
+	}
+	msg, err := Stream(CmdBatchWrite+" "+string(args), onProgress)
+	if err != nil {
+		return nil, err
+	}
+	return msg.Card, nil
+}
+
+// Format waits for a blank MIFARE Classic card and NDEF formats it so it can
+// be written to.
+func Format(onProgress func(Message)) (*Card, error) {
+	msg, err := Stream(CmdFormat, onProgress)
+	if err != nil {
+		return nil, err
+	}
+	return msg.Card, nil
+}
+
+// Erase waits for a card and clears any NDEF data stored on it.
+func Erase(onProgress func(Message)) (*Card, error) {
+	msg, err := Stream(CmdErase, onProgress)
+	if err != nil {
+		return nil, err
+	}
+	return msg.Card, nil
+}
+
+// ReadNext waits for the next card to be placed on the reader and returns
+// it without launching it.
+func ReadNext(onProgress func(Message)) (*Card, error) {
+	msg, err := Stream(CmdReadNext, onProgress)
+	if err != nil {
+		return nil, err
+	}
+	return msg.Card, nil
+}
+
+// Cancel stops any command which is waiting for a card.
+func Cancel() error {
+	_, err := Send(CmdCancel)
+	return err
+}
+
+func SetLauncherEnabled(enabled bool) error {
+	cmd := CmdDisable
+	if enabled {
+		cmd = CmdEnable
+	}
+	_, err := Send(cmd)
+	return err
+}
@@ -0,0 +1,151 @@
+package nfcctl
+
+import (
+	"errors"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// fakeService replies to every connection with a fixed list of messages.
+func fakeService(t *testing.T, replies ...Message) chan string {
+	t.Helper()
+
+	socketPath = filepath.Join(t.TempDir(), "nfc.sock")
+	socket, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = socket.Close()
+	})
+
+	received := make(chan string, 1)
+
+	go func() {
+		conn, err := socket.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		buf := make([]byte, 4096)
+		n, _ := conn.Read(buf)
+		received <- string(buf[:n])
+
+		for _, msg := range replies {
+			data, _ := Encode(msg)
+			_, _ = conn.Write(data)
+		}
+	}()
+
+	return received
+}
+
+func TestWrite(t *testing.T) {
+	written := &Card{UID: "04a1", Type: "NTAG", Text: "**system:snes"}
+	received := fakeService(t,
+		Message{Event: EventWaiting},
+		Message{Event: EventWriting, Card: &Card{UID: "04a1"}},
+		Message{Event: EventWritten, Card: written},
+	)
+
+	progress := make([]string, 0)
+	card, err := Write("**system:snes", func(msg Message) {
+		progress = append(progress, msg.Event)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cmd := <-received; cmd != "v2 write **system:snes\n" {
+		t.Errorf("got command %q", cmd)
+	}
+	if !reflect.DeepEqual(progress, []string{EventWaiting, EventWriting}) {
+		t.Errorf("got progress %v", progress)
+	}
+	if card.Text != written.Text {
+		t.Errorf("got card %+v", card)
+	}
+}
+
+func TestBatchWrite(t *testing.T) {
+	received := fakeService(t,
+		Message{Event: EventWaiting},
+		Message{Event: EventDuplicate, Card: &Card{UID: "04a1"}},
+		Message{Event: EventWriting, Card: &Card{UID: "04b2"}},
+		Message{Event: EventWritten, Card: &Card{UID: "04b2", Text: "SNES/Zelda.sfc"}},
+	)
+
+	progress := make([]string, 0)
+	card, err := BatchWrite("SNES/Zelda.sfc", []string{"04a1"}, func(msg Message) {
+		progress = append(progress, msg.Event)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cmd := <-received; cmd != `v2 batch-write {"text":"SNES/Zelda.sfc","skip":["04a1"]}`+"\n" {
+		t.Errorf("got command %q", cmd)
+	}
+	if !reflect.DeepEqual(progress, []string{EventWaiting, EventDuplicate, EventWriting}) {
+		t.Errorf("got progress %v", progress)
+	}
+	if card.UID != "04b2" {
+		t.Errorf("got card %+v", card)
+	}
+
+	fakeService(t, ErrorMessage(ErrTimedOut))
+	_, err = BatchWrite("SNES/Zelda.sfc", nil, nil)
+	if !errors.Is(err, ErrTimedOut) {
+		t.Errorf("got %v, want timeout", err)
+	}
+}
+
+func TestStreamErrors(t *testing.T) {
+	fakeService(t, Message{Event: EventWaiting}, Message{Event: EventCancelled})
+	_, err := ReadNext(nil)
+	if !errors.Is(err, ErrCancelled) {
+		t.Errorf("got %v, want cancelled error", err)
+	}
+
+	fakeService(t, ErrorMessage(errors.New("reader is busy")))
+	_, err = Write("**system:snes", nil)
+	if err == nil || err.Error() != "reader is busy" {
+		t.Errorf("got %v", err)
+	}
+
+	socketPath = filepath.Join(t.TempDir(), "missing.sock")
+	_, err = GetStatus()
+	if !errors.Is(err, ErrServiceNotRunning) {
+		t.Errorf("got %v", err)
+	}
+
+	_, err = Write("line\nbreak", nil)
+	if err == nil {
+		t.Error("expected line break error")
+	}
+}
+
+func TestParseCommand(t *testing.T) {
+	tests := []struct {
+		line      string
+		cmd       string
+		args      string
+		versioned bool
+	}{
+		{"status", "status", "", false},
+		{"status\n", "status", "", false},
+		{"v2 status\n", "status", "", true},
+		{"v2 write **system:snes\n", "write", "**system:snes", true},
+		{"write Games/SNES/Super Mario World.sfc", "write", "Games/SNES/Super Mario World.sfc", false},
+	}
+
+	for _, tt := range tests {
+		cmd, args, versioned := ParseCommand(tt.line)
+		if cmd != tt.cmd || args != tt.args || versioned != tt.versioned {
+			t.Errorf("%q: got %q %q %t", tt.line, cmd, args, versioned)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+// Package nfclog records every card scanned by the NFC service, along with
+// how it was launched, so misbehaving or incorrectly written cards can be
+// tracked down later.
+//
+// Entries are stored one JSON object per line. When the log grows past its
+// maximum size it's rotated to a numbered backup and a new log is started.
+package nfclog
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// ResultLaunched means the card was launched successfully.
+	ResultLaunched = "launched"
+	// ResultFailed means the card was read but launching it failed.
+	ResultFailed = "failed"
+	// ResultSkipped means the card was read but the launcher was disabled.
+	ResultSkipped = "skipped"
+	// ResultReadError means the card was detected but couldn't be read.
+	ResultReadError = "read_error"
+)
+
+const (
+	DefaultMaxSize = 512 * 1024
+	DefaultBackups = 2
+)
+
+type Entry struct {
+	Time time.Time `json:"time"`
+	UID  string    `json:"uid"`
+	Type string    `json:"type"`
+	// Text stored on the card.
+	Text string `json:"text"`
+	// MappingLine is the line of the database mapping which matched the
+	// card, or 0 if none did.
+	MappingLine int `json:"mappingLine,omitempty"`
+	// Launch is the text which was launched, from the card or a mapping.
+	Launch string `json:"launch"`
+	Result string `json:"result"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Log appends entries to a scan log file, rotating it when it gets too big.
+type Log struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64
+	backups int
+}
+
+// New returns a log writing to path. Zero values for maxSize and backups use
+// the defaults.
+func New(path string, maxSize int64, backups int) *Log {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxSize
+	}
+	if backups <= 0 {
+		backups = DefaultBackups
+	}
+	return &Log{path: path, maxSize: maxSize, backups: backups}
+}
+
+func backupPath(path string, n int) string {
+	return path + "." + strconv.Itoa(n)
+}
+
+func (l *Log) rotate() error {
+	_ = os.Remove(backupPath(l.path, l.backups))
+
+	for n := l.backups - 1; n >= 1; n-- {
+		err := os.Rename(backupPath(l.path, n), backupPath(l.path, n+1))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	return os.Rename(l.path, backupPath(l.path, 1))
+}
+
+// Add appends an entry to the log.
+func (l *Log) Add(entry Entry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	if info, err := os.Stat(l.path); err == nil && info.Size()+int64(len(data)) > l.maxSize {
+		err := l.rotate()
+		if err != nil {
+			return fmt.Errorf("error rotating scan log: %w", err)
+		}
+	}
+
+	err = os.MkdirAll(filepath.Dir(l.path), 0755)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+func readFile(path string) ([]Entry, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := make([]Entry, 0)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		var entry Entry
+		// a partial line can be left behind by a power cut, skip it
+		if json.Unmarshal([]byte(line), &entry) == nil {
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries, scanner.Err()
+}
+
+// Filter limits which entries are returned by Read. Zero values match
+// everything.
+type Filter struct {
+	// UID matches entries for a card exactly, ignoring case.
+	UID string
+	// Result matches entries with the given result.
+	Result string
+	Since  time.Time
+	// Limit returns only the most recent entries.
+	Limit int
+}
+
+func (f Filter) match(entry Entry) bool {
+	if f.UID != "" && !strings.EqualFold(f.UID, entry.UID) {
+		return false
+	}
+	if f.Result != "" && f.Result != entry.Result {
+		return false
+	}
+	if !f.Since.IsZero() && entry.Time.Before(f.Since) {
+		return false
+	}
+	return true
+}
+
+// Read returns entries from a scan log and its backups, newest first.
+func Read(path string, filter Filter) ([]Entry, error) {
+	all := make([]Entry, 0)
+
+	files := []string{path}
+	backups, _ := filepath.Glob(path + ".*")
+	files = append(files, backups...)
+
+	for _, file := range files {
+		if file != path {
+			if _, err := strconv.Atoi(strings.TrimPrefix(file, path+".")); err != nil {
+				continue
+			}
+		}
+
+		entries, err := readFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range entries {
+			if filter.match(entry) {
+				all = append(all, entry)
+			}
+		}
+	}
+
+	sort.SliceStable(all, func(i, j int) bool {
+		return all[i].Time.After(all[j].Time)
+	})
+
+	if filter.Limit > 0 && len(all) > filter.Limit {
+		all = all[:filter.Limit]
+	}
+
+	return all, nil
+}
+
+var csvHeader = []string{"time", "uid", "type", "text", "mapping_line", "launch", "result", "error"}
+
+// WriteCSV exports entries as a CSV file with a header row.
+func WriteCSV(w io.Writer, entries []Entry) error {
+	cw := csv.NewWriter(w)
+
+	err := cw.Write(csvHeader)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		line := ""
+		if entry.MappingLine > 0 {
+			line = strconv.Itoa(entry.MappingLine)
+		}
+
+		err := cw.Write([]string{
+			entry.Time.Format(time.RFC3339),
+			entry.UID,
+			entry.Type,
+			entry.Text,
+			line,
+			entry.Launch,
+			entry.Result,
+			entry.Error,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteJSON exports entries as a JSON array.
+func WriteJSON(w io.Writer, entries []Entry) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(entries)
+}
@@ -0,0 +1,144 @@
+package nfclog
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAddRead(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "scans.log")
+	log := New(path, 0, 0)
+
+	start := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	entries := []Entry{
+		{Time: start, UID: "04a1", Type: "NTAG", Text: "**system:snes", Launch: "**system:snes", Result: ResultLaunched},
+		{Time: start.Add(time.Minute), UID: "04b2", Type: "MIFARE", Result: ResultReadError, Error: "comm error"},
+		{Time: start.Add(2 * time.Minute), UID: "04A1", Type: "NTAG", Text: "**system:snes", MappingLine: 3, Launch: "**random:snes", Result: ResultLaunched},
+	}
+	for _, entry := range entries {
+		if err := log.Add(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := Read(path, Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 3 || got[0].MappingLine != 3 || got[2].UID != "04a1" {
+		t.Errorf("got %+v", got)
+	}
+
+	got, err = Read(path, Filter{UID: "04a1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Errorf("got %d entries for uid, want 2", len(got))
+	}
+
+	got, err = Read(path, Filter{Result: ResultReadError})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].UID != "04b2" {
+		t.Errorf("got %+v", got)
+	}
+
+	got, err = Read(path, Filter{Since: start.Add(30 * time.Second), Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || !got[0].Time.Equal(start.Add(2*time.Minute)) {
+		t.Errorf("got %+v", got)
+	}
+
+	got, err = Read(filepath.Join(t.TempDir(), "missing.log"), Filter{})
+	if err != nil || len(got) != 0 {
+		t.Errorf("got %v %v for missing log", got, err)
+	}
+}
+
+func TestRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "scans.log")
+	log := New(path, 300, 2)
+
+	start := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 20; i++ {
+		err := log.Add(Entry{Time: start.Add(time.Duration(i) * time.Second), UID: "04a1", Result: ResultLaunched})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, p := range []string{path, path + ".1", path + ".2"} {
+		info, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > 300 {
+			t.Errorf("%s is %d bytes", p, info.Size())
+		}
+	}
+	if _, err := os.Stat(path + ".3"); err == nil {
+		t.Error("expected only 2 backups")
+	}
+
+	got, err := Read(path, Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) == 0 || len(got) >= 20 {
+		t.Fatalf("got %d entries after rotation", len(got))
+	}
+	// newest entries are kept
+	if !got[0].Time.Equal(start.Add(19 * time.Second)) {
+		t.Errorf("got newest entry %s", got[0].Time)
+	}
+}
+
+func TestReadPartialLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "scans.log")
+	data := `{"time":"2023-05-01T12:00:00Z","uid":"04a1","result":"launched"}
+{"time":"2023-05-01T12:01:00Z","uid":"04b2","res`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := Read(path, Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].UID != "04a1" {
+		t.Errorf("got %+v", got)
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	var buf bytes.Buffer
+	err := WriteCSV(&buf, []Entry{
+		{
+			Time:        time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC),
+			UID:         "04a1",
+			Type:        "NTAG",
+			Text:        "Games/SNES/Mario, World.sfc",
+			MappingLine: 2,
+			Launch:      "**system:snes",
+			Result:      ResultFailed,
+			Error:       "core not found",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `time,uid,type,text,mapping_line,launch,result,error
+2023-05-01T12:00:00Z,04a1,NTAG,"Games/SNES/Mario, World.sfc",2,**system:snes,failed,core not found
+`
+	if buf.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
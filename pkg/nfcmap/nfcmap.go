@@ -0,0 +1,507 @@
+package nfcmap
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	ColumnMatchUID  = "match_uid"
+	ColumnMatchText = "match_text"
+	ColumnMatchType = "match_type"
+	ColumnText      = "text"
+	ColumnOnRemove  = "on_remove"
+)
+
+var columns = []string{
+	ColumnMatchUID,
+	ColumnMatchText,
+	ColumnMatchType,
+	ColumnText,
+	ColumnOnRemove,
+}
+
+// Mapping is a single row in the NFC database file.
+//
+// MatchUID matches the card UID exactly, or as a prefix if it ends with a *.
+// MatchText matches the card text exactly, or as a regular expression if it's
+// wrapped in slashes, like /^\*\*random:.*$/. Text which really starts and
+// ends with a slash is escaped with a backslash, like \/games/. MatchType matches the card type
+// reported by the reader (e.g. NTAG, MIFARE). All match fields which are set
+// must match for the mapping to be used.
+//
+// Text replaces the card text when launching and OnRemove is an optional
+// token run when the card is removed from the reader.
+//
+// Extra holds the values of any other columns in the file, so they're kept
+// when the file is rewritten. Line is where the row starts in the file.
+type Mapping struct {
+	MatchUID  string            `json:"matchUid"`
+	MatchText string            `json:"matchText"`
+	MatchType string            `json:"matchType"`
+	Text      string            `json:"text"`
+	OnRemove  string            `json:"onRemove"`
+	Extra     map[string]string `json:"extra,omitempty"`
+	Line      int               `json:"-"`
+}
+
+// Rule is a validated mapping ready for matching.
+type Rule struct {
+	Mapping
+	uid       string
+	uidPrefix bool
+	text      string
+	textRegex *regexp.Regexp
+}
+
+type Database struct {
+	Rules []Rule
+}
+
+type ValidationError struct {
+	Line    int    `json:"line"`
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e ValidationError) Error() string {
+	if e.Field == "" {
+		return fmt.Sprintf("line %d: %s", e.Line, e.Message)
+	}
+	return fmt.Sprintf("line %d: %s: %s", e.Line, e.Field, e.Message)
+}
+
+type ValidationErrors []ValidationError
+
+func (es ValidationErrors) Error() string {
+	msgs := make([]string, len(es))
+	for i, e := range es {
+		msgs[i] = e.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// NormalizeUID converts a UID to the format reported by the NFC service:
+// lowercase hex with no separators.
+func NormalizeUID(uid string) string {
+	uid = strings.TrimSpace(uid)
+	uid = strings.ToLower(uid)
+	uid = strings.ReplaceAll(uid, ":", "")
+	uid = strings.ReplaceAll(uid, " ", "")
+	return uid
+}
+
+func isRegex(s string) bool {
+	return len(s) >= 2 && strings.HasPrefix(s, "/") && strings.HasSuffix(s, "/")
+}
+
+// unescapeText returns the literal text of a match_text value which isn't a
+// regex, removing the backslash from an escaped leading slash.
+func unescapeText(s string) string {
+	if strings.HasPrefix(s, `\/`) {
+		return s[1:]
+	}
+	return s
+}
+
+// NewRule validates a mapping and prepares it for matching. The line number
+// is only used for reporting errors.
+func NewRule(m Mapping, line int) (Rule, ValidationErrors) {
+	var errs ValidationErrors
+
+	m.MatchUID = strings.TrimSpace(m.MatchUID)
+	m.MatchText = strings.TrimSpace(m.MatchText)
+	m.MatchType = strings.TrimSpace(m.MatchType)
+	m.Text = strings.TrimSpace(m.Text)
+	m.OnRemove = strings.TrimSpace(m.OnRemove)
+
+	m.Line = line
+	rule := Rule{Mapping: m}
+
+	if m.MatchUID == "" && m.MatchText == "" && m.MatchType == "" {
+		errs = append(errs, ValidationError{
+			Line:    line,
+			Message: "no match_uid, match_text or match_type set",
+		})
+	}
+
+	if m.Text == "" && m.OnRemove == "" {
+		errs = append(errs, ValidationError{
+			Line:    line,
+			Message: "no text or on_remove set",
+		})
+	}
+
+	if m.MatchUID != "" {
+		uid := NormalizeUID(m.MatchUID)
+		if strings.HasSuffix(uid, "*") {
+			rule.uidPrefix = true
+			uid = strings.TrimSuffix(uid, "*")
+		}
+
+		if uid == "" {
+			errs = append(errs, ValidationError{
+				Line:    line,
+				Field:   ColumnMatchUID,
+				Message: "empty uid prefix",
+			})
+		} else if strings.Trim(uid, "0123456789abcdef") != "" {
+			errs = append(errs, ValidationError{
+				Line:    line,
+				Field:   ColumnMatchUID,
+				Message: fmt.Sprintf("invalid hex uid: %s", m.MatchUID),
+			})
+		}
+
+		rule.uid = uid
+	}
+
+	if isRegex(m.MatchText) {
+		re, err := regexp.Compile(m.MatchText[1 : len(m.MatchText)-1])
+		if err != nil {
+			errs = append(errs, ValidationError{
+				Line:    line,
+				Field:   ColumnMatchText,
+				Message: fmt.Sprintf("invalid regex: %s", err),
+			})
+		}
+		rule.textRegex = re
+	} else {
+		rule.text = unescapeText(m.MatchText)
+	}
+
+	return rule, errs
+}
+
+// Matches returns true if all the match fields set in the rule match the
+// given card details.
+func (r *Rule) Matches(uid string, cardType string, text string) bool {
+	if r.uid != "" {
+		uid = NormalizeUID(uid)
+		if r.uidPrefix && !strings.HasPrefix(uid, r.uid) {
+			return false
+		} else if !r.uidPrefix && uid != r.uid {
+			return false
+		}
+	}
+
+	if r.MatchType != "" && !strings.EqualFold(r.MatchType, cardType) {
+		return false
+	}
+
+	if r.textRegex != nil {
+		if !r.textRegex.MatchString(text) {
+			return false
+		}
+	} else if r.text != "" && r.text != strings.TrimSpace(text) {
+		return false
+	}
+
+	return true
+}
+
+// Match returns the first rule in the database which matches the given card
+// details. Rules with a match_text are checked before the others, so a text
+// match takes priority over a UID or type match, and each group is checked in
+// file order.
+func (db *Database) Match(uid string, cardType string, text string) (*Rule, bool) {
+	if db == nil {
+		return nil, false
+	}
+
+	for _, textRules := range []bool{true, false} {
+		for i := range db.Rules {
+			if (db.Rules[i].MatchText != "") != textRules {
+				continue
+			}
+			if db.Rules[i].Matches(uid, cardType, text) {
+				return &db.Rules[i], true
+			}
+		}
+	}
+
+	return nil, false
+}
+
+type row struct {
+	mapping Mapping
+	line    int
+}
+
+func readRows(r io.Reader) ([]row, ValidationErrors, error) {
+	var errs ValidationErrors
+
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if errors.Is(err, io.EOF) {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	indexes := make(map[string]int)
+	extra := make(map[string]int)
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		known := false
+		for _, col := range columns {
+			if name == col {
+				known = true
+				break
+			}
+		}
+
+		if !known {
+			errs = append(errs, ValidationError{
+				Line:    1,
+				Field:   name,
+				Message: "unknown column",
+			})
+			extra[name] = i
+			continue
+		}
+
+		indexes[name] = i
+	}
+
+	rows := make([]row, 0)
+
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			errs = append(errs, ValidationError{
+				Line:    parseErr.Line,
+				Message: parseErr.Err.Error(),
+			})
+			continue
+		} else if err != nil {
+			return nil, errs, err
+		}
+
+		line, _ := reader.FieldPos(0)
+
+		get := func(col string) string {
+			i, ok := indexes[col]
+			if !ok || i >= len(record) {
+				return ""
+			}
+			return record[i]
+		}
+
+		mapping := Mapping{
+			MatchUID:  get(ColumnMatchUID),
+			MatchText: get(ColumnMatchText),
+			MatchType: get(ColumnMatchType),
+			Text:      get(ColumnText),
+			OnRemove:  get(ColumnOnRemove),
+			Line:      line,
+		}
+
+		for name, i := range extra {
+			if i >= len(record) || record[i] == "" {
+				continue
+			}
+			if mapping.Extra == nil {
+				mapping.Extra = make(map[string]string)
+			}
+			mapping.Extra[name] = record[i]
+		}
+
+		rows = append(rows, row{line: line, mapping: mapping})
+	}
+
+	return rows, errs, nil
+}
+
+// Parse reads an NFC database in CSV format. Invalid rows are skipped and
+// reported in a ValidationErrors error alongside the valid rules.
+func Parse(r io.Reader) (*Database, error) {
+	rows, errs, err := readRows(r)
+	if err != nil {
+		return nil, err
+	}
+
+	db := &Database{Rules: make([]Rule, 0, len(rows))}
+
+	for _, row := range rows {
+		rule, ruleErrs := NewRule(row.mapping, row.line)
+		if len(ruleErrs) > 0 {
+			errs = append(errs, ruleErrs...)
+			continue
+		}
+		db.Rules = append(db.Rules, rule)
+	}
+
+	if len(errs) > 0 {
+		return db, errs
+	}
+
+	return db, nil
+}
+
+// Load reads the NFC database file at the given path. A missing file is
+// treated as an empty database.
+func Load(path string) (*Database, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &Database{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer func(c io.Closer) {
+		_ = c.Close()
+	}(f)
+
+	return Parse(f)
+}
+
+// ReadMappings returns every row in the database file, including invalid
+// ones, so they can be edited. If any rows couldn't be parsed as CSV, the
+// other rows are returned along with a ValidationErrors error, and they must
+// not be written back or the unparsable rows will be lost.
+func ReadMappings(path string) ([]Mapping, error) {
+	mappings := make([]Mapping, 0)
+
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return mappings, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer func(c io.Closer) {
+		_ = c.Close()
+	}(f)
+
+	rows, errs, err := readRows(f)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, row := range rows {
+		mappings = append(mappings, row.mapping)
+	}
+
+	// unknown columns are kept in Extra, so only rows which failed to
+	// parse are missing
+	var dropped ValidationErrors
+	for _, e := range errs {
+		if e.Field == "" {
+			dropped = append(dropped, e)
+		}
+	}
+	if len(dropped) > 0 {
+		return mappings, dropped
+	}
+
+	return mappings, nil
+}
+
+// extraColumns returns the names of all extra columns used by mappings, in
+// the order they're written after the standard columns.
+func extraColumns(mappings []Mapping) []string {
+	names := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, m := range mappings {
+		for name := range m.Extra {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// writeRecords writes the header and mappings as CSV, calling onRow before
+// each mapping is written.
+func writeRecords(w *csv.Writer, mappings []Mapping, onRow func(i int)) error {
+	extra := extraColumns(mappings)
+
+	err := w.Write(append(append([]string{}, columns...), extra...))
+	if err != nil {
+		return err
+	}
+
+	for i, m := range mappings {
+		if onRow != nil {
+			onRow(i)
+		}
+
+		record := []string{m.MatchUID, m.MatchText, m.MatchType, m.Text, m.OnRemove}
+		for _, name := range extra {
+			record = append(record, m.Extra[name])
+		}
+
+		err = w.Write(record)
+		if err != nil {
+			return err
+		}
+	}
+
+	w.Flush()
+	return w.Error()
+}
+
+// MappingLines returns the line each mapping will start on once written by
+// WriteMappings. Quoted fields can span several lines, so this isn't always
+// the index plus the header.
+func MappingLines(mappings []Mapping) []int {
+	var buf strings.Builder
+	w := csv.NewWriter(&buf)
+	lines := make([]int, len(mappings))
+
+	_ = writeRecords(w, mappings, func(i int) {
+		w.Flush()
+		lines[i] = strings.Count(buf.String(), "\n") + 1
+	})
+
+	return lines
+}
+
+// WriteMappings replaces the database file with the given mappings. The file
+// is written to a temporary file first and then moved into place, so the NFC
+// service never reads a partially written database.
+func WriteMappings(path string, mappings []Mapping) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".nfc-*.csv")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(tmp.Name())
+	}()
+
+	err = tmp.Chmod(0644)
+	if err != nil {
+		_ = tmp.Close()
+		return err
+	}
+
+	err = writeRecords(csv.NewWriter(tmp), mappings, nil)
+	if err != nil {
+		_ = tmp.Close()
+		return err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
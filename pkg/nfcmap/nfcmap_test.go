@@ -0,0 +1,239 @@
+package nfcmap
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMatch(t *testing.T) {
+	db, err := Parse(strings.NewReader(`match_uid,match_text,match_type,text,on_remove
+04:A2:B3:C4,,,exact uid,
+04ff*,,,uid prefix,
+,**random:snes,,exact text,
+,/^\*\*system:(nes|snes)$/,,regex text,**system:menu
+,,mifare,any mifare,
+04aa*,,NTAG,prefix and type,
+04bb,,,uid before text,
+,**system:gb,,text after uid,
+,\/games/,,literal slashes,
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		uid      string
+		cardType string
+		text     string
+		want     string
+	}{
+		{"exact uid", "04a2b3c4", "NTAG", "", "exact uid"},
+		{"uid prefix", "04ff0011", "NTAG", "", "uid prefix"},
+		{"exact text", "0000", "NTAG", "**random:snes", "exact text"},
+		{"regex text", "0000", "NTAG", "**system:nes", "regex text"},
+		{"regex no match", "0000", "NTAG", "**system:n64", ""},
+		{"card type", "0000", "MIFARE", "", "any mifare"},
+		{"prefix and type", "04aa01", "NTAG", "", "prefix and type"},
+		{"prefix wrong type", "04aa01", "ULTRALIGHT", "", ""},
+		{"file order", "04a2b3c4", "MIFARE", "", "exact uid"},
+		{"text before uid", "04bb", "NTAG", "**system:gb", "text after uid"},
+		{"uid without text", "04bb", "NTAG", "**system:n64", "uid before text"},
+		{"escaped slashes", "0000", "NTAG", "/games/", "literal slashes"},
+		{"escaped slashes not regex", "0000", "NTAG", "/media/fat/games/", ""},
+		{"no match", "1234", "NTAG", "hello", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule, ok := db.Match(tt.uid, tt.cardType, tt.text)
+			got := ""
+			if ok {
+				got = rule.Text
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	rule, _ := db.Match("0000", "NTAG", "**system:snes")
+	if rule.OnRemove != "**system:menu" {
+		t.Errorf("got on_remove %q, want **system:menu", rule.OnRemove)
+	}
+}
+
+func TestParseValidation(t *testing.T) {
+	db, err := Parse(strings.NewReader(`match_uid,match_text,text,colour
+04a2,,valid,
+zz11,,bad uid,
+,/[unclosed/,bad regex,
+,,no match fields,
+04a3,,,
+`))
+
+	var errs ValidationErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("expected validation errors, got %v", err)
+	}
+
+	want := []ValidationError{
+		{Line: 1, Field: "colour", Message: "unknown column"},
+		{Line: 3, Field: ColumnMatchUID},
+		{Line: 4, Field: ColumnMatchText},
+		{Line: 5},
+		{Line: 6},
+	}
+
+	if len(errs) != len(want) {
+		t.Fatalf("got %d errors, want %d: %v", len(errs), len(want), errs)
+	}
+
+	for i, w := range want {
+		if errs[i].Line != w.Line || errs[i].Field != w.Field {
+			t.Errorf("error %d: got %v, want line %d field %q", i, errs[i], w.Line, w.Field)
+		}
+	}
+
+	if len(db.Rules) != 1 || db.Rules[0].Text != "valid" {
+		t.Errorf("expected only the valid rule to load, got %+v", db.Rules)
+	}
+}
+
+func TestReadWriteMappings(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nfc.csv")
+
+	want := []Mapping{
+		{MatchUID: "04a2", Text: "**system:snes", Line: 2},
+		{MatchText: "/^foo, bar$/", MatchType: "NTAG", Text: "**random:all", OnRemove: "**system:menu", Line: 3},
+	}
+
+	err := WriteMappings(path, want)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ReadMappings(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// legacy files without the newer columns still load
+	err = os.WriteFile(path, []byte("match_uid,match_text,text\n04a2,,**system:nes\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := db.Match("04:A2", "", ""); !ok {
+		t.Error("expected legacy entry to match")
+	}
+}
+
+func TestMappingsKeepUnknownData(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nfc.csv")
+
+	err := os.WriteFile(path, []byte(`match_uid,text,notes
+04a2,"**system:snes",my snes card
+04a3,"multi
+line",
+04a4,**system:nes,"two
+lines"
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mappings, err := ReadMappings(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Mapping{
+		{MatchUID: "04a2", Text: "**system:snes", Extra: map[string]string{"notes": "my snes card"}, Line: 2},
+		{MatchUID: "04a3", Text: "multi\nline", Line: 3},
+		{MatchUID: "04a4", Text: "**system:nes", Extra: map[string]string{"notes": "two\nlines"}, Line: 5},
+	}
+	if !reflect.DeepEqual(mappings, want) {
+		t.Fatalf("got %+v, want %+v", mappings, want)
+	}
+
+	if lines := MappingLines(mappings); !reflect.DeepEqual(lines, []int{2, 3, 5}) {
+		t.Errorf("got lines %v", lines)
+	}
+
+	err = WriteMappings(path, mappings)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ReadMappings(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v after rewrite, want %+v", got, want)
+	}
+
+	// rows which can't be parsed are reported so they aren't overwritten
+	err = os.WriteFile(path, []byte("match_uid,text\n04a2,**system:snes\n04a3,\"bad\"quote\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mappings, err = ReadMappings(path)
+	var errs ValidationErrors
+	if !errors.As(err, &errs) || len(errs) != 1 || errs[0].Line != 3 {
+		t.Errorf("expected parse error on line 3, got %v", err)
+	}
+	if len(mappings) != 1 {
+		t.Errorf("got %+v", mappings)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nfc.csv")
+
+	changed := make(chan struct{}, 10)
+	closeWatch, err := Watch(path, func() {
+		changed <- struct{}{}
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = closeWatch()
+	}()
+
+	// several writes in a row should only trigger one reload
+	for i := 0; i < 3; i++ {
+		err = WriteMappings(path, []Mapping{{MatchUID: "04a2", Text: "test"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case <-changed:
+	case <-time.After(3 * time.Second):
+		t.Fatal("timed out waiting for change")
+	}
+
+	select {
+	case <-changed:
+		t.Error("expected changes to be debounced")
+	case <-time.After(2 * reloadDelay):
+	}
+}
@@ -0,0 +1,75 @@
+package nfcmap
+
+import (
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const reloadDelay = 500 * time.Millisecond
+
+// Watch calls onChange whenever the database file at path is created,
+// written, moved into place or removed.
+//
+// The parent folder is watched instead of the file itself, because editors
+// (and WriteMappings) often replace the file rather than writing to it, which
+// would silently kill a watcher on the file. A single write can also emit
+// several events, including while the file is still half-written, so events
+// are debounced and onChange is only called once things settle down.
+func Watch(path string, onChange func(), onError func(error)) (func() error, error) {
+	path = filepath.Clean(path)
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	err = watcher.Add(filepath.Dir(path))
+	if err != nil {
+		_ = watcher.Close()
+		return nil, err
+	}
+
+	var mu sync.Mutex
+	var timer *time.Timer
+
+	go func() {
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+
+				if filepath.Clean(event.Name) != path || event.Op == fsnotify.Chmod {
+					continue
+				}
+
+				mu.Lock()
+				if timer != nil {
+					timer.Stop()
+				}
+				timer = time.AfterFunc(reloadDelay, onChange)
+				mu.Unlock()
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				if onError != nil {
+					onError(err)
+				}
+			}
+		}
+	}()
+
+	return func() error {
+		mu.Lock()
+		if timer != nil {
+			timer.Stop()
+		}
+		mu.Unlock()
+		return watcher.Close()
+	}, nil
+}
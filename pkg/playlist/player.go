@@ -0,0 +1,406 @@
+package playlist
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wizzomafizzo/mrext/pkg/service"
+)
+
+const (
+	ModeSequential = "sequential"
+	ModeShuffle    = "shuffle"
+)
+
+const DefaultDuration = 60 * time.Second
+
+var (
+	ErrNotPlaying      = errors.New("no playlist playing")
+	ErrNothingToResume = errors.New("no playlist to resume")
+	ErrEmptyPlaylist   = errors.New("playlist is empty")
+	ErrUnknownMode     = errors.New("unknown playlist mode")
+)
+
+// errorRetryDelay is how long a failed entry waits before moving on to the
+// next one.
+var errorRetryDelay = 5 * time.Second
+
+type Options struct {
+	Mode string `json:"mode"`
+	Loop bool   `json:"loop"`
+}
+
+// ParseOptions reads a comma separated list of playlist options, as used by
+// the **playlist: launch token. For example: "shuffle,loop".
+func ParseOptions(s string) (Options, error) {
+	opts := Options{Mode: ModeSequential}
+
+	for _, opt := range strings.Split(s, ",") {
+		opt = strings.ToLower(strings.TrimSpace(opt))
+		switch opt {
+		case "":
+			continue
+		case ModeSequential, ModeShuffle:
+			opts.Mode = opt
+		case "loop":
+			opts.Loop = true
+		default:
+			return opts, fmt.Errorf("unknown playlist option: %s", opt)
+		}
+	}
+
+	return opts, nil
+}
+
+// state is persisted to disk after every change so playback can be resumed
+// after a reboot.
+type state struct {
+	Name     string `json:"name"`
+	Mode     string `json:"mode"`
+	Loop     bool   `json:"loop"`
+	Active   bool   `json:"active"`
+	Order    []int  `json:"order"`
+	Position int    `json:"position"`
+}
+
+type Status struct {
+	Playing   bool      `json:"playing"`
+	Name      string    `json:"name"`
+	Mode      string    `json:"mode"`
+	Loop      bool      `json:"loop"`
+	Position  int       `json:"position"`
+	Total     int       `json:"total"`
+	Current   *Entry    `json:"current"`
+	NextAt    time.Time `json:"nextAt"`
+	LastError string    `json:"lastError"`
+}
+
+type Player struct {
+	mu              sync.Mutex
+	logger          *service.Logger
+	launch          func(Entry) error
+	defaultDuration time.Duration
+	rand            *rand.Rand
+	playlist        *Playlist
+	state           state
+	playing         bool
+	timer           *time.Timer
+	generation      int
+	nextAt          time.Time
+	lastError       string
+	// failed launches in a row, the player stops after a full pass of them
+	failures int
+}
+
+func NewPlayer(logger *service.Logger, launch func(Entry) error, defaultDuration time.Duration) *Player {
+	if defaultDuration <= 0 {
+		defaultDuration = DefaultDuration
+	}
+
+	return &Player{
+		logger:          logger,
+		launch:          launch,
+		defaultDuration: defaultDuration,
+		rand:            rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (p *Player) newOrder(size int) []int {
+	if p.state.Mode == ModeShuffle {
+		return p.rand.Perm(size)
+	}
+
+	order := make([]int, size)
+	for i := range order {
+		order[i] = i
+	}
+	return order
+}
+
+func (p *Player) saveState() {
+	data, err := json.Marshal(p.state)
+	if err != nil {
+		p.logger.Error("error encoding playlist state: %s", err)
+		return
+	}
+
+	err = os.MkdirAll(filepath.Dir(stateFile), 0755)
+	if err != nil {
+		p.logger.Error("error creating playlist state folder: %s", err)
+		return
+	}
+
+	err = os.WriteFile(stateFile, data, 0644)
+	if err != nil {
+		p.logger.Error("error writing playlist state: %s", err)
+	}
+}
+
+func loadState() (state, error) {
+	var s state
+
+	data, err := os.ReadFile(stateFile)
+	if err != nil {
+		return s, err
+	}
+
+	err = json.Unmarshal(data, &s)
+	return s, err
+}
+
+func (p *Player) stopTimer() {
+	p.generation++
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+}
+
+// playCurrent launches the entry at the current position and schedules the
+// next one. Must be called with the lock held, which is released while the
+// entry is launching.
+func (p *Player) playCurrent() {
+	p.stopTimer()
+	generation := p.generation
+
+	entry := p.playlist.Entries[p.state.Order[p.state.Position]]
+	delay := p.defaultDuration
+	if entry.Duration > 0 {
+		delay = time.Duration(entry.Duration) * time.Second
+	}
+
+	p.logger.Info(
+		"playlist %s: playing %d/%d: %s",
+		p.state.Name,
+		p.state.Position+1,
+		len(p.state.Order),
+		entry.Path,
+	)
+
+	p.saveState()
+
+	p.mu.Unlock()
+	err := p.launch(entry)
+	p.mu.Lock()
+
+	// playlist was stopped or moved on while launching
+	if generation != p.generation || !p.playing {
+		return
+	}
+
+	if err != nil {
+		p.logger.Error("playlist %s: error launching %s: %s", p.state.Name, entry.Path, err)
+		p.lastError = err.Error()
+		delay = errorRetryDelay
+
+		p.failures++
+		if p.failures >= len(p.state.Order) {
+			p.logger.Error("playlist %s: stopped, no entries could be launched", p.state.Name)
+			p.stop()
+			return
+		}
+	} else {
+		p.lastError = ""
+		p.failures = 0
+	}
+
+	p.nextAt = time.Now().Add(delay)
+	p.timer = time.AfterFunc(delay, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if generation != p.generation || !p.playing {
+			return
+		}
+		p.step(1)
+	})
+}
+
+// step moves the position by delta entries, handling the end of the playlist
+// depending on the loop setting. Must be called with the lock held.
+func (p *Player) step(delta int) {
+	total := len(p.state.Order)
+	pos := p.state.Position + delta
+
+	if pos >= total {
+		if !p.state.Loop {
+			p.logger.Info("playlist %s: finished", p.state.Name)
+			p.stop()
+			return
+		}
+
+		if p.state.Mode == ModeShuffle {
+			p.state.Order = p.newOrder(total)
+		}
+		pos = 0
+	} else if pos < 0 {
+		if p.state.Loop {
+			pos = total - 1
+		} else {
+			pos = 0
+		}
+	}
+
+	p.state.Position = pos
+	p.playCurrent()
+}
+
+func (p *Player) stop() {
+	p.stopTimer()
+	p.playing = false
+	p.nextAt = time.Time{}
+	p.state.Active = false
+	p.saveState()
+}
+
+// Play starts a playlist from the beginning.
+func (p *Player) Play(name string, opts Options) error {
+	pl, err := LoadPlaylist(name)
+	if err != nil {
+		return err
+	}
+
+	if len(pl.Entries) == 0 {
+		return fmt.Errorf("%w: %s", ErrEmptyPlaylist, pl.Name)
+	}
+
+	if opts.Mode == "" {
+		opts.Mode = ModeSequential
+	} else if opts.Mode != ModeSequential && opts.Mode != ModeShuffle {
+		return fmt.Errorf("%w: %s", ErrUnknownMode, opts.Mode)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.playlist = pl
+	p.state = state{
+		Name:   pl.Name,
+		Mode:   opts.Mode,
+		Loop:   opts.Loop,
+		Active: true,
+	}
+	p.state.Order = p.newOrder(len(pl.Entries))
+	p.playing = true
+	p.lastError = ""
+	p.failures = 0
+	p.playCurrent()
+
+	return nil
+}
+
+// Resume continues the last played playlist from its saved position. If
+// activeOnly is true, the playlist is only resumed if it was playing when the
+// state was saved.
+func (p *Player) Resume(activeOnly bool) error {
+	s, err := loadState()
+	if errors.Is(err, os.ErrNotExist) {
+		if activeOnly {
+			return nil
+		}
+		return ErrNothingToResume
+	} else if err != nil {
+		return err
+	}
+
+	if activeOnly && !s.Active {
+		return nil
+	}
+
+	pl, err := LoadPlaylist(s.Name)
+	if err != nil {
+		return err
+	}
+
+	if len(pl.Entries) == 0 {
+		return fmt.Errorf("%w: %s", ErrEmptyPlaylist, pl.Name)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.playlist = pl
+	p.state = s
+	p.state.Active = true
+
+	// playlist was edited since the state was saved
+	if len(p.state.Order) != len(pl.Entries) {
+		p.state.Order = p.newOrder(len(pl.Entries))
+	}
+	if p.state.Position < 0 || p.state.Position >= len(p.state.Order) {
+		p.state.Position = 0
+	}
+
+	p.playing = true
+	p.lastError = ""
+	p.failures = 0
+	p.playCurrent()
+
+	return nil
+}
+
+func (p *Player) Next() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.playing {
+		return ErrNotPlaying
+	}
+
+	p.step(1)
+	return nil
+}
+
+func (p *Player) Previous() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.playing {
+		return ErrNotPlaying
+	}
+
+	p.step(-1)
+	return nil
+}
+
+func (p *Player) Stop() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.playing {
+		return ErrNotPlaying
+	}
+
+	p.logger.Info("playlist %s: stopped", p.state.Name)
+	p.stop()
+	return nil
+}
+
+func (p *Player) Status() Status {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	status := Status{
+		Playing:   p.playing,
+		Name:      p.state.Name,
+		Mode:      p.state.Mode,
+		Loop:      p.state.Loop,
+		Position:  p.state.Position,
+		Total:     len(p.state.Order),
+		NextAt:    p.nextAt,
+		LastError: p.lastError,
+	}
+
+	if p.playing && p.playlist != nil {
+		entry := p.playlist.Entries[p.state.Order[p.state.Position]]
+		status.Current = &entry
+	}
+
+	return status
+}
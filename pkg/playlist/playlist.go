@@ -0,0 +1,186 @@
+package playlist
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gocarina/gocsv"
+	"github.com/wizzomafizzo/mrext/pkg/config"
+	"github.com/wizzomafizzo/mrext/pkg/games"
+	"github.com/wizzomafizzo/mrext/pkg/mister"
+	"github.com/wizzomafizzo/mrext/pkg/utils"
+)
+
+const fileExt = ".csv"
+
+// these are overridden in tests
+var (
+	playlistsFolder = config.PlaylistsFolder
+	stateFile       = config.PlaylistStateFile
+)
+
+var ErrInvalidName = errors.New("invalid playlist name")
+
+// Entry is a single game in a playlist. Duration is in seconds, and a
+// duration of 0 means the player's default duration will be used.
+type Entry struct {
+	System   string `csv:"system" json:"system"`
+	Path     string `csv:"path" json:"path"`
+	Duration int    `csv:"duration" json:"duration"`
+}
+
+type Playlist struct {
+	Name    string  `json:"name"`
+	Entries []Entry `json:"entries"`
+}
+
+// CleanName strips characters from a playlist name which would not be valid
+// in a filename on the SD card.
+func CleanName(name string) string {
+	name = utils.StripBadFileChars(name)
+	name = strings.ReplaceAll(name, "/", "")
+	return strings.TrimSpace(name)
+}
+
+func playlistPath(name string) (string, error) {
+	cleaned := CleanName(name)
+	if cleaned == "" {
+		return "", fmt.Errorf("%w: %s", ErrInvalidName, name)
+	}
+	return filepath.Join(playlistsFolder, cleaned+fileExt), nil
+}
+
+// ListPlaylists returns the names of all playlists in the playlists folder.
+func ListPlaylists() ([]string, error) {
+	names := make([]string, 0)
+
+	files, err := os.ReadDir(playlistsFolder)
+	if errors.Is(err, os.ErrNotExist) {
+		return names, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		if file.IsDir() || !strings.EqualFold(filepath.Ext(file.Name()), fileExt) {
+			continue
+		}
+		names = append(names, utils.RemoveFileExt(file.Name()))
+	}
+
+	sort.Strings(names)
+
+	return names, nil
+}
+
+func LoadPlaylist(name string) (*Playlist, error) {
+	path, err := playlistPath(name)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func(c io.Closer) {
+		_ = c.Close()
+	}(f)
+
+	entries := make([]Entry, 0)
+	err = gocsv.Unmarshal(f, &entries)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing playlist %s: %s", name, err)
+	}
+
+	for i := range entries {
+		entries[i].System = strings.TrimSpace(entries[i].System)
+		entries[i].Path = strings.TrimSpace(entries[i].Path)
+		if entries[i].Duration < 0 {
+			entries[i].Duration = 0
+		}
+	}
+
+	return &Playlist{
+		Name:    CleanName(name),
+		Entries: entries,
+	}, nil
+}
+
+func (p *Playlist) Save() error {
+	path, err := playlistPath(p.Name)
+	if err != nil {
+		return err
+	}
+
+	for i, entry := range p.Entries {
+		if entry.Path == "" {
+			return fmt.Errorf("entry %d has no path", i+1)
+		}
+	}
+
+	err = os.MkdirAll(playlistsFolder, 0755)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer func(c io.Closer) {
+		_ = c.Close()
+	}(f)
+
+	return gocsv.Marshal(p.Entries, f)
+}
+
+func DeletePlaylist(name string) error {
+	path, err := playlistPath(name)
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+// LaunchEntry returns a launcher for the player which starts a playlist entry
+// using the given user config. Relative paths are looked up in each of the
+// games folders.
+func LaunchEntry(cfg *config.UserConfig) func(Entry) error {
+	return func(entry Entry) error {
+		path := entry.Path
+
+		if !filepath.IsAbs(path) {
+			found := ""
+			for _, folder := range games.GetGamesFolders(cfg) {
+				if _, err := os.Stat(filepath.Join(folder, path)); err == nil {
+					found = filepath.Join(folder, path)
+					break
+				}
+			}
+
+			if found == "" {
+				return fmt.Errorf("could not find file: %s", path)
+			}
+
+			path = found
+		}
+
+		if entry.System == "" {
+			return mister.LaunchGenericFile(cfg, path)
+		}
+
+		system, err := games.LookupSystem(entry.System)
+		if err != nil {
+			return err
+		}
+
+		return mister.LaunchGame(cfg, *system, path)
+	}
+}
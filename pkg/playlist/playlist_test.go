@@ -0,0 +1,337 @@
+package playlist
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wizzomafizzo/mrext/pkg/service"
+)
+
+type fakeLauncher struct {
+	mu       sync.Mutex
+	launched []string
+	// err is returned by every launch
+	err error
+}
+
+func (f *fakeLauncher) launch(entry Entry) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.launched = append(f.launched, entry.Path)
+	return f.err
+}
+
+func (f *fakeLauncher) paths() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string{}, f.launched...)
+}
+
+func setupFolders(t *testing.T) {
+	dir := t.TempDir()
+	playlistsFolder = filepath.Join(dir, "playlists")
+	stateFile = filepath.Join(dir, "playlist.json")
+}
+
+func testPlaylist(t *testing.T) *Playlist {
+	pl := &Playlist{
+		Name: "kiosk",
+		Entries: []Entry{
+			{System: "SNES", Path: "/games/a.sfc", Duration: 30},
+			{System: "NES", Path: "/games/b.nes"},
+			{Path: "/games/c.mgl", Duration: 10},
+		},
+	}
+
+	err := pl.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pl
+}
+
+func TestSaveLoadPlaylist(t *testing.T) {
+	setupFolders(t)
+	want := testPlaylist(t)
+
+	got, err := LoadPlaylist("kiosk")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	names, err := ListPlaylists()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names, []string{"kiosk"}) {
+		t.Errorf("got names %v, want [kiosk]", names)
+	}
+
+	err = DeletePlaylist("kiosk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadPlaylist("kiosk"); err == nil {
+		t.Error("expected error loading deleted playlist")
+	}
+}
+
+func TestParseOptions(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    Options
+		wantErr bool
+	}{
+		{"", Options{Mode: ModeSequential}, false},
+		{"shuffle", Options{Mode: ModeShuffle}, false},
+		{"loop", Options{Mode: ModeSequential, Loop: true}, false},
+		{" Shuffle , LOOP ", Options{Mode: ModeShuffle, Loop: true}, false},
+		{"backwards", Options{}, true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseOptions(tt.input)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseOptions(%q) expected error", tt.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseOptions(%q) error: %s", tt.input, err)
+		} else if got != tt.want {
+			t.Errorf("ParseOptions(%q) = %+v, want %+v", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestPlayerControls(t *testing.T) {
+	setupFolders(t)
+	testPlaylist(t)
+
+	fl := &fakeLauncher{}
+	player := NewPlayer(service.NewLogger("playlist-test"), fl.launch, time.Hour)
+
+	err := player.Play("kiosk", Options{Mode: ModeSequential})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = player.Next()
+	_ = player.Next()
+	_ = player.Previous()
+
+	want := []string{"/games/a.sfc", "/games/b.nes", "/games/c.mgl", "/games/b.nes"}
+	if got := fl.paths(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	status := player.Status()
+	if !status.Playing || status.Position != 1 || status.Total != 3 {
+		t.Errorf("unexpected status: %+v", status)
+	}
+
+	// past the end without loop finishes the playlist
+	_ = player.Next()
+	_ = player.Next()
+	if player.Status().Playing {
+		t.Error("expected playlist to finish")
+	}
+	if err := player.Next(); !errors.Is(err, ErrNotPlaying) {
+		t.Errorf("expected ErrNotPlaying when nothing is playing, got %v", err)
+	}
+}
+
+func TestPlayerLoop(t *testing.T) {
+	setupFolders(t)
+	testPlaylist(t)
+
+	fl := &fakeLauncher{}
+	player := NewPlayer(service.NewLogger("playlist-test"), fl.launch, time.Hour)
+
+	err := player.Play("kiosk", Options{Mode: ModeSequential, Loop: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = player.Previous()
+	_ = player.Next()
+
+	want := []string{"/games/a.sfc", "/games/c.mgl", "/games/a.sfc"}
+	if got := fl.paths(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestPlayerShuffle(t *testing.T) {
+	setupFolders(t)
+	testPlaylist(t)
+
+	fl := &fakeLauncher{}
+	player := NewPlayer(service.NewLogger("playlist-test"), fl.launch, time.Hour)
+
+	err := player.Play("kiosk", Options{Mode: ModeShuffle})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = player.Next()
+	_ = player.Next()
+
+	seen := make(map[string]bool)
+	for _, path := range fl.paths() {
+		seen[path] = true
+	}
+	if len(seen) != 3 {
+		t.Errorf("expected every entry to play once, got %v", fl.paths())
+	}
+}
+
+func TestPlayerAutoAdvance(t *testing.T) {
+	setupFolders(t)
+
+	pl := &Playlist{
+		Name: "fast",
+		Entries: []Entry{
+			{Path: "/games/a.mgl"},
+			{Path: "/games/b.mgl"},
+		},
+	}
+	if err := pl.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	fl := &fakeLauncher{}
+	player := NewPlayer(service.NewLogger("playlist-test"), fl.launch, 10*time.Millisecond)
+
+	err := player.Play("fast", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for player.Status().Playing && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	want := []string{"/games/a.mgl", "/games/b.mgl"}
+	if got := fl.paths(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestPlayerResume(t *testing.T) {
+	setupFolders(t)
+	testPlaylist(t)
+
+	fl := &fakeLauncher{}
+	player := NewPlayer(service.NewLogger("playlist-test"), fl.launch, time.Hour)
+
+	err := player.Play("kiosk", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = player.Next()
+
+	// simulate a reboot while playing
+	resumed := &fakeLauncher{}
+	player = NewPlayer(service.NewLogger("playlist-test"), resumed.launch, time.Hour)
+
+	err = player.Resume(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"/games/b.nes"}
+	if got := resumed.paths(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// a stopped playlist is not resumed on start
+	_ = player.Stop()
+	stopped := &fakeLauncher{}
+	player = NewPlayer(service.NewLogger("playlist-test"), stopped.launch, time.Hour)
+
+	err = player.Resume(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stopped.paths()) != 0 || player.Status().Playing {
+		t.Error("expected stopped playlist not to resume")
+	}
+}
+
+func TestPlayerLaunchUnlocked(t *testing.T) {
+	setupFolders(t)
+	testPlaylist(t)
+
+	var player *Player
+	statuses := make(chan Status, 1)
+	launch := func(entry Entry) error {
+		select {
+		case statuses <- player.Status():
+		default:
+		}
+		return nil
+	}
+	player = NewPlayer(service.NewLogger("playlist-test"), launch, time.Hour)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- player.Play("kiosk", Options{})
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("player was locked while launching")
+	}
+
+	if status := <-statuses; !status.Playing || status.Current.Path != "/games/a.sfc" {
+		t.Errorf("unexpected status while launching: %+v", status)
+	}
+}
+
+func TestPlayerStopsWhenAllLaunchesFail(t *testing.T) {
+	setupFolders(t)
+	testPlaylist(t)
+
+	oldDelay := errorRetryDelay
+	errorRetryDelay = 10 * time.Millisecond
+	t.Cleanup(func() { errorRetryDelay = oldDelay })
+
+	fl := &fakeLauncher{err: errors.New("core not found")}
+	player := NewPlayer(service.NewLogger("playlist-test"), fl.launch, time.Hour)
+
+	err := player.Play("kiosk", Options{Loop: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for player.Status().Playing && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	status := player.Status()
+	if status.Playing || status.LastError != "core not found" {
+		t.Errorf("unexpected status: %+v", status)
+	}
+
+	want := []string{"/games/a.sfc", "/games/b.nes", "/games/c.mgl"}
+	if got := fl.paths(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,112 @@
+package playlist
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/wizzomafizzo/mrext/pkg/config"
+	"github.com/wizzomafizzo/mrext/pkg/service"
+)
+
+// handleCommand runs a single socket command against the player and returns
+// the response payload. Errors are returned as "error: <message>".
+func handleCommand(player *Player, msg string) string {
+	parts := strings.SplitN(strings.TrimSpace(msg), " ", 2)
+	cmd := parts[0]
+	args := ""
+	if len(parts) > 1 {
+		args = strings.TrimSpace(parts[1])
+	}
+
+	var err error
+
+	switch cmd {
+	case "play":
+		// play <name>[,option...]
+		opts := strings.SplitN(args, ",", 2)
+		var parsed Options
+		if len(opts) > 1 {
+			parsed, err = ParseOptions(opts[1])
+		} else {
+			parsed, err = ParseOptions("")
+		}
+		if err == nil {
+			err = player.Play(opts[0], parsed)
+		}
+	case "resume":
+		err = player.Resume(false)
+	case "next":
+		err = player.Next()
+	case "previous":
+		err = player.Previous()
+	case "stop":
+		err = player.Stop()
+	case "status":
+		data, err := json.Marshal(player.Status())
+		if err != nil {
+			return "error: " + err.Error()
+		}
+		return string(data)
+	default:
+		return "error: unknown command: " + cmd
+	}
+
+	if err != nil {
+		return "error: " + err.Error()
+	}
+
+	return "ok"
+}
+
+// StartSocket listens for player commands on the playlist socket, so other
+// apps (like the **playlist: launch token) can control playback.
+func StartSocket(logger *service.Logger, player *Player) (func() error, error) {
+	// clean up after an unclean shutdown
+	_ = os.Remove(config.PlaylistSocket)
+
+	socket, err := net.Listen("unix", config.PlaylistSocket)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		for {
+			conn, err := socket.Accept()
+			if err != nil {
+				logger.Info("playlist socket closed: %s", err)
+				return
+			}
+
+			go func(conn net.Conn) {
+				defer func(conn net.Conn) {
+					err := conn.Close()
+					if err != nil {
+						logger.Warn("error closing playlist connection: %s", err)
+					}
+				}(conn)
+
+				buf := make([]byte, 4096)
+				n, err := conn.Read(buf)
+				if err != nil {
+					logger.Error("error reading from playlist connection: %s", err)
+					return
+				}
+
+				if n == 0 {
+					return
+				}
+
+				payload := handleCommand(player, string(buf[:n]))
+
+				_, err = conn.Write([]byte(payload))
+				if err != nil {
+					logger.Error("error writing to playlist connection: %s", err)
+				}
+			}(conn)
+		}
+	}()
+
+	return socket.Close, nil
+}
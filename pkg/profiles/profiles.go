@@ -0,0 +1,679 @@
+// Package profiles exports the settings of a MiSTer to a single archive, so
+// they can be previewed and imported on another MiSTer.
+//
+// A profile is a zip file with a manifest.json and a folder for each part it
+// includes, e.g. inis/MiSTer.ini. Only filenames are taken from a profile,
+// where each file is written to is decided by its part.
+//
+// The peers trusted in remote.ini are never imported, an imported remote.ini
+// keeps the trust_peer entries already on the MiSTer.
+package profiles
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/wizzomafizzo/mrext/pkg/config"
+	"github.com/wizzomafizzo/mrext/pkg/mister"
+	"github.com/wizzomafizzo/mrext/pkg/utils"
+)
+
+const (
+	// PartInis is MiSTer.ini and its alternate .ini files.
+	PartInis = "inis"
+	// PartApps is the .ini files of mrext apps in the Scripts folder, listed
+	// in appIniFiles.
+	PartApps = "apps"
+	// PartNfc is the NFC mappings database.
+	PartNfc = "nfc"
+	// PartUBoot is the u-boot.txt params, except for the MAC address.
+	PartUBoot = "uboot"
+	// PartWallpaper is the active menu wallpaper.
+	PartWallpaper = "wallpaper"
+	// PartFavorites is the .mgl files in the favorites menu folder.
+	PartFavorites = "favorites"
+	// PartPlaylists is the playlists in the playlists folder.
+	PartPlaylists = "playlists"
+)
+
+var AllParts = []string{PartInis, PartApps, PartNfc, PartUBoot, PartWallpaper, PartFavorites, PartPlaylists}
+
+const (
+	StatusNew       = "new"
+	StatusChanged   = "changed"
+	StatusUnchanged = "unchanged"
+)
+
+const (
+	manifestFilename  = "manifest.json"
+	remoteIniFilename = "remote.ini"
+	manifestVersion   = 1
+	uBootFilename     = "u-boot.txt"
+	// MaxSize is the largest profile which will be read, to fit a few
+	// wallpapers.
+	MaxSize = 64 * 1024 * 1024
+)
+
+var ErrInvalidProfile = errors.New("invalid profile")
+
+// appIniFiles are the configs of mrext apps which can be in a profile. Other
+// .ini files in the Scripts folder are never read or written.
+var appIniFiles = []string{
+	"lastplayed.ini",
+	"launchsync.ini",
+	"nfc.ini",
+	"playlog.ini",
+	"random.ini",
+	remoteIniFilename,
+	"savesnap.ini",
+	"search.ini",
+}
+
+var trustPeerRe = regexp.MustCompile(`(?i)^\s*trust_peer\s*=`)
+
+// setWallpaperMode switches the menu to show the wallpaper.
+var setWallpaperMode = func() error {
+	return mister.SetMenuBackgroundMode(mister.BackgroundModeWallpaper)
+}
+
+// Layout is where the settings in a profile are read from and written to.
+type Layout struct {
+	// Sd contains the .ini files and the active wallpaper link.
+	Sd          string
+	Scripts     string
+	NfcDatabase string
+	UBoot       string
+	Wallpapers  string
+	Favorites   string
+	Playlists   string
+	// History keeps versions of .ini files and u-boot.txt when they're
+	// imported.
+	History *mister.History
+}
+
+// Default is the standard MiSTer layout on the SD card.
+var Default = Layout{
+	Sd:          config.SdFolder,
+	Scripts:     config.ScriptsFolder,
+	NfcDatabase: config.NfcDatabaseFile,
+	UBoot:       config.UBootConfigFile,
+	Wallpapers:  config.SdFolder + "/wallpapers",
+	Favorites:   config.FavoritesFolder,
+	Playlists:   config.PlaylistsFolder,
+	History:     mister.DefaultHistory,
+}
+
+type ManifestFile struct {
+	Part string `json:"part"`
+	Name string `json:"name"`
+	Size int    `json:"size"`
+	Hash string `json:"hash"`
+}
+
+type Manifest struct {
+	Version  int            `json:"version"`
+	Hostname string         `json:"hostname"`
+	Created  time.Time      `json:"created"`
+	Parts    []string       `json:"parts"`
+	Files    []ManifestFile `json:"files"`
+}
+
+type Profile struct {
+	Manifest Manifest
+	// Files are the contents of each file, by its path in the archive.
+	Files map[string][]byte
+}
+
+// FileChange is what importing a file from a profile would do.
+type FileChange struct {
+	Part   string `json:"part"`
+	Name   string `json:"name"`
+	Path   string `json:"path"`
+	Status string `json:"status"`
+	// Diff is the changes to a text file in unified diff format.
+	Diff string `json:"diff,omitempty"`
+	data []byte
+}
+
+func hashData(data []byte) string {
+	h := sha1.Sum(data)
+	return hex.EncodeToString(h[:])
+}
+
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && filepath.Base(name) == name && !strings.Contains(name, "\\")
+}
+
+// isMisterIni returns true if a filename is MiSTer.ini or an alternate .ini
+// file, which are named MiSTer_<name>.ini.
+func isMisterIni(name string) bool {
+	lower := strings.ToLower(name)
+	return lower == strings.ToLower(mister.DefaultIniFilename) ||
+		(strings.HasPrefix(lower, "mister_") && filepath.Ext(lower) == ".ini")
+}
+
+func isWallpaper(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	return ext == ".png" || ext == ".jpg"
+}
+
+func isAppIni(name string) bool {
+	for _, ini := range appIniFiles {
+		if strings.EqualFold(name, ini) {
+			return true
+		}
+	}
+	return false
+}
+
+// validPartFile returns true if a file is allowed in a part.
+func validPartFile(part string, name string) bool {
+	if !validName(name) {
+		return false
+	}
+
+	switch part {
+	case PartInis:
+		return isMisterIni(name)
+	case PartApps:
+		return isAppIni(name)
+	case PartNfc:
+		return name == filepath.Base(Default.NfcDatabase)
+	case PartUBoot:
+		return name == uBootFilename
+	case PartWallpaper:
+		return isWallpaper(name)
+	case PartFavorites:
+		return strings.ToLower(filepath.Ext(name)) == ".mgl"
+	case PartPlaylists:
+		return strings.ToLower(filepath.Ext(name)) == ".csv"
+	default:
+		return false
+	}
+}
+
+// activeWallpaper returns the filename of the wallpaper the menu links to,
+// or an empty string if none is set.
+func (l Layout) activeWallpaper() string {
+	for _, name := range []string{"menu.png", "menu.jpg"} {
+		target, err := os.Readlink(filepath.Join(l.Sd, name))
+		if err == nil {
+			return filepath.Base(target)
+		}
+	}
+	return ""
+}
+
+// setWallpaper links the menu to a wallpaper. Menu images which aren't links
+// are moved to the wallpapers folder instead of being deleted.
+func (l Layout) setWallpaper(filename string) error {
+	for _, name := range []string{"menu.png", "menu.jpg"} {
+		menuPath := filepath.Join(l.Sd, name)
+		info, err := os.Lstat(menuPath)
+		if err != nil {
+			continue
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			err = os.Remove(menuPath)
+		} else {
+			err = os.Rename(menuPath, filepath.Join(
+				l.Wallpapers,
+				fmt.Sprintf("menu_%d%s", info.ModTime().Unix(), filepath.Ext(name)),
+			))
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	ext := strings.ToLower(filepath.Ext(filename))
+	return os.Symlink(filepath.Join(l.Wallpapers, filename), filepath.Join(l.Sd, "menu"+ext))
+}
+
+// partFiles returns the current files of a part on this MiSTer, by name.
+func (l Layout) partFiles(part string) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+
+	readFolder := func(folder string, part string) error {
+		entries, err := os.ReadDir(folder)
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			if entry.IsDir() || !validPartFile(part, entry.Name()) {
+				continue
+			}
+
+			data, err := os.ReadFile(filepath.Join(folder, entry.Name()))
+			if err != nil {
+				return err
+			}
+			files[entry.Name()] = data
+		}
+
+		return nil
+	}
+
+	readFile := func(path string, name string) error {
+		data, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		files[name] = data
+		return nil
+	}
+
+	var err error
+	switch part {
+	case PartInis:
+		err = readFolder(l.Sd, part)
+	case PartApps:
+		err = readFolder(l.Scripts, part)
+		// only .ini files belonging to a script are app configs
+		for name := range files {
+			script := strings.TrimSuffix(name, filepath.Ext(name)) + ".sh"
+			if _, statErr := os.Stat(filepath.Join(l.Scripts, script)); statErr != nil {
+				delete(files, name)
+			}
+		}
+	case PartNfc:
+		err = readFile(l.NfcDatabase, filepath.Base(l.NfcDatabase))
+	case PartUBoot:
+		var data []byte
+		data, err = os.ReadFile(l.UBoot)
+		if err == nil {
+			params := mister.ParseUBootParams(string(data))
+			delete(params, mister.UBootMACParam)
+			if len(params) > 0 {
+				files[uBootFilename] = []byte(mister.FormatUBootParams(params))
+			}
+		} else if os.IsNotExist(err) {
+			err = nil
+		}
+	case PartWallpaper:
+		if active := l.activeWallpaper(); active != "" && isWallpaper(active) {
+			err = readFile(filepath.Join(l.Wallpapers, active), active)
+		}
+	case PartFavorites:
+		err = readFolder(l.Favorites, part)
+	case PartPlaylists:
+		err = readFolder(l.Playlists, part)
+	default:
+		err = fmt.Errorf("unknown part: %s", part)
+	}
+
+	return files, err
+}
+
+// Export creates a profile of the given parts of this MiSTer's settings.
+// Parts with nothing to export are left out.
+func (l Layout) Export(parts []string) (*Profile, error) {
+	hostname, _ := os.Hostname()
+
+	profile := &Profile{
+		Manifest: Manifest{
+			Version:  manifestVersion,
+			Hostname: hostname,
+			Created:  time.Now(),
+			Parts:    make([]string, 0),
+			Files:    make([]ManifestFile, 0),
+		},
+		Files: make(map[string][]byte),
+	}
+
+	for _, part := range AllParts {
+		if !utils.Contains(parts, part) {
+			continue
+		}
+
+		files, err := l.partFiles(part)
+		if err != nil {
+			return nil, fmt.Errorf("error exporting %s: %w", part, err)
+		} else if len(files) == 0 {
+			continue
+		}
+
+		profile.Manifest.Parts = append(profile.Manifest.Parts, part)
+
+		for _, name := range utils.SortedMapKeys(files) {
+			profile.Manifest.Files = append(profile.Manifest.Files, ManifestFile{
+				Part: part,
+				Name: name,
+				Size: len(files[name]),
+				Hash: hashData(files[name]),
+			})
+			profile.Files[path.Join(part, name)] = files[name]
+		}
+	}
+
+	return profile, nil
+}
+
+// Write writes a profile as a zip archive.
+func (p *Profile) Write(w io.Writer) error {
+	zw := zip.NewWriter(w)
+
+	manifest, err := json.MarshalIndent(p.Manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	f, err := zw.Create(manifestFilename)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(manifest)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range p.Manifest.Files {
+		f, err := zw.Create(path.Join(file.Part, file.Name))
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(p.Files[path.Join(file.Part, file.Name)])
+		if err != nil {
+			return err
+		}
+	}
+
+	return zw.Close()
+}
+
+func readZipFile(f *zip.File, limit int64) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(io.LimitReader(rc, limit+1))
+	if err != nil {
+		return nil, err
+	} else if int64(len(data)) > limit {
+		return nil, fmt.Errorf("%w: too large", ErrInvalidProfile)
+	}
+
+	return data, nil
+}
+
+// Read reads a profile from a zip archive. Every file listed in the manifest
+// must be in the archive and allowed in its part.
+func Read(r io.ReaderAt, size int64) (*Profile, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidProfile, err)
+	}
+
+	entries := make(map[string]*zip.File)
+	for _, f := range zr.File {
+		entries[f.Name] = f
+	}
+
+	mf, ok := entries[manifestFilename]
+	if !ok {
+		return nil, fmt.Errorf("%w: missing manifest", ErrInvalidProfile)
+	}
+
+	data, err := readZipFile(mf, MaxSize)
+	if err != nil {
+		return nil, err
+	}
+
+	profile := &Profile{Files: make(map[string][]byte)}
+	err = json.Unmarshal(data, &profile.Manifest)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidProfile, err)
+	} else if profile.Manifest.Version != manifestVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidProfile, profile.Manifest.Version)
+	}
+
+	remaining := int64(MaxSize)
+	for _, file := range profile.Manifest.Files {
+		if !validPartFile(file.Part, file.Name) {
+			return nil, fmt.Errorf("%w: file not allowed: %s/%s", ErrInvalidProfile, file.Part, file.Name)
+		}
+
+		name := path.Join(file.Part, file.Name)
+		f, ok := entries[name]
+		if !ok {
+			return nil, fmt.Errorf("%w: missing file: %s", ErrInvalidProfile, name)
+		}
+
+		data, err := readZipFile(f, remaining)
+		if err != nil {
+			return nil, err
+		} else if hashData(data) != file.Hash {
+			return nil, fmt.Errorf("%w: file is corrupt: %s", ErrInvalidProfile, name)
+		}
+		remaining -= int64(len(data))
+
+		profile.Files[name] = data
+	}
+
+	return profile, nil
+}
+
+// ReadFile reads a profile from a zip file.
+func ReadFile(path string) (*Profile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Read(bytes.NewReader(data), int64(len(data)))
+}
+
+// Preview returns what importing the given parts of a profile would change.
+// An empty list of parts previews every part in the profile.
+func (l Layout) Preview(p *Profile, parts []string) ([]FileChange, error) {
+	changes := make([]FileChange, 0, len(p.Manifest.Files))
+
+	current := make(map[string]map[string][]byte)
+	for _, file := range p.Manifest.Files {
+		if len(parts) > 0 && !utils.Contains(parts, file.Part) {
+			continue
+		}
+
+		if _, ok := current[file.Part]; !ok {
+			files, err := l.partFiles(file.Part)
+			if err != nil {
+				return nil, err
+			}
+			current[file.Part] = files
+		}
+
+		data := p.Files[path.Join(file.Part, file.Name)]
+		change := FileChange{
+			Part: file.Part,
+			Name: file.Name,
+			data: data,
+		}
+
+		existing, exists := current[file.Part][file.Name]
+
+		switch file.Part {
+		case PartInis:
+			change.Path = filepath.Join(l.Sd, file.Name)
+		case PartApps:
+			change.Path = filepath.Join(l.Scripts, file.Name)
+			// apps without a script have no current files, but may still
+			// have an .ini file
+			if !exists {
+				existing, exists = readExisting(change.Path)
+			}
+			if strings.EqualFold(file.Name, remoteIniFilename) {
+				change.data = keepTrustedPeers(data, existing)
+			}
+		case PartNfc:
+			change.Path = l.NfcDatabase
+		case PartUBoot:
+			change.Path = l.UBoot
+			currentData, _ := readExisting(l.UBoot)
+			params := mister.ParseUBootParams(string(currentData))
+			merged := mister.MergeUBootParams(params, mister.ParseUBootParams(string(data)))
+			change.data = []byte(mister.FormatUBootParams(merged))
+			existing = []byte(mister.FormatUBootParams(params))
+			exists = len(currentData) > 0
+		case PartWallpaper:
+			change.Path = filepath.Join(l.Wallpapers, file.Name)
+			existing, exists = readExisting(change.Path)
+			// an identical file which isn't active still needs to be set
+			if exists && l.activeWallpaper() != file.Name {
+				existing = nil
+			}
+		case PartFavorites:
+			change.Path = filepath.Join(l.Favorites, file.Name)
+		case PartPlaylists:
+			change.Path = filepath.Join(l.Playlists, file.Name)
+		}
+
+		switch {
+		case !exists:
+			change.Status = StatusNew
+		case bytes.Equal(existing, change.data):
+			change.Status = StatusUnchanged
+		default:
+			change.Status = StatusChanged
+		}
+
+		if change.Status != StatusUnchanged && file.Part != PartWallpaper {
+			change.Diff = utils.UnifiedDiff(
+				file.Name,
+				file.Name,
+				strings.ReplaceAll(string(existing), "\r\n", "\n"),
+				strings.ReplaceAll(string(change.data), "\r\n", "\n"),
+				3,
+			)
+		}
+
+		changes = append(changes, change)
+	}
+
+	return changes, nil
+}
+
+// keepTrustedPeers replaces the trust_peer entries of an imported remote.ini
+// with the existing ones, so importing a profile can't make a MiSTer trust
+// a new peer.
+func keepTrustedPeers(imported []byte, existing []byte) []byte {
+	var trusted []string
+	for _, line := range strings.Split(string(existing), "\n") {
+		if trustPeerRe.MatchString(line) {
+			trusted = append(trusted, strings.TrimRight(line, "\r"))
+		}
+	}
+
+	lines := make([]string, 0)
+	inserted := false
+	for _, line := range strings.Split(string(imported), "\n") {
+		if trustPeerRe.MatchString(line) {
+			continue
+		}
+		lines = append(lines, line)
+		if !inserted && strings.EqualFold(strings.TrimSpace(line), "[remote]") {
+			lines = append(lines, trusted...)
+			inserted = true
+		}
+	}
+
+	if !inserted && len(trusted) > 0 {
+		if len(lines) > 0 && lines[len(lines)-1] == "" {
+			lines = lines[:len(lines)-1]
+		}
+		lines = append(lines, "[remote]")
+		lines = append(lines, trusted...)
+		lines = append(lines, "")
+	}
+
+	return []byte(strings.Join(lines, "\n"))
+}
+
+func readExisting(path string) ([]byte, bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	return data, true
+}
+
+// Import writes the given parts of a profile to this MiSTer, returning what
+// was changed. An empty list of parts imports every part in the profile.
+// Files are only added or replaced, never deleted.
+// MiSTer.ini files, u-boot.txt and the NFC database are saved with the
+// author in their history.
+func (l Layout) Import(p *Profile, parts []string, author string) ([]FileChange, error) {
+	changes, err := l.Preview(p, parts)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, change := range changes {
+		if change.Status == StatusUnchanged {
+			continue
+		}
+
+		switch change.Part {
+		case PartInis, PartUBoot, PartNfc:
+			err = os.MkdirAll(filepath.Dir(change.Path), 0755)
+			if err == nil {
+				err = l.History.Write(change.Path, change.data, author)
+			}
+		case PartWallpaper:
+			err = os.MkdirAll(l.Wallpapers, 0755)
+			if err == nil {
+				err = os.WriteFile(change.Path, change.data, 0644)
+			}
+			if err == nil {
+				err = l.setWallpaper(change.Name)
+			}
+			if err == nil {
+				err = setWallpaperMode()
+			}
+		default:
+			err = os.MkdirAll(filepath.Dir(change.Path), 0755)
+			if err == nil {
+				err = os.WriteFile(change.Path, change.data, 0644)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error importing %s/%s: %w", change.Part, change.Name, err)
+		}
+	}
+
+	return changes, nil
+}
+
+// ParseParts splits a comma separated list of parts, checking each is valid.
+// An empty string returns an empty list.
+func ParseParts(s string) ([]string, error) {
+	parts := make([]string, 0)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		} else if !utils.Contains(AllParts, part) {
+			return nil, fmt.Errorf("unknown part: %s", part)
+		}
+		parts = append(parts, part)
+	}
+	return parts, nil
+}
@@ -0,0 +1,285 @@
+package profiles
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/wizzomafizzo/mrext/pkg/mister"
+)
+
+func testLayout(t *testing.T) Layout {
+	t.Helper()
+
+	root := t.TempDir()
+	l := Layout{
+		Sd:          root,
+		Scripts:     filepath.Join(root, "Scripts"),
+		NfcDatabase: filepath.Join(root, "nfc.csv"),
+		UBoot:       filepath.Join(root, "linux", "u-boot.txt"),
+		Wallpapers:  filepath.Join(root, "wallpapers"),
+		History:     &mister.History{Folder: filepath.Join(root, "history")},
+	}
+
+	for _, folder := range []string{l.Scripts, l.Wallpapers, filepath.Dir(l.UBoot)} {
+		err := os.MkdirAll(folder, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return l
+}
+
+func writeFile(t *testing.T, path string, data string) {
+	t.Helper()
+	err := os.WriteFile(path, []byte(data), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func roundTrip(t *testing.T, p *Profile) *Profile {
+	t.Helper()
+
+	var buf bytes.Buffer
+	err := p.Write(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	read, err := Read(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return read
+}
+
+func TestExportImport(t *testing.T) {
+	setWallpaperMode = func() error { return nil }
+
+	src := testLayout(t)
+	writeFile(t, filepath.Join(src.Sd, "MiSTer.ini"), "[MiSTer]\nvsync_adjust=2\n")
+	writeFile(t, filepath.Join(src.Sd, "MiSTer_alt_1.ini"), "[MiSTer]\nvideo_mode=8\n")
+	writeFile(t, filepath.Join(src.Sd, "downloader.ini"), "[distribution_mister]\n")
+	writeFile(t, filepath.Join(src.Scripts, "remote.ini"), "[remote]\nmdns_service=no\n")
+	writeFile(t, filepath.Join(src.Scripts, "remote.sh"), "")
+	writeFile(t, filepath.Join(src.Scripts, "other.ini"), "[other]\n")
+	// not an mrext app, so not exported even with a script
+	writeFile(t, filepath.Join(src.Scripts, "other.sh"), "")
+	writeFile(t, src.NfcDatabase, "match_uid,text\n")
+	writeFile(t, src.UBoot, "ethaddr=02:03:04:05:06:07\nv=loglevel=4 usbhid.jspoll=1\n")
+	writeFile(t, filepath.Join(src.Wallpapers, "stars.png"), "png")
+	err := os.Symlink(filepath.Join(src.Wallpapers, "stars.png"), filepath.Join(src.Sd, "menu.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exported, err := src.Export(AllParts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	profile := roundTrip(t, exported)
+
+	var files []string
+	for _, file := range profile.Manifest.Files {
+		files = append(files, file.Part+"/"+file.Name)
+	}
+	wantFiles := []string{
+		"inis/MiSTer.ini",
+		"inis/MiSTer_alt_1.ini",
+		"apps/remote.ini",
+		"nfc/nfc.csv",
+		"uboot/u-boot.txt",
+		"wallpaper/stars.png",
+	}
+	if !reflect.DeepEqual(files, wantFiles) {
+		t.Fatalf("got files %v want %v", files, wantFiles)
+	}
+	if got := string(profile.Files["uboot/u-boot.txt"]); got != "v=loglevel=4 usbhid.jspoll=1\n" {
+		t.Errorf("got exported u-boot.txt %q", got)
+	}
+
+	dst := testLayout(t)
+	writeFile(t, filepath.Join(dst.Sd, "MiSTer.ini"), "[MiSTer]\nvsync_adjust=2\n")
+	writeFile(t, filepath.Join(dst.Scripts, "remote.ini"), "[remote]\n")
+	writeFile(t, dst.UBoot, "ethaddr=0A:0B:0C:0D:0E:0F\nv=usbhid.quirks=0x1:0x2:0x4\n")
+
+	changes, err := dst.Preview(profile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	statuses := make(map[string]string)
+	for _, change := range changes {
+		statuses[change.Part+"/"+change.Name] = change.Status
+	}
+	wantStatuses := map[string]string{
+		"inis/MiSTer.ini":       StatusUnchanged,
+		"inis/MiSTer_alt_1.ini": StatusNew,
+		"apps/remote.ini":       StatusChanged,
+		"nfc/nfc.csv":           StatusNew,
+		"uboot/u-boot.txt":      StatusChanged,
+		"wallpaper/stars.png":   StatusNew,
+	}
+	if !reflect.DeepEqual(statuses, wantStatuses) {
+		t.Errorf("got statuses %v want %v", statuses, wantStatuses)
+	}
+
+	_, err = dst.Import(profile, []string{PartInis, PartUBoot, PartWallpaper}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := readFile(t, filepath.Join(dst.Sd, "MiSTer_alt_1.ini")); got != "[MiSTer]\nvideo_mode=8\n" {
+		t.Errorf("got alt ini %q", got)
+	}
+	if got := readFile(t, filepath.Join(dst.Scripts, "remote.ini")); got != "[remote]\n" {
+		t.Errorf("unselected part was imported: %q", got)
+	}
+	if _, err := os.Stat(dst.NfcDatabase); err == nil {
+		t.Error("unselected nfc database was imported")
+	}
+
+	wantUBoot := "ethaddr=0A:0B:0C:0D:0E:0F\nv=loglevel=4 usbhid.jspoll=1 usbhid.quirks=0x1:0x2:0x4\n"
+	if got := readFile(t, dst.UBoot); got != wantUBoot {
+		t.Errorf("got u-boot.txt %q want %q", got, wantUBoot)
+	}
+
+	if got := dst.activeWallpaper(); got != "stars.png" {
+		t.Errorf("got active wallpaper %q", got)
+	}
+
+	versions, _ := dst.History.Versions(filepath.Join(dst.Sd, "MiSTer_alt_1.ini"))
+	if len(versions) != 1 || versions[0].Author != "test" {
+		t.Errorf("import wasn't kept in history: %+v", versions)
+	}
+
+	changes, err = dst.Preview(profile, []string{PartInis, PartUBoot, PartWallpaper})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, change := range changes {
+		if change.Status != StatusUnchanged {
+			t.Errorf("%s/%s: got %s after import", change.Part, change.Name, change.Status)
+		}
+	}
+}
+
+func TestImportTrustedPeersAndNfc(t *testing.T) {
+	src := testLayout(t)
+	writeFile(t, filepath.Join(src.Scripts, "remote.ini"), "[remote]\ntrust_peer = 10.0.0.9\nmdns_service=no\n")
+	writeFile(t, filepath.Join(src.Scripts, "remote.sh"), "")
+	writeFile(t, src.NfcDatabase, "match_uid,text\nabcd,**random:snes\n")
+
+	exported, err := src.Export([]string{PartApps, PartNfc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	profile := roundTrip(t, exported)
+
+	tests := map[string]struct {
+		existing string
+		want     string
+	}{
+		"kept":       {"[remote]\ntrust_peer = 192.168.1.5\n", "[remote]\ntrust_peer = 192.168.1.5\nmdns_service=no\n"},
+		"none":       {"", "[remote]\nmdns_service=no\n"},
+		"no section": {"trust_peer = 192.168.1.5\n", "[remote]\ntrust_peer = 192.168.1.5\nmdns_service=no\n"},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			dst := testLayout(t)
+			if tt.existing != "" {
+				writeFile(t, filepath.Join(dst.Scripts, "remote.ini"), tt.existing)
+			}
+			writeFile(t, dst.NfcDatabase, "match_uid,text\n1234,**random:genesis\n")
+
+			_, err := dst.Import(profile, nil, "test")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := readFile(t, filepath.Join(dst.Scripts, "remote.ini")); got != tt.want {
+				t.Errorf("got remote.ini %q want %q", got, tt.want)
+			}
+
+			versions, _ := dst.History.Versions(dst.NfcDatabase)
+			if len(versions) != 2 || versions[0].Author != "test" || versions[1].Author != mister.HistoryAuthorExternal {
+				t.Fatalf("nfc database wasn't kept in history: %+v", versions)
+			}
+			_, data, err := dst.History.Read(dst.NfcDatabase, versions[1].ID)
+			if err != nil || string(data) != "match_uid,text\n1234,**random:genesis\n" {
+				t.Errorf("got previous nfc database %q %v", data, err)
+			}
+		})
+	}
+}
+
+func TestReadInvalid(t *testing.T) {
+	build := func(manifest string, files map[string]string) []byte {
+		var buf bytes.Buffer
+		zw := zip.NewWriter(&buf)
+		if manifest != "" {
+			f, _ := zw.Create(manifestFilename)
+			_, _ = f.Write([]byte(manifest))
+		}
+		for name, data := range files {
+			f, _ := zw.Create(name)
+			_, _ = f.Write([]byte(data))
+		}
+		_ = zw.Close()
+		return buf.Bytes()
+	}
+
+	tests := []struct {
+		name     string
+		manifest string
+		files    map[string]string
+	}{
+		{"not a zip", "", nil},
+		{"no manifest", "", map[string]string{"inis/MiSTer.ini": ""}},
+		{"bad version", `{"version":99}`, nil},
+		{"traversal", `{"version":1,"files":[{"part":"inis","name":"../MiSTer.ini"}]}`, nil},
+		{"wrong part", `{"version":1,"files":[{"part":"inis","name":"remote.ini"}]}`, map[string]string{"inis/remote.ini": ""}},
+		{"unknown app", `{"version":1,"files":[{"part":"apps","name":"downloader.ini"}]}`, map[string]string{"apps/downloader.ini": ""}},
+		{"missing file", `{"version":1,"files":[{"part":"inis","name":"MiSTer.ini"}]}`, nil},
+		{"bad hash", `{"version":1,"files":[{"part":"inis","name":"MiSTer.ini","hash":"x"}]}`, map[string]string{"inis/MiSTer.ini": ""}},
+	}
+
+	for _, tt := range tests {
+		data := build(tt.manifest, tt.files)
+		if tt.name == "not a zip" {
+			data = []byte("nope")
+		}
+
+		_, err := Read(bytes.NewReader(data), int64(len(data)))
+		if !errors.Is(err, ErrInvalidProfile) {
+			t.Errorf("%s: got %v want invalid profile", tt.name, err)
+		}
+	}
+}
+
+func TestParseParts(t *testing.T) {
+	parts, err := ParseParts("inis, uboot,")
+	if err != nil || !reflect.DeepEqual(parts, []string{PartInis, PartUBoot}) {
+		t.Errorf("got %v, %v", parts, err)
+	}
+
+	if _, err := ParseParts("inis,saves"); err == nil {
+		t.Error("got no error for unknown part")
+	}
+}
@@ -0,0 +1,71 @@
+package profiles
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// PeerPort is the port Remote listens on.
+const PeerPort = 8182
+
+const pushTimeout = 30 * time.Second
+
+// ImportResult is the response of a Remote import or preview.
+type ImportResult struct {
+	Manifest Manifest     `json:"manifest"`
+	Changes  []FileChange `json:"changes"`
+}
+
+// Push sends a profile to Remote running on another MiSTer, which imports
+// the given parts. An empty list of parts imports every part in the profile.
+func Push(p *Profile, host string, parts []string) (ImportResult, error) {
+	u := url.URL{
+		Scheme:   "http",
+		Host:     fmt.Sprintf("%s:%d", host, PeerPort),
+		Path:     "/api/settings/profiles/import",
+		RawQuery: url.Values{"parts": {strings.Join(parts, ",")}}.Encode(),
+	}
+	return Send(p, u.String(), nil)
+}
+
+// Send posts a profile to a URL which imports it and responds with an
+// ImportResult. Extra headers can be added to the request.
+func Send(p *Profile, url string, header http.Header) (ImportResult, error) {
+	var result ImportResult
+
+	var buf bytes.Buffer
+	err := p.Write(&buf)
+	if err != nil {
+		return result, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, url, &buf)
+	if err != nil {
+		return result, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", "application/zip")
+
+	client := &http.Client{Timeout: pushTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return result, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return result, fmt.Errorf("peer returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	return result, err
+}
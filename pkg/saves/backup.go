@@ -0,0 +1,180 @@
+package saves
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Backups of a save are kept in a folder named after the save, which
+// mirrors its location in the saves folder, e.g. backups of
+// saves/SNES/Zelda.sav are in saves_backup/saves/SNES/Zelda.sav/. Each
+// backup is named with the time it was made.
+
+const backupTimeFormat = "20060102-150405"
+
+var ErrBackupNotFound = errors.New("backup not found")
+
+type Backup struct {
+	// ID is the filename of the backup, used to restore it.
+	ID   string    `json:"id"`
+	Path string    `json:"path"`
+	Time time.Time `json:"time"`
+	Size int64     `json:"size"`
+}
+
+// backupFolder returns the folder backups of a save are stored in.
+func (l Layout) backupFolder(path string) (string, error) {
+	path, kind, err := l.Resolve(path)
+	if err != nil {
+		return "", err
+	}
+
+	root := l.roots()[kind]
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(l.Backups, filepath.Base(root), rel), nil
+}
+
+func copyFile(from string, to string) error {
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.Create(to)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(dst, src)
+	if err != nil {
+		_ = dst.Close()
+		return err
+	}
+
+	return dst.Close()
+}
+
+// Backup copies the current version of a save to its backup folder,
+// returning the new backup.
+func (l Layout) Backup(path string) (Backup, error) {
+	folder, err := l.backupFolder(path)
+	if err != nil {
+		return Backup{}, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return Backup{}, err
+	}
+
+	err = os.MkdirAll(folder, 0755)
+	if err != nil {
+		return Backup{}, err
+	}
+
+	now := time.Now()
+	ext := filepath.Ext(path)
+	id := now.Format(backupTimeFormat) + ext
+	// more than one backup in the same second
+	for n := 2; ; n++ {
+		if _, err := os.Stat(filepath.Join(folder, id)); errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+		id = fmt.Sprintf("%s_%d%s", now.Format(backupTimeFormat), n, ext)
+	}
+
+	backupPath := filepath.Join(folder, id)
+	err = copyFile(path, backupPath)
+	if err != nil {
+		return Backup{}, err
+	}
+
+	return Backup{ID: id, Path: backupPath, Time: now, Size: info.Size()}, nil
+}
+
+// ListBackups returns all backups of a save, newest first.
+func (l Layout) ListBackups(path string) ([]Backup, error) {
+	folder, err := l.backupFolder(path)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(folder)
+	if errors.Is(err, fs.ErrNotExist) {
+		return []Backup{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	backups := make([]Backup, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		stamp := strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name()))
+		if i := strings.Index(stamp, "_"); i != -1 {
+			stamp = stamp[:i]
+		}
+		t, err := time.ParseInLocation(backupTimeFormat, stamp, time.Local)
+		if err != nil {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+
+		backups = append(backups, Backup{
+			ID:   entry.Name(),
+			Path: filepath.Join(folder, entry.Name()),
+			Time: t,
+			Size: info.Size(),
+		})
+	}
+
+	sort.SliceStable(backups, func(i, j int) bool {
+		if backups[i].Time.Equal(backups[j].Time) {
+			return backups[i].ID > backups[j].ID
+		}
+		return backups[i].Time.After(backups[j].Time)
+	})
+
+	return backups, nil
+}
+
+// RestoreBackup replaces a save with one of its backups. The current save
+// is backed up first, so a restore can also be undone.
+func (l Layout) RestoreBackup(path string, id string) error {
+	folder, err := l.backupFolder(path)
+	if err != nil {
+		return err
+	}
+
+	if id == "" || filepath.Base(id) != id {
+		return fmt.Errorf("%w: %s", ErrBackupNotFound, id)
+	}
+
+	f, err := os.Open(filepath.Join(folder, id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%w: %s", ErrBackupNotFound, id)
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return l.Write(path, f)
+}
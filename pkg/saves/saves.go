@@ -0,0 +1,295 @@
+// Package saves finds the save files and savestates belonging to games, and
+// keeps versioned backups of them whenever they're replaced or deleted.
+//
+// MiSTer cores store saves in a folder named after the core, using the
+// filename of the game with a different extension, e.g. the save for
+// games/SNES/Zelda.sfc is saves/SNES/Zelda.sav. Savestates are stored the
+// same way in the savestates folder, with a slot number appended to the
+// name, e.g. savestates/SNES/Zelda_1.ss.
+package saves
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/wizzomafizzo/mrext/pkg/config"
+	"github.com/wizzomafizzo/mrext/pkg/games"
+)
+
+const (
+	KindSave      = "save"
+	KindSavestate = "savestate"
+)
+
+var ErrOutsideSaves = errors.New("path is not in a saves folder")
+
+// Layout is where saves and their backups are stored.
+type Layout struct {
+	Saves      string
+	Savestates string
+	Backups    string
+}
+
+// Default is the standard MiSTer layout on the SD card.
+var Default = Layout{
+	Saves:      config.SavesFolder,
+	Savestates: config.SavestatesFolder,
+	Backups:    config.SaveBackupsFolder,
+}
+
+type File struct {
+	Path     string `json:"path"`
+	Filename string `json:"filename"`
+	Kind     string `json:"kind"`
+	SystemId string `json:"systemId"`
+	// Game is the name of the game the file belongs to, which is the
+	// game's filename without an extension.
+	Game     string    `json:"game"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+// GameName returns the name a core uses for the saves of a game file.
+func GameName(gamePath string) string {
+	base := filepath.Base(gamePath)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+// fileGame returns the name of the game a save file belongs to. Savestates
+// have a slot number after the name, which is removed.
+func fileGame(kind string, filename string) string {
+	name := strings.TrimSuffix(filename, filepath.Ext(filename))
+	if kind != KindSavestate {
+		return name
+	}
+
+	i := strings.LastIndex(name, "_")
+	if i == -1 {
+		return name
+	}
+
+	for _, c := range name[i+1:] {
+		if c < '0' || c > '9' {
+			return name
+		}
+	}
+
+	return name[:i]
+}
+
+// SystemFolders returns the folders in root which a system's core saves to.
+// The folder names are matched case-insensitively against the system's
+// games folders and ID.
+func SystemFolders(root string, system games.System) []string {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return nil
+	}
+
+	names := append([]string{system.Id}, system.Folder...)
+
+	folders := make([]string, 0)
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		for _, name := range names {
+			if strings.EqualFold(entry.Name(), name) {
+				folders = append(folders, filepath.Join(root, entry.Name()))
+				break
+			}
+		}
+	}
+
+	return folders
+}
+
+func (l Layout) roots() map[string]string {
+	return map[string]string{
+		KindSave:      l.Saves,
+		KindSavestate: l.Savestates,
+	}
+}
+
+// Folders returns the folder new saves and savestates for a system should
+// be stored in, using the existing folders if there are any.
+func (l Layout) Folders(system games.System) map[string]string {
+	folders := make(map[string]string)
+	for kind, root := range l.roots() {
+		existing := SystemFolders(root, system)
+		if len(existing) > 0 {
+			folders[kind] = existing[0]
+		} else if len(system.Folder) > 0 {
+			folders[kind] = filepath.Join(root, system.Folder[0])
+		} else {
+			folders[kind] = filepath.Join(root, system.Id)
+		}
+	}
+	return folders
+}
+
+func (l Layout) list(system games.System, match func(game string) bool) ([]File, error) {
+	files := make([]File, 0)
+
+	for kind, root := range l.roots() {
+		for _, folder := range SystemFolders(root, system) {
+			entries, err := os.ReadDir(folder)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, entry := range entries {
+				if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+					continue
+				}
+
+				game := fileGame(kind, entry.Name())
+				if !match(game) {
+					continue
+				}
+
+				info, err := entry.Info()
+				if err != nil {
+					continue
+				}
+
+				files = append(files, File{
+					Path:     filepath.Join(folder, entry.Name()),
+					Filename: entry.Name(),
+					Kind:     kind,
+					SystemId: system.Id,
+					Game:     game,
+					Size:     info.Size(),
+					Modified: info.ModTime(),
+				})
+			}
+		}
+	}
+
+	sort.SliceStable(files, func(i, j int) bool {
+		if files[i].Kind != files[j].Kind {
+			return files[i].Kind == KindSave
+		}
+		return files[i].Path < files[j].Path
+	})
+
+	return files, nil
+}
+
+// ListGame returns all saves and savestates for a game, saves first.
+func (l Layout) ListGame(system games.System, gamePath string) ([]File, error) {
+	name := GameName(gamePath)
+	return l.list(system, func(game string) bool {
+		return game == name
+	})
+}
+
+// ListSystem returns every save and savestate for a system.
+func (l Layout) ListSystem(system games.System) ([]File, error) {
+	return l.list(system, func(string) bool {
+		return true
+	})
+}
+
+// CountByGame returns the number of saves and savestates for each game of a
+// system, by game name.
+func (l Layout) CountByGame(system games.System) map[string]int {
+	counts := make(map[string]int)
+	files, err := l.ListSystem(system)
+	if err != nil {
+		return counts
+	}
+	for _, file := range files {
+		counts[file.Game]++
+	}
+	return counts
+}
+
+// Resolve cleans a path and checks it's a file inside a system folder of
+// the saves or savestates folders, returning its kind.
+func (l Layout) Resolve(path string) (string, string, error) {
+	if !filepath.IsAbs(path) {
+		return "", "", ErrOutsideSaves
+	}
+	path = filepath.Clean(path)
+
+	for kind, root := range l.roots() {
+		rel, err := filepath.Rel(root, path)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			continue
+		}
+
+		// must be exactly <root>/<core>/<file>
+		if strings.Count(rel, string(filepath.Separator)) != 1 {
+			return "", "", fmt.Errorf("%w: %s", ErrOutsideSaves, path)
+		}
+
+		return path, kind, nil
+	}
+
+	return "", "", fmt.Errorf("%w: %s", ErrOutsideSaves, path)
+}
+
+// Write replaces a save file with new data, backing up the old file first.
+// The new file is written next to the old one and renamed into place, so a
+// failed upload doesn't leave a broken save behind.
+func (l Layout) Write(path string, r io.Reader) error {
+	path, _, err := l.Resolve(path)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		_, err := l.Backup(path)
+		if err != nil {
+			return fmt.Errorf("error backing up save: %w", err)
+		}
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, r)
+	if err != nil {
+		_ = f.Close()
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// Delete removes a save file, backing it up first.
+func (l Layout) Delete(path string) error {
+	path, _, err := l.Resolve(path)
+	if err != nil {
+		return err
+	}
+
+	_, err = l.Backup(path)
+	if err != nil {
+		return fmt.Errorf("error backing up save: %w", err)
+	}
+
+	return os.Remove(path)
+}
@@ -0,0 +1,195 @@
+package saves
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/wizzomafizzo/mrext/pkg/games"
+)
+
+func testLayout(t *testing.T) Layout {
+	t.Helper()
+	sd := t.TempDir()
+	return Layout{
+		Saves:      filepath.Join(sd, "saves"),
+		Savestates: filepath.Join(sd, "savestates"),
+		Backups:    filepath.Join(sd, "saves_backup"),
+	}
+}
+
+func writeFile(t *testing.T, path string, data string) {
+	t.Helper()
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err == nil {
+		err = os.WriteFile(path, []byte(data), 0644)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestFileGame(t *testing.T) {
+	tests := []struct {
+		kind     string
+		filename string
+		want     string
+	}{
+		{KindSave, "Zelda (USA).sav", "Zelda (USA)"},
+		{KindSave, "Mega_Man_2.sav", "Mega_Man_2"},
+		{KindSavestate, "Zelda (USA)_1.ss", "Zelda (USA)"},
+		{KindSavestate, "Mega_Man_2_3.ss", "Mega_Man_2"},
+		{KindSavestate, "Zelda_Hack.ss", "Zelda_Hack"},
+	}
+
+	for _, tt := range tests {
+		if got := fileGame(tt.kind, tt.filename); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.filename, got, tt.want)
+		}
+	}
+}
+
+func TestListGame(t *testing.T) {
+	l := testLayout(t)
+	snes := games.Systems["SNES"]
+
+	writeFile(t, filepath.Join(l.Saves, "SNES", "Zelda (USA).sav"), "save")
+	writeFile(t, filepath.Join(l.Saves, "SNES", "Mario (USA).sav"), "mario")
+	writeFile(t, filepath.Join(l.Savestates, "snes", "Zelda (USA)_1.ss"), "state1")
+	writeFile(t, filepath.Join(l.Savestates, "snes", "Zelda (USA)_2.ss"), "state2")
+	writeFile(t, filepath.Join(l.Saves, "NES", "Zelda (USA).sav"), "nes")
+
+	files, err := l.ListGame(snes, "/media/fat/games/SNES/Zelda (USA).sfc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make([]string, 0)
+	for _, file := range files {
+		got = append(got, file.Kind+":"+file.Filename)
+		if file.SystemId != "SNES" || file.Game != "Zelda (USA)" {
+			t.Errorf("got file %+v", file)
+		}
+	}
+	want := "save:Zelda (USA).sav,savestate:Zelda (USA)_1.ss,savestate:Zelda (USA)_2.ss"
+	if strings.Join(got, ",") != want {
+		t.Errorf("got %v, want %s", got, want)
+	}
+
+	counts := l.CountByGame(snes)
+	if counts["Zelda (USA)"] != 3 || counts["Mario (USA)"] != 1 {
+		t.Errorf("got counts %v", counts)
+	}
+
+	folders := l.Folders(snes)
+	if folders[KindSavestate] != filepath.Join(l.Savestates, "snes") {
+		t.Errorf("got folders %v", folders)
+	}
+	if folders := l.Folders(games.Systems["Genesis"]); folders[KindSave] != filepath.Join(l.Saves, "MegaDrive") {
+		t.Errorf("got folders %v", folders)
+	}
+}
+
+func TestResolve(t *testing.T) {
+	l := testLayout(t)
+
+	_, kind, err := l.Resolve(filepath.Join(l.Savestates, "SNES", "Zelda_1.ss"))
+	if err != nil || kind != KindSavestate {
+		t.Errorf("got %s, %v", kind, err)
+	}
+
+	for _, path := range []string{
+		"SNES/Zelda.sav",
+		filepath.Join(l.Saves, "Zelda.sav"),
+		filepath.Join(l.Saves, "SNES", "..", "..", "Zelda.sav"),
+		filepath.Join(l.Saves, "SNES", "sub", "Zelda.sav"),
+		filepath.Join(l.Backups, "saves", "SNES", "Zelda.sav"),
+	} {
+		_, _, err := l.Resolve(path)
+		if !errors.Is(err, ErrOutsideSaves) {
+			t.Errorf("%s: got %v, want outside saves error", path, err)
+		}
+	}
+}
+
+func TestWriteBackupRestore(t *testing.T) {
+	l := testLayout(t)
+	path := filepath.Join(l.Saves, "SNES", "Zelda.sav")
+
+	// new save, nothing to back up
+	err := l.Write(path, strings.NewReader("v1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backups, err := l.ListBackups(path)
+	if err != nil || len(backups) != 0 {
+		t.Fatalf("got backups %v, %v", backups, err)
+	}
+
+	err = l.Write(path, strings.NewReader("v2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = l.Write(path, strings.NewReader("v3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := readFile(t, path); got != "v3" {
+		t.Errorf("got %q", got)
+	}
+
+	backups, err = l.ListBackups(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 2 {
+		t.Fatalf("got %d backups", len(backups))
+	}
+	if got := readFile(t, backups[0].Path); got != "v2" {
+		t.Errorf("newest backup is %q", got)
+	}
+	if !strings.HasPrefix(backups[0].Path, filepath.Join(l.Backups, "saves", "SNES", "Zelda.sav")) {
+		t.Errorf("backup stored at %s", backups[0].Path)
+	}
+
+	err = l.RestoreBackup(path, backups[1].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, path); got != "v1" {
+		t.Errorf("restored %q", got)
+	}
+
+	for _, id := range []string{"", "missing.sav", "../../SNES/Zelda.sav"} {
+		err = l.RestoreBackup(path, id)
+		if !errors.Is(err, ErrBackupNotFound) {
+			t.Errorf("%q: got %v, want not found", id, err)
+		}
+	}
+
+	err = l.Delete(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); err == nil {
+		t.Error("save wasn't deleted")
+	}
+
+	backups, _ = l.ListBackups(path)
+	if len(backups) != 4 || readFile(t, backups[0].Path) != "v1" {
+		t.Errorf("got backups %+v", backups)
+	}
+}
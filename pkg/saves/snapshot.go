@@ -0,0 +1,343 @@
+package saves
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/wizzomafizzo/mrext/pkg/games"
+	"github.com/wizzomafizzo/mrext/pkg/tracker"
+)
+
+// Snapshots are copies of all the saves of a game at one point in time,
+// taken when a game is stopped. They're kept separately from backups, in
+// saves_backup/snapshots/<system>/<game>/<id>/, with a manifest listing where
+// each file came from.
+
+const (
+	snapshotsFolder  = "snapshots"
+	snapshotManifest = "snapshot.json"
+)
+
+var ErrSnapshotNotFound = errors.New("snapshot not found")
+
+type SnapshotFile struct {
+	// Path is where the file was copied from, and is restored to.
+	Path     string `json:"path"`
+	Filename string `json:"filename"`
+	Kind     string `json:"kind"`
+	Size     int64  `json:"size"`
+	Hash     string `json:"hash"`
+}
+
+type Snapshot struct {
+	ID       string    `json:"id"`
+	SystemId string    `json:"systemId"`
+	Game     string    `json:"game"`
+	Time     time.Time `json:"time"`
+	// Hash is of the contents of every file in the snapshot, used to skip
+	// taking a snapshot when nothing has changed.
+	Hash  string         `json:"hash"`
+	Files []SnapshotFile `json:"files"`
+}
+
+type SnapshotOptions struct {
+	// Keep is the number of snapshots kept for each game, oldest are
+	// deleted first. Zero keeps every snapshot.
+	Keep             int
+	IgnoreSavestates bool
+}
+
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && filepath.Base(name) == name
+}
+
+// snapshotFolder returns the folder snapshots of a game are stored in.
+func (l Layout) snapshotFolder(systemId string, game string) (string, error) {
+	if !validName(systemId) || !validName(game) {
+		return "", fmt.Errorf("%w: %s/%s", ErrSnapshotNotFound, systemId, game)
+	}
+	return filepath.Join(l.Backups, snapshotsFolder, systemId, game), nil
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha1.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// snapshotHash combines the hashes of every file in a snapshot. Files must
+// be in a stable order.
+func snapshotHash(files []SnapshotFile) string {
+	h := sha1.New()
+	for _, file := range files {
+		_, _ = fmt.Fprintf(h, "%s/%s:%s\n", file.Kind, file.Filename, file.Hash)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func readSnapshot(folder string) (Snapshot, error) {
+	var snapshot Snapshot
+
+	data, err := os.ReadFile(filepath.Join(folder, snapshotManifest))
+	if err != nil {
+		return snapshot, err
+	}
+
+	err = json.Unmarshal(data, &snapshot)
+	if err != nil {
+		return snapshot, err
+	}
+
+	snapshot.ID = filepath.Base(folder)
+	return snapshot, nil
+}
+
+// ListSnapshots returns all snapshots of a game, newest first. The game is
+// its name, as returned by GameName.
+func (l Layout) ListSnapshots(systemId string, game string) ([]Snapshot, error) {
+	folder, err := l.snapshotFolder(systemId, game)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(folder)
+	if errors.Is(err, fs.ErrNotExist) {
+		return []Snapshot{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	snapshots := make([]Snapshot, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		snapshot, err := readSnapshot(filepath.Join(folder, entry.Name()))
+		if err != nil {
+			continue
+		}
+
+		snapshots = append(snapshots, snapshot)
+	}
+
+	sort.SliceStable(snapshots, func(i, j int) bool {
+		if snapshots[i].Time.Equal(snapshots[j].Time) {
+			return snapshots[i].ID > snapshots[j].ID
+		}
+		return snapshots[i].Time.After(snapshots[j].Time)
+	})
+
+	return snapshots, nil
+}
+
+// TakeSnapshot copies the current saves of a game to a new snapshot. If the
+// game has no saves, or they're the same as the latest snapshot, no snapshot
+// is taken and nil is returned. Old snapshots past the retention limit are
+// deleted afterwards.
+func (l Layout) TakeSnapshot(system games.System, gamePath string, opts SnapshotOptions) (*Snapshot, error) {
+	game := GameName(gamePath)
+	folder, err := l.snapshotFolder(system.Id, game)
+	if err != nil {
+		return nil, err
+	}
+
+	saves, err := l.ListGame(system, gamePath)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]SnapshotFile, 0, len(saves))
+	for _, save := range saves {
+		if opts.IgnoreSavestates && save.Kind == KindSavestate {
+			continue
+		}
+
+		hash, err := hashFile(save.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		files = append(files, SnapshotFile{
+			Path:     save.Path,
+			Filename: save.Filename,
+			Kind:     save.Kind,
+			Size:     save.Size,
+			Hash:     hash,
+		})
+	}
+
+	if len(files) == 0 {
+		return nil, nil
+	}
+
+	hash := snapshotHash(files)
+
+	existing, err := l.ListSnapshots(system.Id, game)
+	if err != nil {
+		return nil, err
+	}
+	if len(existing) > 0 && existing[0].Hash == hash {
+		return nil, nil
+	}
+
+	now := time.Now()
+	id := now.Format(backupTimeFormat)
+	// more than one snapshot in the same second
+	for n := 2; ; n++ {
+		if _, err := os.Stat(filepath.Join(folder, id)); errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+		id = fmt.Sprintf("%s_%d", now.Format(backupTimeFormat), n)
+	}
+
+	snapshot := Snapshot{
+		ID:       id,
+		SystemId: system.Id,
+		Game:     game,
+		Time:     now,
+		Hash:     hash,
+		Files:    files,
+	}
+
+	err = writeSnapshot(filepath.Join(folder, id), snapshot)
+	if err != nil {
+		_ = os.RemoveAll(filepath.Join(folder, id))
+		return nil, err
+	}
+
+	err = l.pruneSnapshots(system.Id, game, opts.Keep)
+	if err != nil {
+		return &snapshot, fmt.Errorf("error deleting old snapshots: %w", err)
+	}
+
+	return &snapshot, nil
+}
+
+// writeSnapshot copies the files of a snapshot into its folder, sorted by
+// kind, followed by the manifest.
+func writeSnapshot(folder string, snapshot Snapshot) error {
+	for _, file := range snapshot.Files {
+		err := os.MkdirAll(filepath.Join(folder, file.Kind), 0755)
+		if err != nil {
+			return err
+		}
+
+		err = copyFile(file.Path, filepath.Join(folder, file.Kind, file.Filename))
+		if err != nil {
+			return err
+		}
+	}
+
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(folder, snapshotManifest), data, 0644)
+}
+
+func (l Layout) pruneSnapshots(systemId string, game string, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+
+	snapshots, err := l.ListSnapshots(systemId, game)
+	if err != nil {
+		return err
+	}
+
+	folder, err := l.snapshotFolder(systemId, game)
+	if err != nil {
+		return err
+	}
+
+	for i := keep; i < len(snapshots); i++ {
+		err := os.RemoveAll(filepath.Join(folder, snapshots[i].ID))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RestoreSnapshot copies every file in a snapshot back to where it was taken
+// from. Each save being replaced is backed up first. Saves which didn't
+// exist when the snapshot was taken are left alone.
+func (l Layout) RestoreSnapshot(systemId string, game string, id string) error {
+	folder, err := l.snapshotFolder(systemId, game)
+	if err != nil {
+		return err
+	}
+
+	if !validName(id) {
+		return fmt.Errorf("%w: %s", ErrSnapshotNotFound, id)
+	}
+
+	snapshot, err := readSnapshot(filepath.Join(folder, id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%w: %s", ErrSnapshotNotFound, id)
+	} else if err != nil {
+		return err
+	}
+
+	for _, file := range snapshot.Files {
+		err := func() error {
+			f, err := os.Open(filepath.Join(folder, id, file.Kind, filepath.Base(file.Filename)))
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			return l.Write(file.Path, f)
+		}()
+		if err != nil {
+			return fmt.Errorf("error restoring %s: %w", file.Filename, err)
+		}
+	}
+
+	return nil
+}
+
+// SnapshotEvent takes a snapshot of the game stopped in a tracker event.
+// Other events are ignored, as are games the tracker couldn't match to a
+// system, such as arcade games which are tracked by core name.
+func (l Layout) SnapshotEvent(ev tracker.EventAction, opts SnapshotOptions) (*Snapshot, error) {
+	if ev.Action != tracker.EventActionGameStop || ev.TargetPath == "" {
+		return nil, nil
+	}
+
+	// game IDs are <system>/<filename>
+	i := strings.Index(ev.Target, "/")
+	if i < 1 {
+		return nil, nil
+	}
+
+	system, err := games.GetSystem(ev.Target[:i])
+	if err != nil {
+		return nil, nil
+	}
+
+	return l.TakeSnapshot(*system, ev.TargetPath, opts)
+}
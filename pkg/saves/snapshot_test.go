@@ -0,0 +1,132 @@
+package saves
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/wizzomafizzo/mrext/pkg/tracker"
+)
+
+func gameStopEvent(id string, path string) tracker.EventAction {
+	return tracker.EventAction{
+		Action:     tracker.EventActionGameStop,
+		Target:     id,
+		TargetPath: path,
+	}
+}
+
+func TestSnapshotEvent(t *testing.T) {
+	l := testLayout(t)
+	gamePath := "/media/fat/games/SNES/Zelda (USA).sfc"
+	ev := gameStopEvent("SNES/Zelda (USA).sfc", gamePath)
+	opts := SnapshotOptions{Keep: 2}
+
+	save := filepath.Join(l.Saves, "SNES", "Zelda (USA).sav")
+	state := filepath.Join(l.Savestates, "SNES", "Zelda (USA)_1.ss")
+	writeFile(t, save, "v1")
+	writeFile(t, state, "state1")
+
+	for _, ignored := range []tracker.EventAction{
+		{Action: tracker.EventActionGameStart, Target: ev.Target, TargetPath: gamePath},
+		{Action: tracker.EventActionCoreStop, Target: "SNES"},
+		gameStopEvent(tracker.ArcadeSystem, ""),
+		gameStopEvent("/Zelda (USA).sfc", gamePath),
+		gameStopEvent("SNES/Mario (USA).sfc", "/media/fat/games/SNES/Mario (USA).sfc"),
+	} {
+		snapshot, err := l.SnapshotEvent(ignored, opts)
+		if snapshot != nil || err != nil {
+			t.Errorf("%+v: got snapshot %v, %v", ignored, snapshot, err)
+		}
+	}
+
+	first, err := l.SnapshotEvent(ev, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == nil || len(first.Files) != 2 || first.SystemId != "SNES" || first.Game != "Zelda (USA)" {
+		t.Fatalf("got snapshot %+v", first)
+	}
+
+	// nothing changed
+	snapshot, err := l.SnapshotEvent(ev, opts)
+	if snapshot != nil || err != nil {
+		t.Errorf("got duplicate snapshot %v, %v", snapshot, err)
+	}
+
+	writeFile(t, save, "v2")
+	if snapshot, err := l.SnapshotEvent(ev, opts); snapshot == nil || err != nil {
+		t.Fatalf("got snapshot %v, %v", snapshot, err)
+	}
+
+	writeFile(t, save, "v3")
+	if snapshot, err := l.SnapshotEvent(ev, opts); snapshot == nil || err != nil {
+		t.Fatalf("got snapshot %v, %v", snapshot, err)
+	}
+
+	snapshots, err := l.ListSnapshots("SNES", "Zelda (USA)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 2 {
+		t.Fatalf("got %d snapshots, want 2", len(snapshots))
+	}
+	for _, snapshot := range snapshots {
+		if snapshot.ID == first.ID {
+			t.Error("oldest snapshot wasn't deleted")
+		}
+	}
+
+	// restore v2 over a damaged save
+	writeFile(t, save, "broken")
+	writeFile(t, state, "broken")
+	err = l.RestoreSnapshot("SNES", "Zelda (USA)", snapshots[1].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, save); got != "v2" {
+		t.Errorf("restored save %q", got)
+	}
+	if got := readFile(t, state); got != "state1" {
+		t.Errorf("restored savestate %q", got)
+	}
+
+	backups, _ := l.ListBackups(save)
+	if len(backups) != 1 || readFile(t, backups[0].Path) != "broken" {
+		t.Errorf("damaged save wasn't backed up: %+v", backups)
+	}
+
+	for _, id := range []string{"", "missing", "../" + snapshots[0].ID} {
+		err := l.RestoreSnapshot("SNES", "Zelda (USA)", id)
+		if !errors.Is(err, ErrSnapshotNotFound) {
+			t.Errorf("%q: got %v, want not found", id, err)
+		}
+	}
+}
+
+func TestSnapshotIgnoreSavestates(t *testing.T) {
+	l := testLayout(t)
+	gamePath := "/media/fat/games/NES/Metroid.nes"
+	opts := SnapshotOptions{IgnoreSavestates: true}
+
+	writeFile(t, filepath.Join(l.Savestates, "NES", "Metroid_1.ss"), "state")
+	snapshot, err := l.SnapshotEvent(gameStopEvent("NES/Metroid.nes", gamePath), opts)
+	if snapshot != nil || err != nil {
+		t.Errorf("got snapshot of savestates %v, %v", snapshot, err)
+	}
+
+	writeFile(t, filepath.Join(l.Saves, "NES", "Metroid.sav"), "save")
+	snapshot, err = l.SnapshotEvent(gameStopEvent("NES/Metroid.nes", gamePath), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot == nil || len(snapshot.Files) != 1 || snapshot.Files[0].Kind != KindSave {
+		t.Fatalf("got snapshot %+v", snapshot)
+	}
+
+	stored := filepath.Join(l.Backups, "snapshots", "NES", "Metroid", snapshot.ID, KindSave, "Metroid.sav")
+	if _, err := os.Stat(stored); err != nil {
+		t.Error(err)
+	}
+}
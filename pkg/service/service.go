@@ -207,56 +207,80 @@ func (s *Service) startService() {
 	}
 }
 
-// Start a new service daemon in the background.
-func (s *Service) Start() error {
-	if s.Running() {
-		return fmt.Errorf("%s service already running", s.Name)
-	}
-
-	// create a copy in binary in tmp so the original can be updated
-	binPath := ""
+// appBinPath returns the path of the running app's original binary, not its
+// temporary copy.
+func appBinPath() (string, error) {
 	appPath := os.Getenv(config.UserAppPathEnv)
 	if appPath != "" {
-		binPath = appPath
-	} else {
-		exePath, err := os.Executable()
-		if err != nil {
-			return fmt.Errorf("error getting absolute binary path: %w", err)
-		}
-		binPath = exePath
+		return appPath, nil
+	}
+
+	exePath, err := os.Executable()
+	if err != nil {
+		return "", fmt.Errorf("error getting absolute binary path: %w", err)
 	}
 
+	return exePath, nil
+}
+
+// serviceCommand creates a copy of an app binary in tmp, so the original can
+// be updated while it's running, and returns a command to run the copy
+// pointed at the original app's config file.
+func serviceCommand(name string, binPath string, args ...string) (*exec.Cmd, error) {
 	binFile, err := os.Open(binPath)
 	if err != nil {
-		return fmt.Errorf("error opening binary: %w", err)
+		return nil, fmt.Errorf("error opening binary: %w", err)
 	}
+	defer binFile.Close()
 
-	tempPath := filepath.Join(config.TempFolder, filepath.Base(binPath))
+	tempPath := filepath.Join(config.TempFolder, name+filepath.Ext(binPath))
 	tempFile, err := os.OpenFile(tempPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0755)
 	if err != nil {
-		return fmt.Errorf("error creating temp binary: %w", err)
+		return nil, fmt.Errorf("error creating temp binary: %w", err)
 	}
 
 	_, err = io.Copy(tempFile, binFile)
+	tempFile.Close()
 	if err != nil {
-		return fmt.Errorf("error copying binary to temp: %w", err)
+		return nil, fmt.Errorf("error copying binary to temp: %w", err)
 	}
 
-	tempFile.Close()
-	binFile.Close()
+	cmd := exec.Command(tempPath, args...)
 
-	cmd := exec.Command(tempPath, "-service", "exec", "&")
-	env := os.Environ()
-	cmd.Env = env
+	// the supervisor runs services of other apps, don't pass on its own paths
+	for _, env := range os.Environ() {
+		if !strings.HasPrefix(env, config.UserConfigEnv+"=") && !strings.HasPrefix(env, config.UserAppPathEnv+"=") {
+			cmd.Env = append(cmd.Env, env)
+		}
+	}
 
 	// point new binary to existing config file
-	configPath := filepath.Join(filepath.Dir(binPath), s.Name+".ini")
+	configPath := filepath.Join(filepath.Dir(binPath), name+".ini")
 
 	if _, err := os.Stat(configPath); err == nil {
 		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", config.UserConfigEnv, configPath))
 	}
 	cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", config.UserAppPathEnv, binPath))
 
+	return cmd, nil
+}
+
+// Start a new service daemon in the background.
+func (s *Service) Start() error {
+	if s.Running() {
+		return fmt.Errorf("%s service already running", s.Name)
+	}
+
+	binPath, err := appBinPath()
+	if err != nil {
+		return err
+	}
+
+	cmd, err := serviceCommand(s.Name, binPath, "-service", "exec", "&")
+	if err != nil {
+		return err
+	}
+
 	err = cmd.Start()
 	if err != nil {
 		return fmt.Errorf("error starting %s service: %w", s.Name, err)
@@ -290,6 +314,15 @@ func (s *Service) Stop() error {
 }
 
 func (s *Service) Restart() error {
+	if _, ok := s.supervised(); ok {
+		// the supervisor starts it again once it's stopped
+		err := os.WriteFile(restartRequestPath(s.Name), nil, 0644)
+		if err != nil {
+			return err
+		}
+		return s.Stop()
+	}
+
 	if s.Running() {
 		err := s.Stop()
 		if err != nil {
@@ -309,6 +342,23 @@ func (s *Service) Restart() error {
 	return nil
 }
 
+// HandleSupervise starts the supervisor and exits if the service command is
+// supervise. Apps call it before their own checks, so an app which can't
+// run on this MiSTer still starts the supervisor for the others on boot.
+func HandleSupervise(logger *Logger, cmd *string) {
+	if *cmd != "supervise" {
+		return
+	}
+
+	err := StartSupervisor()
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	os.Exit(0)
+}
+
 func (s *Service) ServiceHandler(cmd *string) {
 	if *cmd == "exec" {
 		s.startService()
@@ -338,12 +388,22 @@ func (s *Service) ServiceHandler(cmd *string) {
 
 		os.Exit(0)
 	} else if *cmd == "status" {
-		if s.Running() {
+		if status, ok := s.supervised(); ok {
+			fmt.Printf("%s service %s (supervised, restarts: %d, last exit code: %d)\n", s.Name, status.State, status.Restarts, status.LastExitCode)
+			if status.LastCrashLog != "" {
+				fmt.Printf("Last crash log: %s\n", status.LastCrashLog)
+			}
+		} else if s.Running() {
 			fmt.Printf("%s service running\n", s.Name)
 		} else {
 			fmt.Printf("%s service not running\n", s.Name)
 		}
 
+		os.Exit(0)
+	} else if *cmd == "supervise" {
+		HandleSupervise(s.Logger, cmd)
+	} else if *cmd == "supervisor" {
+		supervisorService().startService()
 		os.Exit(0)
 	} else if *cmd != "" {
 		fmt.Printf("Invalid service command: %s", *cmd)
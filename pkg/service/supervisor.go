@@ -0,0 +1,670 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/wizzomafizzo/mrext/pkg/config"
+)
+
+// The supervisor runs the services of mrext apps as its own child processes,
+// so it can restart them if they crash. Services it runs are listed in
+// supervisor.json on the SD card, and its current state is written to a
+// status file in tmp for ServiceHandler and Remote to read.
+//
+// A service which exits cleanly, e.g. with -service stop, isn't restarted.
+// Restart asks the supervisor to start it again straight away.
+
+const (
+	SupervisorName       = "supervisor"
+	defaultMinBackoff    = 1 * time.Second
+	defaultMaxBackoff    = 5 * time.Minute
+	defaultStableAfter   = 1 * time.Minute
+	defaultCrashLogsKeep = 5
+	crashOutputSize      = 32 * 1024
+	crashLogLines        = 50
+	unsupervisedPoll     = 5 * time.Second
+	stopTimeout          = 10 * time.Second
+	startTimeout         = 5 * time.Second
+)
+
+const (
+	StateStarting = "starting"
+	StateRunning  = "running"
+	// StateBackoff is waiting to restart after a crash.
+	StateBackoff = "backoff"
+	StateStopped = "stopped"
+	// StateUnsupervised is running, but wasn't started by the supervisor.
+	StateUnsupervised = "unsupervised"
+)
+
+// SupervisedApps are the apps with services that can be run by the
+// supervisor.
+var SupervisedApps = []string{"remote", "nfc", "playlog", "lastplayed", "savesnap"}
+
+var ErrNotSupervisedApp = errors.New("app can't be supervised")
+
+func IsSupervisedApp(name string) bool {
+	for _, app := range SupervisedApps {
+		if app == name {
+			return true
+		}
+	}
+	return false
+}
+
+type SupervisedService struct {
+	Name string `json:"name"`
+	// Path is the app's binary, e.g. /media/fat/Scripts/remote.sh.
+	Path string `json:"path"`
+}
+
+type supervisorFile struct {
+	Services []SupervisedService `json:"services"`
+}
+
+// LoadSupervised returns the services run by the supervisor.
+func LoadSupervised() ([]SupervisedService, error) {
+	data, err := os.ReadFile(config.SupervisorFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return []SupervisedService{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var f supervisorFile
+	err = json.Unmarshal(data, &f)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.Services == nil {
+		f.Services = []SupervisedService{}
+	}
+
+	return f.Services, nil
+}
+
+// SaveSupervised replaces the services run by the supervisor. They're used
+// the next time it starts.
+func SaveSupervised(services []SupervisedService) error {
+	for _, svc := range services {
+		if !IsSupervisedApp(svc.Name) {
+			return fmt.Errorf("%w: %s", ErrNotSupervisedApp, svc.Name)
+		}
+	}
+
+	data, err := json.MarshalIndent(supervisorFile{Services: services}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(config.SupervisorFile), 0755)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(config.SupervisorFile, data, 0644)
+}
+
+type ServiceStatus struct {
+	Name    string    `json:"name"`
+	Path    string    `json:"path"`
+	State   string    `json:"state"`
+	Pid     int       `json:"pid"`
+	Started time.Time `json:"started"`
+	// Restarts is the number of times the service has been restarted after a
+	// crash.
+	Restarts     int       `json:"restarts"`
+	LastExitCode int       `json:"lastExitCode"`
+	LastExit     time.Time `json:"lastExit"`
+	// LastCrashLog is the path of the log written when it last crashed.
+	LastCrashLog string    `json:"lastCrashLog"`
+	NextRestart  time.Time `json:"nextRestart"`
+	Error        string    `json:"error,omitempty"`
+}
+
+type SupervisorStatus struct {
+	// Running is false if the supervisor isn't running, in which case the
+	// services are as they were when it stopped.
+	Running  bool            `json:"running"`
+	Pid      int             `json:"pid"`
+	Started  time.Time       `json:"started"`
+	Services []ServiceStatus `json:"services"`
+}
+
+// Service returns the status of a single service.
+func (ss SupervisorStatus) Service(name string) (ServiceStatus, bool) {
+	for _, status := range ss.Services {
+		if status.Name == name {
+			return status, true
+		}
+	}
+	return ServiceStatus{}, false
+}
+
+// ReadSupervisorStatus returns the status of the running supervisor.
+func ReadSupervisorStatus() (SupervisorStatus, error) {
+	status := SupervisorStatus{Services: []ServiceStatus{}}
+
+	data, err := os.ReadFile(config.SupervisorStatusFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return status, nil
+	} else if err != nil {
+		return status, err
+	}
+
+	err = json.Unmarshal(data, &status)
+	if err != nil {
+		return status, err
+	}
+
+	supervisor := &Service{Name: SupervisorName}
+	pid, _ := supervisor.Pid()
+	status.Running = supervisor.Running() && pid == status.Pid
+
+	return status, nil
+}
+
+// tailBuffer keeps the last bytes written to it.
+type tailBuffer struct {
+	mu   sync.Mutex
+	size int
+	data []byte
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.data = append(t.data, p...)
+	if len(t.data) > t.size {
+		t.data = t.data[len(t.data)-t.size:]
+	}
+	return len(p), nil
+}
+
+func (t *tailBuffer) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return string(t.data)
+}
+
+// tailLines returns the last lines of a file.
+func tailLines(path string, n int) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+func restartRequestPath(name string) string {
+	return filepath.Join(config.TempFolder, name+".restart")
+}
+
+type Supervisor struct {
+	Logger   *Logger
+	Services []SupervisedService
+	// StatusPath is where the status is written when it changes.
+	StatusPath    string
+	CrashFolder   string
+	CrashLogsKeep int
+	MinBackoff    time.Duration
+	MaxBackoff    time.Duration
+	// StableAfter is how long a service must run before a crash resets its
+	// backoff.
+	StableAfter time.Duration
+	// command returns the command which runs a service in the foreground.
+	command func(svc SupervisedService) (*exec.Cmd, error)
+	// running reports if a service was started outside the supervisor.
+	running func(name string) bool
+	mu      sync.Mutex
+	status  SupervisorStatus
+	procs   map[string]*exec.Cmd
+	stop    chan struct{}
+	wg      sync.WaitGroup
+}
+
+func NewSupervisor(logger *Logger, services []SupervisedService) *Supervisor {
+	return &Supervisor{
+		Logger:        logger,
+		Services:      services,
+		StatusPath:    config.SupervisorStatusFile,
+		CrashFolder:   config.CrashLogsFolder,
+		CrashLogsKeep: defaultCrashLogsKeep,
+		MinBackoff:    defaultMinBackoff,
+		MaxBackoff:    defaultMaxBackoff,
+		StableAfter:   defaultStableAfter,
+		command: func(svc SupervisedService) (*exec.Cmd, error) {
+			return serviceCommand(svc.Name, svc.Path, "-service", "exec")
+		},
+		running: func(name string) bool {
+			return (&Service{Name: name}).Running()
+		},
+	}
+}
+
+// Status returns the current state of the supervisor and its services.
+func (s *Supervisor) Status() SupervisorStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := s.status
+	status.Services = append([]ServiceStatus{}, s.status.Services...)
+	return status
+}
+
+// writeStatus writes the status file. Must be called with the lock held.
+func (s *Supervisor) writeStatus() {
+	data, err := json.MarshalIndent(s.status, "", "  ")
+	if err != nil {
+		s.Logger.Error("supervisor: encoding status: %s", err)
+		return
+	}
+
+	tempPath := s.StatusPath + ".tmp"
+	err = os.WriteFile(tempPath, data, 0644)
+	if err == nil {
+		err = os.Rename(tempPath, s.StatusPath)
+	}
+	if err != nil {
+		s.Logger.Error("supervisor: writing status: %s", err)
+	}
+}
+
+// update changes the status of a service and writes the status file.
+func (s *Supervisor) update(name string, change func(status *ServiceStatus)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.status.Services {
+		if s.status.Services[i].Name == name {
+			change(&s.status.Services[i])
+		}
+	}
+
+	s.writeStatus()
+}
+
+// Start runs every service in the background.
+func (s *Supervisor) Start() {
+	s.mu.Lock()
+	s.stop = make(chan struct{})
+	s.procs = make(map[string]*exec.Cmd)
+	s.status = SupervisorStatus{
+		Running:  true,
+		Pid:      os.Getpid(),
+		Started:  time.Now(),
+		Services: make([]ServiceStatus, 0, len(s.Services)),
+	}
+	for _, svc := range s.Services {
+		s.status.Services = append(s.status.Services, ServiceStatus{
+			Name:  svc.Name,
+			Path:  svc.Path,
+			State: StateStarting,
+		})
+	}
+	s.writeStatus()
+	s.mu.Unlock()
+
+	for _, svc := range s.Services {
+		s.wg.Add(1)
+		go func(svc SupervisedService) {
+			defer s.wg.Done()
+			s.supervise(svc)
+		}(svc)
+	}
+}
+
+// Stop stops every service and waits for them to exit.
+func (s *Supervisor) Stop() error {
+	s.mu.Lock()
+	close(s.stop)
+	for name, cmd := range s.procs {
+		s.Logger.Info("supervisor: stopping %s", name)
+		err := cmd.Process.Signal(syscall.SIGTERM)
+		if err != nil {
+			s.Logger.Error("supervisor: stopping %s: %s", name, err)
+		}
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(stopTimeout):
+		s.mu.Lock()
+		for name, cmd := range s.procs {
+			s.Logger.Error("supervisor: %s didn't stop, killing", name)
+			_ = cmd.Process.Kill()
+		}
+		s.mu.Unlock()
+		<-done
+	}
+
+	s.mu.Lock()
+	s.status.Running = false
+	s.writeStatus()
+	s.mu.Unlock()
+
+	return nil
+}
+
+// wait sleeps, returning false if the supervisor was stopped first.
+func (s *Supervisor) wait(d time.Duration) bool {
+	select {
+	case <-s.stop:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+func (s *Supervisor) stopping() bool {
+	select {
+	case <-s.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// supervise runs a service until it exits cleanly or the supervisor is
+// stopped, restarting it with increasing backoff each time it crashes.
+func (s *Supervisor) supervise(svc SupervisedService) {
+	backoff := s.MinBackoff
+
+	for !s.stopping() {
+		// leave a service started outside the supervisor alone until it exits
+		if s.running(svc.Name) {
+			s.update(svc.Name, func(status *ServiceStatus) {
+				status.State = StateUnsupervised
+			})
+			if !s.wait(unsupervisedPoll) {
+				break
+			}
+			continue
+		}
+
+		s.update(svc.Name, func(status *ServiceStatus) {
+			status.State = StateStarting
+			status.Error = ""
+		})
+
+		output := &tailBuffer{size: crashOutputSize}
+		started := time.Now()
+		code, err := s.run(svc, output)
+
+		if s.stopping() {
+			break
+		}
+
+		if err == nil && code == 0 {
+			if _, err := os.Stat(restartRequestPath(svc.Name)); err == nil {
+				_ = os.Remove(restartRequestPath(svc.Name))
+				s.Logger.Info("supervisor: restarting %s", svc.Name)
+				backoff = s.MinBackoff
+				continue
+			}
+
+			s.Logger.Info("supervisor: %s stopped", svc.Name)
+			s.update(svc.Name, func(status *ServiceStatus) {
+				status.State = StateStopped
+				status.Pid = 0
+				status.LastExitCode = code
+				status.LastExit = time.Now()
+			})
+			return
+		}
+
+		if time.Since(started) >= s.StableAfter {
+			backoff = s.MinBackoff
+		}
+
+		crashLog, logErr := s.writeCrashLog(svc, started, code, err, output.String())
+		if logErr != nil {
+			s.Logger.Error("supervisor: writing %s crash log: %s", svc.Name, logErr)
+		}
+
+		s.Logger.Error("supervisor: %s crashed with exit code %d, restarting in %s", svc.Name, code, backoff)
+		s.update(svc.Name, func(status *ServiceStatus) {
+			status.State = StateBackoff
+			status.Pid = 0
+			status.LastExitCode = code
+			status.LastExit = time.Now()
+			status.NextRestart = time.Now().Add(backoff)
+			if crashLog != "" {
+				status.LastCrashLog = crashLog
+			}
+			if err != nil {
+				status.Error = err.Error()
+			}
+		})
+
+		if !s.wait(backoff) {
+			break
+		}
+
+		s.update(svc.Name, func(status *ServiceStatus) {
+			status.Restarts++
+			status.NextRestart = time.Time{}
+		})
+
+		backoff *= 2
+		if backoff > s.MaxBackoff {
+			backoff = s.MaxBackoff
+		}
+	}
+
+	s.update(svc.Name, func(status *ServiceStatus) {
+		status.State = StateStopped
+		status.Pid = 0
+	})
+}
+
+// run starts a service and waits for it to exit. The exit code is -1 if it
+// was killed by a signal or couldn't be started.
+func (s *Supervisor) run(svc SupervisedService, output *tailBuffer) (int, error) {
+	cmd, err := s.command(svc)
+	if err != nil {
+		return -1, err
+	}
+	cmd.Stdout = output
+	cmd.Stderr = output
+
+	s.mu.Lock()
+	if s.stopping() {
+		s.mu.Unlock()
+		return -1, nil
+	}
+	err = cmd.Start()
+	if err != nil {
+		s.mu.Unlock()
+		return -1, err
+	}
+	s.procs[svc.Name] = cmd
+	s.mu.Unlock()
+
+	s.Logger.Info("supervisor: started %s, pid %d", svc.Name, cmd.Process.Pid)
+	s.update(svc.Name, func(status *ServiceStatus) {
+		status.State = StateRunning
+		status.Pid = cmd.Process.Pid
+		status.Started = time.Now()
+	})
+
+	err = cmd.Wait()
+
+	s.mu.Lock()
+	delete(s.procs, svc.Name)
+	s.mu.Unlock()
+
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return cmd.ProcessState.ExitCode(), err
+	}
+
+	return cmd.ProcessState.ExitCode(), nil
+}
+
+// writeCrashLog keeps the output of a crashed service and the end of its log
+// file, and deletes its oldest crash logs past the retention limit.
+func (s *Supervisor) writeCrashLog(svc SupervisedService, started time.Time, code int, runErr error, output string) (string, error) {
+	err := os.MkdirAll(s.CrashFolder, 0755)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("service: %s\n", svc.Name))
+	sb.WriteString(fmt.Sprintf("exit code: %d\n", code))
+	if runErr != nil {
+		sb.WriteString(fmt.Sprintf("error: %s\n", runErr))
+	}
+	sb.WriteString(fmt.Sprintf("started: %s\n", started.Format(time.RFC3339)))
+	sb.WriteString(fmt.Sprintf("exited: %s\n", now.Format(time.RFC3339)))
+	sb.WriteString("\n--- output ---\n")
+	sb.WriteString(output)
+	sb.WriteString(fmt.Sprintf("\n--- %s ---\n", fmt.Sprintf(config.LogFileTemplate, svc.Name)))
+	sb.WriteString(tailLines(fmt.Sprintf(config.LogFileTemplate, svc.Name), crashLogLines))
+	sb.WriteString("\n")
+
+	path := filepath.Join(s.CrashFolder, fmt.Sprintf("%s_%s.log", svc.Name, now.Format("20060102_150405.000")))
+	err = os.WriteFile(path, []byte(sb.String()), 0644)
+	if err != nil {
+		return "", err
+	}
+
+	if s.CrashLogsKeep > 0 {
+		logs, _ := filepath.Glob(filepath.Join(s.CrashFolder, svc.Name+"_*.log"))
+		sort.Strings(logs)
+		if len(logs) > s.CrashLogsKeep {
+			for _, old := range logs[:len(logs)-s.CrashLogsKeep] {
+				_ = os.Remove(old)
+			}
+		}
+	}
+
+	return path, nil
+}
+
+// supervisorService is the service which runs the supervisor itself.
+func supervisorService() *Service {
+	logger := NewLogger(SupervisorName)
+	return &Service{
+		Name:   SupervisorName,
+		Logger: logger,
+		daemon: true,
+		start: func() (func() error, error) {
+			services, err := LoadSupervised()
+			if err != nil {
+				return nil, err
+			}
+
+			// skip apps which have been deleted
+			installed := make([]SupervisedService, 0, len(services))
+			for _, svc := range services {
+				if _, err := os.Stat(svc.Path); err != nil {
+					logger.Error("supervisor: skipping %s: %s", svc.Name, err)
+					continue
+				}
+				installed = append(installed, svc)
+			}
+
+			sv := NewSupervisor(logger, installed)
+			sv.Start()
+			return sv.Stop, nil
+		},
+	}
+}
+
+// StartSupervisor starts the supervisor in the background, using the running
+// app's binary, if it's not already running. Every supervised app starts it
+// on boot, so it waits until the supervisor is running before returning and
+// the next app finds it already started.
+func StartSupervisor() error {
+	lock, err := os.OpenFile(filepath.Join(config.TempFolder, SupervisorName+".lock"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	err = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		return err
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	supervisor := supervisorService()
+	if supervisor.Running() {
+		return nil
+	}
+
+	binPath, err := appBinPath()
+	if err != nil {
+		return err
+	}
+
+	cmd, err := serviceCommand(SupervisorName, binPath, "-service", "supervisor")
+	if err != nil {
+		return err
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return fmt.Errorf("error starting supervisor: %w", err)
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		_ = cmd.Wait()
+		close(exited)
+	}()
+
+	deadline := time.After(startTimeout)
+	for !supervisor.Running() {
+		select {
+		case <-exited:
+			return fmt.Errorf("supervisor exited while starting")
+		case <-deadline:
+			return fmt.Errorf("timed out waiting for supervisor to start")
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	return nil
+}
+
+// supervised returns the status of a service if it's being run by the
+// supervisor.
+func (s *Service) supervised() (ServiceStatus, bool) {
+	status, err := ReadSupervisorStatus()
+	if err != nil || !status.Running {
+		return ServiceStatus{}, false
+	}
+
+	svc, ok := status.Service(s.Name)
+	if !ok || svc.State == StateStopped || svc.State == StateUnsupervised {
+		return ServiceStatus{}, false
+	}
+
+	return svc, true
+}
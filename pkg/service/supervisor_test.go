@@ -0,0 +1,182 @@
+package service
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestSupervisor returns a supervisor which runs each service as a shell
+// script instead of an app binary.
+func newTestSupervisor(t *testing.T, scripts map[string]string) *Supervisor {
+	t.Helper()
+
+	folder := t.TempDir()
+	var services []SupervisedService
+	for name, script := range scripts {
+		path := filepath.Join(folder, name+".sh")
+		err := os.WriteFile(path, []byte(script), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		services = append(services, SupervisedService{Name: name, Path: path})
+	}
+
+	sv := NewSupervisor(&Logger{log: log.New(os.Stderr, "", 0)}, services)
+	sv.StatusPath = filepath.Join(folder, "status.json")
+	sv.CrashFolder = filepath.Join(folder, "crashes")
+	sv.MinBackoff = 10 * time.Millisecond
+	sv.MaxBackoff = 20 * time.Millisecond
+	sv.command = func(svc SupervisedService) (*exec.Cmd, error) {
+		cmd := exec.Command("sh", svc.Path)
+		cmd.Dir = folder
+		return cmd, nil
+	}
+	sv.running = func(name string) bool {
+		return false
+	}
+
+	return sv
+}
+
+func waitForState(t *testing.T, sv *Supervisor, name string, state string) ServiceStatus {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if status, ok := sv.Status().Service(name); ok && status.State == state {
+			return status
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	status, _ := sv.Status().Service(name)
+	t.Fatalf("timed out waiting for %s to be %s, got %+v", name, state, status)
+	return status
+}
+
+func TestSupervisorRestartsCrashes(t *testing.T) {
+	// crashes twice, then stays running
+	sv := newTestSupervisor(t, map[string]string{
+		"crashy": `n=$(cat count 2>/dev/null || echo 0)
+echo $((n + 1)) > count
+if [ "$n" -lt 2 ]; then
+	echo "panic: crash $n" >&2
+	exit 2
+fi
+exec sleep 30
+`,
+		"clean": "exit 0\n",
+	})
+	sv.Start()
+
+	running := waitForState(t, sv, "crashy", StateRunning)
+	deadline := time.Now().Add(10 * time.Second)
+	for running.Restarts < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		running, _ = sv.Status().Service("crashy")
+	}
+	if running.Restarts != 2 || running.LastExitCode != 2 || running.Pid == 0 {
+		t.Errorf("got status %+v", running)
+	}
+
+	crashLog, err := os.ReadFile(running.LastCrashLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(crashLog), "exit code: 2") || !strings.Contains(string(crashLog), "panic: crash 1") {
+		t.Errorf("got crash log:\n%s", crashLog)
+	}
+
+	clean := waitForState(t, sv, "clean", StateStopped)
+	if clean.Restarts != 0 || clean.LastCrashLog != "" {
+		t.Errorf("clean exit was restarted: %+v", clean)
+	}
+
+	err = sv.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status := sv.Status()
+	if status.Running {
+		t.Error("supervisor still running after stop")
+	}
+	if crashy, _ := status.Service("crashy"); crashy.State != StateStopped || crashy.Restarts != 2 {
+		t.Errorf("got stopped status %+v", crashy)
+	}
+}
+
+func TestSupervisorCrashLogsKeep(t *testing.T) {
+	sv := newTestSupervisor(t, map[string]string{
+		"broken": "exit 1\n",
+	})
+	sv.CrashLogsKeep = 2
+	sv.Start()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if status, _ := sv.Status().Service("broken"); status.Restarts >= 4 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	err := sv.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logs, err := filepath.Glob(filepath.Join(sv.CrashFolder, "broken_*.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 2 {
+		t.Errorf("got %d crash logs, want 2: %v", len(logs), logs)
+	}
+
+	status, _ := sv.Status().Service("broken")
+	if status.Restarts < 4 || status.LastExitCode != 1 {
+		t.Errorf("got status %+v", status)
+	}
+	if _, err := os.Stat(status.LastCrashLog); err != nil {
+		t.Errorf("last crash log: %s", err)
+	}
+}
+
+func TestSupervisorRestartRequest(t *testing.T) {
+	name := fmt.Sprintf("mrext_test_%d", os.Getpid())
+	sv := newTestSupervisor(t, map[string]string{
+		name: `n=$(cat count 2>/dev/null || echo 0)
+echo $((n + 1)) > count
+[ "$n" -gt 0 ] && exec sleep 30
+exit 0
+`,
+	})
+
+	err := os.WriteFile(restartRequestPath(name), nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = os.Remove(restartRequestPath(name))
+	})
+
+	sv.Start()
+	status := waitForState(t, sv, name, StateRunning)
+	time.Sleep(50 * time.Millisecond)
+	if status, _ = sv.Status().Service(name); status.State != StateRunning || status.Restarts != 0 {
+		t.Errorf("got status %+v", status)
+	}
+	if _, err := os.Stat(restartRequestPath(name)); !os.IsNotExist(err) {
+		t.Error("restart request wasn't removed")
+	}
+
+	err = sv.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
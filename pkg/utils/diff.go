@@ -0,0 +1,131 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+)
+
+type diffLine struct {
+	op   byte
+	text string
+	// a and b are the number of lines of each text before this line.
+	a int
+	b int
+}
+
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+// diffLines returns the shortest edit from a to b, using the longest common
+// subsequence of lines. Only suitable for small files.
+func diffLines(a []string, b []string) []diffLine {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	lines := make([]diffLine, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			lines = append(lines, diffLine{' ', a[i], i, j})
+			i++
+			j++
+		case j == len(b) || (i < len(a) && lcs[i+1][j] >= lcs[i][j+1]):
+			lines = append(lines, diffLine{'-', a[i], i, j})
+			i++
+		default:
+			lines = append(lines, diffLine{'+', b[j], i, j})
+			j++
+		}
+	}
+
+	return lines
+}
+
+// UnifiedDiff returns the changes from one text to another in unified diff
+// format, with the given number of unchanged lines around each change. An
+// empty string is returned if the texts are the same.
+func UnifiedDiff(fromName string, toName string, from string, to string, context int) string {
+	lines := diffLines(splitLines(from), splitLines(to))
+
+	nextChange := func(i int) int {
+		for i < len(lines) && lines[i].op == ' ' {
+			i++
+		}
+		return i
+	}
+
+	var sb strings.Builder
+	i := nextChange(0)
+	for i < len(lines) {
+		start := i - context
+		if start < 0 {
+			start = 0
+		}
+
+		// merge changes which are close enough to share context
+		end := i
+		for {
+			next := nextChange(end + 1)
+			if next == len(lines) || next-end-1 > context*2 {
+				break
+			}
+			end = next
+		}
+
+		stop := end + context + 1
+		if stop > len(lines) {
+			stop = len(lines)
+		}
+
+		aCount, bCount := 0, 0
+		for _, line := range lines[start:stop] {
+			if line.op != '+' {
+				aCount++
+			}
+			if line.op != '-' {
+				bCount++
+			}
+		}
+
+		aStart, bStart := lines[start].a, lines[start].b
+		if aCount > 0 {
+			aStart++
+		}
+		if bCount > 0 {
+			bStart++
+		}
+
+		if sb.Len() == 0 {
+			_, _ = fmt.Fprintf(&sb, "--- %s\n+++ %s\n", fromName, toName)
+		}
+		_, _ = fmt.Fprintf(&sb, "@@ -%d,%d +%d,%d @@\n", aStart, aCount, bStart, bCount)
+		for _, line := range lines[start:stop] {
+			sb.WriteByte(line.op)
+			sb.WriteString(line.text)
+			sb.WriteByte('\n')
+		}
+
+		i = nextChange(stop)
+	}
+
+	return sb.String()
+}
@@ -157,3 +157,44 @@ func TestMapKeys(t *testing.T) {
 		}
 	}
 }
+
+func TestUnifiedDiff(t *testing.T) {
+	var tests = []struct {
+		name string
+		from string
+		to   string
+		want string
+	}{
+		{"same", "a\nb\n", "a\nb\n", ""},
+		{"empty", "", "", ""},
+		{
+			"change",
+			"a\nb\nc\nd\ne\nf\ng\n",
+			"a\nb\nc\nD\ne\nf\ng\n",
+			"--- old\n+++ new\n@@ -2,5 +2,5 @@\n b\n c\n-d\n+D\n e\n f\n",
+		},
+		{
+			"new file",
+			"",
+			"a\nb\n",
+			"--- old\n+++ new\n@@ -0,0 +1,2 @@\n+a\n+b\n",
+		},
+		{
+			"separate hunks",
+			"1\n2\n3\n4\n5\n6\n7\n8\n9\n",
+			"0\n1\n2\n3\n4\n5\n6\n7\n8\n",
+			"--- old\n+++ new\n@@ -1,2 +1,3 @@\n+0\n 1\n 2\n@@ -7,3 +8,2 @@\n 7\n 8\n-9\n",
+		},
+		{
+			"merged hunks",
+			"1\n2\n3\n4\n5\n",
+			"1\nx\n3\ny\n5\n",
+			"--- old\n+++ new\n@@ -1,5 +1,5 @@\n 1\n-2\n+x\n 3\n-4\n+y\n 5\n",
+		},
+	}
+	for _, tt := range tests {
+		if got := UnifiedDiff("old", "new", tt.from, tt.to, 2); got != tt.want {
+			t.Errorf("UnifiedDiff(%s) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}